@@ -0,0 +1,388 @@
+// Package distributed provides an interface to the files distributed over
+// the other remotes by the dis_* commands.
+//
+// Files uploaded in the legacy format by older releases aren't listed, as
+// only dis_download can read them.
+package distributed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/config/configstruct"
+	"github.com/rclone/rclone/fs/dis_operations"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/lib/encoder"
+)
+
+// Register with Fs
+func init() {
+	fs.Register(&fs.RegInfo{
+		Name:        dis_operations.StoreBackend,
+		Description: "Files distributed over the other remotes by dis_upload",
+		NewFs:       NewFs,
+		Options: []fs.Option{{
+			Name:    "load_balancer",
+			Help:    "How uploaded shards are spread over the remotes.",
+			Default: string(dis_operations.RoundRobin),
+			Examples: []fs.OptionExample{{
+				Value: string(dis_operations.RoundRobin),
+				Help:  "Take the remotes in turn",
+			}, {
+				Value: string(dis_operations.UploadOptima),
+				Help:  "Prefer the remotes with the fastest uploads",
+			}, {
+				Value: string(dis_operations.DownloadOptima),
+				Help:  "Prefer the remotes with the fastest downloads",
+			}, {
+				Value: string(dis_operations.ResourceBased),
+				Help:  "Prefer the remotes with the most free space",
+			}},
+		}, {
+			Name: "profile",
+			Help: `Durability profile of uploaded files.
+
+Profiles are named in the dis_profiles section of the config file, see
+dis_upload. If empty the shard counts grow with the size of the file.`,
+		}, {
+			Name:     config.ConfigEncoding,
+			Help:     config.ConfigEncodingHelp,
+			Advanced: true,
+			// the dis_* commands trim the spaces around logical paths and
+			// the datamap is stored as JSON
+			Default: (encoder.Base |
+				encoder.EncodeInvalidUtf8 |
+				encoder.EncodeBackSlash |
+				encoder.EncodeLeftSpace |
+				encoder.EncodeRightSpace |
+				encoder.EncodeLeftCrLfHtVt |
+				encoder.EncodeRightCrLfHtVt),
+		}},
+	})
+}
+
+// Options defines the configuration for this backend
+type Options struct {
+	LoadBalancer string               `config:"load_balancer"`
+	Profile      string               `config:"profile"`
+	Enc          encoder.MultiEncoder `config:"encoding"`
+}
+
+// Fs represents the namespace of the distributed store
+type Fs struct {
+	name     string
+	root     string
+	opt      Options
+	profile  dis_operations.ShardProfile
+	features *fs.Features
+}
+
+// Object describes a distributed file
+type Object struct {
+	fs     *Fs
+	remote string
+	info   dis_operations.FileInfo
+}
+
+// NewFs constructs an Fs from the path.
+//
+// The shards are kept on every other remote of the config, as for the dis_*
+// commands, so the config of the Fs only chooses how files are uploaded.
+func NewFs(ctx context.Context, name, root string, m configmap.Mapper) (fs.Fs, error) {
+	opt := new(Options)
+	err := configstruct.Set(m, opt)
+	if err != nil {
+		return nil, err
+	}
+	if !dis_operations.LoadBalancerType(opt.LoadBalancer).IsValid() {
+		return nil, fmt.Errorf("unknown load balancer %q", opt.LoadBalancer)
+	}
+	// the backend serves mount and serve, so the passphrase of the dis
+	// keyring comes from RCLONE_DIS_PASSPHRASE rather than the terminal
+	dis_operations.DisablePrompts()
+	// mount and serve write one file after another, so the lock on the
+	// store is taken once for all of them
+	dis_operations.HoldStoreLock()
+	f := &Fs{
+		name: name,
+		root: strings.Trim(path.Clean("/"+root), "/"),
+		opt:  *opt,
+	}
+	if f.profile, err = dis_operations.ResolveShardProfile(opt.Profile, 0, 0, 0, false); err != nil {
+		return nil, err
+	}
+	f.features = (&fs.Features{
+		CanHaveEmptyDirectories: true,
+	}).Fill(ctx, f)
+
+	if err := dis_operations.SyncMetadata(); err != nil {
+		fs.Logf(f, "Metadata not synced with the remotes: %v", err)
+	}
+	if f.root != "" {
+		info, err := dis_operations.GetFileInfoStruct(f.logicalPath(""))
+		if err == nil && !info.IsDir {
+			f.root = strings.Trim(path.Dir("/"+f.root), "/")
+			return f, fs.ErrorIsFile
+		}
+	}
+	return f, nil
+}
+
+// Name of the remote (as passed into NewFs)
+func (f *Fs) Name() string {
+	return f.name
+}
+
+// Root of the remote (as passed into NewFs)
+func (f *Fs) Root() string {
+	return f.root
+}
+
+// String converts this Fs to a string
+func (f *Fs) String() string {
+	return fmt.Sprintf("distributed root '%s'", f.root)
+}
+
+// Features returns the optional features of this Fs
+func (f *Fs) Features() *fs.Features {
+	return f.features
+}
+
+// Precision of the ModTimes in this Fs
+func (f *Fs) Precision() time.Duration {
+	return time.Nanosecond
+}
+
+// Hashes returns the supported hash sets.
+func (f *Fs) Hashes() hash.Set {
+	return hash.Set(hash.SHA256)
+}
+
+// logicalPath returns the path in the datamap of remote
+func (f *Fs) logicalPath(remote string) string {
+	return strings.Trim(f.opt.Enc.FromStandardPath(path.Join(f.root, remote)), "/")
+}
+
+// newObject returns the Object of remote described by info
+func (f *Fs) newObject(remote string, info dis_operations.FileInfo) (fs.Object, error) {
+	if info.IsDir {
+		return nil, fs.ErrorIsDir
+	}
+	// an upload in progress isn't there yet
+	if info.Flag && info.State == "upload" {
+		return nil, fs.ErrorObjectNotFound
+	}
+	// nor is a file which only dis_download can read
+	if !info.Streamable() {
+		return nil, fs.ErrorObjectNotFound
+	}
+	return &Object{fs: f, remote: remote, info: info}, nil
+}
+
+// NewObject finds the Object at remote.  If it can't be found
+// it returns the error fs.ErrorObjectNotFound.
+func (f *Fs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+	info, err := dis_operations.GetFileInfoStruct(f.logicalPath(remote))
+	if err != nil {
+		return nil, fs.ErrorObjectNotFound
+	}
+	return f.newObject(remote, info)
+}
+
+// isDir returns true if the logical path dir is a directory
+func (f *Fs) isDir(dir string) bool {
+	if dir == "" {
+		return true
+	}
+	info, err := dis_operations.GetFileInfoStruct(dir)
+	return err == nil && info.IsDir
+}
+
+// List the objects and directories in dir into entries.  The
+// entries can be returned in any order but should be for a
+// complete directory.
+//
+// dir should be "" to list the root, and should not have
+// trailing slashes.
+//
+// This should return ErrDirNotFound if the directory isn't
+// found.
+func (f *Fs) List(ctx context.Context, dir string) (entries fs.DirEntries, err error) {
+	dirPath := f.logicalPath(dir)
+	infos, err := dis_operations.ListDir(dirPath, false)
+	if err != nil {
+		return nil, fs.ErrorDirNotFound
+	}
+	if len(infos) == 0 && !f.isDir(dirPath) {
+		return nil, fs.ErrorDirNotFound
+	}
+	for _, info := range infos {
+		remote := path.Join(dir, f.opt.Enc.ToStandardName(path.Base(info.FileName)))
+		if info.IsDir {
+			entries = append(entries, fs.NewDir(remote, info.ModTime))
+			continue
+		}
+		o, err := f.newObject(remote, info)
+		if err != nil {
+			if !info.Streamable() {
+				fs.Debugf(f, "Not listing %s: %v", remote, dis_operations.ErrLegacyFormat)
+			}
+			continue
+		}
+		entries = append(entries, o)
+	}
+	return entries, nil
+}
+
+// Put in to the remote path with the modTime given of the given size
+//
+// Uploading a file which exists makes a new version of it.
+func (f *Fs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	o := &Object{fs: f, remote: src.Remote()}
+	return o, o.Update(ctx, in, src, options...)
+}
+
+// Mkdir makes the directory (container, bucket)
+//
+// Shouldn't return an error if it already exists
+func (f *Fs) Mkdir(ctx context.Context, dir string) error {
+	dirPath := f.logicalPath(dir)
+	if f.isDir(dirPath) {
+		return nil
+	}
+	return dis_operations.MakeDir(ctx, dirPath, time.Now())
+}
+
+// Rmdir removes the directory (container, bucket) if empty
+//
+// Return an error if it doesn't exist or isn't empty
+func (f *Fs) Rmdir(ctx context.Context, dir string) error {
+	dirPath := f.logicalPath(dir)
+	infos, err := dis_operations.ListDir(dirPath, false)
+	if err != nil || len(infos) == 0 && !f.isDir(dirPath) {
+		return fs.ErrorDirNotFound
+	}
+	if len(infos) > 0 {
+		return fs.ErrorDirectoryNotEmpty
+	}
+	if dirPath == "" {
+		return nil
+	}
+	err = dis_operations.RemoveDir(ctx, dirPath)
+	if errors.Is(err, dis_operations.ErrDirNotEmpty) {
+		return fs.ErrorDirectoryNotEmpty
+	}
+	return err
+}
+
+// Shutdown releases the lock on the store and publishes the metadata
+func (f *Fs) Shutdown(ctx context.Context) error {
+	dis_operations.ReleaseStoreLock()
+	return nil
+}
+
+// Fs returns the parent Fs
+func (o *Object) Fs() fs.Info {
+	return o.fs
+}
+
+// Return a string version
+func (o *Object) String() string {
+	if o == nil {
+		return "<nil>"
+	}
+	return o.remote
+}
+
+// Remote returns the remote path
+func (o *Object) Remote() string {
+	return o.remote
+}
+
+// Hash returns the SHA-256 of the content of the file
+func (o *Object) Hash(ctx context.Context, t hash.Type) (string, error) {
+	if t != hash.SHA256 {
+		return "", hash.ErrUnsupported
+	}
+	return o.info.SHA256(), nil
+}
+
+// Size returns the size of the file
+func (o *Object) Size() int64 {
+	return o.info.FileSize
+}
+
+// ModTime returns the modification time of the file
+func (o *Object) ModTime(ctx context.Context) time.Time {
+	return o.info.ModTime
+}
+
+// SetModTime sets the modification time of the file
+func (o *Object) SetModTime(ctx context.Context, modTime time.Time) error {
+	if err := dis_operations.SetModTime(ctx, o.fs.logicalPath(o.remote), modTime); err != nil {
+		return err
+	}
+	o.info.ModTime = modTime
+	return nil
+}
+
+// Storable returns whether this object is storable
+func (o *Object) Storable() bool {
+	return true
+}
+
+// Open an object for read
+//
+// The content is decoded from the shards as it is read. With a range or
+// seek option only the parts of the shards holding the range are fetched.
+func (o *Object) Open(ctx context.Context, options ...fs.OpenOption) (io.ReadCloser, error) {
+	var offset, limit int64 = 0, -1
+	for _, option := range options {
+		switch x := option.(type) {
+		case *fs.SeekOption:
+			offset = x.Offset
+		case *fs.RangeOption:
+			offset, limit = x.Decode(o.Size())
+		default:
+			if option.Mandatory() {
+				fs.Logf(o, "Unsupported mandatory option: %v", option)
+			}
+		}
+	}
+	return dis_operations.OpenFile(ctx, o.info, offset, limit)
+}
+
+// Update the object with the contents of the io.Reader, modTime and size
+//
+// The file is uploaded as a new version of it.
+func (o *Object) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) error {
+	info, err := dis_operations.PutFile(ctx, in, o.fs.logicalPath(o.remote), src.Size(), src.ModTime(ctx),
+		dis_operations.LoadBalancerType(o.fs.opt.LoadBalancer), o.fs.profile)
+	if err != nil {
+		return err
+	}
+	o.info = info
+	return nil
+}
+
+// Remove an object
+//
+// Every version of the file is removed.
+func (o *Object) Remove(ctx context.Context) error {
+	return dis_operations.Dis_rm(ctx, []string{o.fs.logicalPath(o.remote)}, false)
+}
+
+// Check the interfaces are satisfied
+var (
+	_ fs.Fs         = (*Fs)(nil)
+	_ fs.Shutdowner = (*Fs)(nil)
+	_ fs.Object     = (*Object)(nil)
+)
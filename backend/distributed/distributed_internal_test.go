@@ -0,0 +1,139 @@
+package distributed
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/rclone/rclone/backend/alias"
+	_ "github.com/rclone/rclone/backend/local"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/dis_operations"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/object"
+	"github.com/rclone/rclone/lib/kv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupRemotes configures three local shard remotes and the distributed
+// remote TestDistributed on top of them
+func setupRemotes(t *testing.T) {
+	if !kv.Supported() {
+		t.Skip("kv not supported on this OS")
+	}
+	dir := t.TempDir()
+	oldConfigPath := config.GetConfigPath()
+	require.NoError(t, config.SetConfigPath(filepath.Join(dir, "rclone.conf")))
+	t.Setenv(dis_operations.PassphraseEnv, "distributed backend test")
+	t.Cleanup(func() {
+		_ = config.SetConfigPath(oldConfigPath)
+		cache.Clear()
+	})
+	for _, name := range []string{"disa", "disb", "disc"} {
+		t.Setenv("RCLONE_CONFIG_"+strings.ToUpper(name)+"_TYPE", "alias")
+		t.Setenv("RCLONE_CONFIG_"+strings.ToUpper(name)+"_REMOTE", filepath.Join(dir, name))
+	}
+	t.Setenv("RCLONE_CONFIG_TESTDISTRIBUTED_TYPE", "distributed")
+}
+
+func readObject(t *testing.T, o fs.Object, options ...fs.OpenOption) []byte {
+	in, err := o.Open(context.Background(), options...)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	return data
+}
+
+func TestDistributedFs(t *testing.T) {
+	setupRemotes(t)
+	ctx := context.Background()
+	f, err := fs.NewFs(ctx, "TestDistributed:backend_test")
+	require.NoError(t, err)
+	defer func() {
+		_ = f.Rmdir(ctx, "dir")
+		_ = f.Rmdir(ctx, "")
+	}()
+
+	data := make([]byte, 200000)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	modTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	src := object.NewStaticObjectInfo("dir/file.bin", modTime, -1, true, nil, f)
+	o, err := f.Put(ctx, bytes.NewReader(data), src)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), o.Size())
+	assert.True(t, modTime.Equal(o.ModTime(ctx)))
+	sum := sha256.Sum256(data)
+	gotHash, err := o.Hash(ctx, hash.SHA256)
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(sum[:]), gotHash)
+
+	// the namespace is listed like any other remote
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	_, isDir := entries[0].(fs.Directory)
+	assert.True(t, isDir)
+	assert.Equal(t, "dir", entries[0].Remote())
+	entries, err = f.List(ctx, "dir")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "dir/file.bin", entries[0].Remote())
+	_, err = f.List(ctx, "missing")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+
+	o, err = f.NewObject(ctx, "dir/file.bin")
+	require.NoError(t, err)
+	assert.Equal(t, data, readObject(t, o))
+	assert.Equal(t, data[1000:1100], readObject(t, o, &fs.RangeOption{Start: 1000, End: 1099}))
+	assert.Equal(t, data[150000:], readObject(t, o, &fs.SeekOption{Offset: 150000}))
+	_, err = f.NewObject(ctx, "dir")
+	assert.ErrorIs(t, err, fs.ErrorIsDir)
+
+	// an update is a new version
+	data = append(data, []byte("more")...)
+	require.NoError(t, o.Update(ctx, bytes.NewReader(data), object.NewStaticObjectInfo("dir/file.bin", modTime, int64(len(data)), true, nil, f)))
+	assert.Equal(t, data, readObject(t, o))
+	versions, err := dis_operations.FileVersions("backend_test/dir/file.bin")
+	require.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	assert.ErrorIs(t, f.Rmdir(ctx, "dir"), fs.ErrorDirectoryNotEmpty)
+	require.NoError(t, o.Remove(ctx))
+	_, err = f.NewObject(ctx, "dir/file.bin")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	require.NoError(t, f.Rmdir(ctx, "dir"))
+	_, err = f.List(ctx, "dir")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+}
+
+func TestDistributedFsLegacyFormat(t *testing.T) {
+	setupRemotes(t)
+	ctx := context.Background()
+	f, err := fs.NewFs(ctx, "TestDistributed:legacy_test")
+	require.NoError(t, err)
+
+	// a file of an older release which only dis_download can read
+	require.NoError(t, dis_operations.MakeDir(ctx, "legacy_test", time.Now()))
+	require.NoError(t, dis_operations.SaveFileInfo(dis_operations.FileInfo{FileName: "legacy_test/old.bin", FileSize: 100}))
+	defer func() {
+		_ = dis_operations.RemoveFileFromMetadata("legacy_test/old.bin")
+	}()
+
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	_, err = f.NewObject(ctx, "old.bin")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+}
@@ -0,0 +1,44 @@
+// Test distributed filesystem interface
+package distributed_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/rclone/rclone/backend/alias"
+	"github.com/rclone/rclone/backend/distributed"
+	_ "github.com/rclone/rclone/backend/local"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/dis_operations"
+	"github.com/rclone/rclone/fstest/fstests"
+	"github.com/rclone/rclone/lib/kv"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIntegration runs integration tests against a distributed remote
+// sharded over three local remotes
+func TestIntegration(t *testing.T) {
+	if !kv.Supported() {
+		t.Skip("kv not supported on this OS")
+	}
+	dir := t.TempDir()
+	oldConfigPath := config.GetConfigPath()
+	require.NoError(t, config.SetConfigPath(filepath.Join(dir, "rclone.conf")))
+	t.Setenv(dis_operations.PassphraseEnv, "distributed integration test")
+	t.Cleanup(func() {
+		_ = config.SetConfigPath(oldConfigPath)
+		cache.Clear()
+	})
+	for _, name := range []string{"disa", "disb", "disc"} {
+		t.Setenv("RCLONE_CONFIG_"+strings.ToUpper(name)+"_TYPE", "alias")
+		t.Setenv("RCLONE_CONFIG_"+strings.ToUpper(name)+"_REMOTE", filepath.Join(dir, name))
+	}
+	t.Setenv("RCLONE_CONFIG_TESTDISTRIBUTED_TYPE", "distributed")
+	fstests.Run(t, &fstests.Opt{
+		RemoteName:  "TestDistributed:",
+		NilObject:   (*distributed.Object)(nil),
+		QuickTestOK: true,
+	})
+}
@@ -25,8 +25,15 @@ import (
 	_ "github.com/rclone/rclone/cmd/deletefile"
 	_ "github.com/rclone/rclone/cmd/dis_config"
 	_ "github.com/rclone/rclone/cmd/dis_download"
+	_ "github.com/rclone/rclone/cmd/dis_gc"
+	_ "github.com/rclone/rclone/cmd/dis_key"
 	_ "github.com/rclone/rclone/cmd/dis_ls"
+	_ "github.com/rclone/rclone/cmd/dis_rebalance"
+	_ "github.com/rclone/rclone/cmd/dis_recover"
 	_ "github.com/rclone/rclone/cmd/dis_rm"
+	_ "github.com/rclone/rclone/cmd/dis_scrub"
+	_ "github.com/rclone/rclone/cmd/dis_sync"
+	_ "github.com/rclone/rclone/cmd/dis_unlock"
 	_ "github.com/rclone/rclone/cmd/dis_upload"
 	_ "github.com/rclone/rclone/cmd/genautocomplete"
 	_ "github.com/rclone/rclone/cmd/gendocs"
@@ -236,6 +236,18 @@ func ShowStats() bool {
 	return statsIntervalFlag != nil && statsIntervalFlag.Changed
 }
 
+// sumStats is set for the dis_* commands, which account every file in a
+// stats group of its own until it is done
+var sumStats bool
+
+// shownStats returns the stats shown by --stats and --progress
+func shownStats() *accounting.StatsInfo {
+	if sumStats {
+		return accounting.SumStats(context.Background())
+	}
+	return accounting.GlobalStats()
+}
+
 func RunWithSustainOS(Retry bool, showStats bool, cmd *cobra.Command, f func() error, sustainOS bool) {
 	ctx := context.Background()
 	ci := fs.GetConfig(ctx)
@@ -244,6 +256,7 @@ func RunWithSustainOS(Retry bool, showStats bool, cmd *cobra.Command, f func() e
 	if !showStats && ShowStats() {
 		showStats = true
 	}
+	sumStats = cmd != nil && strings.HasPrefix(cmd.Name(), "dis_")
 	if ci.Progress {
 		stopStats = startProgress()
 	} else if showStats {
@@ -292,7 +305,7 @@ func RunWithSustainOS(Retry bool, showStats bool, cmd *cobra.Command, f func() e
 	}
 	stopStats()
 	if showStats && (accounting.GlobalStats().Errored() || *statsInterval > 0) {
-		accounting.GlobalStats().Log()
+		shownStats().Log()
 	}
 	fs.Debugf(nil, "%d go routines active\n", runtime.NumGoroutine())
 
@@ -372,7 +385,7 @@ func StartStats() func() {
 		for {
 			select {
 			case <-ticker.C:
-				accounting.GlobalStats().Log()
+				shownStats().Log()
 			case <-stopStats:
 				ticker.Stop()
 				return
@@ -1,6 +1,7 @@
 package dis_download
 
 import (
+	"context"
 	"strings"
 
 	"github.com/rclone/rclone/cmd"
@@ -8,8 +9,11 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var version = 0
+
 func init() {
 	cmd.Root.AddCommand(commandDefinition)
+	commandDefinition.Flags().IntVar(&version, "version", version, "Download this version of the file instead of the current one")
 }
 
 var commandDefinition = &cobra.Command{
@@ -23,6 +27,11 @@ eg
 
 	rclone dis_download test.txt local:path
 
+If target is a directory uploaded with dis_upload, every file below it is
+downloaded and the directory structure is restored under destination.
+
+	rclone dis_download photos local:path
+
 
 Note that during this process, distributed binary files stored remote will be 
 requeted from the remotes and decoded in the process to be downloaded in the 
@@ -32,6 +41,15 @@ original file. Erasure Coding is using Reed Solomon is used during this process
 and parity blocks are used to restore the file. If the damage goes over a
 threshhold, recovery of the file can be difficult.
 
+Only as many shards as are needed to rebuild the file are fetched and they
+are decoded and decrypted while they arrive, writing the file straight into
+destination. Parity shards are only fetched when a data shard can't be read.
+
+Every upload of a file makes a new version of it. Use --version to download
+an earlier version which is still retained, as listed by dis_ls --versions.
+
+	rclone dis_download test.txt local:path --version 2
+
 Downloading the file does not erase the distributed binary files in the remote.
 To erase the files, use the dis_rm command instead.
 
@@ -42,12 +60,16 @@ To erase the files, use the dis_rm command instead.
 	Run: func(command *cobra.Command, args []string) {
 		cmd.CheckArgs(2, 2, command, args)
 		cmd.Run(true, true, command, func() error {
-			sameCommand, err := dis_operations.CheckState("download", args, dis_operations.None) // use default lb, its not going to be used anyways
+			ctx := context.Background()
+			if version != 0 {
+				return dis_operations.Dis_DownloadVersion(ctx, args, version)
+			}
+			sameCommand, err := dis_operations.CheckState(ctx, "download", args, dis_operations.None) // use default lb, its not going to be used anyways
 			if err != nil {
 				return err
 			}
 			if !sameCommand {
-				return dis_operations.Dis_Download(args, false)
+				return dis_operations.Dis_Download(ctx, args, false)
 			}
 			return nil
 		})
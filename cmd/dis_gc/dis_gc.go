@@ -0,0 +1,68 @@
+// Package dis_gc provides the dis_gc command.
+package dis_gc
+
+import (
+	"context"
+	"github.com/rclone/rclone/cmd"
+	"github.com/rclone/rclone/fs/dis_operations"
+	"github.com/spf13/cobra"
+)
+
+var (
+	keepLast  = 0
+	keepDaily = 0
+)
+
+func init() {
+	cmd.Root.AddCommand(commandDefinition)
+	cmdFlags := commandDefinition.Flags()
+	cmdFlags.IntVar(&keepLast, "keep-last", keepLast, "Keep the n most recent versions of each file")
+	cmdFlags.IntVar(&keepDaily, "keep-daily", keepDaily, "Keep the last version of each of the n most recent days")
+}
+
+var commandDefinition = &cobra.Command{
+	Use:   "dis_gc [path]",
+	Short: `Drop the versions of distributed files the retention policy doesn't keep.`,
+	Long: `Drop the earlier versions of distributed files which the retention policy
+doesn't keep and delete their shards from the remotes.
+
+Every dis_upload of a file which is already distributed makes a new version
+of it, see dis_ls --versions. The current version of a file is always kept.
+Of the earlier ones those kept by any of these rules are kept:
+
+  - --keep-last n keeps the n most recent versions
+  - --keep-daily n keeps the last version uploaded on each of the n most
+    recent days with an upload
+
+Without flags the policy of the dis_retention section of the config is used,
+which dis_upload also applies after each upload, eg
+
+    [dis_retention]
+    keep_last = 5
+    keep_daily = 7
+
+With no policy at all every version is kept.
+
+A shard is only deleted if no retained version references it. If path is a
+directory every file below it is pruned, with no path every distributed file
+is. Use --dry-run to list the versions which would be dropped.
+
+    rclone dis_gc photos --keep-last 3 --dry-run
+`,
+	Annotations: map[string]string{
+		"groups": "Important",
+	},
+	Run: func(command *cobra.Command, args []string) {
+		cmd.CheckArgs(0, 1, command, args)
+		cmd.Run(true, true, command, func() error {
+			policy := dis_operations.RetentionPolicy{KeepLast: keepLast, KeepDaily: keepDaily}
+			if !command.Flags().Changed("keep-last") && !command.Flags().Changed("keep-daily") {
+				var err error
+				if policy, err = dis_operations.GetRetentionPolicy(); err != nil {
+					return err
+				}
+			}
+			return dis_operations.Dis_GC(context.Background(), args, policy)
+		})
+	},
+}
@@ -0,0 +1,92 @@
+// Package dis_key provides the dis_key command.
+package dis_key
+
+import (
+	"context"
+	"github.com/rclone/rclone/cmd"
+	"github.com/rclone/rclone/fs/dis_operations"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd.Root.AddCommand(commandDefinition)
+	commandDefinition.AddCommand(rotateCommand, exportCommand, importCommand)
+}
+
+var commandDefinition = &cobra.Command{
+	Use:   "dis_key",
+	Short: `Manage the keys distributed files are encrypted with.`,
+	Long: `Manage the keys distributed files are encrypted with.
+
+Every distributed file is encrypted with its own random data key. The data
+keys are stored in the metadata wrapped by a master key, which is derived
+from a passphrase with scrypt and never stored. The passphrase is read from
+RCLONE_DIS_PASSPHRASE or asked for, and is set the first time a file is
+uploaded. It is only asked for on a terminal: rclone rcd, mount and the
+distributed backend need RCLONE_DIS_PASSPHRASE set.
+
+The random password of the files uploaded by older releases, password.txt
+next to the config file, is moved into the keyring wrapped by the master key
+and removed the first time it is needed.
+
+Without the passphrase, or with the metadata lost, the shards can't be
+decrypted, so keep a backup made with dis_key export.
+`,
+	Annotations: map[string]string{
+		"groups": "Important",
+	},
+}
+
+var rotateCommand = &cobra.Command{
+	Use:   "rotate",
+	Short: `Change the passphrase of the master key.`,
+	Long: `Change the passphrase of the master key.
+
+A new master key is derived from the new passphrase, read from
+RCLONE_DIS_NEW_PASSPHRASE or asked for, and the data keys of every file are
+wrapped by it again. No shard is downloaded or uploaded. Backups made before
+the rotation still need the old passphrase.
+`,
+	Run: func(command *cobra.Command, args []string) {
+		cmd.CheckArgs(0, 0, command, args)
+		cmd.Run(false, false, command, func() error {
+			return dis_operations.RotateMasterKey(context.Background())
+		})
+	},
+}
+
+var exportCommand = &cobra.Command{
+	Use:   "export file",
+	Short: `Back up the keyring and the wrapped data keys to file.`,
+	Long: `Back up the keyring and the wrapped data keys of every file to file.
+
+The backup can only be used with the passphrase, so it can be kept with the
+shards. Export again after uploading files or rotating the master key.
+
+    rclone dis_key export dis-keys.json
+`,
+	Run: func(command *cobra.Command, args []string) {
+		cmd.CheckArgs(1, 1, command, args)
+		cmd.Run(false, false, command, func() error {
+			return dis_operations.ExportKeys(args[0])
+		})
+	},
+}
+
+var importCommand = &cobra.Command{
+	Use:   "import file",
+	Short: `Restore the keyring and the wrapped data keys from file.`,
+	Long: `Restore the keyring and the wrapped data keys from a backup made with
+dis_key export.
+
+The passphrase of the backup is checked first. The data keys of the files
+in the backup are restored, and the keyring is replaced unless files not in
+the backup still need it.
+`,
+	Run: func(command *cobra.Command, args []string) {
+		cmd.CheckArgs(1, 1, command, args)
+		cmd.Run(false, false, command, func() error {
+			return dis_operations.ImportKeys(context.Background(), args[0])
+		})
+	},
+}
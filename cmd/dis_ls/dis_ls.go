@@ -3,6 +3,7 @@ package dis_ls
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/rclone/rclone/cmd"
 	"github.com/rclone/rclone/cmd/dis_ls/dis_lshelp"
@@ -10,12 +11,22 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var (
+	long      = false
+	recursive = false
+	versions  = false
+)
+
 func init() {
 	cmd.Root.AddCommand(commandDefinition)
+	cmdFlags := commandDefinition.Flags()
+	cmdFlags.BoolVarP(&long, "long", "l", long, "Show mode, size and modification time of each entry")
+	cmdFlags.BoolVarP(&recursive, "recursive", "R", recursive, "List all entries below the path")
+	cmdFlags.BoolVar(&versions, "versions", versions, "List every retained version of the files")
 }
 
 var commandDefinition = &cobra.Command{
-	Use:   "dis_ls",
+	Use:   "dis_ls [path]",
 	Short: `List the distributed objects in the path with its name.`,
 	Long: `Lists the distributed objects in the remote storage to standard output in a human
 readable format with its name. 
@@ -23,26 +34,75 @@ readable format with its name.
 Eg
 
     $ rclone dis_ls swift:bucket
+        photos/2024/a.jpg
+        photos/2024/b.jpg
         testfile_1.txt
         testfile_2.txt
 
+Files uploaded as part of a directory are listed with their relative path.
+
+If a path is given, the entries directly inside that directory are listed
+instead, with directories marked by a trailing slash. Use --recursive to list
+everything below it and --long to show mode, size and modification time.
+
+    $ rclone dis_ls photos -l
+    drwxr-xr-x          0 2024-05-01 10:12:00 photos/2024/
+
+Use --versions to list every retained version of the file path, or of the
+files below it, newest first with the time it was uploaded. A version can be
+downloaded with dis_download --version.
+
+    $ rclone dis_ls testfile_1.txt --versions
+    v3      1204 2024-05-03 09:30:12 testfile_1.txt
+    v2      1187 2024-05-02 18:02:45 testfile_1.txt
+
 ` + dis_lshelp.Help,
 	Annotations: map[string]string{
 		"groups": "Filter,Listing",
 	},
 	Run: func(command *cobra.Command, args []string) {
 		// command가 "dis_ls" 인지 체크
-		if command.Use == "dis_ls" {
+		if command.Name() == "dis_ls" {
+			cmd.CheckArgs(0, 1, command, args)
 			cmd.Run(true, true, command, func() error {
-				// command 가 dis_ls라면 GetDistributedFile() 함수 실행
-				fileNames, err := dis_operations.Dis_ls()
+				if versions {
+					name := ""
+					if len(args) > 0 {
+						name = args[0]
+					}
+					entries, err := dis_operations.Dis_lsVersions(name)
+					if err != nil {
+						return fmt.Errorf("error while retrieving distributed files: %v", err)
+					}
+					for _, entry := range entries {
+						fmt.Println(formatVersion(entry))
+					}
+					return nil
+				}
+				if len(args) == 0 && !long && !recursive {
+					// command 가 dis_ls라면 GetDistributedFile() 함수 실행
+					fileNames, err := dis_operations.Dis_ls()
+					if err != nil {
+						return fmt.Errorf("error while retrieving distributed files: %v", err)
+					}
+
+					// distributed 된 파일 이름 출력
+					for _, name := range fileNames {
+						fmt.Println(name)
+					}
+					return nil
+				}
+
+				dirName := ""
+				if len(args) > 0 {
+					dirName = args[0]
+				}
+				entries, err := dis_operations.Dis_lsDir(dirName, recursive)
 				if err != nil {
 					return fmt.Errorf("error while retrieving distributed files: %v", err)
 				}
-
-				// distributed 된 파일 이름 출력
-				for _, name := range fileNames {
-					fmt.Println(name)
+				for _, entry := range entries {
+					fmt.Println(formatEntry(entry))
 				}
 				return nil
 			})
@@ -52,3 +112,32 @@ Eg
 		}
 	},
 }
+
+func formatEntry(entry dis_operations.FileInfo) string {
+	name := entry.FileName
+	if entry.IsDir {
+		name += "/"
+	}
+	if !long {
+		return name
+	}
+	modTime := ""
+	if !entry.ModTime.IsZero() {
+		modTime = entry.ModTime.Local().Format("2006-01-02 15:04:05")
+	}
+	return strings.Join([]string{
+		entry.Mode.String(),
+		fmt.Sprintf("%10d", entry.FileSize),
+		fmt.Sprintf("%-19s", modTime),
+		name,
+	}, " ")
+}
+
+func formatVersion(entry dis_operations.FileInfo) string {
+	return strings.Join([]string{
+		fmt.Sprintf("%-4s", fmt.Sprintf("v%d", entry.VersionNumber())),
+		fmt.Sprintf("%9d", entry.FileSize),
+		entry.Uploaded().Local().Format("2006-01-02 15:04:05"),
+		entry.FileName,
+	}, " ")
+}
@@ -0,0 +1,42 @@
+// Package dis_rebalance provides the dis_rebalance command.
+package dis_rebalance
+
+import (
+	"context"
+	"github.com/rclone/rclone/cmd"
+	"github.com/rclone/rclone/fs/dis_operations"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd.Root.AddCommand(commandDefinition)
+}
+
+var commandDefinition = &cobra.Command{
+	Use:   "dis_rebalance",
+	Short: `Spread the shards of distributed files evenly over the configured remotes.`,
+	Long: `Compare where the shards of every distributed file are stored with the
+remotes currently configured and move them so that the placement is even
+again.
+
+Shards stored on a remote which has been removed from the config are rebuilt
+from the other shards of their file and uploaded to the least loaded remotes,
+so the file gets its full redundancy back. When a remote has been added, or
+the shards are unevenly spread, shards are moved off every remote holding more
+than its fair share, the total number of shards divided by the number of
+remotes, to the remotes holding the fewest.
+
+Use --dry-run to list the planned moves without changing anything.
+
+    rclone dis_rebalance --dry-run
+`,
+	Annotations: map[string]string{
+		"groups": "Important",
+	},
+	Run: func(command *cobra.Command, args []string) {
+		cmd.CheckArgs(0, 0, command, args)
+		cmd.Run(true, true, command, func() error {
+			return dis_operations.Dis_Rebalance(context.Background())
+		})
+	},
+}
@@ -0,0 +1,53 @@
+// Package dis_recover provides the dis_recover command.
+package dis_recover
+
+import (
+	"context"
+	"github.com/rclone/rclone/cmd"
+	"github.com/rclone/rclone/fs/dis_operations"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd.Root.AddCommand(commandDefinition)
+}
+
+var commandDefinition = &cobra.Command{
+	Use:   "dis_recover",
+	Short: `Rebuild the metadata of distributed files from the shards on the remotes.`,
+	Long: `Rebuild the datamap and the load balancer state from the shards stored
+on the configured remotes, for when the local metadata has been lost.
+
+Every shard uploaded by this version starts with a header sealed by the key
+of its file, naming the file, its size, modification time and permissions,
+the shard counts and which shard it is. The key of the file is stored next to
+it wrapped by the master key, so the passphrase in RCLONE_DIS_PASSPHRASE,
+which is asked for if unset, is all that is needed to read the headers back.
+Shards written under a passphrase which has been changed since are read with
+the one in RCLONE_DIS_OLD_PASSPHRASE, asked for if unset.
+
+The Distribution directory of every remote is listed and only the header of
+each shard is downloaded. When the shards of several uploads of the same file
+are found, the most recent one which can be rebuilt wins. Files already in the
+datamap are left alone, so it is safe to run on a datamap which only lost some
+files. Without a local keyring the most recent one found on the remotes is
+adopted.
+
+Files uploaded by older versions don't describe themselves and can't be
+recovered. Recovered files missing shards are reported and can be repaired
+with dis_scrub.
+
+Use --dry-run to see what would be recovered without changing anything.
+
+    rclone dis_recover --dry-run
+`,
+	Annotations: map[string]string{
+		"groups": "Important",
+	},
+	Run: func(command *cobra.Command, args []string) {
+		cmd.CheckArgs(0, 0, command, args)
+		cmd.Run(false, false, command, func() error {
+			return dis_operations.Dis_Recover(context.Background())
+		})
+	},
+}
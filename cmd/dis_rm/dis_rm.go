@@ -1,6 +1,7 @@
 package dis_remove
 
 import (
+	"context"
 	"github.com/rclone/rclone/cmd"
 	"github.com/rclone/rclone/fs/dis_operations"
 	"github.com/spf13/cobra"
@@ -20,12 +21,13 @@ var commandDefinition = &cobra.Command{
 	Run: func(command *cobra.Command, args []string) {
 		cmd.CheckArgs(1, 1, command, args)
 		cmd.Run(true, true, command, func() error {
-			sameCommand, err := dis_operations.CheckState("remove", args, dis_operations.None)
+			ctx := context.Background()
+			sameCommand, err := dis_operations.CheckState(ctx, "remove", args, dis_operations.None)
 			if err != nil {
 				return err
 			}
 			if !sameCommand {
-				return dis_operations.Dis_rm(args, false)
+				return dis_operations.Dis_rm(ctx, args, false)
 			}
 			return nil
 		})
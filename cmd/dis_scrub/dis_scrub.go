@@ -0,0 +1,50 @@
+// Package dis_scrub provides the dis_scrub command.
+package dis_scrub
+
+import (
+	"context"
+	"github.com/rclone/rclone/cmd"
+	"github.com/rclone/rclone/fs/dis_operations"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd.Root.AddCommand(commandDefinition)
+}
+
+var commandDefinition = &cobra.Command{
+	Use:   "dis_scrub [path]",
+	Short: `Verify the shards of distributed files and repair the damaged ones.`,
+	Long: `Verify every shard of the distributed files against its remote and
+repair the ones which are missing or corrupt.
+
+Each shard recorded for a file is looked up on its remote and its size is
+checked. If the backend supports SHA-256 hashes the hash is compared with the
+checksum recorded at upload, otherwise the shard is downloaded and hashed.
+Sealed shards, which carry their own authentication, are always downloaded
+and every block of them is authenticated, so a shard which was tampered with,
+truncated or swapped with another one is reported as corrupt.
+
+Shards which are missing, corrupt or on a remote which can't be reached any
+more are rebuilt from the healthy ones and uploaded again, to the same remote
+if it is reachable or to another one otherwise. A file can be repaired as long
+as no more shards than its parity count are lost.
+
+The redundancy margin, how many more shards each file can lose before it
+can't be rebuilt, is reported for every file.
+
+If path is a directory every file below it is scrubbed, with no path every
+distributed file is. Use --dry-run to check the shards without repairing.
+
+    rclone dis_scrub photos --dry-run
+`,
+	Annotations: map[string]string{
+		"groups": "Important",
+	},
+	Run: func(command *cobra.Command, args []string) {
+		cmd.CheckArgs(0, 1, command, args)
+		cmd.Run(true, true, command, func() error {
+			return dis_operations.Dis_Scrub(context.Background(), args, dis_operations.RoundRobin)
+		})
+	},
+}
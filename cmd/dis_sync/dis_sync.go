@@ -0,0 +1,57 @@
+// Package dis_sync provides the dis_sync command.
+package dis_sync
+
+import (
+	"github.com/rclone/rclone/cmd"
+	"github.com/rclone/rclone/fs/dis_operations"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd.Root.AddCommand(commandDefinition)
+}
+
+var commandDefinition = &cobra.Command{
+	Use:   "dis_sync",
+	Short: `Sync the metadata of distributed files with the remotes.`,
+	Long: `Publish the local changes to the metadata of the distributed files to
+the remotes and apply the changes published there by other machines.
+
+The metadata is kept on every remote as a manifest in the Distribution
+directory next to the shards. It is encrypted by a key derived from the
+master key and can only be read with the passphrase in RCLONE_DIS_PASSPHRASE,
+which is asked for if unset. The manifest carries the keyring, so a second
+machine with the same remotes configured and the same passphrase shares the
+distributed files after its first sync:
+
+    rclone dis_sync
+    rclone dis_ls
+
+Every dis_* command syncs by itself before and after changing anything, and
+carries on with the local metadata if the remotes can't be reached. dis_sync
+fails instead, so it can be used to check the metadata is replicated.
+
+A sync needs to read the manifest on, and write it to, a majority of the
+configured remotes. Each change records which machine made it and the
+manifests count the changes of every machine seen, so changes made on
+different machines in the meantime are merged. When the same file was changed
+on two machines at once the latest change becomes the current version, the
+other one is kept as an earlier version (see dis_ls --versions) and the
+conflict is reported. A change always wins over a removal made at the same
+time.
+
+If the passphrase was changed on another machine the new master key is
+adopted, and the keys of the files uploaded locally in the meantime are
+rewrapped with the previous passphrase in RCLONE_DIS_OLD_PASSPHRASE, asked
+for if unset.
+`,
+	Annotations: map[string]string{
+		"groups": "Important",
+	},
+	Run: func(command *cobra.Command, args []string) {
+		cmd.CheckArgs(0, 0, command, args)
+		cmd.Run(false, false, command, func() error {
+			return dis_operations.SyncMetadata()
+		})
+	},
+}
@@ -0,0 +1,51 @@
+// Package dis_unlock provides the dis_unlock command.
+package dis_unlock
+
+import (
+	"context"
+
+	"github.com/rclone/rclone/cmd"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/dis_operations"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd.Root.AddCommand(commandDefinition)
+}
+
+var commandDefinition = &cobra.Command{
+	Use:   "dis_unlock",
+	Short: `Break the lock on the distributed store.`,
+	Long: `Remove the lock on the distributed store from every remote, whoever
+holds it.
+
+The dis_* commands which change the store, dis_upload, dis_rm, dis_scrub,
+dis_rebalance, dis_recover and dis_key, first take a lease on it, a lock
+object stored next to the shards on the remotes naming the machine, process
+and operation holding it and when it expires. A command finding the store
+locked by another machine waits up to two minutes for it to be released
+before failing, so commands run on different machines sharing the same
+remotes never interleave.
+
+The lease is renewed while its command runs and expires five minutes after
+the machine holding it stopped renewing it, for instance because it crashed,
+after which it is broken by the next command. A command finding its lease
+broken and taken by another machine, or unable to renew it before it
+expires, stops. A mount or serve of the distributed backend keeps the lease
+for 30 seconds after its last write. Use dis_unlock only to break a lease
+which is known to be stale before it expires. With --dry-run the lock is
+only shown.
+
+    rclone dis_unlock --dry-run
+`,
+	Annotations: map[string]string{
+		"groups": "Important",
+	},
+	Run: func(command *cobra.Command, args []string) {
+		cmd.CheckArgs(0, 0, command, args)
+		cmd.Run(false, false, command, func() error {
+			return dis_operations.BreakLock(fs.GetConfig(context.Background()).DryRun)
+		})
+	},
+}
@@ -1,6 +1,7 @@
 package dis_upload
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -9,17 +10,29 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var loadBalancer LoadBalancerFlag
+var (
+	loadBalancer LoadBalancerFlag
+	profileName  string
+	dataShards   int
+	parityShards int
+	autoParity   bool
+	localGroups  int
+)
 
 func init() {
 	cmd.Root.AddCommand(commandDefinition)
 	loadBalancer.Value = dis_operations.RoundRobin // Default value
 	commandDefinition.Flags().VarP(&loadBalancer, "loadbalancer", "b", "Load balancing strategy (RoundRobin, ResourceBased, DownloadOptima, UploadOptima, )")
+	commandDefinition.Flags().StringVar(&profileName, "profile", "", "Durability profile giving the data and parity shards, eg archive or fast")
+	commandDefinition.Flags().IntVar(&dataShards, "data-shards", 0, "Number of data shards, overrides the profile")
+	commandDefinition.Flags().IntVar(&parityShards, "parity-shards", 0, "Number of parity shards, overrides the profile")
+	commandDefinition.Flags().BoolVar(&autoParity, "auto-parity", false, "Derive the parity shards from the number of remotes")
+	commandDefinition.Flags().IntVar(&localGroups, "local-groups", 0, "Number of groups of data shards given a local parity shard, overrides the profile")
 }
 
 var commandDefinition = &cobra.Command{
-	Use:   "dis_upload source:path",
-	Short: `Upload source file via distributing it to registered remotes.`,
+	Use:   "dis_upload source:path [dest:path]",
+	Short: `Upload source file or directory via distributing it to registered remotes.`,
 	Long: strings.ReplaceAll(
 		`Upload source file via distributing it to registered remotes. This 
 means selecting a source file in local path and partioning it to several binary 
@@ -35,8 +48,85 @@ Distributed files will be further encoded and stored in specific directories
 The distribution process will select all remotes accessible at the time of
 call and distribute the files using a fair Load Balancing Algorihtm. 
 
-Uploading duplicate files will enact CLI to start an interactive process that
-will ask the user whether to overwrite the file or to skip uploading it. 
+The source is read only once. It is encrypted and erasure coded in fixed
+size stripes while it is read, and every shard is streamed straight to its
+remote, so no scratch space is needed on the local disk and only a stripe of
+data is held in memory at a time.
+
+Files are first cut into chunks of around 4 MiB at boundaries chosen by
+their content, and every chunk is erasure coded and stored once. Uploading
+a file again only sends the chunks which changed, and files sharing content
+share their chunks. A chunk is deleted once no version of any file uses it.
+
+Every file is encrypted with its own random data key, kept wrapped by the
+master key derived from the passphrase in RCLONE_DIS_PASSPHRASE, which is
+asked for if unset. See dis_key to change the passphrase or back up the keys.
+
+The number of data and parity shards grows with the size of the file unless
+chosen with --data-shards and --parity-shards or a durability profile.
+Profiles are named in the dis_profiles section of the config file, and
+archive (10+6) and fast (4+2) are available without any config:
+
+	[dis_profiles]
+	archive = 10+6
+	spread = 8+auto
+
+	rclone dis_upload --profile archive photos
+
+With a parity of auto, or --auto-parity, the parity is the least which lets
+the file survive the loss of any one remote given the number of remotes
+configured. The profile is recorded with the file.
+
+A third number, or --local-groups, cuts the data shards into as many groups
+and stores one more parity shard per group, the XOR of its data shards. A
+lost shard is then repaired from the few shards of its group rather than
+from as many shards as there are data shards, which keeps repairs of wide
+profiles cheap:
+
+	[dis_profiles]
+	cold = 50+25+5
+
+No remote is given more shards of a file than the file has parity shards, so
+losing any one remote never loses the file. Remotes can be tagged with the
+failure domains they share, such as the provider or the region, and shards
+are spread over the domains as evenly as possible:
+
+	[gdrive]
+	type = drive
+	dis_domain = google,asia
+
+A remote without dis_domain is in the domain of its backend type. The load
+balancer decides how the remaining freedom is used: UploadOptima and
+DownloadOptima favour the fastest remotes, ResourceBased the ones with the
+most free space and RoundRobin treats all remotes alike.
+
+Files are stored under a logical path which is the path of source as given
+on the command line, so a/report.pdf and b/report.pdf are kept apart. Sources
+given as absolute paths or outside the current directory are stored under
+their base name. Pass dest:path to choose the logical path explicitly.
+
+	rclone dis_upload a/report.pdf reports/2024/report.pdf
+
+If source is a directory, every file below it is distributed and recorded
+below the logical path together with the directories themselves, so
+
+	rclone dis_upload photos
+
+stores photos/2024/a.jpg and photos/2024/b.jpg which can be downloaded
+together again with dis_download photos. Modification times and permissions
+are recorded and restored on download.
+
+Uploading a file which is already distributed doesn't ask anything: it makes
+a new version of the file, and the earlier versions are kept until dis_gc
+drops them. They are listed by dis_ls --versions and downloaded with
+dis_download --version.
+
+An interrupted upload is resumed by the next dis_* command, without asking
+anything: the files and chunks uploaded completely aren't sent again, and
+the shards of a chunk which didn't get to their remote are rebuilt from the
+ones which did. A shard cut off in the middle is sent again whole, partial
+multipart uploads aren't carried on. Run the same dis_upload again to
+finish it.
 
 If you wish to simply copy the file without any distribution, use the 
 [copy] (/commands/copy/) command instead.`, "|", "`"),
@@ -44,18 +134,26 @@ If you wish to simply copy the file without any distribution, use the
 		"groups": "Copy,Filter,Listing,Important",
 	},
 	Run: func(command *cobra.Command, args []string) {
-		cmd.CheckArgs(1, 1, command, args)
+		cmd.CheckArgs(1, 2, command, args)
 		cmd.Run(true, true, command, func() error {
 			if !loadBalancer.Value.IsValid() {
 				return fmt.Errorf("invalid load balancer type: %s (valid: RoundRobin, ResourceBased, DownloadOptima, UploadOptima)", loadBalancer.Value)
 			}
 			fmt.Printf("Uploading using load balancer: %s\n", loadBalancer.Value)
+			profile, err := dis_operations.ResolveShardProfile(profileName, dataShards, parityShards, localGroups, autoParity)
+			if err != nil {
+				return err
+			}
 
-			_, err := dis_operations.CheckState("upload", args, loadBalancer.Value)
+			ctx := context.Background()
+			sameCommand, err := dis_operations.CheckState(ctx, "upload", args, loadBalancer.Value)
 			if err != nil {
 				return err
 			}
-			return dis_operations.Dis_Upload(args, false, loadBalancer.Value)
+			if sameCommand {
+				return nil
+			}
+			return dis_operations.Dis_Upload(ctx, args, false, loadBalancer.Value, profile)
 		})
 	},
 }
@@ -10,7 +10,6 @@ import (
 	"time"
 
 	"github.com/rclone/rclone/fs"
-	"github.com/rclone/rclone/fs/accounting"
 	"github.com/rclone/rclone/fs/log"
 	"github.com/rclone/rclone/fs/operations"
 	"github.com/rclone/rclone/lib/terminal"
@@ -85,7 +84,7 @@ func printProgress(logMessage string) {
 
 	var buf bytes.Buffer
 	w, _ := terminal.GetSize()
-	stats := strings.TrimSpace(accounting.GlobalStats().String())
+	stats := strings.TrimSpace(shownStats().String())
 	logMessage = strings.TrimSpace(logMessage)
 
 	out := func(s string) {
@@ -291,6 +291,62 @@ func GlobalStats() *StatsInfo {
 	return StatsGroup(context.Background(), globalStats)
 }
 
+// SumStats returns the stats of all the groups, the global one
+// included, added up.
+func SumStats(ctx context.Context) *StatsInfo {
+	return groups.sum(ctx)
+}
+
+// MergeStatsGroup adds what the stats group counted to the stats of ctx,
+// then deletes the group. The transfers of the group should be done.
+func MergeStatsGroup(ctx context.Context, group string) {
+	from := groups.get(group)
+	if from == nil {
+		return
+	}
+	if into := Stats(ctx); into != from {
+		into.add(from)
+	}
+	groups.delete(group)
+}
+
+// add adds the counters of from to s
+func (s *StatsInfo) add(from *StatsInfo) {
+	from.mu.RLock()
+	defer from.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytes += from.bytes
+	s.errors += from.errors
+	if s.lastError == nil && from.lastError != nil {
+		s.lastError = from.lastError
+	}
+	s.fatalError = s.fatalError || from.fatalError
+	s.retryError = s.retryError || from.retryError
+	if from.retryAfter.After(s.retryAfter) {
+		s.retryAfter = from.retryAfter
+	}
+	s.checks += from.checks
+	s.transfers += from.transfers
+	s.renames += from.renames
+	s.deletes += from.deletes
+	s.deletesSize += from.deletesSize
+	s.deletedDirs += from.deletedDirs
+	s.serverSideCopies += from.serverSideCopies
+	s.serverSideCopyBytes += from.serverSideCopyBytes
+	s.serverSideMoves += from.serverSideMoves
+	s.serverSideMoveBytes += from.serverSideMoveBytes
+
+	// keeping the time spent transferring
+	s.oldTimeRanges = append(s.oldTimeRanges, from.oldTimeRanges...)
+	for _, tr := range from.startedTransfers {
+		start, end := tr.TimeRange()
+		s.oldTimeRanges = append(s.oldTimeRanges, timeRange{start, end})
+	}
+	s.oldTimeRanges.merge()
+	s.oldDuration += from.oldDuration
+}
+
 // NewStatsGroup creates new stats under named group.
 func NewStatsGroup(ctx context.Context, group string) *StatsInfo {
 	stats := NewStats(ctx)
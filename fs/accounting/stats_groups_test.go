@@ -2,6 +2,7 @@ package accounting
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"runtime"
 	"testing"
@@ -236,6 +237,50 @@ func TestCountError(t *testing.T) {
 
 }
 
+func TestSumStats(t *testing.T) {
+	ctx := context.Background()
+	defer func() {
+		groups = newStatsGroups()
+	}()
+	GlobalStats().ResetCounters()
+	GlobalStats().Bytes(3)
+	StatsGroup(ctx, "sum-group").Bytes(4)
+	tr := StatsGroup(ctx, "sum-group").NewTransferRemoteSize("file", 10, nil, nil)
+
+	sum := SumStats(ctx)
+	assert.Equal(t, int64(7), sum.GetBytes())
+	assert.Contains(t, sum.String(), "file")
+	tr.Done(ctx, nil)
+	assert.Equal(t, int64(1), SumStats(ctx).GetTransfers())
+}
+
+func TestMergeStatsGroup(t *testing.T) {
+	ctx := context.Background()
+	defer func() {
+		groups = newStatsGroups()
+	}()
+	GlobalStats().ResetCounters()
+	GlobalStats().Bytes(3)
+	stats := StatsGroup(ctx, "merge-group")
+	stats.Bytes(4)
+	tr := stats.NewTransferRemoteSize("file", 10, nil, nil)
+	tr.Done(ctx, nil)
+	_ = stats.Error(errors.New("failed"))
+
+	MergeStatsGroup(ctx, "merge-group")
+	assert.NotContains(t, groups.names(), "merge-group")
+	assert.Equal(t, int64(7), GlobalStats().GetBytes())
+	assert.Equal(t, int64(1), GlobalStats().GetTransfers())
+	assert.Equal(t, int64(1), GlobalStats().GetErrors())
+
+	// merging into a group of its own just deletes it
+	jobCtx := WithStatsGroup(ctx, "job/1")
+	StatsGroup(jobCtx, "job/1").Bytes(5)
+	MergeStatsGroup(jobCtx, "job/1")
+	assert.Equal(t, int64(7), GlobalStats().GetBytes())
+	assert.NotContains(t, groups.names(), "job/1")
+}
+
 func percentDiff(start, end uint64) uint64 {
 	return (start - end) * 100 / start
 }
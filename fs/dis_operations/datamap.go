@@ -3,18 +3,18 @@ package dis_operations
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"sync"
+	"sort"
 
 	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/reedsolomon"
 )
 
-var jsonFileMutex sync.Mutex
+// name of the JSON datamap used before the metadata store, see store.go
 var datamap_file_name = "datamap.json"
 
 // calculating checksum of file
@@ -32,12 +32,6 @@ func calculateChecksum(filePath string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-// getting path existing json file
-func getJsonFilePath() string {
-	path := GetRcloneDirPath()
-	return filepath.Join(path, "data", datamap_file_name)
-}
-
 // getting rclone dir path
 func GetRcloneDirPath() (path string) {
 	fullConfigPath := config.GetConfigPath()
@@ -45,49 +39,6 @@ func GetRcloneDirPath() (path string) {
 	return path
 }
 
-// reading json file and then returning original file infos
-func readJsonFile() (map[string]FileInfo, error) {
-	file, err := os.Open(getJsonFilePath())
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return make(map[string]FileInfo), nil
-		}
-		return nil, fmt.Errorf("failed to open JSON file : %v", err)
-	}
-	defer file.Close()
-
-	var filesMap map[string]FileInfo
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&filesMap)
-	if err != nil && !errors.Is(err, io.EOF) {
-		return nil, fmt.Errorf("failed to decode JSON: %v", err)
-	}
-	if filesMap == nil {
-		filesMap = make(map[string]FileInfo)
-	}
-
-	return filesMap, nil
-
-}
-
-// writting original file infos on json file
-func writeJsonFile(filePath string, data map[string]FileInfo) error {
-	err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
-	if err != nil {
-		return fmt.Errorf("failed to create directory: %v", err)
-	}
-
-	jsonData, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal JSON: %v", err)
-	}
-
-	if err := os.WriteFile(filePath, jsonData, 0644); err != nil {
-		return fmt.Errorf("failed to write JSON file: %v", err)
-	}
-	return nil
-}
-
 // making distributed file info
 func GetDistributedInfo(fileName string, remote Remote, checksum string) (DistributedFile, error) {
 	if fileName == "" {
@@ -104,13 +55,19 @@ func GetDistributedInfo(fileName string, remote Remote, checksum string) (Distri
 
 // making file info about original file
 func MakeDataMap(originalFilePath string, distributedFiles []DistributedFile, disFileSize int64, paddingAmount int64, shard int, parity int) error {
+	return MakeDataMapWithName(originalFilePath, filepath.Base(originalFilePath), distributedFiles, disFileSize, paddingAmount, reedsolomon.CodecFor(shard+parity), shard, parity)
+}
+
+// making file info about original file which is stored under originalFileName.
+// originalFileName is the logical path of the file, parent directories are created
+func MakeDataMapWithName(originalFilePath string, originalFileName string, distributedFiles []DistributedFile, disFileSize int64, paddingAmount int64, codec reedsolomon.Codec, shard int, parity int) error {
 	if originalFilePath == "" {
 		return errors.New("originalFilePath cannot be empty")
 	}
+	if originalFileName == "" {
+		return errors.New("originalFileName cannot be empty")
+	}
 
-	jsonFilePath := getJsonFilePath()
-
-	originalFileName := filepath.Base(originalFilePath)
 	originalFileInfo, err := os.Stat(originalFilePath)
 	if err != nil {
 		return fmt.Errorf("failed to stat original file: %v", err)
@@ -128,6 +85,8 @@ func MakeDataMap(originalFilePath string, distributedFiles []DistributedFile, di
 
 	newFileInfo := FileInfo{
 		FileName:             originalFileName,
+		ModTime:              originalFileInfo.ModTime(),
+		Mode:                 originalFileInfo.Mode(),
 		FileSize:             originalFileInfo.Size(),
 		DisFileSize:          disFileSize,
 		Shard:                shard,
@@ -136,35 +95,63 @@ func MakeDataMap(originalFilePath string, distributedFiles []DistributedFile, di
 		State:                "upload",
 		Checksum:             checksum,
 		Padding:              paddingAmount,
+		Codec:                string(codec),
 		DistributedFileInfos: dFileMap,
 	}
 
-	FilesMap, err := readJsonFile()
-	if err != nil {
-		return err
-	}
-
-	FilesMap[originalFileName] = newFileInfo
-	return writeJsonFile(jsonFilePath, FilesMap)
+	return SaveFileInfo(newFileInfo)
 }
 
-func RemoveFileFromMetadata(fileName string) error {
-	filesMap, err := readJsonFile()
-	if err != nil {
-		return err
+// storing info in the datamap under its logical path, creating parent directories
+func SaveFileInfo(info FileInfo) error {
+	if info.FileName == "" {
+		return errors.New("originalFileName cannot be empty")
 	}
+	return updateDatamap(func(filesMap map[string]FileInfo) error {
+		if entry, exists := filesMap[info.FileName]; exists && entry.IsDir {
+			return fmt.Errorf("can't upload %q: a directory with that name exists", info.FileName)
+		}
+		if err := addParentDirs(filesMap, info.FileName, info.ModTime); err != nil {
+			return err
+		}
 
-	delete(filesMap, fileName)
+		filesMap[info.FileName] = info
+		return nil
+	})
+}
 
-	return writeJsonFile(getJsonFilePath(), filesMap)
+// updating the entry of originalFileName
+func updateFileInfo(originalFileName string, updateFunc func(*FileInfo) error) error {
+	return updateDatamap(func(filesMap map[string]FileInfo) error {
+		fileInfo, exists := filesMap[originalFileName]
+		if !exists {
+			return fmt.Errorf("file '%s' not found", originalFileName)
+		}
+		if err := updateFunc(&fileInfo); err != nil {
+			return err
+		}
+		filesMap[originalFileName] = fileInfo
+		return nil
+	})
 }
 
+func RemoveFileFromMetadata(fileName string) error {
+	return updateDatamap(func(filesMap map[string]FileInfo) error {
+		delete(filesMap, fileName)
+		return nil
+	})
+}
+
+// returning the datamap entry of the file or directory at the logical path fileName
 func GetFileInfoStruct(fileName string) (FileInfo, error) {
-	filesMap, err := readJsonFile()
+	filesMap, err := readDatamap()
 	if err != nil {
 		return FileInfo{}, err
 	}
 
+	if logicalPath, err := NormalizeLogicalPath(fileName); err == nil {
+		fileName = logicalPath
+	}
 	if fileInfo, exists := filesMap[fileName]; exists {
 		return fileInfo, nil
 	}
@@ -172,18 +159,39 @@ func GetFileInfoStruct(fileName string) (FileInfo, error) {
 	return FileInfo{}, fmt.Errorf("file name '%s' not found", fileName)
 }
 
+// returning logical paths of all files below the directory dirName, sorted
+func GetFileNamesInDir(dirName string) ([]string, error) {
+	filesMap, err := readDatamap()
+	if err != nil {
+		return nil, err
+	}
+
+	var fileNames []string
+	for fileName, info := range filesMap {
+		if !info.IsDir && !isChunkEntry(fileName) && isUnder(fileName, dirName) {
+			fileNames = append(fileNames, fileName)
+		}
+	}
+	sort.Strings(fileNames)
+
+	return fileNames, nil
+}
+
 func DoesFileStructExist(fileName string) (bool, error) {
-	filesMap, err := readJsonFile()
+	filesMap, err := readDatamap()
 	if err != nil {
 		return false, err
 	}
 
-	_, exists := filesMap[fileName]
-	return exists, nil
+	if logicalPath, err := NormalizeLogicalPath(fileName); err == nil {
+		fileName = logicalPath
+	}
+	info, exists := filesMap[fileName]
+	return exists && !info.IsDir, nil
 }
 
 func GetDistributedFileStruct(fileName string) ([]DistributedFile, error) {
-	filesMap, err := readJsonFile()
+	filesMap, err := readDatamap()
 	if err != nil {
 		return nil, err
 	}
@@ -236,13 +244,13 @@ func removeFileByName(files []FileInfo, fileName string) []FileInfo {
 
 // checking to see if it terminated abnormally and if so, returning what command is was previously
 func CheckFlagAndState() (bool, string, string) {
-	filesMap, err := readJsonFile()
+	filesMap, err := readDatamap()
 	if err != nil {
-		fmt.Printf("failed to read json file at checkflag func")
+		fmt.Printf("failed to read datamap at checkflag func: %v\n", err)
 	}
 
-	for _, info := range filesMap {
-		if info.Flag {
+	for name, info := range filesMap {
+		if info.Flag && !isChunkEntry(name) {
 			return info.Flag, info.State, info.FileName
 		}
 	}
@@ -252,65 +260,41 @@ func CheckFlagAndState() (bool, string, string) {
 // Updating file flag to true.
 // this function is used when downloading or deleting a file.
 func UpdateFileFlag(originalFileName string, state string) error {
-	jsonFileMutex.Lock()
-	defer jsonFileMutex.Unlock()
-
-	filesMap, err := readJsonFile()
-	if err != nil {
-		return fmt.Errorf("failed to read JSON file: %v", err)
-	}
-
-	fileInfo, exists := filesMap[originalFileName]
-	if !exists {
-		return fmt.Errorf("file '%s' not found\n", originalFileName)
-	}
-
-	fileInfo.Flag = true
-	fileInfo.State = state
-	filesMap[originalFileName] = fileInfo
-
-	if err := writeJsonFile(getJsonFilePath(), filesMap); err != nil {
-		return fmt.Errorf("failed to write updated JSON: %v", err)
-	}
+	return updateDatamap(func(filesMap map[string]FileInfo) error {
+		fileInfo, exists := filesMap[originalFileName]
+		if !exists {
+			return fmt.Errorf("file '%s' not found", originalFileName)
+		}
 
-	return nil
+		fileInfo.Flag = true
+		fileInfo.State = state
+		filesMap[originalFileName] = fileInfo
+		return nil
+	})
 }
 
 // updating distributedfile check flag after uploading, downloading or removing
 func updateDistributedFile(originalFileName, distributedFileName string, updateFunc func(*DistributedFile) error) error {
-	jsonFileMutex.Lock()
-	defer jsonFileMutex.Unlock()
-
-	filesMap, err := readJsonFile()
-	if err != nil {
-		return fmt.Errorf("failed to read JSON file: %v", err)
-	}
-
-	fileInfo, exists := filesMap[originalFileName]
-	if !exists {
-		return fmt.Errorf("file '%s' not found", originalFileName)
-	}
-
-	dFile, exists := fileInfo.DistributedFileInfos[distributedFileName]
-	if !exists {
-		return fmt.Errorf("distributed file '%s' not found for original file '%s'", distributedFileName, originalFileName)
-	}
-
-	// Apply the update function
-	if err := updateFunc(&dFile); err != nil {
-		return err
-	}
+	return updateDatamap(func(filesMap map[string]FileInfo) error {
+		fileInfo, exists := filesMap[originalFileName]
+		if !exists {
+			return fmt.Errorf("file '%s' not found", originalFileName)
+		}
 
-	fileInfo.DistributedFileInfos[distributedFileName] = dFile
-	filesMap[originalFileName] = fileInfo
+		dFile, exists := fileInfo.DistributedFileInfos[distributedFileName]
+		if !exists {
+			return fmt.Errorf("distributed file '%s' not found for original file '%s'", distributedFileName, originalFileName)
+		}
 
-	err = writeJsonFile(getJsonFilePath(), filesMap)
-	if err != nil {
-		return fmt.Errorf("failed to write updated JSON: %v", err)
-	}
+		// Apply the update function
+		if err := updateFunc(&dFile); err != nil {
+			return err
+		}
 
-	//fmt.Println("Check flag updated!")
-	return nil
+		fileInfo.DistributedFileInfos[distributedFileName] = dFile
+		filesMap[originalFileName] = fileInfo
+		return nil
+	})
 }
 
 func UpdateDistributedFile_CheckFlag(originalFileName, distributedFileName string, newCheck bool) error {
@@ -330,40 +314,29 @@ func UpdateDistributedFile_CheckFlagAndRemote(originalFileName, distributedFileN
 
 // resetting file check flag after finishing operation
 func ResetCheckFlag(originalFileName string) error {
-	jsonFileMutex.Lock()
-	defer jsonFileMutex.Unlock()
-
-	filesMap, err := readJsonFile()
-	if err != nil {
-		return fmt.Errorf("failed to read JSON file: %v", err)
-	}
-
-	fileInfo, exists := filesMap[originalFileName]
-	if !exists {
-		return fmt.Errorf("failed to reset flag: original file '%s' not found", originalFileName)
-	}
-
-	fileInfo.Flag = false
-
-	for key, dFile := range fileInfo.DistributedFileInfos {
-		dFile.Check = false
-		fileInfo.DistributedFileInfos[key] = dFile
-	}
+	return updateDatamap(func(filesMap map[string]FileInfo) error {
+		fileInfo, exists := filesMap[originalFileName]
+		if !exists {
+			return fmt.Errorf("failed to reset flag: original file '%s' not found", originalFileName)
+		}
 
-	filesMap[originalFileName] = fileInfo
+		fileInfo.Flag = false
 
-	if err := writeJsonFile(getJsonFilePath(), filesMap); err != nil {
-		return fmt.Errorf("failed to write updated JSON: %v", err)
-	}
+		for key, dFile := range fileInfo.DistributedFileInfos {
+			dFile.Check = false
+			fileInfo.DistributedFileInfos[key] = dFile
+		}
 
-	return nil
+		filesMap[originalFileName] = fileInfo
+		return nil
+	})
 }
 
 // input으로 originalName과 hashedFileName []string을 넘겨주면 originalFileName []string넘겨주는 함수
 func GetOriginalFileNameList(originalFileName string, hashedFileNameList []string) ([]string, error) {
-	filesMap, err := readJsonFile()
+	filesMap, err := readDatamap()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read JSON file: %v", err)
+		return nil, err
 	}
 
 	fileInfo, exists := filesMap[originalFileName]
@@ -393,9 +366,9 @@ func GetOriginalFileNameList(originalFileName string, hashedFileNameList []strin
 
 // remove하다 멈췄을 때 어떤 파일을 마저 지워야하는지 알려주는 함수
 func GetUncompletedFileInfo(originalFileName string) ([]DistributedFile, error) {
-	filesMap, err := readJsonFile()
+	filesMap, err := readDatamap()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read JSON file: %v", err)
+		return nil, err
 	}
 
 	fileInfo, exists := filesMap[originalFileName]
@@ -413,7 +386,3 @@ func GetUncompletedFileInfo(originalFileName string) ([]DistributedFile, error)
 
 	return uncompleted, nil
 }
-
-func GetDatamapFileName() string {
-	return datamap_file_name
-}
@@ -1,7 +1,6 @@
 package dis_operations
 
 import (
-	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -38,11 +37,11 @@ func TestGetDistributedInfo(t *testing.T) {
 }
 
 func TestMakeDataMap(t *testing.T) {
-	tempFile, err := os.CreateTemp("", "testfile_*.txt")
+	setupTestStore(t)
+	tempFile, err := os.CreateTemp(t.TempDir(), "testfile_*.txt")
 	if err != nil {
 		t.Fatalf("Failed to create temp file: %v", err)
 	}
-	defer os.Remove(tempFile.Name())
 
 	_, err = tempFile.WriteString("This is a test file!!")
 	if err != nil {
@@ -65,50 +64,11 @@ func TestMakeDataMap(t *testing.T) {
 		t.Errorf("Expected no error, but got: %v", err)
 	}
 
-	jsonFilePath, err := os.Getwd()
-	if err != nil {
-		fmt.Errorf("failed to find Path: %v", err)
-	}
-	jsonFilePath = filepath.Join(jsonFilePath, "data", "datamap.json")
-	if _, err := os.Stat(jsonFilePath); os.IsNotExist(err) {
-		t.Errorf("Expected JSON file to be created at %s, but it does not exist", jsonFilePath)
-	}
-
-}
-
-func TestCalculateChecksum(t *testing.T) {
-	// you have to change on your side!!
-	tempFile, err := os.CreateTemp("", "testfile_*.txt")
-	if err != nil {
-		t.Fatalf("Failed to create temp file: %v", err)
-	}
-	defer os.Remove(tempFile.Name())
-
-	content := "This is a test file for checksum."
-	_, err = tempFile.WriteString(content)
+	filesMap, err := readDatamap()
 	if err != nil {
-		t.Fatalf("Failed to write to temp file: %v", err)
-	}
-	tempFile.Close()
-
-	expectedChecksum := "e200bd66430fb559c1a0d6322fe3a154e2ee200a6f113d66a60ce2605ddb88bc"
-	checksum, err := calculateChecksum(tempFile.Name())
-	if err != nil {
-		t.Errorf("Expected no error, but got: %v", err)
+		t.Fatalf("Failed to read datamap: %v", err)
 	}
-
-	if checksum != expectedChecksum {
-		t.Errorf("Expected checksum: %s, but got: %s", expectedChecksum, checksum)
-	}
-}
-
-func TestGetRcloneDirPath(t *testing.T) {
-	fmt.Printf(GetRcloneDirPath())
-}
-
-func TestGetChecksumList(t *testing.T) {
-	checksums := GetChecksumList("IMG_6146.JPG")
-	for idx, checksum := range checksums {
-		fmt.Println(idx, " ", checksum)
+	if _, ok := filesMap[filepath.Base(tempFile.Name())]; !ok {
+		t.Errorf("Expected %s to be recorded in %s", filepath.Base(tempFile.Name()), MetadataStorePath())
 	}
 }
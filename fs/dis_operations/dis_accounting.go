@@ -0,0 +1,130 @@
+package dis_operations
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/rclone/rclone/fs/object"
+)
+
+// Accounting of the dis_* transfers
+//
+// Every logical file uploaded or downloaded gets a stats group of its own,
+// "dis/<name>", so core/stats, --progress and the Prometheus exporter report
+// distributed transfers like any other. The shards are accounted in it as
+// transfers named "<remote>:<shard>", and the encoding or decoding of the
+// file as a check of it lasting as long as the phase. Once the file is done
+// its group is merged into the global stats.
+//
+// In an rc job the files are accounted in the group of the job instead, so
+// its stats stay together and are deleted with it.
+//
+// Outside of the dis_* operations, as when the distributed backend is read,
+// the shards aren't accounted: the transfer of the file already is.
+
+// statsGroupPrefix starts the names of the stats groups of the files
+const statsGroupPrefix = "dis/"
+
+// Phases of a file shown in its stats group
+const (
+	phaseEncode = "encoding"
+	phaseDecode = "decoding"
+)
+
+// fileAccountingKey marks the context of a dis_* operation on a file
+type fileAccountingKey struct{}
+
+// fileStatsContext returns ctx accounting the transfers of the file name,
+// in the stats group of ctx if it has one, else in the group of the file,
+// and the func to call once the file is done
+func fileStatsContext(ctx context.Context, name string) (context.Context, func()) {
+	ctx = context.WithValue(ctx, fileAccountingKey{}, name)
+	if _, ok := accounting.StatsGroupFromContext(ctx); ok {
+		return ctx, func() {}
+	}
+	group := statsGroupPrefix + name
+	return accounting.WithStatsGroup(ctx, group), func() {
+		accounting.MergeStatsGroup(ctx, group)
+	}
+}
+
+// fileStats returns the stats the file of ctx is accounted in, nil if ctx
+// isn't the context of a file, see fileStatsContext
+func fileStats(ctx context.Context) *accounting.StatsInfo {
+	if ctx.Value(fileAccountingKey{}) == nil {
+		return nil
+	}
+	return accounting.Stats(ctx)
+}
+
+// startPhase shows the file name of size bytes going through phase in the
+// stats of ctx. It returns the func ending the phase with its error.
+func startPhase(ctx context.Context, name string, size int64, phase string) func(err error) {
+	stats := fileStats(ctx)
+	if stats == nil {
+		return func(error) {}
+	}
+	tr := stats.NewCheckingTransfer(object.NewStaticObjectInfo(name, time.Now(), size, true, nil, nil), phase)
+	return func(err error) {
+		tr.Done(ctx, err)
+	}
+}
+
+// shardTransferName is the name the transfer of dFile is accounted under
+func shardTransferName(dFile DistributedFile) string {
+	return dFile.Remote.Name + ":" + dFile.DistributedFile
+}
+
+// accountShardUpload returns in, size bytes of dFile uploaded to f, accounted
+// in the stats of ctx, and the func ending its transfer with its error
+func accountShardUpload(ctx context.Context, dFile DistributedFile, f fs.Fs, in io.Reader, size int64) (io.Reader, func(err error)) {
+	stats := fileStats(ctx)
+	if stats == nil {
+		return in, func(error) {}
+	}
+	tr := stats.NewTransferRemoteSize(shardTransferName(dFile), size, nil, f)
+	return tr.Account(ctx, io.NopCloser(in)), func(err error) {
+		tr.Done(ctx, err)
+	}
+}
+
+// accountShardDownload returns in, size bytes of dFile read from f,
+// accounted in the stats of ctx. Its transfer ends when it is closed.
+func accountShardDownload(ctx context.Context, dFile DistributedFile, f fs.Fs, in io.ReadCloser, size int64) io.ReadCloser {
+	stats := fileStats(ctx)
+	if stats == nil {
+		return in
+	}
+	tr := stats.NewTransferRemoteSize(shardTransferName(dFile), size, f, nil)
+	return &shardTransfer{ctx: ctx, tr: tr, acc: tr.Account(ctx, in)}
+}
+
+// shardTransfer accounts the reads of a shard
+type shardTransfer struct {
+	ctx context.Context
+	tr  *accounting.Transfer
+	acc *accounting.Account
+	err error
+}
+
+func (t *shardTransfer) Read(p []byte) (int, error) {
+	n, err := t.acc.Read(p)
+	if err != nil && err != io.EOF && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
+
+// Close ends the transfer. A shard given up for a faster one, its context
+// canceled, isn't counted as an error.
+func (t *shardTransfer) Close() error {
+	err := t.acc.Close()
+	if t.ctx.Err() != nil {
+		t.err = nil
+	}
+	t.tr.Done(t.ctx, t.err)
+	return err
+}
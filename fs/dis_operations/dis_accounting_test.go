@@ -0,0 +1,84 @@
+package dis_operations
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/rclone/rclone/fs/rc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStatsGroup(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	const name = "accounting_test/data.bin"
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+		_, _ = collectChunks(ctx)
+	}()
+
+	data := make([]byte, 300000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "data.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+
+	// outside of a file group nothing is accounted
+	global := accounting.GlobalStats().GetTransfers()
+	require.NoError(t, streamUploadFile(ctx, src, "accounting_test/other.bin", RoundRobin, ShardProfile{}))
+	defer func() {
+		_ = RemoveFileFromMetadata("accounting_test/other.bin")
+	}()
+	assert.Equal(t, global, accounting.GlobalStats().GetTransfers())
+
+	// the group of the file is merged into the global stats once it is done
+	checks, bytes := accounting.GlobalStats().GetChecks(), accounting.GlobalStats().GetBytes()
+	require.NoError(t, disUploadFile(ctx, src, name, false, RoundRobin, ShardProfile{}, nil))
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	files, err := readDatamap()
+	require.NoError(t, err)
+	shards := 0
+	for _, ref := range info.Chunks {
+		shards += len(files[chunkEntryName(ref.ID)].DistributedFileInfos)
+	}
+	require.NotZero(t, shards)
+	stats := accounting.GlobalStats()
+	assert.NotContains(t, statsGroups(t), statsGroupPrefix+name)
+	assert.Equal(t, global+int64(shards), stats.GetTransfers())
+	assert.Greater(t, stats.GetBytes()-bytes, int64(len(data)))
+	assert.Equal(t, checks+1, stats.GetChecks(), "the encoding phase")
+
+	out := t.TempDir()
+	require.NoError(t, disDownloadFile(ctx, name, out, false))
+	got, err := os.ReadFile(filepath.Join(out, "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.NotContains(t, statsGroups(t), statsGroupPrefix+name)
+	assert.Greater(t, stats.GetTransfers(), global+int64(shards))
+	assert.Equal(t, checks+2, stats.GetChecks(), "the decoding phase")
+
+	// an rc job accounts its files in its own group
+	jobCtx := accounting.WithStatsGroup(ctx, "job/dis-test")
+	defer accounting.MergeStatsGroup(jobCtx, "job/dis-test")
+	require.NoError(t, disDownloadFile(jobCtx, name, t.TempDir(), false))
+	assert.NotContains(t, statsGroups(t), statsGroupPrefix+name)
+	jobStats := accounting.StatsGroup(jobCtx, "job/dis-test")
+	assert.NotZero(t, jobStats.GetTransfers())
+	assert.Equal(t, int64(1), jobStats.GetChecks(), "the decoding phase")
+}
+
+// statsGroups returns the names of the stats groups
+func statsGroups(t *testing.T) []string {
+	call := rc.Calls.Get("core/group-list")
+	require.NotNil(t, call)
+	out, err := call.Fn(context.Background(), rc.Params{})
+	require.NoError(t, err)
+	groups, _ := out["groups"].([]string)
+	return groups
+}
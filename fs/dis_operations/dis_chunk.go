@@ -0,0 +1,500 @@
+package dis_operations
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/fastcdc"
+	"golang.org/x/sync/errgroup"
+)
+
+// Chunked files
+//
+// dis_upload cuts files into content defined chunks with lib/fastcdc before
+// anything is erasure coded. Every chunk is stored once, as a sealed entry of
+// its own named after its content, and files list the chunks they are made
+// of. A file uploaded again only sends the chunks which changed, and files
+// with the same content share their chunks.
+//
+// Chunk entries live in the datamap next to the files, under chunkPrefix
+// which no logical path starts with, so they are synced, rebalanced and
+// scrubbed like files but never listed. Their RefCount is the number of file
+// versions using them, kept up to date by every datamap transaction, and
+// chunks no version uses any more are deleted by collectChunks.
+//
+// Chunks are identified by a MAC of their content keyed by the keyring, so
+// the names on the remotes reveal nothing about the content.
+const chunkPrefix = "/chunks/"
+
+// chunkOptions are the sizes files are cut with
+var chunkOptions = fastcdc.Options{}
+
+// ChunkRef is a chunk of a chunked file
+type ChunkRef struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+// isChunkEntry returns true if name is the datamap entry of a chunk
+func isChunkEntry(name string) bool {
+	return strings.HasPrefix(name, chunkPrefix)
+}
+
+// chunkEntryName returns the datamap entry name of the chunk id
+func chunkEntryName(id string) string {
+	return chunkPrefix + id
+}
+
+// ringChunkKey returns the chunk ID key of ring unlocked by master
+func ringChunkKey(ring *KeyRing, master *[32]byte) ([]byte, error) {
+	if ring != nil && len(ring.ChunkKey) > 0 {
+		key, err := unseal(master, ring.ChunkKey)
+		if err != nil {
+			return nil, fmt.Errorf("chunk key: %w", err)
+		}
+		return key, nil
+	}
+	mac := hmac.New(sha256.New, master[:])
+	mac.Write([]byte("dis chunk id"))
+	return mac.Sum(nil), nil
+}
+
+// chunkIDKey returns the key chunks are identified with
+func chunkIDKey() ([]byte, error) {
+	master, _, err := masterKey()
+	if err != nil {
+		return nil, err
+	}
+	ring, err := readKeyRing()
+	if err != nil {
+		return nil, err
+	}
+	return ringChunkKey(ring, master)
+}
+
+// chunkID returns the ID of the chunk holding data
+func chunkID(key []byte, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// countChunkRefs sets the RefCount of every chunk entry of files to the
+// number of file versions using it
+func countChunkRefs(files map[string]FileInfo) {
+	refs := make(map[string]int)
+	for name, info := range files {
+		if isChunkEntry(name) {
+			continue
+		}
+		for _, version := range info.history() {
+			seen := make(map[string]bool, len(version.Chunks))
+			for _, ref := range version.Chunks {
+				if !seen[ref.ID] {
+					seen[ref.ID] = true
+					refs[ref.ID]++
+				}
+			}
+		}
+	}
+	for name, info := range files {
+		if !isChunkEntry(name) {
+			continue
+		}
+		if count := refs[name[len(chunkPrefix):]]; info.RefCount != count {
+			info.RefCount = count
+			files[name] = info
+		}
+	}
+}
+
+// recordedShards returns the shards of info which were given a remote
+func recordedShards(info FileInfo) []DistributedFile {
+	var shards []DistributedFile
+	for _, dFile := range info.DistributedFileInfos {
+		if dFile.Remote.Name != "" {
+			shards = append(shards, dFile)
+		}
+	}
+	return shards
+}
+
+// saveChunkEntry records the chunk entry info
+func saveChunkEntry(info FileInfo) error {
+	return updateDatamap(func(filesMap map[string]FileInfo) error {
+		filesMap[info.FileName] = info
+		return nil
+	})
+}
+
+// uploadChunk uploads data as the chunk id
+func uploadChunk(ctx context.Context, id string, data []byte, loadBalancer LoadBalancerType, profile ShardProfile) error {
+	now := time.Now()
+	// known before anything is sent, so a chunk cut off can be resumed
+	sum := sha256.Sum256(data)
+	entry := FileInfo{FileName: chunkEntryName(id), ModTime: now, UploadTime: now, Checksum: hex.EncodeToString(sum[:])}
+	if err := uploadSealed(ctx, bytes.NewReader(data), int64(len(data)), entry, loadBalancer, profile, saveChunkEntry); err != nil {
+		return fmt.Errorf("failed to upload chunk %s: %w", id, err)
+	}
+	return ResetCheckFlag(entry.FileName)
+}
+
+// chunkedUploadFile uploads absolutePath as originalFileName, sending only
+// the chunks of it which aren't stored yet. The progress is recorded in j if
+// not nil, and an upload of the file j recorded is resumed.
+func chunkedUploadFile(ctx context.Context, absolutePath string, originalFileName string, loadBalancer LoadBalancerType, profile ShardProfile, j *uploadJournal) error {
+	src, err := os.Open(absolutePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	entry := FileInfo{FileName: originalFileName, ModTime: stat.ModTime(), Mode: stat.Mode(), FileSize: stat.Size()}
+	return chunkedUpload(ctx, src, entry, loadBalancer, profile, j)
+}
+
+// chunkedUpload uploads src as the file entry, which gives its name, mode
+// and modification time, sending only the chunks of it which aren't stored
+// yet. The size of src needn't be known in advance.
+//
+// The progress is recorded in j if not nil. If j holds the progress of an
+// interrupted upload of the same source and src can seek, reading starts
+// again where the chunks stored end.
+func chunkedUpload(ctx context.Context, src io.Reader, entry FileInfo, loadBalancer LoadBalancerType, profile ShardProfile, j *uploadJournal) error {
+	originalFileName := entry.FileName
+
+	// the versions uploaded before stay until this one is complete
+	version, versions, err := nextVersion(ctx, originalFileName)
+	if err != nil {
+		return err
+	}
+	idKey, err := chunkIDKey()
+	if err != nil {
+		return err
+	}
+	files, err := readDatamap()
+	if err != nil {
+		return err
+	}
+
+	srcHash := sha256.New()
+	var refs []ChunkRef
+	var size int64
+	entry.Version = version
+	if p := j.progress(entry); p != nil {
+		if refs, err = resumeChunked(src, srcHash, p, files); err != nil {
+			return err
+		}
+		if refs != nil {
+			size = p.Offset
+			fs.Infof(originalFileName, "Resuming from byte %d, %d chunks stored already", size, len(refs))
+		}
+	}
+
+	err = SaveFileInfo(FileInfo{
+		FileName:   originalFileName,
+		ModTime:    entry.ModTime,
+		Mode:       entry.Mode,
+		FileSize:   entry.FileSize,
+		Flag:       true,
+		State:      "upload",
+		Format:     formatChunked,
+		Profile:    profile.Name,
+		Version:    version,
+		UploadTime: time.Now(),
+		Versions:   versions,
+		Chunks:     refs,
+	})
+	if err != nil {
+		return err
+	}
+
+	chunker, err := fastcdc.New(src, chunkOptions)
+	if err != nil {
+		return err
+	}
+
+	// the start of the source held by chunks all stored is recorded in j,
+	// with the state of the checksum at the end of every chunk
+	var mu sync.Mutex
+	stored := make(map[string]bool)
+	committed := len(refs)
+	ends := make([]int64, len(refs))
+	states := make([][]byte, len(refs))
+	if committed > 0 {
+		ends[committed-1] = size
+		states[committed-1], _ = srcHash.(encoding.BinaryMarshaler).MarshalBinary()
+	}
+	commit := func() error {
+		n := committed
+		for n < len(refs) && stored[refs[n].ID] {
+			n++
+		}
+		if n == committed {
+			return nil
+		}
+		committed = n
+		return j.record(fileProgress{
+			FileName: originalFileName,
+			Version:  version,
+			Size:     entry.FileSize,
+			ModTime:  entry.ModTime,
+			Offset:   ends[n-1],
+			Chunks:   append([]ChunkRef(nil), refs[:n]...),
+			Hash:     states[n-1],
+		})
+	}
+
+	queued := make(map[string]bool)
+	sent, reused := 0, 0
+	var sentSize int64
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(fs.GetConfig(ctx).Transfers)
+	var readErr error
+	for gCtx.Err() == nil {
+		data, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			readErr = fmt.Errorf("failed to read %s: %w", originalFileName, err)
+			break
+		}
+		srcHash.Write(data)
+		state, err := srcHash.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			readErr = err
+			break
+		}
+		ref := ChunkRef{ID: chunkID(idKey, data), Size: int64(len(data))}
+		size += ref.Size
+		mu.Lock()
+		refs = append(refs, ref)
+		ends = append(ends, size)
+		states = append(states, state)
+		mu.Unlock()
+		if queued[ref.ID] {
+			continue
+		}
+		queued[ref.ID] = true
+		storedChunk, exists := files[chunkEntryName(ref.ID)]
+		if exists && !storedChunk.Flag {
+			reused++
+			mu.Lock()
+			stored[ref.ID] = true
+			mu.Unlock()
+			continue
+		}
+		sent++
+		sentSize += ref.Size
+		data = append([]byte(nil), data...)
+		g.Go(func() error {
+			var err error
+			if exists {
+				err = resumeChunk(gCtx, storedChunk, data, loadBalancer, profile)
+			} else {
+				err = uploadChunk(gCtx, ref.ID, data, loadBalancer, profile)
+			}
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			stored[ref.ID] = true
+			return commit()
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if readErr != nil {
+		return readErr
+	}
+	fs.Infof(originalFileName, "%d chunks, %d uploaded (%d bytes), %d already stored", len(refs), sent, sentSize, reused)
+
+	return updateFileInfo(originalFileName, func(info *FileInfo) error {
+		info.Chunks = refs
+		info.FileSize = size
+		info.Checksum = hex.EncodeToString(srcHash.Sum(nil))
+		return nil
+	})
+}
+
+// resumeChunked prepares carrying on with the upload recorded in p: it
+// moves src to the end of the chunks stored and restores srcHash as it was
+// there. It returns the chunks stored, nil to start from the beginning when
+// src can't seek or some of the chunks are gone.
+func resumeChunked(src io.Reader, srcHash hash.Hash, p *fileProgress, files map[string]FileInfo) ([]ChunkRef, error) {
+	seeker, ok := src.(io.Seeker)
+	if !ok || len(p.Chunks) == 0 {
+		return nil, nil
+	}
+	for _, ref := range p.Chunks {
+		if chunk, ok := files[chunkEntryName(ref.ID)]; !ok || chunk.Flag {
+			return nil, nil
+		}
+	}
+	if err := srcHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(p.Hash); err != nil {
+		return nil, fmt.Errorf("failed to restore the checksum of %s: %w", p.FileName, err)
+	}
+	if _, err := seeker.Seek(p.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return p.Chunks, nil
+}
+
+// resumeChunk carries on with the interrupted upload of the chunk stored,
+// which holds data, sending only the shards missing. The chunk is uploaded
+// again from scratch if the shards sent before can't be used.
+func resumeChunk(ctx context.Context, stored FileInfo, data []byte, loadBalancer LoadBalancerType, profile ShardProfile) error {
+	err := resumeSealed(ctx, stored)
+	if err == nil {
+		return ResetCheckFlag(stored.FileName)
+	}
+	if !errors.Is(err, errResumeMismatch) {
+		return err
+	}
+	if err := deleteShards(ctx, recordedShards(stored)); err != nil {
+		return err
+	}
+	return uploadChunk(ctx, stored.FileName[len(chunkPrefix):], data, loadBalancer, profile)
+}
+
+// chunkedDecode writes the content of the chunked version info to w,
+// checking it against the recorded checksum
+func chunkedDecode(ctx context.Context, info FileInfo, w io.Writer) error {
+	files, err := readDatamap()
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	out := io.MultiWriter(w, h)
+	for i, ref := range info.Chunks {
+		chunk, ok := files[chunkEntryName(ref.ID)]
+		if !ok || chunk.FileSize != ref.Size {
+			return fmt.Errorf("chunk %d of %s is missing from the datamap", i, info.FileName)
+		}
+		if err := streamDecode(ctx, chunk, out); err != nil {
+			return fmt.Errorf("chunk %d of %s: %w", i, info.FileName, err)
+		}
+	}
+	if info.Checksum != "" && hex.EncodeToString(h.Sum(nil)) != info.Checksum {
+		return fmt.Errorf("checksum mismatch for %s", info.FileName)
+	}
+	return nil
+}
+
+// chunkedDecodeRange writes limit bytes of the content of the chunked
+// version info, from offset, to w. A negative limit reads to the end.
+//
+// Only the chunks holding the range are read, and of the first and last of
+// them only the part in the range.
+func chunkedDecodeRange(ctx context.Context, info FileInfo, offset, limit int64, w io.Writer) error {
+	files, err := readDatamap()
+	if err != nil {
+		return err
+	}
+	end := info.FileSize
+	if limit >= 0 && offset+limit < end {
+		end = offset + limit
+	}
+	var chunkEnd int64
+	for i, ref := range info.Chunks {
+		chunkStart := chunkEnd
+		chunkEnd += ref.Size
+		if chunkEnd <= offset {
+			continue
+		}
+		if chunkStart >= end {
+			break
+		}
+		chunk, ok := files[chunkEntryName(ref.ID)]
+		if !ok || chunk.FileSize != ref.Size {
+			return fmt.Errorf("chunk %d of %s is missing from the datamap", i, info.FileName)
+		}
+		from, to := max(offset, chunkStart)-chunkStart, min(end, chunkEnd)-chunkStart
+		if from == 0 && to == ref.Size {
+			err = streamDecode(ctx, chunk, w)
+		} else {
+			err = streamDecodeRange(ctx, chunk, from, to-from, w)
+		}
+		if err != nil {
+			return fmt.Errorf("chunk %d of %s: %w", i, info.FileName, err)
+		}
+	}
+	return nil
+}
+
+// expandChunks replaces the chunked files of fileNames by the entries of
+// their chunks, each listed once
+func expandChunks(fileNames []string) ([]string, error) {
+	files, err := readDatamap()
+	if err != nil {
+		return nil, err
+	}
+	var expanded []string
+	seen := make(map[string]bool)
+	for _, name := range fileNames {
+		info := files[name]
+		if info.Format != formatChunked {
+			expanded = append(expanded, name)
+			continue
+		}
+		for _, ref := range info.Chunks {
+			chunkName := chunkEntryName(ref.ID)
+			if !seen[chunkName] {
+				seen[chunkName] = true
+				expanded = append(expanded, chunkName)
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// collectChunks removes the chunks no file version uses any more and
+// deletes their shards. It returns the number of chunks removed.
+func collectChunks(ctx context.Context) (int, error) {
+	var dropped []FileInfo
+	var files map[string]FileInfo
+	err := updateDatamap(func(filesMap map[string]FileInfo) error {
+		dropped, files = nil, filesMap
+		countChunkRefs(filesMap)
+		for name, info := range filesMap {
+			if isChunkEntry(name) && info.RefCount == 0 {
+				dropped = append(dropped, info)
+				delete(filesMap, name)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(dropped) == 0 {
+		return 0, err
+	}
+	sort.Slice(dropped, func(i, j int) bool {
+		return dropped[i].FileName < dropped[j].FileName
+	})
+	if err := deleteShards(ctx, unreferencedShards(files, dropped)); err != nil {
+		return len(dropped), fmt.Errorf("failed to delete the shards of unused chunks: %w", err)
+	}
+	fs.Infof(nil, "Deleted %d chunks no file uses any more", len(dropped))
+	return len(dropped), nil
+}
@@ -0,0 +1,130 @@
+package dis_operations
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rclone/rclone/lib/fastcdc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkedUpload(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	oldOptions := chunkOptions
+	chunkOptions = fastcdc.Options{MinSize: 4 << 10, AvgSize: 16 << 10, MaxSize: 64 << 10}
+	defer func() {
+		chunkOptions = oldOptions
+	}()
+	const name, copyName = "chunk_test/data.bin", "chunk_test/copy.bin"
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+		_ = RemoveFileFromMetadata(copyName)
+	}()
+
+	chunkEntries := func() map[string]FileInfo {
+		files, err := readDatamap()
+		require.NoError(t, err)
+		chunks := make(map[string]FileInfo)
+		for entryName, info := range files {
+			if isChunkEntry(entryName) {
+				chunks[entryName] = info
+			}
+		}
+		return chunks
+	}
+	shardsExist := func(info FileInfo) (n int) {
+		for _, dFile := range info.DistributedFileInfos {
+			hashedFileName, err := CalculateHash(dFile.DistributedFile)
+			require.NoError(t, err)
+			if _, err := os.Stat(filepath.Join(dir, dFile.Remote.Name, remoteDirectory, hashedFileName)); err == nil {
+				n++
+			}
+		}
+		return n
+	}
+	upload := func(name string, data []byte) FileInfo {
+		src := filepath.Join(dir, "data.bin")
+		require.NoError(t, os.WriteFile(src, data, 0644))
+		require.NoError(t, chunkedUploadFile(ctx, src, name, RoundRobin, ShardProfile{}, nil))
+		require.NoError(t, ResetCheckFlag(name))
+		info, err := GetFileInfoStruct(name)
+		require.NoError(t, err)
+		require.Equal(t, formatChunked, info.Format)
+		return info
+	}
+	download := func(info FileInfo) []byte {
+		out := t.TempDir()
+		require.NoError(t, streamDownloadFile(ctx, info, out))
+		got, err := os.ReadFile(filepath.Join(out, filepath.Base(info.FileName)))
+		require.NoError(t, err)
+		return got
+	}
+
+	data := make([]byte, 400000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	first := upload(name, data)
+	assert.Greater(t, len(first.Chunks), 5)
+	chunks := chunkEntries()
+	assert.Len(t, chunks, len(first.Chunks))
+	for _, chunk := range chunks {
+		assert.Equal(t, 1, chunk.RefCount)
+		assert.Equal(t, formatSealed, chunk.Format)
+	}
+	assert.Equal(t, data, download(first))
+
+	// editing the middle of the file only sends the chunks around the edit
+	edited := append(append(append([]byte(nil), data[:200000]...), []byte("some new bytes")...), data[200000:]...)
+	second := upload(name, edited)
+	assert.Equal(t, 2, second.VersionNumber())
+	after := chunkEntries()
+	assert.LessOrEqual(t, len(after)-len(chunks), 2)
+	assert.Equal(t, edited, download(second))
+
+	// a copy of the file shares all of its chunks
+	upload(copyName, edited)
+	assert.Len(t, chunkEntries(), len(after))
+	for _, ref := range second.Chunks {
+		assert.GreaterOrEqual(t, after[chunkEntryName(ref.ID)].RefCount, 1)
+		assert.Equal(t, after[chunkEntryName(ref.ID)].RefCount+1, chunkEntries()[chunkEntryName(ref.ID)].RefCount)
+	}
+
+	// chunked files are listed, their chunks aren't
+	fileNames, err := GetFileNamesInDir("chunk_test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{copyName, name}, fileNames)
+
+	// dropping the first version deletes the chunks only it used
+	dropped, err := pruneVersions(ctx, name, RetentionPolicy{KeepLast: 1}, false)
+	require.NoError(t, err)
+	require.Len(t, dropped, 1)
+	remaining := chunkEntries()
+	for entryName, chunk := range after {
+		if _, ok := remaining[entryName]; ok {
+			assert.Equal(t, len(chunk.DistributedFileInfos), shardsExist(chunk))
+		} else {
+			assert.Zero(t, shardsExist(chunk))
+		}
+	}
+	assert.Less(t, len(remaining), len(after))
+	assert.Equal(t, edited, download(second))
+
+	// the chunks go once no file uses them
+	require.NoError(t, RemoveFileFromMetadata(name))
+	_, err = collectChunks(ctx)
+	require.NoError(t, err)
+	assert.Len(t, chunkEntries(), len(remaining))
+	require.NoError(t, RemoveFileFromMetadata(copyName))
+	n, err := collectChunks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, len(remaining), n)
+	assert.Empty(t, chunkEntries())
+	for _, chunk := range remaining {
+		assert.Zero(t, shardsExist(chunk))
+	}
+}
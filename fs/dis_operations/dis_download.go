@@ -6,267 +6,260 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"sync"
+	"strings"
 	"time"
 
-	"github.com/rclone/rclone/cmd"
-	"github.com/rclone/rclone/fs/operations"
 	"github.com/rclone/rclone/reedsolomon"
-	"github.com/spf13/cobra"
 )
 
-var copyCommandDefinitionForDown = &cobra.Command{
-	Use: "copy source:path dest:path",
-	Annotations: map[string]string{
-		"groups": "Copy,Filter,Listing,Important",
-	},
-	Run: func(command *cobra.Command, args []string) {
-		cmd.CheckArgs(2, 2, command, args)
-		fsrc, srcFileName, fdst := cmd.NewFsSrcFileDst(args)
-		cmd.RunWithSustainOS(true, true, command, func() error {
-			if srcFileName == "" {
-				fmt.Printf("%s is a directory or doesn't exist\n", args[0])
-				return nil
-			}
-			return operations.CopyFile(context.Background(), fdst, fsrc, srcFileName, srcFileName)
-		}, true)
-	},
-}
-
-func Dis_Download(args []string, reSignal bool) (err error) {
+func Dis_Download(ctx context.Context, args []string, reSignal bool) (err error) {
 
-	//rclonePath := GetRcloneDirPath()
+	syncMetadata()
 
-	//remote->local sync
-	// err = dis_config.SyncAnyRemoteToLocal(rclonePath)
-	// if err != nil {
-	// 	return err
-	// }
+	originalFileName, err := NormalizeLogicalPath(args[0])
+	if err != nil {
+		return err
+	}
 
-	originalFileName := filepath.Base(args[0])
-	_, err = GetFileInfoStruct(originalFileName)
+	absolutePath, err := getAbsolutePath(args[1])
 	if err != nil {
 		return err
 	}
 
-	var distributedFileInfos []DistributedFile
+	exists, err := DoesFileStructExist(originalFileName)
+	if err != nil {
+		return err
+	}
 
-	if reSignal {
-		//Get Distribution list(Check 읽어서 false인 것만 들고 오기)
-		distributedFileInfos, err = GetUncompletedFileInfo(originalFileName)
+	if !exists {
+		// target may be a directory
+		entries, err := ListDir(originalFileName, true)
 		if err != nil {
-			return err
-		}
-
-	} else {
-		//state 변경
-		err = UpdateFileFlag(originalFileName, "download")
-		if err != nil {
-			return err
-		}
-		distributedFileInfos, err = GetDistributedFileStruct(originalFileName)
-		if err != nil {
-			return err
+			return fmt.Errorf("file name '%s' not found", originalFileName)
 		}
+		return disDownloadDir(ctx, originalFileName, entries, absolutePath, reSignal)
 	}
 
-	start := time.Now()
-	if err := startDownloadFileGoroutine_Worker(distributedFileInfos, originalFileName, 32); err != nil {
+	if err := disDownloadFile(ctx, originalFileName, absolutePath, reSignal); err != nil {
+		return err
+	}
+	info, err := GetFileInfoStruct(originalFileName)
+	if err != nil {
 		return err
 	}
+	applyEntryMetadata(filepath.Join(absolutePath, path.Base(originalFileName)), info)
+	return nil
+}
 
-	elapsed := time.Since(start)
-	fmt.Println("Current Time:", time.Now().Format("2006-01-02 15:04:05"))
-	fmt.Printf("Time taken for dis_download: %s\n", elapsed)
+// Dis_DownloadVersion downloads version of the file args[0] into the
+// directory args[1]. Earlier versions are read straight from their shards,
+// which only the stream formats allow.
+func Dis_DownloadVersion(ctx context.Context, args []string, version int) error {
+	syncMetadata()
 
+	originalFileName, err := NormalizeLogicalPath(args[0])
+	if err != nil {
+		return err
+	}
 	absolutePath, err := getAbsolutePath(args[1])
 	if err != nil {
 		return err
 	}
 
-	// Move downloaded file to destination
-	fileInfo, err := GetFileInfoStruct(originalFileName)
+	current, err := GetFileInfoStruct(originalFileName)
 	if err != nil {
 		return err
 	}
-
-	checksums := make(map[string]string)
-	for _, each := range distributedFileInfos {
-		checksums[each.DistributedFile] = each.Checksum
+	if current.IsDir {
+		return fmt.Errorf("%s is a directory, only a file can be downloaded by version", originalFileName)
 	}
-
-	err = reedsolomon.DoDecode(originalFileName, absolutePath, fileInfo.Padding, checksums, fileInfo.Shard, fileInfo.Parity, tryGetPassword())
-	if err != nil {
-		result := ShowDescription_RemoveFile(originalFileName, err)
-		if result {
-			err = Dis_rm([]string{originalFileName}, false)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
+	if current.VersionNumber() == version {
+		return Dis_Download(ctx, args, false)
 	}
-
-	// change Flag and Check to false
-	err = ResetCheckFlag(args[0])
+	info, err := FileVersion(originalFileName, version)
 	if err != nil {
 		return err
 	}
-
-	fmt.Printf("File successfully downloaded to %s\n", absolutePath)
-
-	var distributedFiles []string
-	for _, info := range distributedFileInfos {
-		distributedFiles = append(distributedFiles, info.DistributedFile)
+	if info.Format != formatStream && info.Format != formatSealed && info.Format != formatChunked {
+		return fmt.Errorf("version %d of %s was uploaded in the legacy format, only its current version can be downloaded", version, originalFileName)
 	}
 
-	reedsolomon.DeleteShardWithFileNames(distributedFiles)
-
+	if err := os.MkdirAll(absolutePath, 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	ctx, done := fileStatsContext(ctx, originalFileName)
+	defer done()
+	if err := streamDownloadFile(ctx, info, absolutePath); err != nil {
+		return err
+	}
+	applyEntryMetadata(filepath.Join(absolutePath, path.Base(originalFileName)), info)
+	fmt.Printf("Version %d of %s successfully downloaded to %s\n", version, originalFileName, absolutePath)
 	return nil
 }
 
-func startDownloadFileGoroutine_Worker(distributedFileInfos []DistributedFile, originalFileName string, workerCount int) (err error) {
-	shardDir, err := reedsolomon.GetShardDir()
-	if err != nil {
-		return err
+// downloading every entry below dirName, restoring the directory structure,
+// modes and modification times below absolutePath
+func disDownloadDir(ctx context.Context, dirName string, entries []FileInfo, absolutePath string, reSignal bool) error {
+	parent := path.Dir(dirName)
+	localPath := func(name string) string {
+		rel := name
+		if parent != "." {
+			rel = strings.TrimPrefix(name, parent+"/")
+		}
+		return filepath.Join(absolutePath, filepath.FromSlash(rel))
 	}
 
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	var errs []error
-
-	jobs := make(chan DistributedFile, len(distributedFileInfos))
+	dirInfo, err := GetFileInfoStruct(dirName)
+	if err != nil {
+		dirInfo = newDirEntry(dirName, time.Time{}, 0755)
+	}
+	entries = append([]FileInfo{dirInfo}, entries...)
 
-	// Worker function
-	downloader := func() {
-		for fileInfo := range jobs {
-			if err := downloadFile(fileInfo, shardDir, originalFileName, &mu, &errs); err != nil {
-				mu.Lock()
-				errs = append(errs, err)
-				mu.Unlock()
-			}
-			wg.Done()
+	var dirs []FileInfo
+	for _, entry := range entries {
+		if !entry.IsDir {
+			continue
+		}
+		if err := os.MkdirAll(localPath(entry.FileName), 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
 		}
+		dirs = append(dirs, entry)
 	}
 
-	// Start worker goroutines
-	for i := 0; i < workerCount; i++ {
-		wg.Add(1)
-		go func() {
-			downloader()
-			wg.Done()
-		}()
+	for _, entry := range entries {
+		if entry.IsDir {
+			continue
+		}
+		destDir := filepath.Dir(localPath(entry.FileName))
+		if err := disDownloadFile(ctx, entry.FileName, destDir, reSignal); err != nil {
+			return fmt.Errorf("failed to download %s: %w", entry.FileName, err)
+		}
+		applyEntryMetadata(localPath(entry.FileName), entry)
 	}
 
-	// Send jobs to workers
-	for _, fileInfo := range distributedFileInfos {
-		wg.Add(1)
-		jobs <- fileInfo
+	// writing files changes the directory times, so restore them last, deepest first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		applyEntryMetadata(localPath(dirs[i].FileName), dirs[i])
 	}
 
-	close(jobs) // Close channel to signal workers
-	wg.Wait()   // Wait for all workers to finish
-
-	// if len(errs) > 0 {
-	// 	return fmt.Errorf("errors occurred during download: %v", errs)
-	// }
-
+	fmt.Printf("Directory %s successfully downloaded to %s\n", dirName, absolutePath)
 	return nil
 }
 
-func startDownloadFileGoroutine(distributedFileInfos []DistributedFile, originalFileName string) (err error) {
-	shardDir, err := reedsolomon.GetShardDir()
+// downloading a single distributed file into the directory absolutePath
+func disDownloadFile(ctx context.Context, originalFileName string, absolutePath string, reSignal bool) (err error) {
+	reportFile(originalFileName, stateDownloading, nil)
+	defer func() {
+		reportFile(originalFileName, stateDownloaded, err)
+	}()
+	fileInfo, err := GetFileInfoStruct(originalFileName)
 	if err != nil {
 		return err
 	}
 
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	var errs []error
-
-	for _, fileInfo := range distributedFileInfos {
-		wg.Add(1)
-		go func(fileInfo DistributedFile) {
-			defer wg.Done()
-			if err := downloadFile(fileInfo, shardDir, originalFileName, &mu, &errs); err != nil {
-				mu.Lock()
-				errs = append(errs, err)
-				mu.Unlock()
-			}
-		}(fileInfo)
+	if fileInfo.Format == formatStream || fileInfo.Format == formatSealed || fileInfo.Format == formatChunked {
+		return disDownloadStreamFile(ctx, fileInfo, absolutePath)
 	}
 
-	wg.Wait()
+	if !reSignal {
+		//state 변경
+		err = UpdateFileFlag(originalFileName, "download")
+		if err != nil {
+			return err
+		}
+	}
 
-	// if len(errs) > 0 {
-	// 	return fmt.Errorf("errors occurred during download: %v", errs)
-	// }
+	ctx, done := fileStatsContext(ctx, originalFileName)
+	defer done()
+	start := time.Now()
+	if err := downloadShards(ctx, fileInfo); err != nil {
+		return err
+	}
 
-	return nil
-}
+	elapsed := time.Since(start)
+	fmt.Println("Current Time:", time.Now().Format("2006-01-02 15:04:05"))
+	fmt.Printf("Time taken for dis_download: %s\n", elapsed)
 
-func downloadFile(fileInfo DistributedFile, shardDir, originalFileName string, mu *sync.Mutex, errs *[]error) error {
-	startTime := time.Now()
+	if err := os.MkdirAll(absolutePath, 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
 
-	hashedFileName, err := CalculateHash(fileInfo.DistributedFile)
+	// Move downloaded file to destination
+	fileInfo, err = GetFileInfoStruct(originalFileName)
 	if err != nil {
-		mu.Lock()
-		*errs = append(*errs, fmt.Errorf("CalculateHash for %s: %w", fileInfo.DistributedFile, err))
-		mu.Unlock()
 		return err
 	}
 
-	source := fmt.Sprintf("%s:%s/%s", fileInfo.Remote.Name, remoteDirectory, hashedFileName)
-	fmt.Printf("Downloading shard %s to %s\n", source, shardDir)
-	downloadedFilePath := path.Join(shardDir, hashedFileName)
+	// shards are stored locally under their base names
+	checksums := make(map[string]string)
+	for _, each := range fileInfo.DistributedFileInfos {
+		checksums[path.Base(each.DistributedFile)] = each.Checksum
+	}
 
-	if err := remoteCallCopyforDown([]string{source, shardDir}); err != nil {
-		mu.Lock()
-		*errs = append(*errs, fmt.Errorf("remoteCallCopyforDown for %s: %w", fileInfo.DistributedFile, err))
-		mu.Unlock()
+	password, err := legacyPassword()
+	if err != nil {
 		return err
 	}
+	endPhase := startPhase(ctx, originalFileName, fileInfo.FileSize, phaseDecode)
+	err = reedsolomon.DoDecode(ctx, path.Base(originalFileName), absolutePath, fileInfo.Padding, checksums, reedsolomon.Codec(fileInfo.Codec), fileInfo.Shard, fileInfo.Parity, password)
+	endPhase(err)
+	if ctx.Err() != nil {
+		return err
+	}
+	if err != nil {
+		// the shards fetched stay staged until the next command dumps them
+		return fmt.Errorf("failed to decode %s: %w", originalFileName, err)
+	}
 
-	elapsedTime := time.Since(startTime)
-	downloadedFile, err := os.Stat(downloadedFilePath)
+	// change Flag and Check to false
+	err = ResetCheckFlag(originalFileName)
 	if err != nil {
-		mu.Lock()
-		*errs = append(*errs, fmt.Errorf("downloaded file %s does not exist", downloadedFilePath))
-		mu.Unlock()
 		return err
 	}
 
-	// Calculate throughput
-	throughput := float64(downloadedFile.Size()) / elapsedTime.Seconds()
-	throughputKbps := throughput * 8 / 1e3
+	fmt.Printf("File successfully downloaded to %s\n", absolutePath)
 
-	if err := ConvertFileNameForDo(hashedFileName, fileInfo.DistributedFile); err != nil {
-		return fmt.Errorf("ConvertFileNameForDo for %s: %w", fileInfo.DistributedFile, err)
+	var distributedFiles []string
+	for _, info := range fileInfo.DistributedFileInfos {
+		distributedFiles = append(distributedFiles, path.Base(info.DistributedFile))
 	}
 
-	// Update remote info
-	err = updateRemoteInfo_Down(originalFileName, fileInfo, throughputKbps, mu)
-	if err != nil {
-		return err
-	}
+	reedsolomon.DeleteShardWithFileNames(distributedFiles)
 
 	return nil
 }
 
-func updateRemoteInfo_Down(originalFileName string, shardInfo DistributedFile, throughputKbps float64, mu *sync.Mutex) error {
-	mu.Lock()
-	err := UpdateDistributedFile_CheckFlag(originalFileName, shardInfo.DistributedFile, true)
-	if err != nil {
-		mu.Unlock()
-		return fmt.Errorf("UpdateDistributedFileCheckFlag error: %v", err)
+// downloading a stream format file. The shards are decoded as they arrive
+// from the remotes so nothing is staged in the shard dir, and an interrupted
+// download simply starts again.
+func disDownloadStreamFile(ctx context.Context, fileInfo FileInfo, absolutePath string) error {
+	originalFileName := fileInfo.FileName
+	if err := UpdateFileFlag(originalFileName, "download"); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(absolutePath, 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
 	}
-	err = UpdateRemoteInfo(shardInfo.Remote, func(b *RemoteInfo) {
-		b.UpdateThroughput(throughputKbps, 1)
-	})
-	mu.Unlock()
+
+	start := time.Now()
+	ctx, done := fileStatsContext(ctx, originalFileName)
+	defer done()
+	err := streamDownloadFile(ctx, fileInfo, absolutePath)
 	if err != nil {
+		// nothing is staged, so there is nothing left for the next command
+		_ = ResetCheckFlag(originalFileName)
+		return err
+	}
+
+	fmt.Println("Current Time:", time.Now().Format("2006-01-02 15:04:05"))
+	fmt.Printf("Time taken for dis_download: %s\n", time.Since(start))
+
+	if err := ResetCheckFlag(originalFileName); err != nil {
 		return err
 	}
+
+	fmt.Printf("File successfully downloaded to %s\n", absolutePath)
 	return nil
 }
 
@@ -287,18 +280,3 @@ func getAbsolutePath(arg string) (string, error) {
 	destinationPath := filepath.Join(cwd, arg)
 	return filepath.Clean(destinationPath), nil
 }
-
-func remoteCallCopyforDown(args []string) (err error) {
-	fmt.Printf("Calling remoteCallCopy with args: %v\n", args)
-
-	// Fetch the copy command
-	copyCommand := *copyCommandDefinitionForDown
-	copyCommand.SetArgs(args)
-
-	err = copyCommand.Execute()
-	if err != nil {
-		return fmt.Errorf("error executing copyCommand: %w", err)
-	}
-
-	return nil
-}
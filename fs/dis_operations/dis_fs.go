@@ -0,0 +1,168 @@
+package dis_operations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Access to the store for backend/distributed
+//
+// These are the dis_* operations for a single file or directory, working on
+// streams instead of local paths, so the store can be used as an fs.Fs. They
+// don't sync the metadata themselves: the backend holds the lock across them,
+// see HoldStoreLock, and the metadata is synced when it takes and releases it.
+
+// ErrLegacyFormat is returned when a file uploaded in the legacy format is
+// opened. Such files can only be read with dis_download, so the backend
+// doesn't list them, see Streamable.
+var ErrLegacyFormat = errors.New("file was uploaded in the legacy format, use dis_download")
+
+// ErrDirNotEmpty is returned when removing a directory with entries in it
+var ErrDirNotEmpty = errors.New("directory not empty")
+
+// Streamable returns true if the content of info can be read with OpenFile,
+// false for a file uploaded in the legacy format
+func (info FileInfo) Streamable() bool {
+	return info.Format == formatChunked || info.Format == formatStream || info.Format == formatSealed
+}
+
+// SHA256 returns the SHA-256 of the content of info, "" if it isn't known
+func (info FileInfo) SHA256() string {
+	if info.Format == formatLegacy {
+		return ""
+	}
+	return info.Checksum
+}
+
+// decodeReader reads what a decoding goroutine writes to its pipe
+type decodeReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+// Close stops the decoding
+func (r *decodeReader) Close() error {
+	r.cancel()
+	return r.PipeReader.Close()
+}
+
+// OpenFile returns limit bytes of the content of info, a file or a version
+// of it, from offset, decoded from the shards as it is read. A negative
+// limit reads to the end. Only the whole content is checked against the
+// checksum, parts of it are checked block by block as they are decrypted.
+func OpenFile(ctx context.Context, info FileInfo, offset, limit int64) (io.ReadCloser, error) {
+	if info.IsDir {
+		return nil, fmt.Errorf("%q is a directory", info.FileName)
+	}
+	if info.Flag && info.State == "upload" {
+		return nil, fmt.Errorf("%s has an unfinished upload", info.FileName)
+	}
+	if !info.Streamable() {
+		return nil, ErrLegacyFormat
+	}
+	offset = max(offset, 0)
+	if offset >= info.FileSize || limit == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	whole := offset == 0 && (limit < 0 || limit >= info.FileSize)
+	var decode func(context.Context, FileInfo, io.Writer) error
+	switch {
+	case info.Format == formatChunked && whole:
+		decode = chunkedDecode
+	case info.Format == formatChunked:
+		decode = func(ctx context.Context, info FileInfo, w io.Writer) error {
+			return chunkedDecodeRange(ctx, info, offset, limit, w)
+		}
+	case whole:
+		decode = streamDecode
+	default:
+		decode = func(ctx context.Context, info FileInfo, w io.Writer) error {
+			return streamDecodeRange(ctx, info, offset, limit, w)
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(decode(ctx, info, pw))
+	}()
+	return &decodeReader{PipeReader: pr, cancel: cancel}, nil
+}
+
+// PutFile uploads the content of in as the file name, a new version of it if
+// it exists, and returns its entry. size is -1 if unknown.
+func PutFile(ctx context.Context, in io.Reader, name string, size int64, modTime time.Time, loadBalancer LoadBalancerType, profile ShardProfile) (FileInfo, error) {
+	ctx, unlock, err := lockStore(ctx, "upload")
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer unlock()
+	if name, err = NormalizeLogicalPath(name); err != nil {
+		return FileInfo{}, err
+	}
+
+	existing, err := GetFileInfoStruct(name)
+	if err == nil && existing.Flag && existing.State == "rm" {
+		if err := Dis_rm(ctx, []string{name}, false); err != nil {
+			return FileInfo{}, err
+		}
+	}
+	if size < 0 {
+		size = 0
+	}
+	entry := FileInfo{FileName: name, ModTime: modTime, Mode: 0644, FileSize: size}
+	if err := chunkedUpload(ctx, in, entry, loadBalancer, profile, nil); err != nil {
+		return FileInfo{}, err
+	}
+	if err := ResetCheckFlag(name); err != nil {
+		return FileInfo{}, err
+	}
+	if err := applyRetention(ctx, name); err != nil {
+		return FileInfo{}, err
+	}
+	return GetFileInfoStruct(name)
+}
+
+// SetModTime changes the modification time recorded for the file or
+// directory name
+func SetModTime(ctx context.Context, name string, modTime time.Time) error {
+	_, unlock, err := lockStore(ctx, "touch")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return updateFileInfo(name, func(info *FileInfo) error {
+		info.ModTime = modTime
+		return nil
+	})
+}
+
+// MakeDir records the directory name and its parents
+func MakeDir(ctx context.Context, name string, modTime time.Time) error {
+	_, unlock, err := lockStore(ctx, "mkdir")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return MakeDirEntry(name, modTime, 0755)
+}
+
+// RemoveDir removes the empty directory name
+func RemoveDir(ctx context.Context, name string) error {
+	_, unlock, err := lockStore(ctx, "rmdir")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, err := ListDir(name, false)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%q: %w", name, ErrDirNotEmpty)
+	}
+	return RemoveDirFromMetadata(name)
+}
@@ -0,0 +1,106 @@
+package dis_operations
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rclone/rclone/lib/fastcdc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readFile(t *testing.T, info FileInfo, offset, limit int64) ([]byte, error) {
+	in, err := OpenFile(context.Background(), info, offset, limit)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, in.Close())
+	return data, err
+}
+
+func TestOpenFileRange(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	const name = "range_test/data.bin"
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+	}()
+
+	data := make([]byte, 300000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "data.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	require.NoError(t, streamUploadFile(ctx, src, name, RoundRobin, ShardProfile{Data: 5, Parity: 3}))
+	require.NoError(t, ResetCheckFlag(name))
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	require.Equal(t, 5, info.Shard)
+
+	for _, r := range [][2]int64{{0, -1}, {100, 1000}, {70000, 100000}, {299990, 100}, {299999, -1}} {
+		end := min(int64(len(data)), r[0]+r[1])
+		if r[1] < 0 {
+			end = int64(len(data))
+		}
+		got, err := readFile(t, info, r[0], r[1])
+		require.NoError(t, err)
+		assert.Equal(t, data[r[0]:end], got, "range %v", r)
+	}
+	got, err := readFile(t, info, 400000, 10)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	// the start of the file only needs the first data shards
+	shards := shardsByIndex(info)
+	for _, i := range []int{3, 4, 5, 6, 7} {
+		hashedFileName, err := CalculateHash(shards[i].DistributedFile)
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(filepath.Join(dir, shards[i].Remote.Name, remoteDirectory, hashedFileName)))
+	}
+	got, err = readFile(t, info, 100, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, data[100:1100], got)
+	_, err = readFile(t, info, 0, -1)
+	assert.Error(t, err)
+}
+
+func TestOpenChunkedFileRange(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	oldOptions := chunkOptions
+	chunkOptions = fastcdc.Options{MinSize: 4 << 10, AvgSize: 16 << 10, MaxSize: 64 << 10}
+	defer func() {
+		chunkOptions = oldOptions
+	}()
+	const name = "range_test/chunked.bin"
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+		_, _ = collectChunks(ctx)
+	}()
+
+	data := make([]byte, 200000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "chunked.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	require.NoError(t, chunkedUploadFile(ctx, src, name, RoundRobin, ShardProfile{}, nil))
+	require.NoError(t, ResetCheckFlag(name))
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	require.Greater(t, len(info.Chunks), 2)
+
+	// across the boundaries of the chunks
+	first := info.Chunks[0].Size
+	for _, r := range [][2]int64{{0, -1}, {first - 10, 20}, {1, first - 1}, {first, info.Chunks[1].Size}, {5000, 150000}, {199000, -1}} {
+		end := min(int64(len(data)), r[0]+r[1])
+		if r[1] < 0 {
+			end = int64(len(data))
+		}
+		got, err := readFile(t, info, r[0], r[1])
+		require.NoError(t, err)
+		assert.Equal(t, data[r[0]:end], got, "range %v", r)
+	}
+}
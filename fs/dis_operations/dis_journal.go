@@ -0,0 +1,150 @@
+package dis_operations
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// Journal of dis_upload
+//
+// dis_upload records its progress in a journal kept in the metadata store,
+// so running it again after an interruption carries on where it stopped
+// rather than starting over:
+//
+//   - the files of a directory uploaded completely are skipped,
+//   - of the file being uploaded, the start of the source held by chunks
+//     all stored is recorded as a byte offset, with the chunks and the state
+//     of the checksum there, and reading the source starts again from it,
+//   - of a chunk cut off in the middle, the shards uploaded completely are
+//     marked in its datamap entry and the others are rebuilt from them
+//     without encrypting anything again, see resumeSealed.
+//
+// The shard is the smallest unit resumed: a shard cut off in the middle is
+// sent again whole. Resuming within a shard from the multipart upload state
+// of a backend isn't supported, as fs.Fs.Put can't carry on with an upload
+// another process started, which is why the progress within a file is kept
+// chunk by chunk.
+//
+// The journal is local, like the source paths in it, and isn't synced with
+// the remotes. CheckState resumes it before any other dis_* command runs.
+
+// uploadJournal is the progress of a dis_upload
+type uploadJournal struct {
+	// Args are the arguments of the command, Source and Target the
+	// absolute path and logical path they resolved to
+	Args         []string         `json:"args"`
+	Source       string           `json:"source"`
+	Target       string           `json:"target"`
+	LoadBalancer LoadBalancerType `json:"load_balancer"`
+	Profile      ShardProfile     `json:"profile"`
+	Started      time.Time        `json:"started"`
+	// Done are the files uploaded completely
+	Done []string `json:"done,omitempty"`
+	// Current is the progress of the file being uploaded
+	Current *fileProgress `json:"current,omitempty"`
+}
+
+// fileProgress is how much of the chunked upload of a file is stored
+type fileProgress struct {
+	FileName string `json:"file_name"`
+	Version  int    `json:"version"`
+	// Size and ModTime of the source, which mustn't change
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Offset is the size of the start of the source held by Chunks
+	Offset int64      `json:"offset"`
+	Chunks []ChunkRef `json:"chunks"`
+	// Hash is the state of the SHA-256 of the source up to Offset
+	Hash []byte `json:"hash"`
+}
+
+// startJournal returns the journal of the upload of source as target, the
+// one an interrupted run left if resume is set
+func startJournal(args []string, source, target string, resume bool, loadBalancer LoadBalancerType, profile ShardProfile) (*uploadJournal, error) {
+	if resume {
+		j, err := readJournal()
+		if err != nil {
+			return nil, err
+		}
+		if j != nil && j.Source == source && j.Target == target {
+			return j, nil
+		}
+	}
+	j := &uploadJournal{
+		Args:         args,
+		Source:       source,
+		Target:       target,
+		LoadBalancer: loadBalancer,
+		Profile:      profile,
+		Started:      time.Now(),
+	}
+	return j, writeJournal(j, nil)
+}
+
+// isDone returns true if the file name was uploaded completely
+func (j *uploadJournal) isDone(name string) bool {
+	return j != nil && slices.Contains(j.Done, name)
+}
+
+// progress returns the progress recorded of the upload of entry, nil if
+// there is none or the source changed since
+func (j *uploadJournal) progress(entry FileInfo) *fileProgress {
+	if j == nil || j.Current == nil {
+		return nil
+	}
+	p := j.Current
+	if p.FileName != entry.FileName || p.Version != entry.Version {
+		return nil
+	}
+	if p.Size != entry.FileSize || !p.ModTime.Equal(entry.ModTime) {
+		fmt.Printf("%s changed since its upload was interrupted, uploading it from the start\n", entry.FileName)
+		return nil
+	}
+	return p
+}
+
+// record saves the progress p. The chunks stored are listed in the entry
+// being uploaded too so they are kept until the upload completes.
+func (j *uploadJournal) record(p fileProgress) error {
+	if j == nil {
+		return nil
+	}
+	j.Current = &p
+	return writeJournal(j, func(filesMap map[string]FileInfo) error {
+		info, ok := filesMap[p.FileName]
+		if !ok {
+			return fmt.Errorf("file '%s' not found", p.FileName)
+		}
+		info.Chunks = p.Chunks
+		filesMap[p.FileName] = info
+		return nil
+	})
+}
+
+// finish records that the file name was uploaded completely
+func (j *uploadJournal) finish(name string) error {
+	if j == nil {
+		return nil
+	}
+	j.Done = append(j.Done, name)
+	j.Current = nil
+	return writeJournal(j, nil)
+}
+
+// resumeJournal carries on with the upload recorded in j. If its source is
+// gone the upload is given up, going back to the versions before it.
+func resumeJournal(ctx context.Context, j *uploadJournal) error {
+	if _, err := os.Stat(j.Source); os.IsNotExist(err) {
+		fmt.Printf("%s is gone, giving up its upload\n", j.Source)
+		if j.Current != nil {
+			if err := discardUpload(ctx, j.Current.FileName); err != nil {
+				return err
+			}
+		}
+		return writeJournal(nil, nil)
+	}
+	return Dis_Upload(ctx, []string{j.Source, j.Target}, true, j.LoadBalancer, j.Profile)
+}
@@ -0,0 +1,248 @@
+package dis_operations
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/rclone/rclone/lib/fastcdc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// countingFile counts the bytes read from it
+type countingFile struct {
+	*os.File
+	n int64
+}
+
+func (f *countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.n += int64(n)
+	return n, err
+}
+
+// interruptedUpload starts the chunked upload of src as name, which stops
+// after n bytes are read
+func interruptedUpload(t *testing.T, src, name string, n int64, j *uploadJournal) {
+	in, err := os.Open(src)
+	require.NoError(t, err)
+	defer func() {
+		_ = in.Close()
+	}()
+	stat, err := in.Stat()
+	require.NoError(t, err)
+	entry := FileInfo{FileName: name, ModTime: stat.ModTime(), Mode: stat.Mode(), FileSize: stat.Size()}
+	err = chunkedUpload(context.Background(), io.MultiReader(io.LimitReader(in, n), iotest.ErrReader(errInterrupted)), entry, RoundRobin, ShardProfile{}, j)
+	require.ErrorIs(t, err, errInterrupted)
+}
+
+func smallChunks(t *testing.T) {
+	oldOptions := chunkOptions
+	chunkOptions = fastcdc.Options{MinSize: 4 << 10, AvgSize: 16 << 10, MaxSize: 64 << 10}
+	t.Cleanup(func() {
+		chunkOptions = oldOptions
+	})
+}
+
+func TestResumeChunkedUpload(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	smallChunks(t)
+	ctx := context.Background()
+	const name = "journal_test/data.bin"
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+		_ = writeJournal(nil, nil)
+		_, _ = collectChunks(ctx)
+	}()
+
+	data := make([]byte, 400000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "data.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	j, err := startJournal([]string{src, name}, src, name, false, RoundRobin, ShardProfile{})
+	require.NoError(t, err)
+
+	interruptedUpload(t, src, name, 200000, j)
+	j, err = readJournal()
+	require.NoError(t, err)
+	require.NotNil(t, j.Current)
+	p := *j.Current
+	assert.Greater(t, p.Offset, int64(0))
+	assert.LessOrEqual(t, p.Offset, int64(200000))
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	assert.True(t, info.Flag)
+	assert.Equal(t, p.Chunks, info.Chunks, "the chunks stored are kept")
+	removed, err := collectChunks(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, removed)
+
+	// reading carries on after the chunks stored
+	in, err := os.Open(src)
+	require.NoError(t, err)
+	defer func() {
+		_ = in.Close()
+	}()
+	counting := &countingFile{File: in}
+	entry := FileInfo{FileName: name, ModTime: info.ModTime, Mode: info.Mode, FileSize: info.FileSize}
+	require.NoError(t, chunkedUpload(ctx, counting, entry, RoundRobin, ShardProfile{}, j))
+	assert.Equal(t, int64(len(data))-p.Offset, counting.n)
+	require.NoError(t, ResetCheckFlag(name))
+
+	info, err = GetFileInfoStruct(name)
+	require.NoError(t, err)
+	assert.Equal(t, 1, info.VersionNumber())
+	assert.Equal(t, p.Chunks, info.Chunks[:len(p.Chunks)])
+	sum := sha256.Sum256(data)
+	assert.Equal(t, hex.EncodeToString(sum[:]), info.Checksum)
+	got, err := readFile(t, info, 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestResumeSealedShards(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	const name = "journal_test/sealed.bin"
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+	}()
+
+	data := make([]byte, 300000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "sealed.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	require.NoError(t, streamUploadFile(ctx, src, name, RoundRobin, ShardProfile{Data: 5, Parity: 3}))
+
+	// interrupted with the last shards not uploaded
+	shardPath := func(dFile DistributedFile) string {
+		hashedFileName, err := CalculateHash(dFile.DistributedFile)
+		require.NoError(t, err)
+		return filepath.Join(dir, dFile.Remote.Name, remoteDirectory, hashedFileName)
+	}
+	interrupt := func(missing ...int) FileInfo {
+		require.NoError(t, updateFileInfo(name, func(info *FileInfo) error {
+			// the checksum is only recorded once the upload is done
+			info.Flag, info.State, info.Checksum = true, "upload", ""
+			for key, dFile := range info.DistributedFileInfos {
+				dFile.Check = true
+				info.DistributedFileInfos[key] = dFile
+			}
+			for _, idx := range missing {
+				dFile := info.DistributedFileInfos[shardName(name, 1, idx)]
+				dFile.Check = false
+				info.DistributedFileInfos[dFile.DistributedFile] = dFile
+			}
+			return nil
+		}))
+		info, err := GetFileInfoStruct(name)
+		require.NoError(t, err)
+		return info
+	}
+	info := interrupt(5, 6, 7)
+	marker := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	shards := shardsByIndex(info)
+	for idx, dFile := range shards {
+		if idx < 5 {
+			require.NoError(t, os.Chtimes(shardPath(dFile), marker, marker))
+		} else {
+			require.NoError(t, os.Remove(shardPath(dFile)))
+		}
+	}
+
+	require.NoError(t, resumeSealedFile(ctx, src, info))
+	sum := sha256.Sum256(data)
+	resumed, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(sum[:]), resumed.Checksum)
+	for idx, dFile := range shards {
+		stat, err := os.Stat(shardPath(dFile))
+		require.NoError(t, err)
+		assert.Equal(t, idx < 5, stat.ModTime().Equal(marker), "shard %d", idx)
+	}
+	require.NoError(t, ResetCheckFlag(name))
+	info, err = GetFileInfoStruct(name)
+	require.NoError(t, err)
+	got, err := readFile(t, info, 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// too few shards were uploaded to rebuild the others
+	info = interrupt(0, 1, 2, 3)
+	assert.ErrorIs(t, resumeSealedFile(ctx, src, info), errResumeMismatch)
+
+	// the shards uploaded don't hold a source which changed
+	info = interrupt(7)
+	data[1000]++
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	require.NoError(t, os.Chtimes(src, info.ModTime, info.ModTime))
+	assert.ErrorIs(t, resumeSealedFile(ctx, src, info), errResumeMismatch)
+}
+
+func TestCheckStateResumesUpload(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	smallChunks(t)
+	const name = "journal_test/resumed.bin"
+
+	// CheckState resumes any journal and drops any unfinished upload, so
+	// the test runs on a store and journal of its own
+	require.Equal(t, filepath.Join(dir, "data", storeFileName), MetadataStorePath())
+	j, err := readJournal()
+	require.NoError(t, err)
+	require.Nil(t, j)
+
+	data := make([]byte, 300000)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "resumed.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	args := []string{src, name}
+	j, err = startJournal(args, src, name, false, RoundRobin, ShardProfile{})
+	require.NoError(t, err)
+	interruptedUpload(t, src, name, 100000, j)
+
+	// running the same command again finishes it
+	sameCommand, err := CheckState(context.Background(), "upload", args, RoundRobin)
+	require.NoError(t, err)
+	assert.True(t, sameCommand)
+	j, err = readJournal()
+	require.NoError(t, err)
+	assert.Nil(t, j)
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	assert.False(t, info.Flag)
+	assert.Equal(t, 1, info.VersionNumber())
+	got, err := readFile(t, info, 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// without a journal only the unfinished version is dropped
+	changed := append([]byte(nil), data...)
+	changed[0]++
+	require.NoError(t, os.WriteFile(src, changed, 0644))
+	interruptedUpload(t, src, name, 100000, nil)
+	sameCommand, err = CheckState(context.Background(), "upload", []string{"other"}, RoundRobin)
+	require.NoError(t, err)
+	assert.False(t, sameCommand)
+	info, err = GetFileInfoStruct(name)
+	require.NoError(t, err)
+	assert.False(t, info.Flag)
+	assert.Equal(t, 1, info.VersionNumber())
+	assert.Empty(t, info.Versions)
+	got, err = readFile(t, info, 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
@@ -0,0 +1,671 @@
+package dis_operations
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rclone/rclone/backend/crypt"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/rc"
+	"github.com/rclone/rclone/lib/terminal"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Key management
+//
+// Every stream format file is encrypted with its own random data key, which
+// is stored in its FileInfo wrapped (sealed with NaCl secretbox) by the
+// master key. The master key is derived from the user's passphrase with
+// scrypt and never stored: the keyring in the metadata store only holds the
+// salt, the scrypt parameters and a check value which tells a wrong
+// passphrase apart. Changing the passphrase rewraps the data keys without
+// touching a single shard.
+//
+// Files uploaded before the keyring existed are still read with the random
+// password of password.txt. It is moved into the keyring, wrapped by the
+// master key, and only ever unwrapped in memory from then on.
+//
+// The passphrase is asked for on the terminal only when there is one to ask
+// on and prompts aren't disabled, see DisablePrompts. Otherwise it has to be
+// in the environment.
+const (
+	// PassphraseEnv holds the passphrase of the master key, asked for if unset
+	PassphraseEnv = "RCLONE_DIS_PASSPHRASE"
+	// NewPassphraseEnv holds the new passphrase for dis_key rotate
+	NewPassphraseEnv = "RCLONE_DIS_NEW_PASSPHRASE"
+	// OldPassphraseEnv holds the passphrase of an earlier master key for
+	// dis_recover
+	OldPassphraseEnv = "RCLONE_DIS_OLD_PASSPHRASE"
+
+	dataKeySize = 32
+	nonceSize   = 24
+
+	// scrypt parameters of new keyrings
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	errWrongPassphrase = errors.New("wrong passphrase for the dis keyring")
+	errKeyRingChanged  = errors.New("the dis keyring was changed by another process")
+)
+
+// KeyRing is what is needed to derive and check the master key
+type KeyRing struct {
+	// Version is incremented by every rotation and recorded with the data
+	// keys wrapped by it
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	// Check is an empty message sealed by the master key
+	Check []byte `json:"check"`
+	// LegacyPassword is the content of password.txt sealed by the master key
+	LegacyPassword []byte `json:"legacy_password,omitempty"`
+	// ChunkKey is the key chunks are identified with sealed by the master
+	// key, see chunkIDKey. Until the first rotation it is derived from the
+	// master key instead.
+	ChunkKey []byte `json:"chunk_key,omitempty"`
+}
+
+// KeyBackup is what dis_key export writes: the keyring and the wrapped data
+// key of every file, which with the passphrase decrypt every shard
+type KeyBackup struct {
+	KeyRing KeyRing               `json:"keyring"`
+	Files   map[string]WrappedKey `json:"files"`
+	// Versions are the data keys of the earlier versions of the files, by
+	// file ID
+	Versions map[string]WrappedKey `json:"versions,omitempty"`
+}
+
+// WrappedKey is a data key sealed by the master key of Version
+type WrappedKey struct {
+	Key     []byte `json:"key"`
+	Version int    `json:"version"`
+}
+
+// the master key once unlocked by this process from the keyring of the
+// metadata store masterStore
+var (
+	masterMu      sync.Mutex
+	masterCache   *[32]byte
+	masterVersion int
+	masterStore   string
+)
+
+// the legacy password once unwrapped by this process from the keyring of the
+// metadata store legacyStore
+var (
+	legacyMu    sync.Mutex
+	legacyCache string
+	legacyStore string
+)
+
+// checkMasterStore forgets the cached master key if it was unlocked from
+// another metadata store, as after the config directory changed. Called
+// with masterMu held.
+func checkMasterStore() {
+	if store := MetadataStorePath(); store != masterStore {
+		masterCache, masterVersion, masterStore = nil, 0, store
+	}
+}
+
+// promptsDisabled is set by DisablePrompts
+var promptsDisabled atomic.Bool
+
+// DisablePrompts makes the dis operations of this process fail instead of
+// asking on the terminal, for the processes serving others such as mount
+func DisablePrompts() {
+	promptsDisabled.Store(true)
+}
+
+// canPrompt returns true if the user can be asked on the terminal. A process
+// serving the rc, such as rclone rcd, never asks for the whole of its life:
+// nobody is at its terminal for the dis/* calls it runs.
+func canPrompt() bool {
+	return !promptsDisabled.Load() && !rc.Opt.Enabled && fs.GetConfig(context.Background()).AskPassword && terminal.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// legacyPasswordPath returns the path of the password of the files uploaded
+// before the keyring
+func legacyPasswordPath() string {
+	return filepath.Join(GetRcloneDirPath(), "password.txt")
+}
+
+// getPassphrase returns the passphrase from env or asks for it, twice if
+// confirm is set. It fails if env is unset and nobody can be asked.
+func getPassphrase(env, name string, confirm bool) (string, error) {
+	if passphrase := os.Getenv(env); passphrase != "" {
+		return passphrase, nil
+	}
+	if !canPrompt() {
+		return "", fmt.Errorf("the %s passphrase can't be asked for here - set %s", name, env)
+	}
+	if confirm {
+		return config.ChangePassword(name), nil
+	}
+	return config.GetPassword(fmt.Sprintf("Enter %s passphrase:", name)), nil
+}
+
+// seal encrypts msg with key, prefixed by a random nonce
+func seal(key *[32]byte, msg []byte) ([]byte, error) {
+	var nonce [nonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], msg, &nonce, key), nil
+}
+
+// unseal decrypts what seal returned
+func unseal(key *[32]byte, sealed []byte) ([]byte, error) {
+	if len(sealed) < nonceSize+secretbox.Overhead {
+		return nil, errors.New("sealed key too short")
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], sealed)
+	msg, ok := secretbox.Open(nil, sealed[nonceSize:], &nonce, key)
+	if !ok {
+		return nil, errors.New("failed to unwrap key")
+	}
+	return msg, nil
+}
+
+// deriveKey derives the master key of ring from passphrase
+func deriveKey(passphrase string, ring *KeyRing) (*[32]byte, error) {
+	key, err := scrypt.Key([]byte(passphrase), ring.Salt, ring.N, ring.R, ring.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive master key: %w", err)
+	}
+	var master [32]byte
+	copy(master[:], key)
+	return &master, nil
+}
+
+// unlockKeyRing returns the master key of ring if passphrase is right
+func unlockKeyRing(passphrase string, ring *KeyRing) (*[32]byte, error) {
+	master, err := deriveKey(passphrase, ring)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unseal(master, ring.Check); err != nil {
+		return nil, errWrongPassphrase
+	}
+	return master, nil
+}
+
+// newKeyRing returns a keyring of version for passphrase with a fresh salt
+// and its master key
+func newKeyRing(passphrase string, version int) (*KeyRing, *[32]byte, error) {
+	ring := &KeyRing{Version: version, Salt: make([]byte, 32), N: scryptN, R: scryptR, P: scryptP}
+	if _, err := io.ReadFull(rand.Reader, ring.Salt); err != nil {
+		return nil, nil, err
+	}
+	master, err := deriveKey(passphrase, ring)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ring.Check, err = seal(master, nil); err != nil {
+		return nil, nil, err
+	}
+	return ring, master, nil
+}
+
+// masterKey returns the master key and its version. The keyring is created
+// on first use, with password.txt moved into it if there is one.
+func masterKey() (*[32]byte, int, error) {
+	masterMu.Lock()
+	defer masterMu.Unlock()
+	checkMasterStore()
+	if masterCache != nil {
+		return masterCache, masterVersion, nil
+	}
+
+	ring, err := readKeyRing()
+	if err != nil {
+		return nil, 0, err
+	}
+	if ring == nil {
+		passphrase, err := getPassphrase(PassphraseEnv, "new dis master key", true)
+		if err != nil {
+			return nil, 0, err
+		}
+		newRing, master, err := newKeyRing(passphrase, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		legacy, err := os.ReadFile(legacyPasswordPath())
+		if err == nil {
+			if newRing.LegacyPassword, err = seal(master, legacy); err != nil {
+				return nil, 0, err
+			}
+		}
+		err = writeKeyRing(newRing, 0, nil)
+		if err == nil {
+			if legacy != nil {
+				removeLegacyPassword()
+			}
+			fmt.Println("Created the dis keyring, back it up with rclone dis_key export")
+			masterCache, masterVersion = master, newRing.Version
+			return master, newRing.Version, nil
+		}
+		if !errors.Is(err, errKeyRingChanged) {
+			return nil, 0, err
+		}
+		// created by another process in the meantime
+		if ring, err = readKeyRing(); err != nil {
+			return nil, 0, err
+		}
+		if master, err = unlockKeyRing(passphrase, ring); err != nil {
+			return nil, 0, err
+		}
+		masterCache, masterVersion = master, ring.Version
+		return master, ring.Version, nil
+	}
+
+	passphrase, err := getPassphrase(PassphraseEnv, "dis master key", false)
+	if err != nil {
+		return nil, 0, err
+	}
+	master, err := unlockKeyRing(passphrase, ring)
+	if err != nil {
+		return nil, 0, err
+	}
+	masterCache, masterVersion = master, ring.Version
+	return master, ring.Version, nil
+}
+
+// forgetMasterKey drops the master key and the legacy password unlocked by
+// this process
+func forgetMasterKey() {
+	masterMu.Lock()
+	masterCache, masterVersion = nil, 0
+	masterMu.Unlock()
+	forgetLegacyPassword()
+}
+
+// setMasterKey makes master of version the master key of this process
+func setMasterKey(master *[32]byte, version int) {
+	masterMu.Lock()
+	defer masterMu.Unlock()
+	checkMasterStore()
+	masterCache, masterVersion = master, version
+}
+
+// cachedMasterKey returns the master key unlocked by this process and its
+// version, nil if there is none
+func cachedMasterKey() (*[32]byte, int) {
+	masterMu.Lock()
+	defer masterMu.Unlock()
+	checkMasterStore()
+	return masterCache, masterVersion
+}
+
+// newDataKey returns a random data key for a new file, the key wrapped by
+// the master key and the version of the master key
+func newDataKey() (key []byte, wrapped []byte, version int, err error) {
+	master, version, err := masterKey()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	key = make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, 0, err
+	}
+	if wrapped, err = seal(master, key); err != nil {
+		return nil, nil, 0, err
+	}
+	return key, wrapped, version, nil
+}
+
+// fileDataKey returns the data key of info
+func fileDataKey(info FileInfo) ([]byte, error) {
+	master, version, err := masterKey()
+	if err != nil {
+		return nil, err
+	}
+	if info.KeyVersion != version {
+		return nil, fmt.Errorf("data key of %s is wrapped by master key version %d but the keyring is at version %d", info.FileName, info.KeyVersion, version)
+	}
+	key, err := unseal(master, info.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("data key of %s: %w", info.FileName, err)
+	}
+	return key, nil
+}
+
+// the ciphers of the data keys used lately, as making one runs scrypt
+var (
+	cipherMu    sync.Mutex
+	cipherCache = make(map[[sha256.Size]byte]*crypt.Cipher)
+)
+
+// maxCachedCiphers is the most ciphers kept in cipherCache
+const maxCachedCiphers = 64
+
+// dataKeyCipher returns the backend/crypt cipher of dataKey
+func dataKeyCipher(dataKey []byte) (*crypt.Cipher, error) {
+	id := sha256.Sum256(dataKey)
+	cipherMu.Lock()
+	defer cipherMu.Unlock()
+	if cipher, ok := cipherCache[id]; ok {
+		return cipher, nil
+	}
+	cipher, err := newStreamCipher(hex.EncodeToString(dataKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to make cipher: %w", err)
+	}
+	if len(cipherCache) >= maxCachedCiphers {
+		clear(cipherCache)
+	}
+	cipherCache[id] = cipher
+	return cipher, nil
+}
+
+// fileCipher returns the cipher of a stream format file
+func fileCipher(info FileInfo) (*crypt.Cipher, error) {
+	if len(info.WrappedKey) == 0 {
+		password, err := legacyPassword()
+		if err != nil {
+			return nil, err
+		}
+		return newStreamCipher(password)
+	}
+	key, err := fileDataKey(info)
+	if err != nil {
+		return nil, err
+	}
+	return dataKeyCipher(key)
+}
+
+// legacyPassword returns the password of the files uploaded before the
+// keyring, unwrapped from the keyring. A password.txt left from before is
+// moved into the keyring first, and a password is made for the first file
+// uploaded in the legacy format if there is none.
+func legacyPassword() (string, error) {
+	legacyMu.Lock()
+	defer legacyMu.Unlock()
+	if store := MetadataStorePath(); store != legacyStore {
+		legacyCache, legacyStore = "", store
+	}
+	if legacyCache != "" {
+		return legacyCache, nil
+	}
+
+	master, version, err := masterKey()
+	if err != nil {
+		return "", err
+	}
+	ring, err := readKeyRing()
+	if err != nil {
+		return "", err
+	}
+	if ring == nil || ring.Version != version {
+		return "", errKeyRingChanged
+	}
+	var password []byte
+	if len(ring.LegacyPassword) > 0 {
+		if password, err = unseal(master, ring.LegacyPassword); err != nil {
+			return "", fmt.Errorf("legacy password: %w", err)
+		}
+	}
+
+	plain, err := os.ReadFile(legacyPasswordPath())
+	switch {
+	case os.IsNotExist(err):
+		plain = nil
+	case err != nil:
+		return "", err
+	case password != nil && !bytes.Equal(plain, password):
+		return "", fmt.Errorf("%s isn't the legacy password in the keyring, move it away to use the keyring's", legacyPasswordPath())
+	case password == nil:
+		password = plain
+	}
+
+	if password == nil {
+		random, err := generateRandomPassword(16)
+		if err != nil {
+			return "", err
+		}
+		password = []byte(random)
+	}
+	if len(ring.LegacyPassword) == 0 {
+		if ring.LegacyPassword, err = seal(master, password); err != nil {
+			return "", err
+		}
+		if err := writeKeyRing(ring, ring.Version, nil); err != nil {
+			return "", err
+		}
+	}
+	if plain != nil {
+		removeLegacyPassword()
+	}
+	legacyCache = string(password)
+	return legacyCache, nil
+}
+
+// removeLegacyPassword removes password.txt once the keyring holds it
+func removeLegacyPassword() {
+	if err := os.Remove(legacyPasswordPath()); err != nil {
+		fmt.Printf("Failed to remove %s, the keyring holds it: %v\n", legacyPasswordPath(), err)
+		return
+	}
+	fmt.Printf("Moved %s into the dis keyring\n", legacyPasswordPath())
+}
+
+// forgetLegacyPassword drops the legacy password unwrapped by this process
+func forgetLegacyPassword() {
+	legacyMu.Lock()
+	defer legacyMu.Unlock()
+	legacyCache = ""
+}
+
+// RotateMasterKey replaces the master key by one derived from a new
+// passphrase. The data keys of every file are rewrapped by the new key in
+// the same transaction which replaces the keyring, no shard is touched.
+func RotateMasterKey(ctx context.Context) error {
+	_, unlock, err := lockStore(ctx, "rotate")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	oldMaster, version, err := masterKey()
+	if err != nil {
+		return err
+	}
+	ring, err := readKeyRing()
+	if err != nil {
+		return err
+	}
+
+	newPassphrase, err := getPassphrase(NewPassphraseEnv, "new dis master key", true)
+	if err != nil {
+		return err
+	}
+	newRing, newMaster, err := newKeyRing(newPassphrase, version+1)
+	if err != nil {
+		return err
+	}
+	if len(ring.LegacyPassword) > 0 {
+		legacy, err := unseal(oldMaster, ring.LegacyPassword)
+		if err != nil {
+			return fmt.Errorf("legacy password: %w", err)
+		}
+		if newRing.LegacyPassword, err = seal(newMaster, legacy); err != nil {
+			return err
+		}
+	}
+
+	// chunks keep their IDs whatever the master key
+	chunkKey, err := ringChunkKey(ring, oldMaster)
+	if err != nil {
+		return err
+	}
+	if newRing.ChunkKey, err = seal(newMaster, chunkKey); err != nil {
+		return err
+	}
+
+	rewrapped := 0
+	err = writeKeyRing(newRing, version, func(files map[string]FileInfo) error {
+		rewrapped = 0
+		for name, info := range files {
+			changed := false
+			err := info.eachVersion(func(v *FileInfo) error {
+				if len(v.WrappedKey) == 0 {
+					return nil
+				}
+				changed = true
+				if v.KeyVersion != version {
+					return fmt.Errorf("data key of %s version %d is wrapped by master key version %d, not %d", name, v.VersionNumber(), v.KeyVersion, version)
+				}
+				key, err := unseal(oldMaster, v.WrappedKey)
+				if err != nil {
+					return fmt.Errorf("data key of %s version %d: %w", name, v.VersionNumber(), err)
+				}
+				if v.WrappedKey, err = seal(newMaster, key); err != nil {
+					return err
+				}
+				v.KeyVersion = newRing.Version
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if changed {
+				files[name] = info
+				rewrapped++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	setMasterKey(newMaster, newRing.Version)
+	fmt.Printf("Rotated to master key version %d, rewrapped the data keys of %d files\n", newRing.Version, rewrapped)
+	return nil
+}
+
+// ExportKeys writes the keyring and the wrapped data keys of every file to
+// path. Nothing in it can be read without the passphrase.
+func ExportKeys(path string) error {
+	ring, err := readKeyRing()
+	if err != nil {
+		return err
+	}
+	if ring == nil {
+		return errors.New("there is no dis keyring to export yet")
+	}
+	files, err := readDatamap()
+	if err != nil {
+		return err
+	}
+
+	backup := KeyBackup{KeyRing: *ring, Files: make(map[string]WrappedKey), Versions: make(map[string]WrappedKey)}
+	for name, info := range files {
+		if len(info.WrappedKey) > 0 {
+			backup.Files[name] = WrappedKey{Key: info.WrappedKey, Version: info.KeyVersion}
+		}
+		for _, version := range info.Versions {
+			if len(version.WrappedKey) > 0 {
+				backup.Versions[version.FileID] = WrappedKey{Key: version.WrappedKey, Version: version.KeyVersion}
+			}
+		}
+	}
+	data, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Exported master key version %d and the data keys of %d files to %s\n", ring.Version, len(backup.Files), path)
+	return nil
+}
+
+// ImportKeys restores the keyring and the data keys of the files in the
+// datamap from a backup written by ExportKeys, once its passphrase is
+// checked. A keyring other than the one backed up is only replaced if no
+// file uses it.
+func ImportKeys(ctx context.Context, path string) error {
+	_, unlock, err := lockStore(ctx, "import")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var backup KeyBackup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return fmt.Errorf("failed to decode key backup %s: %w", path, err)
+	}
+	passphrase, err := getPassphrase(PassphraseEnv, "dis master key", false)
+	if err != nil {
+		return err
+	}
+	master, err := unlockKeyRing(passphrase, &backup.KeyRing)
+	if err != nil {
+		return err
+	}
+
+	current, err := readKeyRing()
+	if err != nil {
+		return err
+	}
+	expectVersion := 0
+	sameRing := true
+	if current != nil {
+		expectVersion = current.Version
+		sameRing = bytes.Equal(current.Salt, backup.KeyRing.Salt)
+	}
+	restored := 0
+	err = writeKeyRing(&backup.KeyRing, expectVersion, func(files map[string]FileInfo) error {
+		restored = 0
+		for name, info := range files {
+			wrapped, ok := backup.Files[name]
+			if !ok {
+				if len(info.WrappedKey) > 0 && (!sameRing || info.KeyVersion != backup.KeyRing.Version) {
+					return fmt.Errorf("%s uses a keyring which isn't in the backup", name)
+				}
+				continue
+			}
+			if wrapped.Version != backup.KeyRing.Version {
+				return fmt.Errorf("data key of %s in the backup is wrapped by master key version %d, not %d", name, wrapped.Version, backup.KeyRing.Version)
+			}
+			info.WrappedKey, info.KeyVersion = wrapped.Key, wrapped.Version
+			for i, version := range info.Versions {
+				if old, ok := backup.Versions[version.FileID]; ok && old.Version == backup.KeyRing.Version {
+					info.Versions[i].WrappedKey, info.Versions[i].KeyVersion = old.Key, old.Version
+				}
+			}
+			files[name] = info
+			restored++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	setMasterKey(master, backup.KeyRing.Version)
+	forgetLegacyPassword()
+	fmt.Printf("Imported master key version %d and the data keys of %d files\n", backup.KeyRing.Version, restored)
+	return nil
+}
@@ -0,0 +1,127 @@
+package dis_operations
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealUnseal(t *testing.T) {
+	ring, master, err := newKeyRing("right", 1)
+	require.NoError(t, err)
+
+	sealed, err := seal(master, []byte("data key"))
+	require.NoError(t, err)
+	got, err := unseal(master, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data key"), got)
+
+	unlocked, err := unlockKeyRing("right", ring)
+	require.NoError(t, err)
+	assert.Equal(t, master, unlocked)
+	_, err = unlockKeyRing("wrong", ring)
+	assert.ErrorIs(t, err, errWrongPassphrase)
+
+	sealed[len(sealed)-1] ^= 1
+	_, err = unseal(master, sealed)
+	assert.Error(t, err)
+}
+
+func TestRotateExportImportKeys(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	const name = "keys_test/data.bin"
+
+	data := bytes.Repeat([]byte("secret"), 10000)
+	src := filepath.Join(dir, "data.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	require.NoError(t, streamUploadFile(ctx, src, name, RoundRobin, ShardProfile{}))
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+	}()
+
+	download := func() []byte {
+		out := t.TempDir()
+		info, err := GetFileInfoStruct(name)
+		require.NoError(t, err)
+		require.NoError(t, streamDownloadFile(ctx, info, out))
+		got, err := os.ReadFile(filepath.Join(out, "data.bin"))
+		require.NoError(t, err)
+		return got
+	}
+
+	before, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	require.NotEmpty(t, before.WrappedKey)
+	backup := filepath.Join(dir, "keys.json")
+	require.NoError(t, ExportKeys(backup))
+
+	// the data key is rewrapped, the shards stay as they are
+	t.Setenv(NewPassphraseEnv, "rotated passphrase")
+	require.NoError(t, RotateMasterKey(context.Background()))
+	after, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	assert.Equal(t, before.KeyVersion+1, after.KeyVersion)
+	assert.NotEqual(t, before.WrappedKey, after.WrappedKey)
+	assert.Equal(t, before.DistributedFileInfos, after.DistributedFileInfos)
+
+	forgetMasterKey()
+	_, err = fileDataKey(after)
+	assert.ErrorIs(t, err, errWrongPassphrase)
+	t.Setenv(PassphraseEnv, "rotated passphrase")
+	assert.True(t, bytes.Equal(data, download()))
+
+	// the backup brings back the old passphrase
+	forgetMasterKey()
+	t.Setenv(PassphraseEnv, testPassphrase)
+	require.NoError(t, ImportKeys(context.Background(), backup))
+	restored, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	assert.Equal(t, before.WrappedKey, restored.WrappedKey)
+	forgetMasterKey()
+	assert.True(t, bytes.Equal(data, download()))
+
+	t.Setenv(PassphraseEnv, "wrong")
+	assert.ErrorIs(t, ImportKeys(context.Background(), backup), errWrongPassphrase)
+}
+
+func TestLegacyPasswordKeptWrapped(t *testing.T) {
+	setupStreamRemotes(t)
+	require.NoError(t, os.WriteFile(legacyPasswordPath(), []byte("legacy secret"), 0600))
+
+	// password.txt moves into the keyring
+	password, err := legacyPassword()
+	require.NoError(t, err)
+	assert.Equal(t, "legacy secret", password)
+	assert.NoFileExists(t, legacyPasswordPath())
+	ring, err := readKeyRing()
+	require.NoError(t, err)
+	assert.NotEmpty(t, ring.LegacyPassword)
+
+	// and is unwrapped from it from then on, without writing it back
+	forgetMasterKey()
+	password, err = legacyPassword()
+	require.NoError(t, err)
+	assert.Equal(t, "legacy secret", password)
+	assert.NoFileExists(t, legacyPasswordPath())
+
+	// another password.txt isn't taken for it
+	forgetMasterKey()
+	require.NoError(t, os.WriteFile(legacyPasswordPath(), []byte("other"), 0600))
+	_, err = legacyPassword()
+	assert.Error(t, err)
+}
+
+func TestPassphraseNotAsked(t *testing.T) {
+	setupStreamRemotes(t)
+	t.Setenv(PassphraseEnv, "")
+
+	// there is no terminal to ask on
+	_, _, err := masterKey()
+	assert.ErrorContains(t, err, PassphraseEnv)
+}
@@ -2,11 +2,8 @@ package dis_operations
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
 	"strings"
 	"sync"
 
@@ -16,6 +13,7 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// name of the JSON load balancer state used before the metadata store, see store.go
 var lb_file_name = "loadbalancer.json"
 
 type LoadBalancerType string
@@ -39,23 +37,22 @@ func (lb LoadBalancerType) IsValid() bool {
 }
 
 func LoadBalancer_RoundRobin() (Remote, error) {
-	jsonFilePath := getLoadBalancerJsonFilePath()
-	existingLBInfo, err := readJSON(jsonFilePath)
-	if err != nil {
-		return Remote{}, err
-	}
-
-	remotes := config.GetRemotes()
+	remotes := shardRemotes()
 	if len(remotes) == 0 {
 		return Remote{}, fmt.Errorf("no available remotes")
 	}
 
-	// Select a remote using Round Robin
-	selectedRemote := remotes[existingLBInfo.RoundRobinCounter%len(remotes)]
-	selectedRemoteObj := Remote{selectedRemote.Name, selectedRemote.Type}
-
-	// Increment counters
-	IncrementRoundRobinCounter()
+	// Select a remote using Round Robin and increment the counter in the same transaction
+	var selectedRemoteObj Remote
+	err := updateLoadBalancerInfo(func(lbInfo *LoadBalancerInfo) error {
+		selectedRemote := remotes[lbInfo.RoundRobinCounter%len(remotes)]
+		selectedRemoteObj = Remote{selectedRemote.Name, selectedRemote.Type}
+		lbInfo.RoundRobinCounter++
+		return nil
+	})
+	if err != nil {
+		return Remote{}, err
+	}
 
 	return selectedRemoteObj, nil
 }
@@ -79,14 +76,10 @@ func LoadBalancer_UploadOptima() (Remote, error) {
 	return remote, nil
 }
 
-var bestRemote_save = Remote{"", ""}
-
+// LoadBalancer_ResourceBased returns the remote with the most free space.
+// Free space changes with every upload so it is asked again on every call.
 func LoadBalancer_ResourceBased() (Remote, error) {
-	if bestRemote_save.Name != "" && bestRemote_save.Type != "" {
-		return bestRemote_save, nil
-	}
-
-	remotes := config.GetRemotes()
+	remotes := shardRemotes()
 	var errs []error
 	var wg sync.WaitGroup
 	var mu sync.Mutex // To protect shared variables
@@ -124,136 +117,35 @@ func LoadBalancer_ResourceBased() (Remote, error) {
 		return Remote{}, fmt.Errorf("all remotes failed: %v", errs)
 	}
 
-	bestRemote_save = bestRemote
 	return bestRemote, nil
 }
 
 func IncrementRoundRobinCounter() error {
-	jsonFilePath := getLoadBalancerJsonFilePath()
-	existingLBInfo, err := readJSON(jsonFilePath)
-	if err != nil {
-		return err
-	}
-
-	existingLBInfo.RoundRobinCounter = (existingLBInfo.RoundRobinCounter + 1)
-
-	return writeJSON(jsonFilePath, existingLBInfo)
+	return updateLoadBalancerInfo(func(lbInfo *LoadBalancerInfo) error {
+		lbInfo.RoundRobinCounter++
+		return nil
+	})
 }
 
 func UpdateRemoteInfo(remote Remote, updateFunc func(*RemoteInfo)) error {
-	jsonFilePath := getLoadBalancerJsonFilePath()
-	lbInfo, err := getLoadBalancerInfo(jsonFilePath)
-	if err != nil {
-		return err
-	}
-
-	// Get or initialize RemoteInfo (use pointer to it)
-	remoteInfo := getRemoteInfo(remote, lbInfo)
-
-	// Apply the provided update function
-	updateFunc(&remoteInfo)
-
-	// Since the map stores struct values, we must explicitly update it
-	lbInfo.RemoteInfos[remote.String()] = remoteInfo
-
-	// Write updated info back to JSON
-	err = writeJSON(jsonFilePath, lbInfo)
-	if err != nil {
-		return fmt.Errorf("failed to write JSON: %w", err)
-	}
-
-	return nil
-}
-
-func getLoadBalancerJsonFilePath() string {
-	path := GetRcloneDirPath()
-
-	// Construct the file path
-	filePath := filepath.Join(path, "data", lb_file_name)
+	err := updateLoadBalancerInfo(func(lbInfo *LoadBalancerInfo) error {
+		// Get or initialize RemoteInfo
+		remoteInfo := getRemoteInfo(remote, lbInfo)
 
-	// Check if the file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		// Create the directories if they don't exist
-		err := os.MkdirAll(filepath.Dir(filePath), 0755)
-		if err != nil {
-			fmt.Println("Error creating directories:", err)
-			return ""
-		}
-
-		// Create the JSON file
-		file, err := os.Create(filePath)
-		if err != nil {
-			fmt.Println("Error creating file:", err)
-			return ""
-		}
-		defer file.Close()
-
-		// Initialize LoadBalancerInfo with default values
-		lbInfo := LoadBalancerInfo{
-			RoundRobinCounter: 0,
-			RemoteInfos:       make(map[string]RemoteInfo),
-		}
-
-		// Marshal the LoadBalancerInfo struct to JSON format
-		data, err := json.MarshalIndent(lbInfo, "", "  ")
-		if err != nil {
-			fmt.Println("Error marshaling data:", err)
-			return ""
-		}
-
-		// Write the initialized data to the file
-		_, err = file.Write(data)
-		if err != nil {
-			fmt.Println("Error writing to file:", err)
-			return ""
-		}
-	}
-
-	return filePath
-}
+		// Apply the provided update function
+		updateFunc(&remoteInfo)
 
-func readJSON(filename string) (*LoadBalancerInfo, error) {
-	// Open the file
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	// Read the file contents
-	var lbInfo LoadBalancerInfo
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&lbInfo)
-	if err != nil {
-		return nil, err
-	}
-
-	return &lbInfo, nil
-}
-
-func writeJSON(filename string, lbInfo *LoadBalancerInfo) error {
-	data, err := json.MarshalIndent(lbInfo, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	err = os.WriteFile(filename, data, 0644)
+		// Since the map stores struct values, we must explicitly update it
+		lbInfo.RemoteInfos[remote.String()] = remoteInfo
+		return nil
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to update remote info: %w", err)
 	}
 
 	return nil
 }
 
-func getLoadBalancerInfo(jsonFilePath string) (*LoadBalancerInfo, error) {
-	existingLBInfo, err := readJSON(jsonFilePath)
-	if err != nil {
-		return nil, err
-	}
-
-	return existingLBInfo, nil
-}
-
 func getRemoteInfo(remote Remote, loadBalancerInfo *LoadBalancerInfo) RemoteInfo {
 	if loadBalancerInfo.RemoteInfos == nil {
 		loadBalancerInfo.RemoteInfos = make(map[string]RemoteInfo)
@@ -292,8 +184,7 @@ func getRemoteOfHighestDownThroughput() (Remote, error) {
 }
 
 func getRemoteOfHighestThroughput(selector func(RemoteInfo) float64) (Remote, error) {
-	jsonFilePath := getLoadBalancerJsonFilePath()
-	existingLBInfo, err := readJSON(jsonFilePath)
+	existingLBInfo, err := readLoadBalancerInfo()
 	if err != nil {
 		return LoadBalancer_RoundRobin()
 	}
@@ -392,14 +283,10 @@ func getFreeStorage(f fs.Fs) (int64, error) {
 	if err != nil {
 		return 0, fmt.Errorf("about call failed: %w", err)
 	}
-	if u == nil {
-		return 0, errors.New("nil usage returned")
+	if u == nil || u.Free == nil {
+		return 0, errors.New("free space unknown")
 	}
 
 	// Return free storage
 	return *u.Free, nil
 }
-
-func GetLBFileName() string {
-	return lb_file_name
-}
@@ -0,0 +1,615 @@
+package dis_operations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/object"
+	"github.com/rclone/rclone/lib/atexit"
+)
+
+// Store lock
+//
+// Operations changing the distributed store take a lease on it, an object
+// stored next to the shards on every remote, as cmd/bisync does with its
+// lock file locally. The lease names its owner and when it expires. It is
+// held once written to a majority of the remotes and read back from them
+// after a moment, so of machines racing for it at most one gets it and the
+// others back off and try again.
+//
+// The lease is renewed while the operation runs, once checked to be still
+// held: if it was broken and taken by another machine, or can't be renewed
+// before it expires, the operation is cancelled. If the machine holding it
+// dies it expires and the next machine to want it breaks it. dis_unlock
+// breaks a lease known to be stale before it expires.
+//
+// Under the lease the operations of a process run one at a time. A process
+// serving the store, as a mount, keeps the lease across the operations
+// following each other, see HoldStoreLock.
+const lockObject = "dis_lock"
+
+var (
+	// lockLease is how long a lease lasts unless renewed
+	lockLease = 5 * time.Minute
+	// lockWait is how long to wait for another machine to release the lease
+	lockWait = 2 * time.Minute
+	// lockSettle is how long a lease written is left before being read back
+	lockSettle = 2 * time.Second
+)
+
+var errLocked = errors.New("the distributed store is locked")
+
+// Lease is the lock object stored on the remotes
+type Lease struct {
+	Node      string    `json:"node"`
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	Token     string    `json:"token"`
+	Operation string    `json:"operation"`
+	Acquired  time.Time `json:"acquired"`
+	Expires   time.Time `json:"expires"`
+}
+
+func (l *Lease) String() string {
+	return fmt.Sprintf("%s by pid %d on %s (machine %s) since %s, expires %s",
+		l.Operation, l.PID, l.Host, l.Node, l.Acquired.Format(time.RFC3339), l.Expires.Format(time.RFC3339))
+}
+
+// expired returns true if the lease can be broken at now
+func (l *Lease) expired(now time.Time) bool {
+	return now.After(l.Expires)
+}
+
+// readLease returns the lease on remote, nil if there is none
+func readLease(ctx context.Context, remote Remote) (*Lease, error) {
+	f, err := getShardFs(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := f.NewObject(ctx, lockObject)
+	if errors.Is(err, fs.ErrorObjectNotFound) || errors.Is(err, fs.ErrorDirNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	in, err := obj.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	data, err := io.ReadAll(io.LimitReader(in, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	lease := &Lease{}
+	if err := json.Unmarshal(data, lease); err != nil {
+		return nil, fmt.Errorf("bad lock on %s: %w", remote.Name, err)
+	}
+	return lease, nil
+}
+
+// writeLease writes lease to remote
+func writeLease(ctx context.Context, remote Remote, lease Lease) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	f, err := getShardFs(ctx, remote)
+	if err != nil {
+		return err
+	}
+	info := object.NewStaticObjectInfo(lockObject, time.Now(), int64(len(data)), true, nil, f)
+	_, err = f.Put(ctx, bytes.NewReader(data), info)
+	return err
+}
+
+// removeLease removes the lease on remote if it has token, or whatever it
+// is if token is empty
+func removeLease(ctx context.Context, remote Remote, token string) error {
+	lease, err := readLease(ctx, remote)
+	if err != nil || lease == nil || (token != "" && lease.Token != token) {
+		return err
+	}
+	f, err := getShardFs(ctx, remote)
+	if err != nil {
+		return err
+	}
+	obj, err := f.NewObject(ctx, lockObject)
+	if err != nil {
+		return err
+	}
+	return obj.Remove(ctx)
+}
+
+// leaseResult is the lease read on a remote
+type leaseResult struct {
+	lease *Lease
+	err   error
+}
+
+// readLeases reads the lease of every remote
+func readLeases(ctx context.Context, remotes []Remote) []leaseResult {
+	results := make([]leaseResult, len(remotes))
+	var wg sync.WaitGroup
+	for i, remote := range remotes {
+		i, remote := i, remote
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].lease, results[i].err = readLease(ctx, remote)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// forEachRemote runs fn on every remote at once and returns how many
+// succeeded
+func forEachRemote(remotes []Remote, fn func(remote Remote) error) int {
+	errs := make([]error, len(remotes))
+	var wg sync.WaitGroup
+	for i, remote := range remotes {
+		i, remote := i, remote
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(remote)
+		}()
+	}
+	wg.Wait()
+	ok := 0
+	for i, err := range errs {
+		if err != nil {
+			fmt.Printf("Lock on %s failed: %v\n", remotes[i].Name, err)
+			continue
+		}
+		ok++
+	}
+	return ok
+}
+
+// tryLock tries once to take lease on remotes
+func tryLock(ctx context.Context, remotes []Remote, lease Lease) error {
+	need := quorum(len(remotes))
+	now := time.Now()
+	reached := 0
+	for i, r := range readLeases(ctx, remotes) {
+		if r.err != nil {
+			fmt.Printf("Can't read the lock on %s: %v\n", remotes[i].Name, r.err)
+			continue
+		}
+		reached++
+		if r.lease == nil || r.lease.Token == lease.Token {
+			continue
+		}
+		if !r.lease.expired(now) {
+			return fmt.Errorf("%w: %v", errLocked, r.lease)
+		}
+		fmt.Printf("Breaking the expired lock on %s: %v\n", remotes[i].Name, r.lease)
+	}
+	if reached < need {
+		return fmt.Errorf("%w: read the lock on %d of %d remotes, %d needed", errNoQuorum, reached, len(remotes), need)
+	}
+
+	release := func() {
+		forEachRemote(remotes, func(remote Remote) error {
+			return removeLease(ctx, remote, lease.Token)
+		})
+	}
+	written := forEachRemote(remotes, func(remote Remote) error {
+		return writeLease(ctx, remote, lease)
+	})
+	if written < need {
+		release()
+		return fmt.Errorf("%w: wrote the lock on %d of %d remotes, %d needed", errNoQuorum, written, len(remotes), need)
+	}
+
+	// another machine writing its lease at the same time overwrote ours
+	time.Sleep(lockSettle)
+	mine := 0
+	var other *Lease
+	for _, r := range readLeases(ctx, remotes) {
+		switch {
+		case r.err != nil || r.lease == nil:
+		case r.lease.Token == lease.Token:
+			mine++
+		default:
+			other = r.lease
+		}
+	}
+	if mine < need {
+		release()
+		if other != nil {
+			return fmt.Errorf("%w: %v", errLocked, other)
+		}
+		return fmt.Errorf("%w: the lock was read back from %d of %d remotes, %d needed", errNoQuorum, mine, len(remotes), need)
+	}
+	return nil
+}
+
+// storeSession is the lease held by this process, shared by its operations
+type storeSession struct {
+	lease   Lease
+	remotes []Remote
+	// store is the path of the metadata store the session works on
+	store string
+	// ctx is cancelled once the lease is lost
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	users  int
+	idle   *time.Timer
+	stop   chan struct{}
+	done   sync.WaitGroup
+}
+
+var (
+	// lockMu guards session and lockHeld
+	lockMu  sync.Mutex
+	session *storeSession
+	// lockHeld is how long the lease is kept after the last operation using
+	// it, see HoldStoreLock
+	lockHeld time.Duration
+	// opLock excludes the operations of this process from each other
+	opLock = make(chan struct{}, 1)
+	// lockHold is how long HoldStoreLock keeps the lease
+	lockHold = 30 * time.Second
+)
+
+var errLeaseLost = errors.New("lost the lock on the distributed store")
+
+// heldLockKey marks the context of an operation holding the lock
+type heldLockKey struct{}
+
+// renewOnce extends the lease on the remotes which still hold it. The lease
+// is lost if another machine took it or it can't be renewed before it
+// expires.
+func (s *storeSession) renewOnce() error {
+	ctx := context.Background()
+	need := quorum(len(s.remotes))
+	var mine []Remote
+	unreachable := 0
+	for i, r := range readLeases(ctx, s.remotes) {
+		switch {
+		case r.err != nil:
+			fmt.Printf("Can't read the lock on %s: %v\n", s.remotes[i].Name, r.err)
+			unreachable++
+		case r.lease != nil && r.lease.Token == s.lease.Token:
+			mine = append(mine, s.remotes[i])
+		case r.lease != nil:
+			fmt.Printf("The lock on %s was taken: %v\n", s.remotes[i].Name, r.lease)
+		}
+	}
+	if len(mine)+unreachable < need {
+		return fmt.Errorf("%w: held on %d of %d remotes, %d needed", errLeaseLost, len(mine), len(s.remotes), need)
+	}
+	renewed := 0
+	lease := s.lease
+	lease.Expires = time.Now().Add(lockLease)
+	if len(mine) >= need {
+		renewed = forEachRemote(mine, func(remote Remote) error {
+			return writeLease(ctx, remote, lease)
+		})
+	}
+	if renewed >= need {
+		s.lease = lease
+		return nil
+	}
+	if time.Now().Add(lockLease / 3).After(s.lease.Expires) {
+		return fmt.Errorf("%w: renewed on %d of %d remotes, %d needed", errLeaseLost, renewed, len(s.remotes), need)
+	}
+	fmt.Printf("Renewed the lock on only %d of %d remotes, trying again\n", renewed, len(s.remotes))
+	return nil
+}
+
+// renew extends the lease until stop is closed, cancelling the session if
+// it is lost
+func (s *storeSession) renew() {
+	defer s.done.Done()
+	ticker := time.NewTicker(lockLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.renewOnce(); err != nil {
+				fmt.Printf("%v, stopping %s\n", err, s.lease.Operation)
+				s.cancel(err)
+				return
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// end ends s and returns the function releasing its lease, publishing the
+// metadata first if the lease was held across operations. It is called with
+// lockMu held and the function without it, as it talks to the remotes.
+func (s *storeSession) end() (release func()) {
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	publish := lockHeld > 0 && s.ctx.Err() == nil && s.store == MetadataStorePath()
+	if session == s {
+		session = nil
+	}
+	return func() {
+		if publish {
+			syncSessionMetadata()
+		}
+		close(s.stop)
+		s.done.Wait()
+		s.cancel(errLeaseLost)
+		forEachRemote(s.remotes, func(remote Remote) error {
+			return removeLease(context.Background(), remote, s.lease.Token)
+		})
+	}
+}
+
+// takeLease takes the lease on remotes for operation, waiting up to
+// lockWait for another machine to release it
+func takeLease(ctx context.Context, remotes []Remote, operation string) (*storeSession, error) {
+	state, err := loadManifestState()
+	if err != nil {
+		return nil, err
+	}
+	token, err := newFileID()
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	deadline := time.Now().Add(lockWait)
+	waiting := false
+	for {
+		now := time.Now()
+		lease := Lease{
+			Node:      state.Node,
+			Host:      host,
+			PID:       os.Getpid(),
+			Token:     token,
+			Operation: operation,
+			Acquired:  now,
+			Expires:   now.Add(lockLease),
+		}
+		err := tryLock(ctx, remotes, lease)
+		if err == nil {
+			s := &storeSession{lease: lease, remotes: remotes, stop: make(chan struct{})}
+			s.ctx, s.cancel = context.WithCancelCause(context.Background())
+			s.done.Add(1)
+			go s.renew()
+			return s, nil
+		}
+		if !errors.Is(err, errLocked) || time.Now().After(deadline) {
+			if errors.Is(err, errLocked) {
+				err = fmt.Errorf("%w\nIf it is stale it expires by itself, or can be broken with rclone dis_unlock", err)
+			}
+			return nil, err
+		}
+		if !waiting {
+			fmt.Printf("Waiting for the lock: %v\n", err)
+			waiting = true
+		}
+		// back off for a random time so racing machines don't collide again
+		select {
+		case <-time.After(lockSettle + time.Duration(rand.Int63n(int64(lockSettle)+1))):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// sameRemotes returns true if a and b are the same remotes
+func sameRemotes(a, b []Remote) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// joinSession returns the session holding the lease, taking the lease if
+// this process doesn't hold it. It is nil without remotes.
+func joinSession(ctx context.Context, operation string) (*storeSession, error) {
+	lockMu.Lock()
+	remotes := configuredRemotes()
+	store := MetadataStorePath()
+	if session != nil && session.ctx.Err() == nil && session.store == store && sameRemotes(session.remotes, remotes) {
+		if session.idle != nil {
+			session.idle.Stop()
+			session.idle = nil
+		}
+		session.users++
+		lockMu.Unlock()
+		return session, nil
+	}
+	// the lease was lost, or is held for another config
+	release := func() {}
+	if session != nil && session.users == 0 {
+		release = session.end()
+	}
+	lockMu.Unlock()
+	release()
+	if len(remotes) == 0 {
+		return nil, nil
+	}
+	// the caller holds opLock so no other session is taken meanwhile
+	s, err := takeLease(ctx, remotes, operation)
+	if err != nil {
+		return nil, err
+	}
+	s.users = 1
+	s.store = store
+	lockMu.Lock()
+	session = s
+	held := lockHeld > 0
+	lockMu.Unlock()
+	if held {
+		// no other machine changes the store until the lease is released
+		syncSessionMetadata()
+	}
+	return s, nil
+}
+
+// leaveSession releases the lease of s once no operation uses it, or
+// lockHeld later
+func leaveSession(s *storeSession) {
+	if s == nil {
+		return
+	}
+	lockMu.Lock()
+	s.users--
+	if s.users > 0 || session != s {
+		lockMu.Unlock()
+		return
+	}
+	if lockHeld > 0 && s.ctx.Err() == nil {
+		s.idle = time.AfterFunc(lockHeld, func() {
+			lockMu.Lock()
+			release := func() {}
+			if s.users == 0 && session == s {
+				release = s.end()
+			}
+			lockMu.Unlock()
+			release()
+		})
+		lockMu.Unlock()
+		return
+	}
+	release := s.end()
+	lockMu.Unlock()
+	release()
+}
+
+// lockStore takes the lease on the distributed store for operation, waiting
+// up to lockWait for another machine to release it, and returns the context
+// the operation runs in and the function releasing the lease. The operations
+// of the process run one at a time, and the ones nested in an operation,
+// called with its context, share its lock. The context is cancelled if the
+// lease is lost.
+func lockStore(ctx context.Context, operation string) (context.Context, func(), error) {
+	if ctx.Value(heldLockKey{}) != nil {
+		return ctx, func() {}, nil
+	}
+	// a stopped operation doesn't start even if the lock is free
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	select {
+	case opLock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	s, err := joinSession(ctx, operation)
+	if err != nil {
+		<-opLock
+		return nil, nil, err
+	}
+	opCtx, cancel := context.WithCancelCause(context.WithValue(ctx, heldLockKey{}, true))
+	stopLost := func() bool { return false }
+	if s != nil {
+		stopLost = context.AfterFunc(s.ctx, func() {
+			cancel(context.Cause(s.ctx))
+		})
+	}
+	var once sync.Once
+	unlock := func() {
+		once.Do(func() {
+			stopLost()
+			cancel(nil)
+			leaveSession(s)
+			<-opLock
+		})
+	}
+	return opCtx, unlock, nil
+}
+
+// lockHeldAcross returns true if this process holds the lease across
+// operations
+func lockHeldAcross() bool {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	return lockHeld > 0 && session != nil && session.ctx.Err() == nil
+}
+
+// syncSessionMetadata syncs the metadata when the lease held across operations
+// is taken or released
+func syncSessionMetadata() {
+	if err := SyncMetadata(); err != nil {
+		fmt.Printf("Metadata not synced with the remotes: %v\n", err)
+	}
+}
+
+// HoldStoreLock keeps the lease on the distributed store for a while after
+// the operation which took it, so the operations following each other, as
+// those of a mount, take it only once. The metadata is synced when the lease
+// is taken and when it is released instead of by every operation.
+func HoldStoreLock() {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	if lockHeld == 0 {
+		atexit.Register(ReleaseStoreLock)
+	}
+	lockHeld = lockHold
+}
+
+// ReleaseStoreLock releases the lease kept by HoldStoreLock if no operation
+// uses it
+func ReleaseStoreLock() {
+	lockMu.Lock()
+	release := func() {}
+	if session != nil && session.users == 0 {
+		release = session.end()
+	}
+	lockMu.Unlock()
+	release()
+}
+
+// BreakLock removes the lease on the distributed store from every remote,
+// whoever holds it. Unless dryRun is set.
+func BreakLock(dryRun bool) error {
+	ctx := context.Background()
+	remotes := configuredRemotes()
+	found := 0
+	for i, r := range readLeases(ctx, remotes) {
+		if r.err != nil {
+			fmt.Printf("Can't read the lock on %s: %v\n", remotes[i].Name, r.err)
+			continue
+		}
+		if r.lease == nil {
+			continue
+		}
+		found++
+		fmt.Printf("Lock on %s: %v\n", remotes[i].Name, r.lease)
+	}
+	if found == 0 {
+		fmt.Println("The distributed store isn't locked")
+		return nil
+	}
+	if dryRun {
+		return nil
+	}
+	removed := forEachRemote(remotes, func(remote Remote) error {
+		return removeLease(ctx, remote, "")
+	})
+	if removed < len(remotes) {
+		return fmt.Errorf("failed to remove the lock from %d of %d remotes", len(remotes)-removed, len(remotes))
+	}
+	fmt.Println("Lock broken")
+	return nil
+}
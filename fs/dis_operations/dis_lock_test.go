@@ -0,0 +1,145 @@
+package dis_operations
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockStore(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	oldWait := lockWait
+	lockWait = 50 * time.Millisecond
+	defer func() {
+		lockWait = oldWait
+	}()
+	remotes := configuredRemotes()
+	lockPath := func(remote string) string {
+		return filepath.Join(dir, remote, remoteDirectory, lockObject)
+	}
+
+	// nested operations share the lease, released by the outermost
+	opCtx, unlock, err := lockStore(ctx, "upload")
+	require.NoError(t, err)
+	lease, err := readLease(ctx, remotes[0])
+	require.NoError(t, err)
+	require.NotNil(t, lease)
+	assert.Equal(t, "upload", lease.Operation)
+	_, inner, err := lockStore(opCtx, "rm")
+	require.NoError(t, err)
+	inner()
+	assert.FileExists(t, lockPath("streama"))
+
+	// other operations of the process wait for it
+	locked := make(chan struct{})
+	go func() {
+		_, unlock, err := lockStore(ctx, "mkdir")
+		if err == nil {
+			unlock()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("two operations of the process hold the lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+	for _, remote := range []string{"streama", "streamb", "streamc"} {
+		assert.NoFileExists(t, lockPath(remote))
+	}
+
+	// a live lease of another machine on a majority of the remotes
+	other := Lease{Node: "other", Host: "laptop", PID: 42, Token: "other", Operation: "upload", Acquired: time.Now(), Expires: time.Now().Add(time.Hour)}
+	for _, remote := range remotes[:2] {
+		require.NoError(t, writeLease(ctx, remote, other))
+	}
+	_, _, err = lockStore(ctx, "upload")
+	assert.ErrorIs(t, err, errLocked)
+	assert.ErrorContains(t, err, "laptop")
+
+	// is broken once expired
+	other.Expires = time.Now().Add(-time.Second)
+	for _, remote := range remotes[:2] {
+		require.NoError(t, writeLease(ctx, remote, other))
+	}
+	_, unlock, err = lockStore(ctx, "upload")
+	require.NoError(t, err)
+	lease, err = readLease(ctx, remotes[1])
+	require.NoError(t, err)
+	assert.NotEqual(t, "other", lease.Token)
+	unlock()
+
+	// or by hand
+	other.Expires = time.Now().Add(time.Hour)
+	require.NoError(t, writeLease(ctx, remotes[2], other))
+	require.NoError(t, BreakLock(true))
+	assert.FileExists(t, lockPath("streamc"))
+	require.NoError(t, BreakLock(false))
+	assert.NoFileExists(t, lockPath("streamc"))
+}
+
+func TestLockStoreLost(t *testing.T) {
+	setupStreamRemotes(t)
+	ctx := context.Background()
+	remotes := configuredRemotes()
+
+	opCtx, unlock, err := lockStore(ctx, "upload")
+	require.NoError(t, err)
+	defer unlock()
+	require.NoError(t, session.renewOnce())
+
+	// another machine broke the lease and took it
+	other := Lease{Node: "other", Host: "laptop", PID: 42, Token: "other", Operation: "upload", Acquired: time.Now(), Expires: time.Now().Add(time.Hour)}
+	for _, remote := range remotes[:2] {
+		require.NoError(t, writeLease(ctx, remote, other))
+	}
+	lost := session.renewOnce()
+	assert.ErrorIs(t, lost, errLeaseLost)
+	lease, err := readLease(ctx, remotes[0])
+	require.NoError(t, err)
+	assert.Equal(t, "other", lease.Token)
+
+	// which cancels the operation
+	session.cancel(lost)
+	<-opCtx.Done()
+	assert.ErrorIs(t, context.Cause(opCtx), errLeaseLost)
+}
+
+func TestHoldStoreLock(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	lockPath := filepath.Join(dir, "streama", remoteDirectory, lockObject)
+	oldHold := lockHold
+	lockHold = time.Hour
+	HoldStoreLock()
+	defer func() {
+		ReleaseStoreLock()
+		lockMu.Lock()
+		lockHeld, lockHold = 0, oldHold
+		lockMu.Unlock()
+	}()
+
+	// the lease outlives the operations, which share it
+	_, unlock, err := lockStore(ctx, "mkdir")
+	require.NoError(t, err)
+	lease, err := readLease(ctx, configuredRemotes()[0])
+	require.NoError(t, err)
+	unlock()
+	assert.FileExists(t, lockPath)
+	_, unlock, err = lockStore(ctx, "upload")
+	require.NoError(t, err)
+	again, err := readLease(ctx, configuredRemotes()[0])
+	require.NoError(t, err)
+	assert.Equal(t, lease.Token, again.Token)
+	unlock()
+
+	ReleaseStoreLock()
+	assert.NoFileExists(t, lockPath)
+}
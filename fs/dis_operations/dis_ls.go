@@ -1,40 +1,66 @@
 package dis_operations
 
 import (
-	"encoding/json"
-	"fmt"
-	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
-// return filename
+// return filenames sorted by path.
+// files uploaded as part of a directory are listed with their relative path
 func Dis_ls() ([]string, error) {
+	syncMetadata()
 
-	//rclonePath := GetRcloneDirPath()
-
-	//remote->local sync
-	//err := dis_config.SyncAnyRemoteToLocal(rclonePath)
-	//fmt.Printf("dis_ls err : %s\n", err)
-
-	FilePath := getJsonFilePath()
-
-	// 파일 열기
-	file, err := os.Open(FilePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open file : %v", err)
-	}
-	defer file.Close()
-
-	var data map[string]FileInfo
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&data)
+	data, err := readDatamap()
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode JSON: %v", err)
+		return nil, err
 	}
 
 	var fileNames []string
-	for fileName := range data {
+	for fileName, info := range data {
+		if info.IsDir || isChunkEntry(fileName) {
+			continue
+		}
 		fileNames = append(fileNames, fileName)
 	}
+	sort.Strings(fileNames)
 
 	return fileNames, nil
 }
+
+// returning the entries directly inside the directory dirName, or all entries
+// below it when recursive is set. An empty dirName is the root of the namespace.
+func Dis_lsDir(dirName string, recursive bool) ([]FileInfo, error) {
+	if strings.Trim(filepath.ToSlash(dirName), "/.") != "" {
+		logicalPath, err := NormalizeLogicalPath(dirName)
+		if err != nil {
+			return nil, err
+		}
+		dirName = logicalPath
+	} else {
+		dirName = ""
+	}
+	return ListDir(dirName, recursive)
+}
+
+// returning every retained version of the file name, newest first, or of
+// every file below it if it is a directory. An empty name lists every file.
+func Dis_lsVersions(name string) ([]FileInfo, error) {
+	syncMetadata()
+	if strings.Trim(filepath.ToSlash(name), "/.") != "" {
+		return FileVersions(name)
+	}
+	fileNames, err := Dis_ls()
+	if err != nil {
+		return nil, err
+	}
+	var versions []FileInfo
+	for _, fileName := range fileNames {
+		history, err := FileVersions(fileName)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, history...)
+	}
+	return versions, nil
+}
@@ -0,0 +1,718 @@
+package dis_operations
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/object"
+)
+
+// Metadata replication
+//
+// The datamap is published to the remotes as a manifest, an object stored
+// next to the shards in the Distribution directory of every remote. It is
+// sealed by a key derived from the master key and carries the keyring in the
+// clear, so another machine with the same remotes configured can open it
+// with the passphrase alone.
+//
+// Every machine has its own node ID. The manifest records for each entry the
+// change which last wrote it, the node and its counter, and a version vector
+// counting the changes of every node it has seen. Removed entries are kept as
+// tombstones so removals are replicated too. Changes seen by only one of two
+// manifests are kept. Concurrent changes of the same entry on different
+// machines conflict: the latest one becomes the current version and the
+// other one is retained as an earlier version of it, so neither is lost to
+// a clock set wrong. A change always wins over a concurrent removal. The
+// machine which settles a conflict publishes the result as a change of its
+// own.
+//
+// A sync reads the manifest of every remote, publishes the local changes made
+// since the last sync, merges everything and writes the result back to the
+// remotes. Reads and writes both need a majority of the remotes, so a sync
+// always sees the manifest written by the previous one. The local changes are
+// committed and the merged ones applied in a single transaction of the
+// metadata store.
+const (
+	manifestMagic   = "DISMANI\x01"
+	manifestObject  = "dis_manifest"
+	maxManifestSize = 256 << 20
+)
+
+var errNoQuorum = errors.New("not enough remotes reachable")
+
+// quorum returns the number of remotes out of n which make a majority
+func quorum(n int) int {
+	return n/2 + 1
+}
+
+// VersionVector counts the changes of every node
+type VersionVector map[string]uint64
+
+// covers returns true if v has seen change counter of node
+func (v VersionVector) covers(node string, counter uint64) bool {
+	return v[node] >= counter
+}
+
+// merge returns the version vector which has seen the changes of v and other
+func (v VersionVector) merge(other VersionVector) VersionVector {
+	out := make(VersionVector, len(v))
+	for node, counter := range v {
+		out[node] = counter
+	}
+	for node, counter := range other {
+		if counter > out[node] {
+			out[node] = counter
+		}
+	}
+	return out
+}
+
+// equal returns true if v and other have seen the same changes
+func (v VersionVector) equal(other VersionVector) bool {
+	if len(v) != len(other) {
+		return false
+	}
+	for node, counter := range v {
+		if other[node] != counter {
+			return false
+		}
+	}
+	return true
+}
+
+// ManifestEntry is the last change of an entry of the datamap
+type ManifestEntry struct {
+	// Info is nil once the entry is removed
+	Info *FileInfo `json:"info,omitempty"`
+	// Node and Counter identify the change
+	Node    string    `json:"node"`
+	Counter uint64    `json:"counter"`
+	Time    time.Time `json:"time"`
+}
+
+// sameChange returns true if e and other were written by the same change
+func (e ManifestEntry) sameChange(other ManifestEntry) bool {
+	return e.Node == other.Node && e.Counter == other.Counter
+}
+
+// Manifest is the datamap as published to the remotes
+type Manifest struct {
+	Clock   VersionVector            `json:"clock"`
+	Entries map[string]ManifestEntry `json:"entries"`
+}
+
+func newManifest() Manifest {
+	return Manifest{Clock: make(VersionVector), Entries: make(map[string]ManifestEntry)}
+}
+
+func (m Manifest) clone() Manifest {
+	out := Manifest{Clock: m.Clock.merge(nil), Entries: make(map[string]ManifestEntry, len(m.Entries))}
+	for name, entry := range m.Entries {
+		out.Entries[name] = entry
+	}
+	return out
+}
+
+// manifestState is what is kept locally: the ID of this machine and the
+// manifest it last synced
+type manifestState struct {
+	Node     string   `json:"node"`
+	Manifest Manifest `json:"manifest"`
+}
+
+// loadManifestState returns the manifest state, giving this machine its
+// node ID on first use
+func loadManifestState() (*manifestState, error) {
+	state, err := readManifestState()
+	if err != nil || state != nil {
+		return state, err
+	}
+	node, err := newFileID()
+	if err != nil {
+		return nil, err
+	}
+	state = &manifestState{Node: node, Manifest: newManifest()}
+	return state, writeManifestState(state)
+}
+
+// manifestEnvelope is the object stored on the remotes
+type manifestEnvelope struct {
+	KeyRing KeyRing `json:"keyring"`
+	// Manifest is the Manifest sealed by the manifest key
+	Manifest []byte `json:"manifest"`
+}
+
+// manifestKeyOf derives the key sealing the manifest from master
+func manifestKeyOf(master *[32]byte) *[32]byte {
+	mac := hmac.New(sha256.New, master[:])
+	_, _ = mac.Write([]byte("dis manifest"))
+	return toKey(mac.Sum(nil))
+}
+
+// publishedInfo returns info as published, without the state of an
+// operation in progress on this machine
+func publishedInfo(info FileInfo) FileInfo {
+	info.Flag = false
+	info.State = ""
+	info.RefCount = 0
+	if info.DistributedFileInfos != nil {
+		dFiles := make(map[string]DistributedFile, len(info.DistributedFileInfos))
+		for key, dFile := range info.DistributedFileInfos {
+			dFile.Check = false
+			dFiles[key] = dFile
+		}
+		info.DistributedFileInfos = dFiles
+	}
+	return info
+}
+
+// samePublished returns true if entry holds info as published
+func samePublished(entry ManifestEntry, info FileInfo) bool {
+	if entry.Info == nil {
+		return false
+	}
+	a, errA := json.Marshal(entry.Info)
+	b, errB := json.Marshal(publishedInfo(info))
+	return errA == nil && errB == nil && bytes.Equal(a, b)
+}
+
+// commit returns the manifest last synced with the changes made to files
+// since, all recorded as a single change of this node, and how many entries
+// changed. Entries an operation is in progress on are left as they were.
+func (s *manifestState) commit(files map[string]FileInfo, now time.Time) (Manifest, int) {
+	m := s.Manifest.clone()
+	counter := m.Clock[s.Node] + 1
+	changes := 0
+	for name, info := range files {
+		if info.Flag {
+			continue
+		}
+		if entry, ok := m.Entries[name]; ok && samePublished(entry, info) {
+			continue
+		}
+		published := publishedInfo(info)
+		m.Entries[name] = ManifestEntry{Info: &published, Node: s.Node, Counter: counter, Time: now}
+		changes++
+	}
+	for name, entry := range m.Entries {
+		if _, ok := files[name]; !ok && entry.Info != nil {
+			m.Entries[name] = ManifestEntry{Node: s.Node, Counter: counter, Time: now}
+			changes++
+		}
+	}
+	if changes > 0 {
+		m.Clock[s.Node] = counter
+	}
+	return m, changes
+}
+
+// mergeManifests returns the manifest holding the changes of a and b and
+// the names of the entries changed concurrently in both, see resolveConflict
+func mergeManifests(a, b Manifest) (Manifest, []string) {
+	out := Manifest{Clock: a.Clock.merge(b.Clock), Entries: make(map[string]ManifestEntry, len(a.Entries))}
+	var conflicts []string
+	for name, ea := range a.Entries {
+		eb, ok := b.Entries[name]
+		switch {
+		case !ok || ea.sameChange(eb):
+			out.Entries[name] = ea
+		case b.Clock.covers(ea.Node, ea.Counter):
+			out.Entries[name] = eb
+		case a.Clock.covers(eb.Node, eb.Counter):
+			out.Entries[name] = ea
+		default:
+			entry, conflict := resolveConflict(ea, eb)
+			out.Entries[name] = entry
+			if conflict {
+				conflicts = append(conflicts, name)
+			}
+		}
+	}
+	for name, eb := range b.Entries {
+		if _, ok := a.Entries[name]; !ok {
+			out.Entries[name] = eb
+		}
+	}
+	sort.Strings(conflicts)
+	return out, conflicts
+}
+
+// resolveConflict returns the entry settling the concurrent changes a and b
+// of the same entry and false if they made the same change. The latest
+// change stays current and the other one is kept as an earlier version of
+// it, a removal loses against a change. Every machine settles a conflict the
+// same way.
+func resolveConflict(a, b ManifestEntry) (ManifestEntry, bool) {
+	if b.Node > a.Node || (b.Node == a.Node && b.Counter > a.Counter) {
+		a, b = b, a
+	}
+	switch {
+	case sameInfo(a.Info, b.Info):
+		return a, false
+	case b.Info == nil:
+		return a, true
+	case a.Info == nil:
+		return b, true
+	}
+	latest, other := a, b
+	if other.Time.After(latest.Time) {
+		latest, other = other, latest
+	}
+	if latest.Info.IsDir || other.Info.IsDir {
+		return latest, true
+	}
+	info := *latest.Info
+	info.Versions = mergeVersions(latest.Info.Versions, other.Info.history())
+	latest.Info = &info
+	return latest, true
+}
+
+// sameInfo returns true if a and b hold the same published entry
+func sameInfo(a, b *FileInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	dataA, errA := json.Marshal(a)
+	dataB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(dataA, dataB)
+}
+
+// mergeVersions returns the versions of a and b without duplicates, newest
+// first
+func mergeVersions(a, b []FileInfo) []FileInfo {
+	out := make([]FileInfo, 0, len(a)+len(b))
+	seen := make(map[string]bool, len(a)+len(b))
+	for _, version := range append(append([]FileInfo(nil), a...), b...) {
+		version = publishedInfo(version)
+		data, err := json.Marshal(version)
+		if err == nil && seen[string(data)] {
+			continue
+		}
+		seen[string(data)] = true
+		out = append(out, version)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Uploaded().After(out[j].Uploaded())
+	})
+	return out
+}
+
+// encodeManifest seals m with master for the keyring ring
+func encodeManifest(m Manifest, ring *KeyRing, master *[32]byte) ([]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	env := manifestEnvelope{KeyRing: *ring}
+	if env.Manifest, err = seal(manifestKeyOf(master), data); err != nil {
+		return nil, err
+	}
+	envData, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(manifestMagic), envData...), nil
+}
+
+// decodeManifestEnvelope decodes the manifest object data
+func decodeManifestEnvelope(data []byte) (*manifestEnvelope, error) {
+	if !bytes.HasPrefix(data, []byte(manifestMagic)) {
+		return nil, errors.New("not a dis manifest")
+	}
+	env := &manifestEnvelope{}
+	if err := json.Unmarshal(data[len(manifestMagic):], env); err != nil {
+		return nil, fmt.Errorf("bad manifest: %w", err)
+	}
+	return env, nil
+}
+
+// open unseals the manifest of env with master
+func (env *manifestEnvelope) open(master *[32]byte) (Manifest, error) {
+	m := newManifest()
+	data, err := unseal(manifestKeyOf(master), env.Manifest)
+	if err != nil {
+		return m, fmt.Errorf("manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("bad manifest: %w", err)
+	}
+	if m.Clock == nil {
+		m.Clock = make(VersionVector)
+	}
+	if m.Entries == nil {
+		m.Entries = make(map[string]ManifestEntry)
+	}
+	return m, nil
+}
+
+// readRemoteManifest reads the manifest envelope on remote, nil if it has
+// none yet
+func readRemoteManifest(ctx context.Context, remote Remote) (*manifestEnvelope, error) {
+	f, err := getShardFs(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := f.NewObject(ctx, manifestObject)
+	if errors.Is(err, fs.ErrorObjectNotFound) || errors.Is(err, fs.ErrorDirNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	in, err := obj.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	data, err := io.ReadAll(io.LimitReader(in, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxManifestSize {
+		return nil, errors.New("manifest too big")
+	}
+	return decodeManifestEnvelope(data)
+}
+
+// writeRemoteManifest replaces the manifest on remote by data
+func writeRemoteManifest(ctx context.Context, remote Remote, data []byte) error {
+	f, err := getShardFs(ctx, remote)
+	if err != nil {
+		return err
+	}
+	info := object.NewStaticObjectInfo(manifestObject, time.Now(), int64(len(data)), true, nil, f)
+	_, err = f.Put(ctx, bytes.NewReader(data), info)
+	return err
+}
+
+// remoteManifest is the manifest read on a remote
+type remoteManifest struct {
+	remote Remote
+	// env is nil if the remote has no manifest yet
+	env      *manifestEnvelope
+	manifest Manifest
+	err      error
+}
+
+// manifestMasters unlocks the keyrings manifests are sealed under
+type manifestMasters struct {
+	local      *KeyRing
+	passphrase func() (string, error)
+	masters    map[string]*[32]byte
+}
+
+// master returns the master key of ring
+func (k *manifestMasters) master(ring *KeyRing) (*[32]byte, error) {
+	salt := string(ring.Salt)
+	if master, ok := k.masters[salt]; ok {
+		return master, nil
+	}
+	isLocal := k.local != nil && bytes.Equal(ring.Salt, k.local.Salt) && ring.Version == k.local.Version
+	if cached, version := cachedMasterKey(); isLocal && cached != nil && version == ring.Version {
+		k.masters[salt] = cached
+		return cached, nil
+	}
+	passphrase, err := k.passphrase()
+	if err != nil {
+		return nil, err
+	}
+	master, err := unlockKeyRing(passphrase, ring)
+	if err != nil {
+		return nil, fmt.Errorf("keyring version %d: %w", ring.Version, err)
+	}
+	if isLocal {
+		setMasterKey(master, ring.Version)
+	}
+	k.masters[salt] = master
+	return master, nil
+}
+
+// adoptKeyRing replaces the local keyring by newest, published by another
+// machine, if it is more recent. The data keys of the local changes not
+// published yet are rewrapped by the new master key.
+func adoptKeyRing(keys *manifestMasters, newest *KeyRing, state *manifestState) error {
+	local := keys.local
+	if newest == nil || (local != nil && (newest.Version < local.Version || bytes.Equal(newest.Salt, local.Salt))) {
+		return nil
+	}
+	if local != nil && newest.Version == local.Version {
+		return errors.New("the keyring published on the remotes isn't the local one: export the keys on one machine with dis_key export and import them on the other")
+	}
+	master, err := keys.master(newest)
+	if err != nil {
+		return err
+	}
+
+	expectVersion := 0
+	var rewrap func(files map[string]FileInfo) error
+	if local != nil {
+		expectVersion = local.Version
+		oldMaster, err := keys.master(local)
+		if errors.Is(err, errWrongPassphrase) {
+			var passphrase string
+			if passphrase, err = getPassphrase(OldPassphraseEnv, "previous dis master key", false); err == nil {
+				oldMaster, err = unlockKeyRing(passphrase, local)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("local keyring: %w", err)
+		}
+		rewrap = func(files map[string]FileInfo) error {
+			for name, info := range files {
+				if entry, ok := state.Manifest.Entries[name]; ok && samePublished(entry, info) {
+					// published already, so replaced by the remote version
+					continue
+				}
+				err := info.eachVersion(func(v *FileInfo) error {
+					if len(v.WrappedKey) == 0 || v.KeyVersion != local.Version {
+						return nil
+					}
+					key, err := unseal(oldMaster, v.WrappedKey)
+					if err != nil {
+						return fmt.Errorf("data key of %s version %d: %w", name, v.VersionNumber(), err)
+					}
+					if v.WrappedKey, err = seal(master, key); err != nil {
+						return err
+					}
+					v.KeyVersion = newest.Version
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				files[name] = info
+			}
+			return nil
+		}
+	}
+	if err := writeKeyRing(newest, expectVersion, rewrap); err != nil {
+		return err
+	}
+	setMasterKey(master, newest.Version)
+	keys.local = newest
+	fmt.Printf("Adopted master key version %d published on the remotes\n", newest.Version)
+	return nil
+}
+
+// SyncMetadata publishes the local changes to the datamap to the remotes
+// and applies the changes published by other machines
+func SyncMetadata() error {
+	ctx := context.Background()
+	remotes := configuredRemotes()
+	if len(remotes) == 0 {
+		return nil
+	}
+	need := quorum(len(remotes))
+
+	results := make([]remoteManifest, len(remotes))
+	var wg sync.WaitGroup
+	for i, remote := range remotes {
+		i, remote := i, remote
+		results[i].remote = remote
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].env, results[i].err = readRemoteManifest(ctx, remote)
+		}()
+	}
+	wg.Wait()
+
+	local, err := readKeyRing()
+	if err != nil {
+		return err
+	}
+	state, err := loadManifestState()
+	if err != nil {
+		return err
+	}
+	keys := &manifestMasters{
+		local: local,
+		passphrase: sync.OnceValues(func() (string, error) {
+			return getPassphrase(PassphraseEnv, "dis master key", false)
+		}),
+		masters: make(map[string]*[32]byte),
+	}
+
+	// the keyring changes before anything sealed by it is read
+	var newest *KeyRing
+	for _, r := range results {
+		if r.err == nil && r.env != nil && (newest == nil || r.env.KeyRing.Version > newest.Version) {
+			newest = &r.env.KeyRing
+		}
+	}
+	if err := adoptKeyRing(keys, newest, state); err != nil {
+		return err
+	}
+
+	reached := 0
+	for i := range results {
+		r := &results[i]
+		if r.err == nil && r.env != nil {
+			master, err := keys.master(&r.env.KeyRing)
+			if err == nil {
+				r.manifest, err = r.env.open(master)
+			}
+			r.err = err
+		}
+		if r.err != nil {
+			fmt.Printf("Can't read the manifest on %s: %v\n", r.remote.Name, r.err)
+			continue
+		}
+		reached++
+	}
+	if reached < need {
+		return fmt.Errorf("%w: read the manifest on %d of %d remotes, %d needed", errNoQuorum, reached, len(remotes), need)
+	}
+
+	// publish, merge and apply in one transaction so no local change made
+	// meanwhile is lost
+	var (
+		merged    Manifest
+		conflicts []string
+		changes   int
+		applied   int
+		published bool
+	)
+	err = syncManifestState(func(state *manifestState, filesMap map[string]FileInfo) error {
+		now := time.Now()
+		var mine Manifest
+		mine, changes = state.commit(filesMap, now)
+		merged, conflicts, published = mine, nil, false
+		seen := make(map[string]bool)
+		for _, r := range results {
+			if r.err != nil || r.env == nil {
+				continue
+			}
+			published = true
+			var found []string
+			merged, found = mergeManifests(merged, r.manifest)
+			for _, name := range found {
+				if !seen[name] {
+					seen[name] = true
+					conflicts = append(conflicts, name)
+				}
+			}
+		}
+		// the settled conflicts are a change of this node, seeing both sides
+		if len(conflicts) > 0 {
+			counter := merged.Clock[state.Node] + 1
+			for _, name := range conflicts {
+				entry := merged.Entries[name]
+				entry.Node, entry.Counter, entry.Time = state.Node, counter, now
+				merged.Entries[name] = entry
+			}
+			merged.Clock[state.Node] = counter
+		}
+
+		// apply the changes made elsewhere
+		applied = 0
+		for name, entry := range merged.Entries {
+			if entry.sameChange(mine.Entries[name]) {
+				continue
+			}
+			if current, ok := filesMap[name]; ok && current.Flag {
+				fmt.Printf("Not updating %s, an operation on it is in progress\n", name)
+				continue
+			}
+			if entry.Info == nil {
+				if _, ok := filesMap[name]; !ok {
+					continue
+				}
+				delete(filesMap, name)
+			} else {
+				filesMap[name] = *entry.Info
+			}
+			applied++
+		}
+		state.Manifest = merged
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range conflicts {
+		fmt.Printf("%s was changed on several machines at once, keeping the latest change and the other one as an earlier version\n", name)
+	}
+
+	// nothing to publish yet
+	if !published && len(merged.Entries) == 0 {
+		return nil
+	}
+
+	acks := 0
+	var stale []Remote
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+		case r.env != nil && r.manifest.Clock.equal(merged.Clock):
+			acks++
+		default:
+			stale = append(stale, r.remote)
+		}
+	}
+	if len(stale) > 0 {
+		master, version, err := masterKey()
+		if err != nil {
+			return err
+		}
+		ring, err := readKeyRing()
+		if err != nil {
+			return err
+		}
+		if ring == nil || ring.Version != version {
+			return errKeyRingChanged
+		}
+		data, err := encodeManifest(merged, ring, master)
+		if err != nil {
+			return err
+		}
+		errs := make([]error, len(stale))
+		for i, remote := range stale {
+			i, remote := i, remote
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = writeRemoteManifest(ctx, remote, data)
+			}()
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				fmt.Printf("Can't write the manifest on %s: %v\n", stale[i].Name, err)
+				continue
+			}
+			acks++
+		}
+	}
+	if changes > 0 || applied > 0 {
+		fmt.Printf("Synced metadata with %d remotes: published %d changes, applied %d from other machines\n", acks, changes, applied)
+	}
+	if acks < need {
+		return fmt.Errorf("%w: wrote the manifest on %d of %d remotes, %d needed", errNoQuorum, acks, len(remotes), need)
+	}
+	return nil
+}
+
+// syncMetadata runs SyncMetadata, carrying on with the local metadata if it
+// fails. Nothing is done while the lock is held across operations, the
+// metadata is synced when it is released.
+func syncMetadata() {
+	if lockHeldAcross() {
+		return
+	}
+	if err := SyncMetadata(); err != nil {
+		fmt.Printf("Metadata not synced with the remotes: %v\n", err)
+	}
+}
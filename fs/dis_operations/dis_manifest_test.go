@@ -0,0 +1,155 @@
+package dis_operations
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeManifests(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	info := func(size int64) *FileInfo {
+		return &FileInfo{FileName: "f", FileSize: size}
+	}
+	base := newManifest()
+	base.Clock["a"] = 1
+	base.Entries["f"] = ManifestEntry{Info: info(1), Node: "a", Counter: 1, Time: t0}
+	base.Entries["g"] = ManifestEntry{Info: info(1), Node: "a", Counter: 1, Time: t0}
+
+	a := manifestState{Node: "a", Manifest: base}
+	b := manifestState{Node: "b", Manifest: base.clone()}
+
+	// a changes f, b removes g and adds h: no conflict
+	ma, changes := a.commit(map[string]FileInfo{"f": *info(2), "g": *info(1)}, t0.Add(time.Minute))
+	assert.Equal(t, 1, changes)
+	mb, changes := b.commit(map[string]FileInfo{"f": *info(1), "h": *info(3)}, t0.Add(time.Minute))
+	assert.Equal(t, 2, changes)
+
+	merged, conflicts := mergeManifests(ma, mb)
+	assert.Empty(t, conflicts)
+	assert.Equal(t, VersionVector{"a": 2, "b": 1}, merged.Clock)
+	assert.Equal(t, int64(2), merged.Entries["f"].Info.FileSize)
+	assert.Nil(t, merged.Entries["g"].Info)
+	assert.Equal(t, int64(3), merged.Entries["h"].Info.FileSize)
+	reverse, _ := mergeManifests(mb, ma)
+	assert.Equal(t, merged, reverse)
+
+	// both change f concurrently: the latest change is current and the
+	// other one retained
+	a.Manifest, b.Manifest = merged, merged.clone()
+	ma, _ = a.commit(map[string]FileInfo{"f": *info(4), "h": *info(3)}, t0.Add(2*time.Minute))
+	mb, _ = b.commit(map[string]FileInfo{"f": *info(5), "h": *info(3)}, t0.Add(3*time.Minute))
+	merged, conflicts = mergeManifests(ma, mb)
+	assert.Equal(t, []string{"f"}, conflicts)
+	assert.Equal(t, int64(5), merged.Entries["f"].Info.FileSize)
+	require.Len(t, merged.Entries["f"].Info.Versions, 1)
+	assert.Equal(t, int64(4), merged.Entries["f"].Info.Versions[0].FileSize)
+	reverse, _ = mergeManifests(mb, ma)
+	assert.Equal(t, merged, reverse)
+
+	// even when the clock of the machine with the newer change is behind
+	mb, _ = b.commit(map[string]FileInfo{"f": *info(5), "h": *info(3)}, t0)
+	merged, _ = mergeManifests(ma, mb)
+	assert.Equal(t, int64(4), merged.Entries["f"].Info.FileSize)
+	require.Len(t, merged.Entries["f"].Info.Versions, 1)
+	assert.Equal(t, int64(5), merged.Entries["f"].Info.Versions[0].FileSize)
+
+	// machines settling the same conflict agree
+	settled := merged.clone()
+	settledA, settledB := settled.Entries["f"], settled.Entries["f"]
+	settledA.Node, settledB.Node = "a", "b"
+	settled.Entries["f"] = settledA
+	other := settled.clone()
+	other.Entries["f"] = settledB
+	_, conflicts = mergeManifests(settled, other)
+	assert.Empty(t, conflicts)
+
+	// a change wins over a concurrent removal
+	ma, _ = a.commit(map[string]FileInfo{"h": *info(3)}, t0.Add(4*time.Minute))
+	mb, _ = b.commit(map[string]FileInfo{"f": *info(6), "h": *info(3)}, t0.Add(2*time.Minute))
+	merged, conflicts = mergeManifests(ma, mb)
+	assert.Equal(t, []string{"f"}, conflicts)
+	assert.Equal(t, int64(6), merged.Entries["f"].Info.FileSize)
+
+	// an operation in progress isn't published
+	_, changes = a.commit(map[string]FileInfo{"f": {FileName: "f", FileSize: 6, Flag: true}, "h": *info(3)}, t0)
+	assert.Equal(t, 0, changes)
+}
+
+func TestSyncMetadata(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	const name = "manifest_test/data.bin"
+
+	oldState, err := readManifestState()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if oldState != nil {
+			_ = writeManifestState(oldState)
+		}
+	})
+	require.NoError(t, writeManifestState(&manifestState{Node: "machine-a", Manifest: newManifest()}))
+
+	data := make([]byte, 100000)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "data.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	require.NoError(t, streamUploadFile(ctx, src, name, RoundRobin, ShardProfile{}))
+	require.NoError(t, ResetCheckFlag(name))
+	forget := func() {
+		require.NoError(t, updateDatamap(func(filesMap map[string]FileInfo) error {
+			delete(filesMap, name)
+			delete(filesMap, "manifest_test")
+			return nil
+		}))
+	}
+	defer forget()
+	require.NoError(t, SyncMetadata())
+	for _, remote := range []string{"streama", "streamb", "streamc"} {
+		assert.FileExists(t, filepath.Join(dir, remote, remoteDirectory, manifestObject))
+	}
+	stateA, err := readManifestState()
+	require.NoError(t, err)
+	uploaded, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+
+	// a second machine sharing the remotes gets the file
+	forget()
+	require.NoError(t, writeManifestState(&manifestState{Node: "machine-b", Manifest: newManifest()}))
+	require.NoError(t, SyncMetadata())
+	shared, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	assert.Equal(t, uploaded.FileID, shared.FileID)
+	assert.Equal(t, uploaded.WrappedKey, shared.WrappedKey)
+	out := t.TempDir()
+	require.NoError(t, streamDownloadFile(ctx, shared, out))
+	got, err := os.ReadFile(filepath.Join(out, "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// and removes it
+	forget()
+	require.NoError(t, SyncMetadata())
+
+	// which the first machine learns on its next sync
+	require.NoError(t, updateDatamap(func(filesMap map[string]FileInfo) error {
+		filesMap[name] = uploaded
+		return nil
+	}))
+	require.NoError(t, writeManifestState(stateA))
+	require.NoError(t, SyncMetadata())
+	_, err = GetFileInfoStruct(name)
+	assert.Error(t, err)
+
+	// the manifest can't be read without the passphrase
+	sealed, err := os.ReadFile(filepath.Join(dir, "streama", remoteDirectory, manifestObject))
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), name)
+}
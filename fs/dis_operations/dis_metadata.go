@@ -2,6 +2,8 @@ package dis_operations
 
 import (
 	"fmt"
+	"os"
+	"time"
 )
 
 var remoteDirectory = "Distribution"
@@ -16,17 +18,40 @@ const (
 )
 
 // The Top Data Structure
+//
+// FileName is the logical path of the entry in the distributed namespace,
+// eg "photos/2024/a.jpg". Directories are stored with IsDir set and no shards.
 type FileInfo struct {
 	FileName             string                     `json:"original_file_name"`
+	FileID               string                     `json:"file_id,omitempty"`
+	IsDir                bool                       `json:"is_dir,omitempty"`
+	ModTime              time.Time                  `json:"mod_time"`
+	Mode                 os.FileMode                `json:"mode"`
 	FileSize             int64                      `json:"original_file_size"`
 	DisFileSize          int64                      `json:"distributed_file_size"`
 	Shard                int                        `json:"shard_count"`
 	Parity               int                        `json:"parity_count"`
+	LocalGroups          int                        `json:"local_groups,omitempty"`
 	Flag                 bool                       `json:"flag"`
 	State                string                     `json:"state"`
 	Checksum             string                     `json:"checksum"`
 	Padding              int64                      `json:"padding_amount"`
+	Format               string                     `json:"format,omitempty"`
+	Codec                string                     `json:"codec,omitempty"`
+	StripeSize           int                        `json:"stripe_size,omitempty"`
+	Profile              string                     `json:"profile,omitempty"`
+	WrappedKey           []byte                     `json:"wrapped_key,omitempty"`
+	KeyVersion           int                        `json:"key_version,omitempty"`
+	Version              int                        `json:"version,omitempty"`
+	UploadTime           time.Time                  `json:"upload_time"`
 	DistributedFileInfos map[string]DistributedFile `json:"distributed_file_infos"`
+	// Versions are the earlier uploads of the file which are retained,
+	// newest first, see dis_version.go
+	Versions []FileInfo `json:"versions,omitempty"`
+	// Chunks are the chunks of a chunked file in order, see dis_chunk.go
+	Chunks []ChunkRef `json:"chunks,omitempty"`
+	// RefCount is the number of file versions using a chunk entry
+	RefCount int `json:"ref_count,omitempty"`
 }
 
 type DistributedFile struct {
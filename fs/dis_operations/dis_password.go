@@ -28,43 +28,6 @@ func generateRandomPassword(length int) (string, error) {
 	return base64.URLEncoding.EncodeToString(bytes)[:length], nil
 }
 
-func tryGetPassword() string {
-	path := GetRcloneDirPath()
-	filePath := filepath.Join(path, "password.txt")
-
-	// If file exists, read and return the password
-	if _, err := os.Stat(filePath); err == nil {
-		data, err := os.ReadFile(filePath)
-		if err != nil {
-			fmt.Println("Error reading password file:", err)
-			return ""
-		}
-		return string(data)
-	}
-
-	// If it doesn't exist, create the directory
-	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-		fmt.Println("Error creating directories:", err)
-		return ""
-	}
-
-	// Generate a new random password
-	randomPassword, err := generateRandomPassword(16) // 16-character password
-	if err != nil {
-		fmt.Println("Error generating password:", err)
-		return ""
-	}
-
-	// Write the password to the file
-	err = os.WriteFile(filePath, []byte(randomPassword), 0600)
-	if err != nil {
-		fmt.Println("Error writing to password file:", err)
-		return ""
-	}
-
-	return randomPassword
-}
-
 func GetUserPassword() string {
 	path := GetRcloneDirPath()
 	filePath := filepath.Join(path, "user_password.txt")
@@ -0,0 +1,230 @@
+package dis_operations
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/config"
+)
+
+// Shard placement
+//
+// The shards of a file are spread so that losing a single remote never loses
+// more shards than the file has parity. Remotes can be tagged with failure
+// domains in rclone.conf, eg
+//
+//	[gdrive]
+//	type = drive
+//	dis_domain = google,asia
+//
+// and shards are spread evenly over the domains too, so a provider or region
+// going down takes as few shards as possible with it. A remote without tags
+// is in the domain of its backend type. Within those limits remotes get
+// shards in proportion to their weight, which depends on the load balancer:
+// upload or download throughput for UploadOptima and DownloadOptima, free
+// space for ResourceBased and the same for all with RoundRobin.
+const domainConfigKey = "dis_domain"
+
+// placementRemote is a remote which may receive shards
+type placementRemote struct {
+	remote  Remote
+	domains []string
+	weight  float64
+}
+
+// remoteDomains returns the failure domains of remote
+func remoteDomains(remote Remote) []string {
+	var domains []string
+	for _, tag := range strings.Split(config.GetValue(remote.Name, domainConfigKey), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			domains = append(domains, tag)
+		}
+	}
+	if len(domains) == 0 {
+		domains = []string{remote.Type}
+	}
+	return domains
+}
+
+// freeSpace returns the free space of remote, 0 if unknown
+func freeSpace(ctx context.Context, remote Remote) int64 {
+	f, err := cache.Get(ctx, remote.Name+":")
+	if err != nil {
+		return 0
+	}
+	free, err := getFreeStorage(f)
+	if err != nil {
+		return 0
+	}
+	return free
+}
+
+// placementCandidates returns the configured remotes, except those in
+// exclude, weighted for loadBalancer
+func placementCandidates(ctx context.Context, loadBalancer LoadBalancerType, exclude map[string]bool) ([]placementRemote, error) {
+	var candidates []placementRemote
+	for _, remote := range configuredRemotes() {
+		if !exclude[remote.Name] {
+			candidates = append(candidates, placementRemote{remote: remote, domains: remoteDomains(remote)})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no available remotes")
+	}
+
+	lbInfo, err := readLoadBalancerInfo()
+	if err != nil {
+		lbInfo = nil
+	}
+	switch loadBalancer {
+	case UploadOptima:
+		for i := range candidates {
+			if lbInfo != nil {
+				candidates[i].weight = lbInfo.RemoteInfos[candidates[i].remote.String()].AvgUpThroughput
+			}
+		}
+	case DownloadOptima:
+		for i := range candidates {
+			candidates[i].weight = downThroughput(lbInfo, candidates[i].remote)
+		}
+	case ResourceBased:
+		var wg sync.WaitGroup
+		for i := range candidates {
+			wg.Add(1)
+			go func(c *placementRemote) {
+				defer wg.Done()
+				c.weight = float64(freeSpace(ctx, c.remote))
+			}(&candidates[i])
+		}
+		wg.Wait()
+	default:
+		// starting at a different remote for every file
+		counter := 0
+		err := updateLoadBalancerInfo(func(lbInfo *LoadBalancerInfo) error {
+			counter = lbInfo.RoundRobinCounter
+			lbInfo.RoundRobinCounter++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		offset := counter % len(candidates)
+		candidates = append(candidates[offset:], candidates[:offset]...)
+	}
+
+	// remotes nothing is known about get the average weight
+	known, sum := 0, 0.0
+	for _, c := range candidates {
+		if c.weight > 0 {
+			known++
+			sum += c.weight
+		}
+	}
+	fallback := 1.0
+	if known > 0 {
+		fallback = sum / float64(known)
+	}
+	for i := range candidates {
+		if candidates[i].weight <= 0 {
+			candidates[i].weight = fallback
+		}
+	}
+	return candidates, nil
+}
+
+// placeShards picks a remote among candidates for each of count new shards
+// of a file which already has shards on existing.
+//
+// No remote gets more than maxPerRemote shards of the file. No failure domain
+// does either while another domain has room, and within that remotes are
+// filled in proportion to their weight.
+func placeShards(candidates []placementRemote, existing []Remote, count int, maxPerRemote int) ([]Remote, error) {
+	if maxPerRemote < 1 {
+		maxPerRemote = 1
+	}
+	load := make(map[string]int)
+	domainLoad := make(map[string]int)
+	for _, remote := range existing {
+		load[remote.Name]++
+		for _, domain := range remoteDomains(remote) {
+			domainLoad[domain]++
+		}
+	}
+
+	room := 0
+	for _, c := range candidates {
+		if free := maxPerRemote - load[c.remote.Name]; free > 0 {
+			room += free
+		}
+	}
+	if room < count {
+		return nil, fmt.Errorf("can't place %d shards with at most %d on each of %d remotes: add remotes or parity shards",
+			count+len(existing), maxPerRemote, len(candidates))
+	}
+
+	busiestDomain := func(c placementRemote) int {
+		busiest := 0
+		for _, domain := range c.domains {
+			if domainLoad[domain] > busiest {
+				busiest = domainLoad[domain]
+			}
+		}
+		return busiest
+	}
+	better := func(a, b placementRemote) bool {
+		if da, db := busiestDomain(a), busiestDomain(b); da != db {
+			return da < db
+		}
+		return float64(load[a.remote.Name]+1)/a.weight < float64(load[b.remote.Name]+1)/b.weight
+	}
+
+	placed := make([]Remote, 0, count)
+	for n := 0; n < count; n++ {
+		best := -1
+		// the domain limit is dropped only when no remote satisfies it
+		for pass := 0; pass < 2 && best < 0; pass++ {
+			for i, c := range candidates {
+				if load[c.remote.Name] >= maxPerRemote {
+					continue
+				}
+				if pass == 0 && busiestDomain(c) >= maxPerRemote {
+					continue
+				}
+				if best < 0 || better(c, candidates[best]) {
+					best = i
+				}
+			}
+		}
+		c := candidates[best]
+		load[c.remote.Name]++
+		for _, domain := range c.domains {
+			domainLoad[domain]++
+		}
+		placed = append(placed, c.remote)
+	}
+	return placed, nil
+}
+
+// PlaceShards picks the remotes for the shard data and parity shards of a
+// new file
+func PlaceShards(ctx context.Context, shard, parity int, loadBalancer LoadBalancerType) ([]Remote, error) {
+	candidates, err := placementCandidates(ctx, loadBalancer, nil)
+	if err != nil {
+		return nil, err
+	}
+	return placeShards(candidates, nil, shard+parity, parity)
+}
+
+// placeReplacements picks the remotes for count shards of a file being
+// rebuilt, the other shards of the file staying on existing. Remotes in
+// exclude are never picked.
+func placeReplacements(ctx context.Context, loadBalancer LoadBalancerType, existing []Remote, count, parity int, exclude map[string]bool) ([]Remote, error) {
+	candidates, err := placementCandidates(ctx, loadBalancer, exclude)
+	if err != nil {
+		return nil, err
+	}
+	return placeShards(candidates, existing, count, parity)
+}
@@ -0,0 +1,66 @@
+package dis_operations
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func countPlaced(remotes []Remote) map[string]int {
+	counts := make(map[string]int)
+	for _, remote := range remotes {
+		counts[remote.Name]++
+	}
+	return counts
+}
+
+func TestPlaceShards(t *testing.T) {
+	candidate := func(name, domain string, weight float64) placementRemote {
+		return placementRemote{remote: Remote{Name: name, Type: "local"}, domains: []string{domain}, weight: weight}
+	}
+
+	// a much faster remote still gets no more than parity shards
+	candidates := []placementRemote{
+		candidate("fast", "fast", 1000),
+		candidate("b", "b", 1),
+		candidate("c", "c", 1),
+		candidate("d", "d", 1),
+	}
+	placed, err := placeShards(candidates, nil, 8, 3)
+	require.NoError(t, err)
+	require.Len(t, placed, 8)
+	for remote, n := range countPlaced(placed) {
+		assert.LessOrEqual(t, n, 3, remote)
+	}
+
+	// shards are spread over domains before remotes of the same domain
+	candidates = []placementRemote{
+		candidate("a1", "aws", 1),
+		candidate("a2", "aws", 1),
+		candidate("a3", "aws", 1),
+		candidate("g1", "google", 1),
+		candidate("m1", "azure", 1),
+	}
+	placed, err = placeShards(candidates, nil, 6, 2)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"a1": 1, "a2": 1, "g1": 2, "m1": 2}, countPlaced(placed))
+
+	// within a domain the heavier remote is filled first
+	candidates = []placementRemote{
+		candidate("slow", "x", 1),
+		candidate("fast", "x", 3),
+	}
+	placed, err = placeShards(candidates, nil, 4, 3)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"fast": 3, "slow": 1}, countPlaced(placed))
+
+	// shards already placed count against the limit
+	placed, err = placeShards(candidates, []Remote{{Name: "fast", Type: "local"}}, 2, 2)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"fast": 1, "slow": 1}, countPlaced(placed))
+
+	// not enough remotes to keep the guarantee
+	_, err = placeShards(candidates, nil, 8, 3)
+	assert.Error(t, err)
+}
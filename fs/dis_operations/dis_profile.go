@@ -0,0 +1,158 @@
+package dis_operations
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/reedsolomon"
+)
+
+// Durability profiles
+//
+// A profile is the ratio of data to parity shards files are uploaded with.
+// Profiles are named in the dis_profiles section of rclone.conf, eg
+//
+//	[dis_profiles]
+//	archive = 10+6
+//	spread = 8+auto
+//	cold = 50+25+5
+//
+// where auto parity is derived from the number of remotes, see autoParity,
+// and a third number adds as many local parity shards, each covering a group
+// of the data shards, see reedsolomon.WithLocalParity.
+// Without a profile the ratio depends on the file size, see
+// reedsolomon.ShardsForSize.
+const profileSection = "dis_profiles"
+
+// name of the profile recorded for files uploaded with explicit shard counts
+const customProfile = "custom"
+
+// profiles available without any config, which the config may override
+var builtinProfiles = map[string]string{
+	"archive": "10+6",
+	"fast":    "4+2",
+}
+
+// ShardProfile chooses the number of data and parity shards of a file
+type ShardProfile struct {
+	// Name is recorded in the FileInfo, empty for the size based default
+	Name string
+	// Data and Parity are the shard counts, 0 for the size based default
+	Data   int
+	Parity int
+	// AutoParity derives Parity from the number of remotes
+	AutoParity bool
+	// LocalGroups is the number of groups of data shards given a local
+	// parity shard, 0 for none
+	LocalGroups int
+}
+
+// ParseShardProfile parses spec, the "data+parity" ratio of profile name,
+// optionally followed by "+local" groups. The parity may be "auto".
+func ParseShardProfile(name, spec string) (ShardProfile, error) {
+	dataSpec, paritySpec, ok := strings.Cut(strings.TrimSpace(spec), "+")
+	if !ok {
+		return ShardProfile{}, fmt.Errorf("profile %s: %q isn't of the form data+parity", name, spec)
+	}
+	paritySpec, localSpec, hasLocal := strings.Cut(paritySpec, "+")
+	profile := ShardProfile{Name: name}
+	var err error
+	if profile.Data, err = strconv.Atoi(strings.TrimSpace(dataSpec)); err != nil || profile.Data < 1 {
+		return ShardProfile{}, fmt.Errorf("profile %s: bad data shards %q", name, dataSpec)
+	}
+	if paritySpec = strings.TrimSpace(paritySpec); paritySpec == "auto" {
+		profile.AutoParity = true
+	} else if profile.Parity, err = strconv.Atoi(paritySpec); err != nil || profile.Parity < 1 {
+		return ShardProfile{}, fmt.Errorf("profile %s: bad parity shards %q", name, paritySpec)
+	}
+	if hasLocal {
+		if profile.LocalGroups, err = strconv.Atoi(strings.TrimSpace(localSpec)); err != nil || profile.LocalGroups < 1 {
+			return ShardProfile{}, fmt.Errorf("profile %s: bad local groups %q", name, localSpec)
+		}
+	}
+	return profile, nil
+}
+
+// GetShardProfile returns the profile called name from the config or, if
+// it isn't there, from the built in ones
+func GetShardProfile(name string) (ShardProfile, error) {
+	spec := config.GetValue(profileSection, name)
+	if spec == "" {
+		spec = builtinProfiles[name]
+	}
+	if spec == "" {
+		return ShardProfile{}, fmt.Errorf("durability profile %q not found in the [%s] config section", name, profileSection)
+	}
+	return ParseShardProfile(name, spec)
+}
+
+// ResolveShardProfile returns the profile for the dis_upload flags: the
+// profile called name if given, with data, parity and localGroups
+// overriding its counts when not 0 and autoParity its parity.
+func ResolveShardProfile(name string, data, parity, localGroups int, autoParity bool) (ShardProfile, error) {
+	var profile ShardProfile
+	if name != "" {
+		var err error
+		if profile, err = GetShardProfile(name); err != nil {
+			return ShardProfile{}, err
+		}
+	} else if data != 0 || parity != 0 || localGroups != 0 || autoParity {
+		profile.Name = customProfile
+	}
+	if data < 0 || parity < 0 || localGroups < 0 {
+		return ShardProfile{}, fmt.Errorf("shard counts can't be negative")
+	}
+	if data != 0 {
+		profile.Data = data
+	}
+	if parity != 0 {
+		profile.Parity = parity
+		profile.AutoParity = false
+	}
+	if localGroups != 0 {
+		profile.LocalGroups = localGroups
+	}
+	if autoParity {
+		profile.Parity = 0
+		profile.AutoParity = true
+	}
+	return profile, nil
+}
+
+// autoParity returns the least parity with which data shards can be spread
+// over remotes so that losing any one remote loses no more shards than
+// there is parity
+func autoParity(data, remotes int) (int, error) {
+	if remotes < 2 {
+		return 0, fmt.Errorf("parity can't be derived from %d remotes: at least 2 are needed", remotes)
+	}
+	return (data + remotes - 2) / (remotes - 1), nil
+}
+
+// Shards returns the data and parity shards of a file of fileSize bytes
+// uploaded to remotes remotes
+func (p ShardProfile) Shards(fileSize int64, remotes int) (data, parity int, err error) {
+	data, parity = reedsolomon.ShardsForSize(fileSize)
+	if p.Data > 0 {
+		data = p.Data
+		parity = (data + 1) / 2
+	}
+	if p.Parity > 0 {
+		parity = p.Parity
+	}
+	if p.AutoParity {
+		// local parity shards are spread like data shards
+		if parity, err = autoParity(data+p.LocalGroups, remotes); err != nil {
+			return 0, 0, err
+		}
+	}
+	if maxShards := reedsolomon.CodecLeopardGF16.MaxShards(); data+parity > maxShards {
+		return 0, 0, fmt.Errorf("%d data + %d parity shards: no more than %d shards are supported", data, parity, maxShards)
+	}
+	if p.LocalGroups > data {
+		return 0, 0, fmt.Errorf("%d local groups: no more than the %d data shards", p.LocalGroups, data)
+	}
+	return data, parity, nil
+}
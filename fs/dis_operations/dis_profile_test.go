@@ -0,0 +1,99 @@
+package dis_operations
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseShardProfile(t *testing.T) {
+	profile, err := ParseShardProfile("archive", "10+6")
+	require.NoError(t, err)
+	assert.Equal(t, ShardProfile{Name: "archive", Data: 10, Parity: 6}, profile)
+
+	profile, err = ParseShardProfile("spread", " 8 + auto ")
+	require.NoError(t, err)
+	assert.Equal(t, ShardProfile{Name: "spread", Data: 8, AutoParity: true}, profile)
+
+	profile, err = ParseShardProfile("cold", "50+25+5")
+	require.NoError(t, err)
+	assert.Equal(t, ShardProfile{Name: "cold", Data: 50, Parity: 25, LocalGroups: 5}, profile)
+
+	for _, spec := range []string{"10", "0+2", "4+0", "x+2", "4+y", "4+2+0", "4+2+z"} {
+		_, err = ParseShardProfile("bad", spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestResolveShardProfile(t *testing.T) {
+	t.Setenv("RCLONE_CONFIG_DIS_PROFILES_MINE", "6+auto")
+
+	profile, err := ResolveShardProfile("mine", 0, 0, 0, false)
+	require.NoError(t, err)
+	assert.Equal(t, ShardProfile{Name: "mine", Data: 6, AutoParity: true}, profile)
+
+	// flags override the profile
+	profile, err = ResolveShardProfile("mine", 0, 2, 0, false)
+	require.NoError(t, err)
+	assert.Equal(t, ShardProfile{Name: "mine", Data: 6, Parity: 2}, profile)
+
+	profile, err = ResolveShardProfile("fast", 0, 0, 0, false)
+	require.NoError(t, err)
+	assert.Equal(t, ShardProfile{Name: "fast", Data: 4, Parity: 2}, profile)
+
+	profile, err = ResolveShardProfile("", 3, 0, 0, false)
+	require.NoError(t, err)
+	assert.Equal(t, ShardProfile{Name: customProfile, Data: 3}, profile)
+
+	profile, err = ResolveShardProfile("", 0, 0, 0, false)
+	require.NoError(t, err)
+	assert.Equal(t, ShardProfile{}, profile)
+
+	_, err = ResolveShardProfile("missing", 0, 0, 0, false)
+	assert.Error(t, err)
+}
+
+func TestShardProfileShards(t *testing.T) {
+	// the size based default
+	data, parity, err := ShardProfile{}.Shards(1000, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []int{5, 3}, []int{data, parity})
+
+	data, parity, err = ShardProfile{Data: 7}.Shards(1000, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []int{7, 4}, []int{data, parity})
+
+	data, parity, err = ShardProfile{Data: 10, Parity: 6}.Shards(1000, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []int{10, 6}, []int{data, parity})
+
+	// any one of 3 remotes may be lost with 4 data shards spread 2+2+2
+	data, parity, err = ShardProfile{Data: 4, AutoParity: true}.Shards(1000, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []int{4, 2}, []int{data, parity})
+
+	data, parity, err = ShardProfile{Data: 8, AutoParity: true}.Shards(1000, 5)
+	require.NoError(t, err)
+	assert.Equal(t, []int{8, 2}, []int{data, parity})
+
+	_, _, err = ShardProfile{Data: 4, AutoParity: true}.Shards(1000, 1)
+	assert.Error(t, err)
+
+	// above 256 shards Leopard is used
+	data, parity, err = ShardProfile{Data: 200, Parity: 100}.Shards(1000, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []int{200, 100}, []int{data, parity})
+
+	_, _, err = ShardProfile{Data: 60000, Parity: 10000}.Shards(1000, 3)
+	assert.Error(t, err)
+
+	// local parity shards count as data for the auto parity: 4+2 data and
+	// local shards spread 3+3+3 with the parity
+	data, parity, err = ShardProfile{Data: 4, AutoParity: true, LocalGroups: 2}.Shards(1000, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []int{4, 3}, []int{data, parity})
+
+	_, _, err = ShardProfile{Data: 4, Parity: 2, LocalGroups: 5}.Shards(1000, 3)
+	assert.Error(t, err)
+}
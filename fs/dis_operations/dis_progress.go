@@ -0,0 +1,196 @@
+package dis_operations
+
+import (
+	"sync"
+	"time"
+)
+
+// Progress of the dis_* operations
+//
+// The operations report the state of every file and shard they work on to
+// the operation in progress, if one was started with startProgress, so that
+// the rc calls can return structured progress rather than the text printed.
+// The operations of a process run one at a time, see rcRun.
+
+// States of files and shards reported
+const (
+	stateUploading   = "uploading"
+	stateUploaded    = "uploaded"
+	stateSkipped     = "skipped"
+	stateDownloading = "downloading"
+	stateDownloaded  = "downloaded"
+	stateRemoved     = "removed"
+	stateDeleted     = "deleted"
+	stateScrubbed    = "scrubbed"
+	stateRepaired    = "repaired"
+	stateFailed      = "failed"
+)
+
+// keepProgress is how many finished operations are remembered
+const keepProgress = 16
+
+// ShardState is the last state reported of a shard
+type ShardState struct {
+	File    string    `json:"file"`
+	Shard   string    `json:"shard"`
+	Remote  string    `json:"remote"`
+	State   string    `json:"state"`
+	Error   string    `json:"error,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// FileState is the last state reported of a file
+type FileState struct {
+	Name    string    `json:"name"`
+	State   string    `json:"state"`
+	Error   string    `json:"error,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// Progress is the progress of an operation
+type Progress struct {
+	ID        int64        `json:"id"`
+	JobID     int64        `json:"jobid,omitempty"`
+	Operation string       `json:"operation"`
+	Args      []string     `json:"args"`
+	Started   time.Time    `json:"started"`
+	Finished  bool         `json:"finished"`
+	Ended     time.Time    `json:"ended"`
+	Error     string       `json:"error,omitempty"`
+	Files     []FileState  `json:"files"`
+	Shards    []ShardState `json:"shards"`
+
+	files  map[string]int
+	shards map[string]int
+}
+
+var (
+	progressMu      sync.Mutex
+	lastProgressID  int64
+	currentProgress *Progress
+	pastProgress    []*Progress
+)
+
+// startProgress starts recording the progress of operation, run with args
+// for the rc job jobID, 0 if none
+func startProgress(operation string, args []string, jobID int64) *Progress {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	lastProgressID++
+	currentProgress = &Progress{
+		ID:        lastProgressID,
+		JobID:     jobID,
+		Operation: operation,
+		Args:      args,
+		Started:   time.Now(),
+		Files:     []FileState{},
+		Shards:    []ShardState{},
+		files:     make(map[string]int),
+		shards:    make(map[string]int),
+	}
+	return currentProgress
+}
+
+// finish ends the operation p with the error err
+func (p *Progress) finish(err error) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	p.Finished = true
+	p.Ended = time.Now()
+	if err != nil {
+		p.Error = err.Error()
+	}
+	if currentProgress == p {
+		currentProgress = nil
+	}
+	pastProgress = append(pastProgress, p)
+	if len(pastProgress) > keepProgress {
+		pastProgress = pastProgress[len(pastProgress)-keepProgress:]
+	}
+}
+
+// snapshot returns a copy of p which isn't updated any more
+func (p *Progress) snapshot() Progress {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	c := *p
+	c.Files = append([]FileState(nil), p.Files...)
+	c.Shards = append([]ShardState(nil), p.Shards...)
+	c.files, c.shards = nil, nil
+	return c
+}
+
+// errorString returns the message of err, "" if nil
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// reportFile records the state of the file name, stateFailed if err is set
+func reportFile(name, state string, err error) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	p := currentProgress
+	if p == nil {
+		return
+	}
+	if err != nil {
+		state = stateFailed
+	}
+	fileState := FileState{Name: name, State: state, Error: errorString(err), Updated: time.Now()}
+	if i, ok := p.files[name]; ok {
+		p.Files[i] = fileState
+		return
+	}
+	p.files[name] = len(p.Files)
+	p.Files = append(p.Files, fileState)
+}
+
+// reportShard records the state of the shard dFile of the file name,
+// stateFailed if err is set
+func reportShard(name string, dFile DistributedFile, state string, err error) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	p := currentProgress
+	if p == nil {
+		return
+	}
+	if err != nil {
+		state = stateFailed
+	}
+	shardState := ShardState{
+		File:    name,
+		Shard:   dFile.DistributedFile,
+		Remote:  dFile.Remote.Name,
+		State:   state,
+		Error:   errorString(err),
+		Updated: time.Now(),
+	}
+	key := dFile.Remote.Name + ":" + dFile.DistributedFile
+	if i, ok := p.shards[key]; ok {
+		p.Shards[i] = shardState
+		return
+	}
+	p.shards[key] = len(p.Shards)
+	p.Shards = append(p.Shards, shardState)
+}
+
+// findProgress returns the operation id, the one in progress or the last
+// if id is 0, or the one of the rc job jobID if that isn't 0
+func findProgress(id, jobID int64) *Progress {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	all := append(append([]*Progress(nil), pastProgress...), currentProgress)
+	for i := len(all) - 1; i >= 0; i-- {
+		p := all[i]
+		if p == nil {
+			continue
+		}
+		if id == 0 && jobID == 0 || id != 0 && p.ID == id || jobID != 0 && p.JobID == jobID {
+			return p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package dis_operations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// RebalanceMove is a shard relocation planned by dis_rebalance
+type RebalanceMove struct {
+	FileName string
+	Shard    string
+	From     Remote
+	To       Remote
+	// Regenerate is set when From is no longer configured, so the shard is
+	// rebuilt from the other shards of the file instead of being moved
+	Regenerate bool
+}
+
+func (m RebalanceMove) String() string {
+	if m.Regenerate {
+		return fmt.Sprintf("regenerate %s on %s (%s was removed)", m.Shard, m.To.Name, m.From.Name)
+	}
+	return fmt.Sprintf("move %s from %s to %s", m.Shard, m.From.Name, m.To.Name)
+}
+
+// StoreBackend is the type of the remotes which mount the store, see
+// backend/distributed. They hold no shards.
+const StoreBackend = "distributed"
+
+// shardRemotes returns the remotes of the config shards are stored on, in
+// config order
+func shardRemotes() []config.Remote {
+	var remotes []config.Remote
+	for _, remote := range config.GetRemotes() {
+		if remote.Type != StoreBackend {
+			remotes = append(remotes, remote)
+		}
+	}
+	return remotes
+}
+
+// configuredRemotes returns the remotes of the config in config order
+func configuredRemotes() []Remote {
+	var remotes []Remote
+	for _, remote := range shardRemotes() {
+		remotes = append(remotes, Remote{Name: remote.Name, Type: remote.Type})
+	}
+	return remotes
+}
+
+// planRebalance plans the moves which bring the shards of files onto
+// remotes so that no remote holds more than its fair share, the total
+// number of shards divided by the number of remotes rounded up, and no
+// shard is left on a remote which isn't configured any more.
+//
+// Targets are the remotes holding the fewest shards, preferring those
+// holding the fewest shards of the same file. As on upload no remote gets more
+// shards of a file than the file has parity.
+func planRebalance(files map[string]FileInfo, remotes []Remote) ([]RebalanceMove, error) {
+	if len(remotes) == 0 {
+		return nil, errors.New("no available remotes")
+	}
+
+	type shardRef struct {
+		file  string
+		dFile DistributedFile
+	}
+
+	configured := make(map[string]bool, len(remotes))
+	for _, remote := range remotes {
+		configured[remote.Name] = true
+	}
+
+	var names []string
+	for name, info := range files {
+		if !info.IsDir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	counts := make(map[string]int)
+	// shards per file per remote
+	perFile := make(map[string]map[string]int)
+	byRemote := make(map[string][]shardRef)
+	var orphans []shardRef
+	total := 0
+	for _, name := range names {
+		perFile[name] = make(map[string]int)
+		dFiles := make([]DistributedFile, 0, len(files[name].DistributedFileInfos))
+		for _, dFile := range files[name].DistributedFileInfos {
+			dFiles = append(dFiles, dFile)
+		}
+		sort.Slice(dFiles, func(i, j int) bool {
+			return dFiles[i].DistributedFile < dFiles[j].DistributedFile
+		})
+		for _, dFile := range dFiles {
+			total++
+			ref := shardRef{file: name, dFile: dFile}
+			if !configured[dFile.Remote.Name] {
+				orphans = append(orphans, ref)
+				continue
+			}
+			counts[dFile.Remote.Name]++
+			perFile[name][dFile.Remote.Name]++
+			byRemote[dFile.Remote.Name] = append(byRemote[dFile.Remote.Name], ref)
+		}
+	}
+	fairShare := (total + len(remotes) - 1) / len(remotes)
+
+	// the least loaded remote other than exclude with room for file
+	target := func(file, exclude string) (Remote, bool) {
+		var best Remote
+		found := false
+		maxPerRemote := max(files[file].Parity, 1)
+		for _, remote := range remotes {
+			if remote.Name == exclude || perFile[file][remote.Name] >= maxPerRemote {
+				continue
+			}
+			if !found || counts[remote.Name] < counts[best.Name] ||
+				(counts[remote.Name] == counts[best.Name] && perFile[file][remote.Name] < perFile[file][best.Name]) {
+				best = remote
+				found = true
+			}
+		}
+		return best, found
+	}
+
+	var moves []RebalanceMove
+	for _, ref := range orphans {
+		to, ok := target(ref.file, "")
+		if !ok {
+			fmt.Printf("No remote can take %s without holding more shards than %s has parity\n", ref.dFile.DistributedFile, ref.file)
+			continue
+		}
+		counts[to.Name]++
+		perFile[ref.file][to.Name]++
+		moves = append(moves, RebalanceMove{FileName: ref.file, Shard: ref.dFile.DistributedFile, From: ref.dFile.Remote, To: to, Regenerate: true})
+	}
+
+	for _, from := range remotes {
+		refs := byRemote[from.Name]
+		// moving shards of the files most concentrated on this remote first
+		sort.SliceStable(refs, func(i, j int) bool {
+			return perFile[refs[i].file][from.Name] > perFile[refs[j].file][from.Name]
+		})
+		for _, ref := range refs {
+			if counts[from.Name] <= fairShare {
+				break
+			}
+			to, ok := target(ref.file, from.Name)
+			if !ok {
+				continue
+			}
+			if counts[to.Name]+1 > fairShare {
+				break
+			}
+			counts[from.Name]--
+			perFile[ref.file][from.Name]--
+			counts[to.Name]++
+			perFile[ref.file][to.Name]++
+			moves = append(moves, RebalanceMove{FileName: ref.file, Shard: ref.dFile.DistributedFile, From: ref.dFile.Remote, To: to})
+		}
+	}
+	return moves, nil
+}
+
+// PlanRebalance compares the current shard placement with the configured
+// remotes and returns the moves needed to rebalance it
+func PlanRebalance() ([]RebalanceMove, error) {
+	files, err := readDatamap()
+	if err != nil {
+		return nil, err
+	}
+	return planRebalance(files, configuredRemotes())
+}
+
+// Dis_Rebalance moves or regenerates shards so that every remote holds its
+// fair share and no shard is left on a removed remote. With --dry-run the
+// planned moves are only listed.
+func Dis_Rebalance(ctx context.Context) error {
+	if !fs.GetConfig(ctx).DryRun {
+		var unlock func()
+		var err error
+		ctx, unlock, err = lockStore(ctx, "rebalance")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	syncMetadata()
+	moves, err := PlanRebalance()
+	if err != nil {
+		return err
+	}
+	if len(moves) == 0 {
+		fmt.Println("Shards are balanced, nothing to do")
+		return nil
+	}
+
+	for _, move := range moves {
+		fmt.Printf("Planned: %s: %v\n", move.FileName, move)
+	}
+	if fs.GetConfig(ctx).DryRun {
+		fmt.Printf("Dry run: %d moves planned\n", len(moves))
+		return nil
+	}
+
+	// grouping regenerations per file so the file is decoded only once
+	regenerate := make(map[string][]RebalanceMove)
+	var fileOrder []string
+	var errs []error
+	for _, move := range moves {
+		if move.Regenerate {
+			if _, ok := regenerate[move.FileName]; !ok {
+				fileOrder = append(fileOrder, move.FileName)
+			}
+			regenerate[move.FileName] = append(regenerate[move.FileName], move)
+			continue
+		}
+		if err := moveShard(ctx, move); err != nil {
+			fmt.Printf("Failed to %v: %v\n", move, err)
+			errs = append(errs, err)
+		}
+	}
+	for _, name := range fileOrder {
+		if err := regenerateShards(ctx, name, regenerate[name]); err != nil {
+			fmt.Printf("Failed to regenerate shards of %s: %v\n", name, err)
+			errs = append(errs, err)
+		}
+	}
+
+	fmt.Printf("Rebalanced %d shards, %d failed\n", len(moves)-len(errs), len(errs))
+	syncMetadata()
+	return errors.Join(errs...)
+}
+
+// moveShard moves a shard between two configured remotes and records its
+// new place
+func moveShard(ctx context.Context, move RebalanceMove) error {
+	fsrc, err := getShardFs(ctx, move.From)
+	if err != nil {
+		return err
+	}
+	fdst, err := getShardFs(ctx, move.To)
+	if err != nil {
+		return err
+	}
+	hashedFileName, err := CalculateHash(move.Shard)
+	if err != nil {
+		return err
+	}
+	obj, err := fsrc.NewObject(ctx, hashedFileName)
+	if err != nil {
+		return fmt.Errorf("shard %s on %s: %w", move.Shard, move.From.Name, err)
+	}
+	if _, err := operations.Move(ctx, fdst, nil, hashedFileName, obj); err != nil {
+		return err
+	}
+
+	err = updateDistributedFile(move.FileName, move.Shard, func(dFile *DistributedFile) error {
+		dFile.Remote = move.To
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Moved %s from %s to %s\n", move.Shard, move.From.Name, move.To.Name)
+	return nil
+}
+
+// regenerateShards rebuilds the shards of fileName which were on removed
+// remotes onto the remotes planned for them
+func regenerateShards(ctx context.Context, fileName string, moves []RebalanceMove) error {
+	info, err := GetFileInfoStruct(fileName)
+	if err != nil {
+		return err
+	}
+	shards := shardsByIndex(info)
+
+	targets := make(map[string]Remote, len(moves))
+	for _, move := range moves {
+		targets[move.Shard] = move.To
+	}
+	statuses := make([]string, len(shards))
+	for i, dFile := range shards {
+		statuses[i] = shardOK
+		if _, ok := targets[dFile.DistributedFile]; ok {
+			statuses[i] = shardUnreachable
+		}
+	}
+
+	pick := func(i int, dFile *DistributedFile) error {
+		to, ok := targets[dFile.DistributedFile]
+		if !ok {
+			return fmt.Errorf("no target planned for %s", dFile.DistributedFile)
+		}
+		dFile.Remote = to
+		return nil
+	}
+	_, err = repairShards(ctx, info, shards, statuses, pick)
+	return err
+}
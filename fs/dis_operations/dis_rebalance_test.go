@@ -0,0 +1,125 @@
+package dis_operations
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeRebalanceFile(name string, remotes ...Remote) FileInfo {
+	info := FileInfo{FileName: name, Parity: 2, DistributedFileInfos: make(map[string]DistributedFile)}
+	for i, remote := range remotes {
+		shard := fmt.Sprintf("%s%s.%d", name, fileCryptExtension, i)
+		info.DistributedFileInfos[shard] = DistributedFile{DistributedFile: shard, Remote: remote}
+	}
+	return info
+}
+
+func TestPlanRebalance(t *testing.T) {
+	a := Remote{Name: "a", Type: "local"}
+	b := Remote{Name: "b", Type: "local"}
+	c := Remote{Name: "c", Type: "local"}
+	gone := Remote{Name: "gone", Type: "drive"}
+
+	// balanced already
+	files := map[string]FileInfo{
+		"x": makeRebalanceFile("x", a, b, c),
+		"d": {FileName: "d", IsDir: true},
+	}
+	moves, err := planRebalance(files, []Remote{a, b, c})
+	require.NoError(t, err)
+	assert.Empty(t, moves)
+
+	// a new remote takes its fair share from the loaded ones
+	files = map[string]FileInfo{
+		"x": makeRebalanceFile("x", a, a, b, b),
+		"y": makeRebalanceFile("y", a, a, b, b),
+	}
+	moves, err = planRebalance(files, []Remote{a, b, c})
+	require.NoError(t, err)
+	counts := map[string]int{"a": 4, "b": 4}
+	for _, move := range moves {
+		assert.False(t, move.Regenerate)
+		assert.Equal(t, "c", move.To.Name)
+		counts[move.From.Name]--
+		counts[move.To.Name]++
+	}
+	assert.Equal(t, map[string]int{"a": 3, "b": 3, "c": 2}, counts)
+
+	// shards on a removed remote are regenerated elsewhere
+	files = map[string]FileInfo{
+		"x": makeRebalanceFile("x", a, b, gone),
+	}
+	moves, err = planRebalance(files, []Remote{a, b, c})
+	require.NoError(t, err)
+	require.Len(t, moves, 1)
+	assert.True(t, moves[0].Regenerate)
+	assert.Equal(t, "x"+fileCryptExtension+".2", moves[0].Shard)
+	assert.Equal(t, "c", moves[0].To.Name)
+
+	_, err = planRebalance(files, nil)
+	assert.Error(t, err)
+}
+
+func TestRebalanceRemovedRemote(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	const name = "rebalance_test/data.bin"
+
+	data := bytes.Repeat([]byte("rebalance"), 20000)
+	src := filepath.Join(dir, "data.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	require.NoError(t, streamUploadFile(ctx, src, name, RoundRobin, ShardProfile{}))
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+	}()
+
+	// other tests may have left entries in the datamap
+	planFor := func() []RebalanceMove {
+		moves, err := PlanRebalance()
+		require.NoError(t, err)
+		var own []RebalanceMove
+		for _, move := range moves {
+			if move.FileName == name {
+				own = append(own, move)
+			}
+		}
+		return own
+	}
+
+	// streamc is replaced by streamd, the two left couldn't hold every shard
+	t.Setenv("RCLONE_CONFIG_STREAMD_TYPE", "alias")
+	t.Setenv("RCLONE_CONFIG_STREAMD_REMOTE", filepath.Join(dir, "streamd"))
+	require.NoError(t, os.Unsetenv("RCLONE_CONFIG_STREAMC_TYPE"))
+	moves := planFor()
+	require.NotEmpty(t, moves)
+	for _, move := range moves {
+		assert.True(t, move.Regenerate)
+	}
+	require.NoError(t, regenerateShards(ctx, name, moves))
+
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	perRemote := make(map[string]int)
+	for _, dFile := range info.DistributedFileInfos {
+		assert.NotEqual(t, "streamc", dFile.Remote.Name)
+		perRemote[dFile.Remote.Name]++
+	}
+	for remote, n := range perRemote {
+		assert.LessOrEqual(t, n, info.Parity, remote)
+	}
+
+	out := t.TempDir()
+	require.NoError(t, streamDownloadFile(ctx, info, out))
+	got, err := os.ReadFile(filepath.Join(out, "data.bin"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+
+	assert.Empty(t, planFor())
+}
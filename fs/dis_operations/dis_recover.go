@@ -0,0 +1,445 @@
+package dis_operations
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/rclone/rclone/fs"
+	"golang.org/x/sync/errgroup"
+)
+
+// Disaster recovery
+//
+// Every sealed shard carries in its envelope the keyring parameters, the
+// wrapped data key of its file and its sealed ShardHeader, so with the
+// passphrase the datamap can be rebuilt from nothing but the Distribution
+// directories of the remotes. Shards of the legacy and stream formats don't
+// describe themselves and can't be recovered. The chunks of chunked files
+// are recovered but the list of chunks of each file only comes back with
+// the manifest, see dis_manifest.go.
+
+// RecoverReport sums up what dis_recover found on the remotes
+type RecoverReport struct {
+	Remotes int
+	// Shards is the number of sealed shards read
+	Shards int
+	// Recovered are the files added to the datamap
+	Recovered []string
+	// Known are the files found which were in the datamap already
+	Known []string
+	// Incomplete are the files with fewer shards than needed to rebuild them
+	Incomplete []string
+	// Stale is the number of shards left by interrupted or replaced uploads
+	// of a file
+	Stale int
+	// Unsealed is the number of objects which aren't sealed shards
+	Unsealed int
+	// Locked is the number of shards sealed under an unknown passphrase
+	Locked int
+	// Misplaced is the number of shards stored under another shard's name
+	Misplaced int
+}
+
+func (r RecoverReport) String() string {
+	return fmt.Sprintf("Read %d sealed shards on %d remotes: %d files recovered, %d already known, %d incomplete, %d stale shards, %d objects not sealed, %d shards under an unknown passphrase, %d misplaced",
+		r.Shards, r.Remotes, len(r.Recovered), len(r.Known), len(r.Incomplete), r.Stale, r.Unsealed, r.Locked, r.Misplaced)
+}
+
+// foundShard is a sealed shard read on a remote
+type foundShard struct {
+	remote Remote
+	env    *shardEnvelope
+}
+
+// recoveredFile gathers the shards of one upload of a file
+type recoveredFile struct {
+	header  ShardHeader
+	dataKey []byte
+	shards  map[int]Remote
+}
+
+// shardKeys unlocks the keyrings found in shard envelopes with the
+// passphrases of the user, asking for each keyring only once
+type shardKeys struct {
+	passphrase string
+	masters    map[string]*[32]byte
+	locked     map[string]bool
+	// current are the keyrings unlocked by passphrase
+	current map[string]bool
+}
+
+// master returns the master key of ring, nil if no passphrase unlocks it
+func (k *shardKeys) master(ring *KeyRing) *[32]byte {
+	salt := hex.EncodeToString(ring.Salt)
+	if master, ok := k.masters[salt]; ok || k.locked[salt] {
+		return master
+	}
+	master, err := unlockKeyRing(k.passphrase, ring)
+	if err == nil {
+		k.current[salt] = true
+	} else if errors.Is(err, errWrongPassphrase) {
+		name := fmt.Sprintf("earlier dis master key (version %d)", ring.Version)
+		var passphrase string
+		if passphrase, err = getPassphrase(OldPassphraseEnv, name, false); err == nil {
+			master, err = unlockKeyRing(passphrase, ring)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Can't unlock the keyring of version %d: %v\n", ring.Version, err)
+		k.locked[salt] = true
+		return nil
+	}
+	k.masters[salt] = master
+	return master
+}
+
+// listSealedShards reads the envelope of every object in the Distribution
+// directory of remote
+func listSealedShards(ctx context.Context, remote Remote, found func(name string, env *shardEnvelope)) (unsealed int, err error) {
+	f, err := getShardFs(ctx, remote)
+	if err != nil {
+		return 0, err
+	}
+	entries, err := f.List(ctx, "")
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %s: %w", remote.Name, err)
+	}
+
+	var mu sync.Mutex
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(fs.GetConfig(ctx).Checkers)
+	for _, entry := range entries {
+		obj, ok := entry.(fs.Object)
+		if !ok || obj.Remote() == manifestObject || obj.Remote() == lockObject {
+			continue
+		}
+		g.Go(func() error {
+			in, err := obj.Open(gCtx, &fs.RangeOption{Start: 0, End: int64(len(shardMagic)) + 4 + maxEnvelopeSize - 1})
+			if err != nil {
+				return fmt.Errorf("failed to open %s on %s: %w", obj.Remote(), remote.Name, err)
+			}
+			env, _, err := readShardEnvelope(in)
+			_ = in.Close()
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				unsealed++
+				return nil
+			}
+			found(obj.Remote(), env)
+			return nil
+		})
+	}
+	return unsealed, g.Wait()
+}
+
+// recoveryMasterKey returns the master key new wrapped data keys are made
+// with. Without a local keyring the most recent keyring of the shards
+// unlocked by the passphrase is adopted, or a new one made if there is none,
+// and stored unless dryRun is set.
+func recoveryMasterKey(keys *shardKeys, shards []foundShard, dryRun bool) (*[32]byte, int, error) {
+	ring, err := readKeyRing()
+	if err != nil {
+		return nil, 0, err
+	}
+	if ring != nil {
+		master, err := unlockKeyRing(keys.passphrase, ring)
+		if err != nil {
+			return nil, 0, err
+		}
+		setMasterKey(master, ring.Version)
+		return master, ring.Version, nil
+	}
+
+	var adopted *KeyRing
+	for _, shard := range shards {
+		candidate := shard.env.KeyRing
+		if adopted != nil && candidate.Version <= adopted.Version {
+			continue
+		}
+		if keys.current[hex.EncodeToString(candidate.Salt)] {
+			adopted = &candidate
+		}
+	}
+	var master *[32]byte
+	if adopted != nil {
+		master = keys.master(adopted)
+		fmt.Printf("Adopting the keyring of version %d found on the remotes\n", adopted.Version)
+	} else if adopted, master, err = newKeyRing(keys.passphrase, 1); err != nil {
+		return nil, 0, err
+	}
+	if dryRun {
+		return master, adopted.Version, nil
+	}
+	if err := writeKeyRing(adopted, 0, nil); err != nil {
+		return nil, 0, err
+	}
+	setMasterKey(master, adopted.Version)
+	return master, adopted.Version, nil
+}
+
+// Dis_Recover rebuilds the datamap and the load balancer state from the
+// sealed shards on the configured remotes. Files already in the datamap are
+// left alone. With --dry-run nothing is written.
+func Dis_Recover(ctx context.Context) error {
+	dryRun := fs.GetConfig(ctx).DryRun
+	remotes := configuredRemotes()
+	if len(remotes) == 0 {
+		return errors.New("no available remotes")
+	}
+	if !dryRun {
+		var unlock func()
+		var err error
+		ctx, unlock, err = lockStore(ctx, "recover")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	report := RecoverReport{Remotes: len(remotes)}
+	var shards []foundShard
+	var names []string
+	for _, remote := range remotes {
+		fmt.Printf("Reading the shards on %s\n", remote.Name)
+		unsealed, err := listSealedShards(ctx, remote, func(name string, env *shardEnvelope) {
+			shards = append(shards, foundShard{remote: remote, env: env})
+			names = append(names, name)
+		})
+		if err != nil {
+			return err
+		}
+		report.Unsealed += unsealed
+	}
+	report.Shards = len(shards)
+
+	passphrase, err := getPassphrase(PassphraseEnv, "dis master key", false)
+	if err != nil {
+		return err
+	}
+	keys := &shardKeys{
+		passphrase: passphrase,
+		masters:    make(map[string]*[32]byte),
+		locked:     make(map[string]bool),
+		current:    make(map[string]bool),
+	}
+
+	// group the shards by upload
+	uploads := make(map[string]*recoveredFile)
+	for i, shard := range shards {
+		master := keys.master(&shard.env.KeyRing)
+		if master == nil {
+			report.Locked++
+			continue
+		}
+		dataKey, err := unseal(master, shard.env.WrappedKey)
+		if err != nil {
+			report.Locked++
+			continue
+		}
+		header, err := shard.env.openHeader(dataKey)
+		if err != nil {
+			report.Locked++
+			continue
+		}
+		want, err := CalculateHash(shardName(header.FileName, header.Version, header.Index))
+		if err != nil {
+			return err
+		}
+		if names[i] != want {
+			fmt.Printf("Skipping %s on %s: it holds shard %d of %s\n", names[i], shard.remote.Name, header.Index, header.FileName)
+			report.Misplaced++
+			continue
+		}
+		upload, ok := uploads[header.FileID]
+		if !ok {
+			upload = &recoveredFile{header: header, dataKey: dataKey, shards: make(map[int]Remote)}
+			uploads[header.FileID] = upload
+		}
+		if _, dup := upload.shards[header.Index]; !dup {
+			upload.shards[header.Index] = shard.remote
+		}
+	}
+
+	// the newest complete upload of each version of a file wins
+	type versionKey struct {
+		name    string
+		version int
+	}
+	latest := make(map[versionKey]*recoveredFile)
+	for _, upload := range uploads {
+		key := versionKey{upload.header.FileName, upload.header.Version}
+		best, ok := latest[key]
+		if ok && best.isBetter(upload) {
+			report.Stale += len(upload.shards)
+			continue
+		}
+		if ok {
+			report.Stale += len(best.shards)
+		}
+		latest[key] = upload
+	}
+	versions := make(map[string][]*recoveredFile)
+	for key, upload := range latest {
+		versions[key.name] = append(versions[key.name], upload)
+	}
+	fileNames := make([]string, 0, len(versions))
+	for name, uploads := range versions {
+		fileNames = append(fileNames, name)
+		sort.Slice(uploads, func(i, j int) bool {
+			return uploads[i].header.Version > uploads[j].header.Version
+		})
+	}
+	sort.Strings(fileNames)
+
+	master, keyVersion, err := recoveryMasterKey(keys, shards, dryRun)
+	if err != nil {
+		return err
+	}
+	recovered := make(map[string]FileInfo)
+	for _, name := range fileNames {
+		// the newest complete version is the current one, the older ones
+		// are kept as its versions
+		var history []FileInfo
+		stale := 0
+		for _, upload := range versions[name] {
+			if len(upload.shards) < upload.header.Shard {
+				stale += len(upload.shards)
+				continue
+			}
+			info, err := upload.fileInfo(master, keyVersion)
+			if err != nil {
+				return err
+			}
+			history = append(history, info)
+		}
+		if len(history) == 0 {
+			upload := versions[name][0]
+			fmt.Printf("%s: only %d of the %d shards needed were found\n", name, len(upload.shards), upload.header.Shard)
+			report.Incomplete = append(report.Incomplete, name)
+			continue
+		}
+		report.Stale += stale
+		info := history[0]
+		for _, version := range history[1:] {
+			info.Versions = append(info.Versions, publishedInfo(version))
+		}
+		recovered[name] = info
+	}
+
+	err = updateDatamap(func(filesMap map[string]FileInfo) error {
+		report.Recovered, report.Known = nil, nil
+		for _, name := range fileNames {
+			info, ok := recovered[name]
+			if !ok {
+				continue
+			}
+			if _, exists := filesMap[name]; exists {
+				report.Known = append(report.Known, name)
+				continue
+			}
+			if isChunkEntry(name) {
+				// not a path of the namespace
+			} else if err := addParentDirs(filesMap, name, info.ModTime); err != nil {
+				fmt.Printf("Skipping %v\n", err)
+				continue
+			}
+			filesMap[name] = info
+			report.Recovered = append(report.Recovered, name)
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return err
+	}
+	for _, name := range report.Recovered {
+		if dryRun {
+			fmt.Printf("Would recover %s\n", name)
+		} else {
+			fmt.Printf("Recovered %s\n", name)
+		}
+	}
+
+	if !dryRun {
+		err = updateLoadBalancerInfo(func(lbInfo *LoadBalancerInfo) error {
+			for _, remote := range remotes {
+				getRemoteInfo(remote, lbInfo)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		syncMetadata()
+	}
+
+	fmt.Println(report)
+	return nil
+}
+
+// errDryRun aborts the datamap transaction of a dry run
+var errDryRun = errors.New("dry run")
+
+// isBetter returns true if upload r should be kept over other for the same
+// file: a complete upload over an incomplete one, then the newest
+func (r *recoveredFile) isBetter(other *recoveredFile) bool {
+	complete, otherComplete := len(r.shards) >= r.header.Shard, len(other.shards) >= other.header.Shard
+	if complete != otherComplete {
+		return complete
+	}
+	return !other.header.ModTime.After(r.header.ModTime)
+}
+
+// fileInfo returns the datamap entry of r with its data key wrapped by
+// master of version
+func (r *recoveredFile) fileInfo(master *[32]byte, version int) (FileInfo, error) {
+	h := r.header
+	wrapped, err := seal(master, r.dataKey)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	cipher, err := dataKeyCipher(r.dataKey)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	dFileMap := make(map[string]DistributedFile, len(r.shards))
+	for index, remote := range r.shards {
+		dFile, err := GetDistributedInfo(shardName(h.FileName, h.Version, index), remote, "")
+		if err != nil {
+			return FileInfo{}, err
+		}
+		dFileMap[dFile.DistributedFile] = dFile
+	}
+	return FileInfo{
+		FileName:             h.FileName,
+		FileID:               h.FileID,
+		ModTime:              h.ModTime,
+		Mode:                 h.Mode,
+		FileSize:             h.FileSize,
+		DisFileSize:          h.ShardSize,
+		Shard:                h.Shard,
+		Parity:               h.Parity,
+		LocalGroups:          h.Local,
+		Codec:                h.Codec,
+		State:                "upload",
+		Padding:              h.ShardSize*int64(h.Shard) - cipher.EncryptedSize(h.FileSize),
+		Format:               formatSealed,
+		StripeSize:           h.StripeSize,
+		Profile:              h.Profile,
+		WrappedKey:           wrapped,
+		KeyVersion:           version,
+		Version:              h.Version,
+		UploadTime:           h.UploadTime,
+		DistributedFileInfos: dFileMap,
+	}, nil
+}
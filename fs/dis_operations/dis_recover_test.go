@@ -0,0 +1,82 @@
+package dis_operations
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecover(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	names := []string{"recover_test/a.bin", "recover_test/sub/b.bin"}
+
+	contents := make(map[string][]byte)
+	for i, name := range names {
+		data := make([]byte, 100000*(i+1))
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		contents[name] = data
+		src := filepath.Join(dir, filepath.Base(name))
+		require.NoError(t, os.WriteFile(src, data, 0644))
+		require.NoError(t, streamUploadFile(ctx, src, name, RoundRobin, ShardProfile{}))
+	}
+
+	before := make(map[string]FileInfo)
+	for _, name := range names {
+		info, err := GetFileInfoStruct(name)
+		require.NoError(t, err)
+		before[name] = info
+	}
+
+	// lose the datamap
+	forget := func() {
+		require.NoError(t, updateDatamap(func(filesMap map[string]FileInfo) error {
+			for name := range filesMap {
+				if isUnder(name, "recover_test") || name == "recover_test" {
+					delete(filesMap, name)
+				}
+			}
+			return nil
+		}))
+	}
+	forget()
+	defer forget()
+	_, err := GetFileInfoStruct(names[0])
+	require.Error(t, err)
+
+	require.NoError(t, Dis_Recover(context.Background()))
+
+	for _, name := range names {
+		info, err := GetFileInfoStruct(name)
+		require.NoError(t, err, name)
+		want := before[name]
+		assert.Equal(t, want.FileID, info.FileID)
+		assert.Equal(t, want.FileSize, info.FileSize)
+		assert.Equal(t, want.DisFileSize, info.DisFileSize)
+		assert.Equal(t, want.Padding, info.Padding)
+		assert.Equal(t, want.StripeSize, info.StripeSize)
+		assert.True(t, want.ModTime.Equal(info.ModTime))
+		require.Len(t, info.DistributedFileInfos, len(want.DistributedFileInfos))
+		for key, dFile := range want.DistributedFileInfos {
+			assert.Equal(t, dFile.Remote, info.DistributedFileInfos[key].Remote)
+		}
+
+		out := t.TempDir()
+		require.NoError(t, streamDownloadFile(ctx, info, out))
+		got, err := os.ReadFile(filepath.Join(out, filepath.Base(name)))
+		require.NoError(t, err)
+		assert.Equal(t, contents[name], got)
+	}
+	dir1, err := GetFileInfoStruct("recover_test/sub")
+	require.NoError(t, err)
+	assert.True(t, dir1.IsDir)
+
+	// a second run finds nothing new
+	require.NoError(t, Dis_Recover(context.Background()))
+}
@@ -13,19 +13,53 @@ import (
 
 var PERM_DEL_FLAG = "--drive-use-trash=false"
 
-func Dis_rm(arg []string, reSignal bool) (err error) {
-	//rclonePath := GetRcloneDirPath()
+func Dis_rm(ctx context.Context, arg []string, reSignal bool) (err error) {
+	ctx, unlock, err := lockStore(ctx, "rm")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	syncMetadata()
+
+	originalFileName, err := NormalizeLogicalPath(arg[0])
+	if err != nil {
+		return err
+	}
 
-	//remote->local sync
-	//err = dis_config.SyncAnyRemoteToLocal(rclonePath)
-	//if err != nil {
-	//	return err
-	//}
+	exists, err := DoesFileStructExist(originalFileName)
+	if err != nil {
+		return err
+	}
 
-	originalFileName := arg[0]
+	if !exists {
+		// target may be a directory
+		if _, err := ListDir(originalFileName, true); err != nil {
+			return fmt.Errorf("file name '%s' not found", originalFileName)
+		}
+		fileNames, err := GetFileNamesInDir(originalFileName)
+		if err != nil {
+			return err
+		}
+		for _, fileName := range fileNames {
+			if err := disRmFile(ctx, fileName, reSignal); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", fileName, err)
+			}
+		}
+		return RemoveDirFromMetadata(originalFileName)
+	}
+
+	return disRmFile(ctx, originalFileName, reSignal)
+}
+
+// removing every shard of every version of a single distributed file and its
+// datamap entry
+func disRmFile(ctx context.Context, originalFileName string, reSignal bool) (err error) {
+	defer func() {
+		reportFile(originalFileName, stateRemoved, err)
+	}()
 	var distributedFileArray []DistributedFile
 
-	_, err = GetFileInfoStruct(originalFileName)
+	fileInfo, err := GetFileInfoStruct(originalFileName)
 	if err != nil {
 		return err
 	}
@@ -53,6 +87,9 @@ func Dis_rm(arg []string, reSignal bool) (err error) {
 	if err := startRmFileGoroutine(originalFileName, distributedFileArray); err != nil {
 		return err
 	}
+	if err := removeVersions(ctx, originalFileName, fileInfo.Versions); err != nil {
+		return fmt.Errorf("failed to delete the earlier versions: %w", err)
+	}
 
 	elapsed := time.Since(start)
 	fmt.Printf("Time taken for dis_rm: %s\n", elapsed)
@@ -65,12 +102,12 @@ func Dis_rm(arg []string, reSignal bool) (err error) {
 	if err != nil {
 		return fmt.Errorf("failed to remove file from metadata: %v", err)
 	}
+	if _, err := collectChunks(ctx); err != nil {
+		return err
+	}
 
 	fmt.Printf("Successfully deleted all parts of %s and updated metadata.\n", originalFileName)
-	//err = dis_config.SyncAllLocalToRemote(rclonePath)
-	//if err != nil {
-	//	return err
-	//}
+	syncMetadata()
 
 	return nil
 }
@@ -117,7 +154,10 @@ func startRmFileGoroutine(originalFileName string, distributedFileArray []Distri
 			remotePath := fmt.Sprintf("%s:%s/%s", info.Remote.Name, remoteDirectory, hashedFileName)
 
 			if err := remoteCallDeleteFile([]string{PERM_DEL_FLAG, remotePath}); err != nil {
+				reportShard(originalFileName, info, stateDeleted, err)
 				errCh <- fmt.Errorf("failed to delete %s on remote %s: %w", info.DistributedFile, info.Remote.Name, err)
+			} else {
+				reportShard(originalFileName, info, stateDeleted, nil)
 			}
 
 			// Update flags
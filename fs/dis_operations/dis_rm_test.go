@@ -1,76 +1,138 @@
 package dis_operations
 
 import (
+	"context"
+	"crypto/rand"
 	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
-type MockGetDistributedFile struct {
-	mock.Mock
+// shardFileExists returns true if the shard dFile is on its remote below dir
+func shardFileExists(t *testing.T, dir string, dFile DistributedFile) bool {
+	hashedFileName, err := CalculateHash(dFile.DistributedFile)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, dFile.Remote.Name, remoteDirectory, hashedFileName))
+	return err == nil
 }
 
-func (m *MockGetDistributedFile) GetDistributedFile() ([]string, error) {
-	args := m.Called()
-	return args.Get(0).([]string), args.Error(1)
-}
-
-// Mock for deleteFileDefinition.Execute
-type MockCommand struct {
-	mock.Mock
-}
-
-func (m *MockCommand) Execute() error {
-	args := m.Called()
-	return args.Error(0)
+// chunkCount returns the number of chunks stored
+func chunkCount(t *testing.T) (n int) {
+	files, err := readDatamap()
+	require.NoError(t, err)
+	for name := range files {
+		if isChunkEntry(name) {
+			n++
+		}
+	}
+	return n
 }
 
 func TestDisrm_Success(t *testing.T) {
-	// Setup mocks
-	mockCmd := new(MockCommand)
-	deleteFileDefinition = &cobra.Command{
-		Run: func(command *cobra.Command, args []string) {
-			// Call the mock's Execute method
-			mockCmd.Execute()
-		},
+	dir := setupStreamRemotes(t)
+	smallChunks(t)
+	ctx := context.Background()
+	const name, copyName = "rm_test/data.bin", "rm_test/copy.bin"
+
+	data := make([]byte, 200000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "data.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	upload := func(name string) {
+		require.NoError(t, disUploadFile(ctx, src, name, false, RoundRobin, ShardProfile{}, nil))
+		require.NoError(t, ResetCheckFlag(name))
 	}
-	mockCmd.On("Execute").Return(nil)
 
-	// Test case
-	args := []string{"picture.jpg"}
-	err := Dis_rm(args, false)
+	// two versions of name and a copy sharing their chunks
+	upload(name)
+	data[0]++
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	upload(name)
+	upload(copyName)
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	require.Equal(t, 2, info.VersionNumber())
+	require.Len(t, info.Versions, 1)
+	chunks := chunkCount(t)
+	require.NotZero(t, chunks)
+
+	// every version goes, the chunks the copy uses stay
+	require.NoError(t, Dis_rm(ctx, []string{name}, false))
+	_, err = GetFileInfoStruct(name)
+	assert.Error(t, err)
+	versions, err := FileVersions(name)
+	assert.True(t, err != nil || len(versions) == 0)
+	remaining := chunkCount(t)
+	assert.NotZero(t, remaining)
+	assert.Less(t, remaining, chunks, "the chunks only the first version used are collected")
+	copyInfo, err := GetFileInfoStruct(copyName)
+	require.NoError(t, err)
+	got, err := readFile(t, copyInfo, 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
 
-	// Assertions
-	assert.NoError(t, err, "Expected no error on successful file deletion")
-	mockCmd.AssertCalled(t, "Execute")
+	// the last file using them takes the chunks and their shards along
+	files, err := readDatamap()
+	require.NoError(t, err)
+	var shards []DistributedFile
+	for entryName, entry := range files {
+		if isChunkEntry(entryName) {
+			for _, dFile := range entry.DistributedFileInfos {
+				shards = append(shards, dFile)
+			}
+		}
+	}
+	require.NoError(t, Dis_rm(ctx, []string{copyName}, false))
+	assert.Zero(t, chunkCount(t))
+	for _, dFile := range shards {
+		assert.False(t, shardFileExists(t, dir, dFile), dFile.DistributedFile)
+	}
 }
 
 func TestDisRemove_FileNotFound(t *testing.T) {
+	setupStreamRemotes(t)
 
-	// Test case
-	args := []string{"file4"}
-	err := Dis_rm(args, false)
-
-	// Assertions
-	assert.Error(t, err, "Expected an error when file is not found")
-	assert.Equal(t, "file4 not found", err.Error())
+	err := Dis_rm(context.Background(), []string{"file4"}, false)
+	assert.EqualError(t, err, "file name 'file4' not found")
 }
 
 func TestDisRemove_ExecutionError(t *testing.T) {
-	// Setup mocks
-	mockCmd := new(MockCommand)
-	deleteFileDefinition = &cobra.Command{}
-	mockCmd.On("Execute").Return(errors.New("execution failed"))
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	const name = "rm_test/sealed.bin"
+
+	src := filepath.Join(dir, "sealed.bin")
+	require.NoError(t, os.WriteFile(src, []byte("sealed shards"), 0644))
+	require.NoError(t, streamUploadFile(ctx, src, name, RoundRobin, ShardProfile{}))
+	require.NoError(t, ResetCheckFlag(name))
 
-	// Test case
-	args := []string{"file1"}
-	err := Dis_rm(args, false)
+	oldDefinition := deleteFileDefinition
+	deleteFileDefinition = &cobra.Command{
+		RunE: func(command *cobra.Command, args []string) error {
+			return errors.New("execution failed")
+		},
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	t.Cleanup(func() {
+		deleteFileDefinition = oldDefinition
+	})
 
-	// Assertions
-	assert.Error(t, err, "Expected an error when execution fails")
-	assert.Contains(t, err.Error(), "error executing copyCommand")
-	mockCmd.AssertCalled(t, "Execute")
+	// the entry stays, marked for the next command to finish removing it
+	err := Dis_rm(ctx, []string{name}, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "error executing deleteCommand")
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	assert.True(t, info.Flag)
+	assert.Equal(t, "rm", info.State)
+	for _, dFile := range info.DistributedFileInfos {
+		assert.True(t, shardFileExists(t, dir, dFile), dFile.DistributedFile)
+	}
 }
@@ -0,0 +1,265 @@
+package dis_operations
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Download scheduling
+//
+// Reed-Solomon only needs Shard of the Shard+Parity shards of a file, so
+// downloads start with the Shard shards on the fastest remotes. A shard which
+// takes hedgeFactor times longer than its remote's throughput predicts gets a
+// hedged request for a spare shard, and whatever is still running once
+// enough verified shards are in is cancelled.
+const (
+	hedgeFactor = 3
+	// never hedge before this
+	hedgeMinDelay = 2 * time.Second
+	// used for remotes without any recorded download
+	hedgeDefaultDelay = 10 * time.Second
+	// how often running downloads are checked against their deadline
+	hedgeCheckInterval = 250 * time.Millisecond
+)
+
+// shardsByIndex returns the shards of info indexed by shard number. Shards
+// which aren't recorded are left empty.
+func shardsByIndex(info FileInfo) []DistributedFile {
+	shards := make([]DistributedFile, info.shardCount())
+	for _, dFile := range info.DistributedFileInfos {
+		idx, err := shardIndexOf(dFile.DistributedFile)
+		if err != nil || idx >= len(shards) {
+			fmt.Printf("Skipping shard %s: %v\n", dFile.DistributedFile, err)
+			continue
+		}
+		shards[idx] = dFile
+	}
+	return shards
+}
+
+// downThroughput returns the average download throughput of remote in Kbps,
+// 0 if unknown
+func downThroughput(lbInfo *LoadBalancerInfo, remote Remote) float64 {
+	if lbInfo == nil {
+		return 0
+	}
+	return lbInfo.RemoteInfos[remote.String()].AvgDownThroughput
+}
+
+// shardOrder returns the indexes of the recorded shards, fastest remote first.
+// Remotes without a recorded download come last, and data shards go before
+// parity shards on remotes equally fast.
+func shardOrder(shards []DistributedFile, lbInfo *LoadBalancerInfo) []int {
+	order := make([]int, 0, len(shards))
+	for i, dFile := range shards {
+		if dFile.DistributedFile != "" {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return downThroughput(lbInfo, shards[order[a]].Remote) > downThroughput(lbInfo, shards[order[b]].Remote)
+	})
+	return order
+}
+
+// localParityLast moves the local parity shards of info to the end of
+// order: only they can't stand in for any missing shard
+func localParityLast(info FileInfo, order []int) []int {
+	global := info.Shard + info.Parity
+	sort.SliceStable(order, func(a, b int) bool {
+		return order[a] < global && order[b] >= global
+	})
+	return order
+}
+
+// hedgeDelay returns how long reading size bytes at kbps may take before
+// a hedged request is sent
+func hedgeDelay(size int64, kbps float64) time.Duration {
+	if kbps <= 0 {
+		return hedgeDefaultDelay
+	}
+	expected := time.Duration(float64(size) * 8 / 1e3 / kbps * float64(time.Second))
+	if delay := hedgeFactor * expected; delay > hedgeMinDelay {
+		return delay
+	}
+	return hedgeMinDelay
+}
+
+// fetchShard downloads the whole shard dFile to localPath and checks it
+// against its recorded checksum
+func fetchShard(ctx context.Context, dFile DistributedFile, localPath string) (err error) {
+	in, err := openShard(ctx, dFile, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	out, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && dFile.Checksum != "" && hex.EncodeToString(h.Sum(nil)) != dFile.Checksum {
+		err = fmt.Errorf("checksum mismatch for shard %s", dFile.DistributedFile)
+	}
+	if err != nil {
+		_ = os.Remove(localPath)
+	}
+	return err
+}
+
+// downloadShards downloads Shard verified shards of info into the shard dir.
+// Shards left there by an interrupted download are checked and reused.
+func downloadShards(ctx context.Context, info FileInfo) error {
+	shardDir := GetShardPath()
+	if err := os.MkdirAll(shardDir, 0755); err != nil {
+		return err
+	}
+
+	lbInfo, err := readLoadBalancerInfo()
+	if err != nil {
+		fmt.Printf("Download throughput unknown, shards are fetched in order: %v\n", err)
+	}
+	shards := shardsByIndex(info)
+	localPath := func(i int) string {
+		return filepath.Join(shardDir, path.Base(shards[i].DistributedFile))
+	}
+
+	verified := 0
+	var pending []int
+	for _, i := range shardOrder(shards, lbInfo) {
+		if sum, err := calculateChecksum(localPath(i)); err == nil && sum == shards[i].Checksum {
+			fmt.Printf("Shard %d already downloaded\n", i)
+			verified++
+			continue
+		}
+		pending = append(pending, i)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i   int
+		err error
+	}
+	type transfer struct {
+		cancel   context.CancelFunc
+		deadline time.Time
+		hedged   bool
+	}
+	results := make(chan result, len(pending))
+	inflight := make(map[int]*transfer)
+	var errs []error
+
+	startNext := func() bool {
+		if len(pending) == 0 {
+			return false
+		}
+		i := pending[0]
+		pending = pending[1:]
+		dFile := shards[i]
+		tCtx, tCancel := context.WithCancel(ctx)
+		inflight[i] = &transfer{
+			cancel:   tCancel,
+			deadline: time.Now().Add(hedgeDelay(info.DisFileSize, downThroughput(lbInfo, dFile.Remote))),
+		}
+		fmt.Printf("Downloading shard %d from %s\n", i, dFile.Remote.Name)
+		go func() {
+			results <- result{i: i, err: fetchShard(tCtx, dFile, localPath(i))}
+		}()
+		return true
+	}
+
+	ticker := time.NewTicker(hedgeCheckInterval)
+	defer ticker.Stop()
+
+	for verified < info.Shard {
+		for len(inflight) < info.Shard-verified {
+			if !startNext() {
+				break
+			}
+		}
+		if len(inflight) == 0 {
+			return fmt.Errorf("only %d of %d shards of %s could be downloaded: %w", verified, info.Shard, info.FileName, errors.Join(errs...))
+		}
+
+		select {
+		case res := <-results:
+			inflight[res.i].cancel()
+			delete(inflight, res.i)
+			if res.err != nil {
+				fmt.Printf("Shard %d failed: %v\n", res.i, res.err)
+				errs = append(errs, res.err)
+				continue
+			}
+			verified++
+			if err := UpdateDistributedFile_CheckFlag(info.FileName, shards[res.i].DistributedFile, true); err != nil {
+				return err
+			}
+		case now := <-ticker.C:
+			for i, t := range inflight {
+				if !t.hedged && now.After(t.deadline) {
+					t.hedged = true
+					fmt.Printf("Shard %d from %s is slow, sending a hedged request\n", i, shards[i].Remote.Name)
+					startNext()
+				}
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// cancelling the transfers which are no longer needed
+	for _, t := range inflight {
+		t.cancel()
+	}
+	for len(inflight) > 0 {
+		res := <-results
+		delete(inflight, res.i)
+		if res.err == nil {
+			// finished before it was cancelled, keep it for reconstruction
+			continue
+		}
+		_ = os.Remove(localPath(res.i))
+	}
+	return nil
+}
+
+// streamDecodeOptions returns the shard order and hedging delay used when
+// decoding the stripes of info
+func streamDecodeOptions(info FileInfo, shards []DistributedFile) (order []int, hedgeAfter time.Duration) {
+	lbInfo, err := readLoadBalancerInfo()
+	if err != nil {
+		fmt.Printf("Download throughput unknown, shards are fetched in order: %v\n", err)
+	}
+	order = localParityLast(info, shardOrder(shards, lbInfo))
+
+	// the stripe is as slow as the slowest of the shards read
+	slowest := 0.0
+	for n, i := range order {
+		if n == info.Shard {
+			break
+		}
+		kbps := downThroughput(lbInfo, shards[i].Remote)
+		if n == 0 || kbps < slowest {
+			slowest = kbps
+		}
+	}
+	return order, hedgeDelay(int64(info.StripeSize), slowest)
+}
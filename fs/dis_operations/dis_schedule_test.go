@@ -0,0 +1,44 @@
+package dis_operations
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardOrder(t *testing.T) {
+	fast := Remote{Name: "fast", Type: "s3"}
+	slow := Remote{Name: "slow", Type: "drive"}
+	unknown := Remote{Name: "unknown", Type: "local"}
+	lbInfo := &LoadBalancerInfo{RemoteInfos: map[string]RemoteInfo{
+		fast.String(): {AvgDownThroughput: 1000},
+		slow.String(): {AvgDownThroughput: 10},
+	}}
+
+	shards := []DistributedFile{
+		{DistributedFile: "a.fcef.0", Remote: unknown},
+		{DistributedFile: "a.fcef.1", Remote: slow},
+		{},
+		{DistributedFile: "a.fcef.3", Remote: fast},
+		{DistributedFile: "a.fcef.4", Remote: slow},
+	}
+	assert.Equal(t, []int{3, 1, 4, 0}, shardOrder(shards, lbInfo))
+	assert.Equal(t, []int{0, 1, 3, 4}, shardOrder(shards, nil))
+}
+
+func TestHedgeDelay(t *testing.T) {
+	assert.Equal(t, hedgeDefaultDelay, hedgeDelay(1<<20, 0))
+	assert.Equal(t, hedgeMinDelay, hedgeDelay(1000, 1e6))
+	// 1 MB at 800 Kbps takes 10s
+	assert.Equal(t, hedgeFactor*10*time.Second, hedgeDelay(1e6, 800))
+}
+
+func TestShardIndexOf(t *testing.T) {
+	idx, err := shardIndexOf("dir/report.pdf.fcef.12")
+	assert.NoError(t, err)
+	assert.Equal(t, 12, idx)
+
+	_, err = shardIndexOf("report")
+	assert.Error(t, err)
+}
@@ -0,0 +1,401 @@
+package dis_operations
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/reedsolomon"
+	"golang.org/x/sync/errgroup"
+)
+
+// states of a shard found by dis_scrub
+const (
+	shardOK          = "ok"
+	shardMissing     = "missing"
+	shardCorrupt     = "corrupt"
+	shardUnreachable = "unreachable"
+)
+
+// ScrubReport is the outcome of scrubbing a distributed file
+type ScrubReport struct {
+	FileName string
+	Shard    int
+	Parity   int
+	// LocalGroups is the number of local parity shards
+	LocalGroups int
+	// Healthy is the number of shards found intact before any repair
+	Healthy int
+	// Lost describes every shard which wasn't intact
+	Lost []string
+	// Repaired is the number of shards rebuilt and uploaded again
+	Repaired int
+	// Margin is how many more shards can be lost before the file can't be
+	// rebuilt, negative if it is already lost
+	Margin int
+}
+
+func (r ScrubReport) String() string {
+	s := fmt.Sprintf("%s: %d/%d shards healthy, %d repaired, redundancy margin %d",
+		r.FileName, r.Healthy, r.Shard+r.Parity+r.LocalGroups, r.Repaired, r.Margin)
+	for _, lost := range r.Lost {
+		s += "\n\t" + lost
+	}
+	return s
+}
+
+// Dis_Scrub checks every shard of the files named in args, every file when
+// args is empty, and rebuilds the ones which are missing or corrupt.
+// With --dry-run the shards are only checked.
+func Dis_Scrub(ctx context.Context, args []string, loadBalancer LoadBalancerType) error {
+	repair := !fs.GetConfig(ctx).DryRun
+	if repair {
+		var unlock func()
+		var err error
+		ctx, unlock, err = lockStore(ctx, "scrub")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	syncMetadata()
+
+	var fileNames []string
+	if len(args) == 0 {
+		entries, err := ListDir("", true)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir {
+				fileNames = append(fileNames, entry.FileName)
+			}
+		}
+	} else {
+		name, err := NormalizeLogicalPath(args[0])
+		if err != nil {
+			return err
+		}
+		exists, err := DoesFileStructExist(name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			fileNames = []string{name}
+		} else if fileNames, err = GetFileNamesInDir(name); err != nil {
+			return fmt.Errorf("file name '%s' not found", name)
+		}
+	}
+
+	// chunked files are scrubbed chunk by chunk
+	fileNames, err := expandChunks(fileNames)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	damaged := 0
+	for _, name := range fileNames {
+		fileCtx, done := fileStatsContext(ctx, name)
+		report, err := scrubFile(fileCtx, name, loadBalancer, repair)
+		done()
+		reportFile(name, stateScrubbed, err)
+		fmt.Println(report)
+		if err != nil {
+			fmt.Printf("Failed to scrub %s: %v\n", name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+		if report.Margin < report.Parity {
+			damaged++
+		}
+	}
+
+	fmt.Printf("Scrubbed %d files, %d with reduced redundancy\n", len(fileNames), damaged)
+	if repair {
+		syncMetadata()
+	}
+	return errors.Join(errs...)
+}
+
+// checkShard checks the shard dFile of info on its remote. The size is
+// checked first, then the SHA-256 if the backend supports it, otherwise the
+// shard is downloaded and hashed. Sealed shards are always downloaded, to be
+// authenticated.
+func checkShard(ctx context.Context, info FileInfo, dFile DistributedFile) (string, error) {
+	f, err := getShardFs(ctx, dFile.Remote)
+	if err != nil {
+		return shardUnreachable, err
+	}
+	hashedFileName, err := CalculateHash(dFile.DistributedFile)
+	if err != nil {
+		return shardUnreachable, err
+	}
+	obj, err := f.NewObject(ctx, hashedFileName)
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return shardMissing, err
+	} else if err != nil {
+		return shardUnreachable, err
+	}
+
+	if info.Format != formatSealed {
+		if info.DisFileSize > 0 && obj.Size() != info.DisFileSize {
+			return shardCorrupt, fmt.Errorf("size %d, expected %d", obj.Size(), info.DisFileSize)
+		}
+		if dFile.Checksum == "" {
+			return shardOK, nil
+		}
+	}
+
+	if info.Format != formatSealed && f.Hashes().Contains(hash.SHA256) {
+		sum, err := obj.Hash(ctx, hash.SHA256)
+		if err == nil && sum != "" {
+			if sum != dFile.Checksum {
+				return shardCorrupt, errors.New("checksum mismatch")
+			}
+			return shardOK, nil
+		}
+	}
+
+	in, err := openShardData(ctx, info, dFile, 0)
+	if errors.Is(err, errShardSeal) {
+		return shardCorrupt, err
+	} else if err != nil {
+		return shardUnreachable, err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	h := sha256.New()
+	if _, err := io.Copy(h, in); errors.Is(err, errShardSeal) {
+		return shardCorrupt, err
+	} else if err != nil {
+		return shardUnreachable, err
+	}
+	if dFile.Checksum != "" && hex.EncodeToString(h.Sum(nil)) != dFile.Checksum {
+		return shardCorrupt, errors.New("checksum mismatch")
+	}
+	return shardOK, nil
+}
+
+// scrubFile checks every shard of originalFileName and, if repair is set,
+// rebuilds the lost ones from the survivors
+func scrubFile(ctx context.Context, originalFileName string, loadBalancer LoadBalancerType, repair bool) (ScrubReport, error) {
+	info, err := GetFileInfoStruct(originalFileName)
+	if err != nil {
+		return ScrubReport{FileName: originalFileName}, err
+	}
+	report := ScrubReport{FileName: originalFileName, Shard: info.Shard, Parity: info.Parity, LocalGroups: info.LocalGroups}
+
+	shards := shardsByIndex(info)
+	statuses := make([]string, len(shards))
+	var mu sync.Mutex
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(fs.GetConfig(ctx).Checkers)
+	for i, dFile := range shards {
+		i, dFile := i, dFile
+		if dFile.DistributedFile == "" {
+			statuses[i] = shardMissing
+			report.Lost = append(report.Lost, fmt.Sprintf("shard %d: not recorded", i))
+			continue
+		}
+		g.Go(func() error {
+			status, err := checkShard(gCtx, info, dFile)
+			reportShard(originalFileName, dFile, status, nil)
+			mu.Lock()
+			defer mu.Unlock()
+			statuses[i] = status
+			if status != shardOK {
+				report.Lost = append(report.Lost, fmt.Sprintf("shard %d on %s: %s: %v", i, dFile.Remote.Name, status, err))
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	// local parity shards speed repairs up but don't add to the margin
+	global := 0
+	for i, status := range statuses {
+		if status == shardOK {
+			report.Healthy++
+			if i < info.Shard+info.Parity {
+				global++
+			}
+		}
+	}
+	report.Margin = global - info.Shard
+	if report.Healthy == len(shards) || !repair {
+		return report, nil
+	}
+	if report.Healthy < info.Shard {
+		return report, fmt.Errorf("can't be repaired: only %d of %d needed shards are healthy", report.Healthy, info.Shard)
+	}
+
+	// rebuilt shards stay on their remote unless it can't be reached
+	unreachable := make(map[string]bool)
+	var staying []Remote
+	var moving []int
+	for i, status := range statuses {
+		switch {
+		case status == shardUnreachable:
+			unreachable[shards[i].Remote.Name] = true
+			moving = append(moving, i)
+		case shards[i].Remote.Name == "":
+			moving = append(moving, i)
+		default:
+			staying = append(staying, shards[i].Remote)
+		}
+	}
+	replacements, err := placeReplacements(ctx, loadBalancer, staying, len(moving), info.Parity, unreachable)
+	if err != nil {
+		return report, err
+	}
+	targets := make(map[int]Remote, len(moving))
+	for n, i := range moving {
+		targets[i] = replacements[n]
+	}
+	pick := func(i int, dFile *DistributedFile) error {
+		if to, ok := targets[i]; ok {
+			dFile.Remote = to
+		}
+		return nil
+	}
+	repaired, err := repairShards(ctx, info, shards, statuses, pick)
+	for i, status := range statuses {
+		if status != shardOK && err == nil {
+			reportShard(originalFileName, shards[i], stateRepaired, nil)
+			if i < info.Shard+info.Parity {
+				report.Margin++
+			}
+		}
+	}
+	report.Repaired = repaired
+	return report, err
+}
+
+// repairReads returns the healthy shards to read to repair the others:
+// the rest of their local groups if that is enough, else the fastest
+// healthy shards, as many as there are data shards
+func repairReads(info FileInfo, shards []DistributedFile, statuses []string) []int {
+	var lost []int
+	for i, status := range statuses {
+		if status != shardOK {
+			lost = append(lost, i)
+		}
+	}
+	if reads, ok := reedsolomon.LocalRepairShards(info.Shard, info.Parity, info.LocalGroups, lost); ok {
+		return reads
+	}
+	lbInfo, _ := readLoadBalancerInfo()
+	var reads []int
+	for _, i := range localParityLast(info, shardOrder(shards, lbInfo)) {
+		if len(reads) == info.Shard {
+			break
+		}
+		if statuses[i] == shardOK {
+			reads = append(reads, i)
+		}
+	}
+	return reads
+}
+
+// repairShards rebuilds the shards of info which aren't ok from the healthy
+// ones and uploads them to the remote chosen by pick. It returns the number
+// of shards repaired.
+func repairShards(ctx context.Context, info FileInfo, shards []DistributedFile, statuses []string, pick func(i int, dFile *DistributedFile) error) (int, error) {
+	readers := make([]io.Reader, len(shards))
+	for _, i := range repairReads(info, shards, statuses) {
+		in, err := openShardData(ctx, info, shards[i], 0)
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			_ = in.Close()
+		}()
+		readers[i] = in
+	}
+
+	var dataKey []byte
+	if info.Format == formatSealed {
+		var err error
+		if dataKey, err = fileDataKey(info); err != nil {
+			return 0, err
+		}
+	}
+
+	fill := make([]io.Writer, len(shards))
+	pipes := make([]*io.PipeWriter, len(shards))
+	shardHashes := make(map[int]*hashingWriter)
+	g, gCtx := errgroup.WithContext(ctx)
+	for i, status := range statuses {
+		if status == shardOK {
+			continue
+		}
+		dFile := shards[i]
+		if dFile.DistributedFile == "" {
+			dFile.DistributedFile = shardName(info.FileName, info.Version, i)
+		}
+		if err := pick(i, &dFile); err != nil {
+			return 0, err
+		}
+		shards[i] = dFile
+
+		pr, pw := io.Pipe()
+		upload, size, err := shardUpload(info, dataKey, i, pr)
+		if err != nil {
+			return 0, err
+		}
+		pipes[i] = pw
+		hw := &hashingWriter{w: pw, h: sha256.New()}
+		shardHashes[i] = hw
+		fill[i] = hw
+		g.Go(func() error {
+			err := putShard(gCtx, dFile, upload, size, info.ModTime)
+			_ = pr.CloseWithError(err)
+			if err != nil {
+				return fmt.Errorf("failed to upload shard %s to %s: %w", dFile.DistributedFile, dFile.Remote.Name, err)
+			}
+			fmt.Printf("Rebuilt shard %s on %s\n", dFile.DistributedFile, dFile.Remote.Name)
+			return nil
+		})
+	}
+
+	stripeSize := info.StripeSize
+	if stripeSize == 0 {
+		stripeSize = reedsolomon.StripeSizeFor(info.DisFileSize*int64(info.Shard), info.Shard)
+	}
+	rebuildErr := reedsolomon.ReconstructStripes(gCtx, readers, reedsolomon.Codec(info.Codec), info.Shard, info.Parity, stripeSize, info.DisFileSize, fill, info.stripeOptions()...)
+	for _, pw := range pipes {
+		if pw != nil {
+			_ = pw.CloseWithError(rebuildErr)
+		}
+	}
+	if err := g.Wait(); err != nil {
+		return 0, err
+	}
+	if rebuildErr != nil {
+		return 0, rebuildErr
+	}
+
+	err := updateFileInfo(info.FileName, func(fileInfo *FileInfo) error {
+		for i, hw := range shardHashes {
+			dFile := shards[i]
+			sum := hex.EncodeToString(hw.h.Sum(nil))
+			if dFile.Checksum != "" && dFile.Checksum != sum {
+				return fmt.Errorf("rebuilt shard %s doesn't match its checksum", dFile.DistributedFile)
+			}
+			dFile.Checksum = sum
+			fileInfo.DistributedFileInfos[dFile.DistributedFile] = dFile
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(shardHashes), nil
+}
@@ -0,0 +1,329 @@
+package dis_operations
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rclone/rclone/backend/crypt"
+	"github.com/rclone/rclone/fs"
+)
+
+// Sealed shards
+//
+// Shards of the sealed format are authenticated objects which describe
+// themselves. Each one starts with
+//
+//	shardMagic
+//	length of the envelope, uint32 big endian
+//	envelope, JSON encoded shardEnvelope
+//
+// The envelope carries the keyring parameters and the wrapped data key of
+// the file, so a shard can be opened with nothing but the passphrase, and
+// the ShardHeader sealed by the data key. The shard data follows encrypted by
+// backend/crypt under the data key of the file, as a crypt file of its own
+// with a random nonce. The ShardHeader holds the crypt header of the data,
+// which binds the data to the header, and the size of the data. A shard which
+// was tampered with, truncated or swapped with another one, of the same file
+// or not, fails to open.
+const (
+	shardMagic      = "DISSHRD\x01"
+	maxEnvelopeSize = 64 * 1024
+)
+
+// errShardSeal is returned for shards failing authentication
+var errShardSeal = errors.New("shard failed authentication")
+
+// ShardHeader describes a sealed shard and the file it belongs to
+type ShardHeader struct {
+	FileID     string      `json:"file_id"`
+	FileName   string      `json:"file_name"`
+	Index      int         `json:"index"`
+	Shard      int         `json:"shard"`
+	Parity     int         `json:"parity"`
+	Local      int         `json:"local,omitempty"`
+	Codec      string      `json:"codec,omitempty"`
+	StripeSize int         `json:"stripe_size"`
+	ShardSize  int64       `json:"shard_size"`
+	FileSize   int64       `json:"file_size"`
+	ModTime    time.Time   `json:"mod_time"`
+	Mode       os.FileMode `json:"mode"`
+	Profile    string      `json:"profile,omitempty"`
+	Version    int         `json:"version,omitempty"`
+	UploadTime time.Time   `json:"upload_time"`
+	// DataHeader is the crypt header the shard data starts with
+	DataHeader []byte `json:"data_header,omitempty"`
+}
+
+// shardEnvelope is stored in the clear at the start of a sealed shard
+type shardEnvelope struct {
+	KeyRing    KeyRing `json:"keyring"`
+	WrappedKey []byte  `json:"wrapped_key"`
+	// Header is the ShardHeader sealed by the data key
+	Header []byte `json:"header"`
+}
+
+// newFileID returns a random ID for a new file
+func newFileID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// shardHeaderOf returns the header of shard index of info
+func shardHeaderOf(info FileInfo, index int) ShardHeader {
+	return ShardHeader{
+		FileID:     info.FileID,
+		FileName:   info.FileName,
+		Index:      index,
+		Shard:      info.Shard,
+		Parity:     info.Parity,
+		Local:      info.LocalGroups,
+		Codec:      info.Codec,
+		StripeSize: info.StripeSize,
+		ShardSize:  info.DisFileSize,
+		FileSize:   info.FileSize,
+		ModTime:    info.ModTime,
+		Mode:       info.Mode,
+		Profile:    info.Profile,
+		Version:    info.Version,
+		UploadTime: info.UploadTime,
+	}
+}
+
+// toKey returns dataKey as a secretbox key
+func toKey(dataKey []byte) *[32]byte {
+	var key [32]byte
+	copy(key[:], dataKey)
+	return &key
+}
+
+// sealShard returns in, the data of shard index of info, sealed with
+// dataKey, and the size of the sealed shard
+func sealShard(info FileInfo, dataKey []byte, index int, in io.Reader) (io.Reader, int64, error) {
+	ring, err := readKeyRing()
+	if err != nil {
+		return nil, 0, err
+	}
+	if ring == nil || ring.Version != info.KeyVersion {
+		return nil, 0, fmt.Errorf("the keyring doesn't hold master key version %d of %s", info.KeyVersion, info.FileName)
+	}
+	ring.LegacyPassword = nil
+	cipher, err := dataKeyCipher(dataKey)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the crypt header comes out before anything is read from in
+	encrypted, err := cipher.EncryptData(in)
+	if err != nil {
+		return nil, 0, err
+	}
+	shardHeader := shardHeaderOf(info, index)
+	shardHeader.DataHeader = make([]byte, cipher.EncryptedSize(0))
+	if _, err := io.ReadFull(encrypted, shardHeader.DataHeader); err != nil {
+		return nil, 0, err
+	}
+
+	header, err := json.Marshal(shardHeader)
+	if err != nil {
+		return nil, 0, err
+	}
+	env := shardEnvelope{KeyRing: *ring, WrappedKey: info.WrappedKey}
+	if env.Header, err = seal(toKey(dataKey), header); err != nil {
+		return nil, 0, err
+	}
+	envData, err := json.Marshal(env)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var prefix bytes.Buffer
+	prefix.WriteString(shardMagic)
+	_ = binary.Write(&prefix, binary.BigEndian, uint32(len(envData)))
+	prefix.Write(envData)
+	prefix.Write(shardHeader.DataHeader)
+	return io.MultiReader(&prefix, encrypted), int64(prefix.Len()) - int64(len(shardHeader.DataHeader)) + cipher.EncryptedSize(info.DisFileSize), nil
+}
+
+// readShardEnvelope reads the envelope at the start of a sealed shard and
+// returns it with the number of bytes before the shard data
+func readShardEnvelope(in io.Reader) (*shardEnvelope, int64, error) {
+	prefix := make([]byte, len(shardMagic)+4)
+	if _, err := io.ReadFull(in, prefix); err != nil {
+		return nil, 0, fmt.Errorf("%w: no header: %v", errShardSeal, err)
+	}
+	if string(prefix[:len(shardMagic)]) != shardMagic {
+		return nil, 0, fmt.Errorf("%w: not a sealed shard", errShardSeal)
+	}
+	size := binary.BigEndian.Uint32(prefix[len(shardMagic):])
+	if size > maxEnvelopeSize {
+		return nil, 0, fmt.Errorf("%w: header of %d bytes is too big", errShardSeal, size)
+	}
+	envData := make([]byte, size)
+	if _, err := io.ReadFull(in, envData); err != nil {
+		return nil, 0, fmt.Errorf("%w: truncated header: %v", errShardSeal, err)
+	}
+	env := &shardEnvelope{}
+	if err := json.Unmarshal(envData, env); err != nil {
+		return nil, 0, fmt.Errorf("%w: bad header", errShardSeal)
+	}
+	return env, int64(len(prefix)) + int64(size), nil
+}
+
+// openHeader unseals the header of env with dataKey
+func (env *shardEnvelope) openHeader(dataKey []byte) (ShardHeader, error) {
+	var header ShardHeader
+	data, err := unseal(toKey(dataKey), env.Header)
+	if err != nil {
+		return header, fmt.Errorf("%w: header: %v", errShardSeal, err)
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return header, fmt.Errorf("%w: header: %v", errShardSeal, err)
+	}
+	return header, nil
+}
+
+// dataHeaderReader checks that the shard data it reads starts with the crypt
+// header recorded in the sealed ShardHeader
+type dataHeaderReader struct {
+	io.ReadCloser
+	want []byte
+}
+
+func (r *dataHeaderReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if len(r.want) > 0 {
+		checked := min(n, len(r.want))
+		if !bytes.Equal(p[:checked], r.want[:checked]) {
+			return 0, fmt.Errorf("%w: holds the data of another shard", errShardSeal)
+		}
+		r.want = r.want[checked:]
+	}
+	return n, err
+}
+
+// unsealingReader reads the data decrypted by crypt, checking that the shard
+// holds exactly the data it should
+type unsealingReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (r *unsealingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	switch {
+	case r.remaining < 0:
+		return 0, fmt.Errorf("%w: data after the end", errShardSeal)
+	case err == io.EOF && r.remaining > 0:
+		return n, fmt.Errorf("%w: truncated", errShardSeal)
+	}
+	return n, sealError(err)
+}
+
+// sealError returns err as errShardSeal if crypt failed to authenticate
+// the shard data
+func sealError(err error) error {
+	for _, cryptErr := range []error{crypt.ErrorEncryptedBadBlock, crypt.ErrorEncryptedFileBadHeader, crypt.ErrorEncryptedFileTooShort, crypt.ErrorEncryptedBadMagic} {
+		if errors.Is(err, cryptErr) {
+			return fmt.Errorf("%w: %v", errShardSeal, err)
+		}
+	}
+	return err
+}
+
+// openSealedShard opens the data of the sealed shard dFile of info from
+// offset, after checking it is the shard it should be
+func openSealedShard(ctx context.Context, info FileInfo, dFile DistributedFile, offset int64) (io.ReadCloser, error) {
+	index, err := shardIndexOf(dFile.DistributedFile)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := fileDataKey(info)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the header is read when starting further in
+	var options []fs.OpenOption
+	if offset > 0 {
+		options = append(options, &fs.RangeOption{Start: 0, End: int64(len(shardMagic)) + 4 + maxEnvelopeSize - 1})
+	}
+	in, err := openShardObject(ctx, dFile, options...)
+	if err != nil {
+		return nil, err
+	}
+	env, headerSize, err := readShardEnvelope(in)
+	var header ShardHeader
+	if err == nil {
+		header, err = env.openHeader(dataKey)
+		if err == nil && (header.FileID != info.FileID || header.Index != index || header.ShardSize != info.DisFileSize) {
+			err = fmt.Errorf("%w: holds shard %d of %s (%s)", errShardSeal, header.Index, header.FileName, header.FileID)
+		}
+	}
+	if err != nil {
+		_ = in.Close()
+		return nil, fmt.Errorf("shard %s on %s: %w", dFile.DistributedFile, dFile.Remote.Name, err)
+	}
+
+	cipher, err := dataKeyCipher(dataKey)
+	if err != nil {
+		_ = in.Close()
+		return nil, err
+	}
+	var data io.ReadCloser
+	if offset == 0 {
+		data, err = cipher.DecryptData(&dataHeaderReader{ReadCloser: in, want: header.DataHeader})
+	} else {
+		_ = in.Close()
+		open := func(ctx context.Context, underlyingOffset, underlyingLimit int64) (io.ReadCloser, error) {
+			end := int64(-1)
+			if underlyingLimit >= 0 {
+				end = headerSize + underlyingOffset + underlyingLimit - 1
+			}
+			in, err := openShardObject(ctx, dFile, &fs.RangeOption{Start: headerSize + underlyingOffset, End: end})
+			if err != nil || underlyingOffset > 0 {
+				return in, err
+			}
+			return &dataHeaderReader{ReadCloser: in, want: header.DataHeader}, nil
+		}
+		data, err = cipher.DecryptDataSeek(ctx, open, offset, -1)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("shard %s on %s: %w", dFile.DistributedFile, dFile.Remote.Name, sealError(err))
+	}
+	return &shardReader{
+		ReadCloser: &unsealingReader{ReadCloser: data, remaining: info.DisFileSize - offset},
+		remote:     dFile.Remote,
+		start:      time.Now(),
+	}, nil
+}
+
+// openShardData opens the data of the shard dFile of info from offset,
+// whether the shard is sealed or not
+func openShardData(ctx context.Context, info FileInfo, dFile DistributedFile, offset int64) (io.ReadCloser, error) {
+	if info.Format == formatSealed {
+		return openSealedShard(ctx, info, dFile, offset)
+	}
+	return openShard(ctx, dFile, offset)
+}
+
+// shardUpload returns what is uploaded for the data of shard index of info
+// read from in, sealed if info is of the sealed format, and its size
+func shardUpload(info FileInfo, dataKey []byte, index int, in io.Reader) (io.Reader, int64, error) {
+	if info.Format != formatSealed {
+		return in, info.DisFileSize, nil
+	}
+	return sealShard(info, dataKey, index, in)
+}
@@ -0,0 +1,107 @@
+package dis_operations
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+func TestSealedShards(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	const name = "seal_test/data.bin"
+
+	data := make([]byte, 1000000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "data.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	require.NoError(t, streamUploadFile(ctx, src, name, RoundRobin, ShardProfile{}))
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+	}()
+
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	require.Equal(t, formatSealed, info.Format)
+	require.Greater(t, info.DisFileSize, int64(2*64*1024))
+	shards := shardsByIndex(info)
+	objectPath := func(i int) string {
+		hashedFileName, err := CalculateHash(shards[i].DistributedFile)
+		require.NoError(t, err)
+		return filepath.Join(dir, shards[i].Remote.Name, remoteDirectory, hashedFileName)
+	}
+	readShard := func(i int, offset int64) ([]byte, error) {
+		in, err := openShardData(ctx, info, shards[i], offset)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = in.Close()
+		}()
+		return io.ReadAll(in)
+	}
+
+	// reading from the middle of a block gives the end of the shard
+	whole, err := readShard(0, 0)
+	require.NoError(t, err)
+	require.Len(t, whole, int(info.DisFileSize))
+	offset := int64(64*1024 + 1234)
+	part, err := readShard(0, offset)
+	require.NoError(t, err)
+	assert.Equal(t, whole[offset:], part)
+
+	// a flipped bit is caught by the shard itself
+	sealed, err := os.ReadFile(objectPath(1))
+	require.NoError(t, err)
+	sealed[len(sealed)-100] ^= 1
+	require.NoError(t, os.WriteFile(objectPath(1), sealed, 0644))
+	_, err = readShard(1, 0)
+	assert.ErrorIs(t, err, errShardSeal)
+	status, _ := checkShard(ctx, info, shards[1])
+	assert.Equal(t, shardCorrupt, status)
+
+	// so is a shard swapped with another one of the same file
+	own, err := os.ReadFile(objectPath(2))
+	require.NoError(t, err)
+	other, err := os.ReadFile(objectPath(3))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(objectPath(2), other, 0644))
+	_, err = readShard(2, 0)
+	assert.ErrorIs(t, err, errShardSeal)
+
+	// or the data of one put under the envelope of another
+	envelopeSize := func(sealed []byte) int {
+		_, size, err := readShardEnvelope(bytes.NewReader(sealed))
+		require.NoError(t, err)
+		return int(size)
+	}
+	spliced := append(own[:envelopeSize(own):envelopeSize(own)], other[envelopeSize(other):]...)
+	require.NoError(t, os.WriteFile(objectPath(2), spliced, 0644))
+	_, err = readShard(2, 0)
+	assert.ErrorIs(t, err, errShardSeal)
+	_, err = readShard(2, offset)
+	assert.ErrorIs(t, err, errShardSeal)
+
+	// and one cut short
+	sealed, err = os.ReadFile(objectPath(4))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(objectPath(4), sealed[:len(sealed)-(64*1024+secretbox.Overhead)], 0644))
+	_, err = readShard(4, 0)
+	assert.ErrorIs(t, err, errShardSeal)
+
+	// the file is still there thanks to parity
+	out := t.TempDir()
+	require.NoError(t, streamDownloadFile(ctx, info, out))
+	got, err := os.ReadFile(filepath.Join(out, "data.bin"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+}
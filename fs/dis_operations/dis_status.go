@@ -1,13 +1,43 @@
 package dis_operations
 
 import (
+	"context"
 	"fmt"
+	"path"
+	"strings"
 
 	"github.com/rclone/rclone/reedsolomon"
 )
 
-// if return true, do original cmd
-func CheckState(action string, args []string, loadbalancer LoadBalancerType) (bool, error) {
+// CheckState finishes the work an interrupted dis_* command left before
+// action runs with args, without asking anything. An upload with a journal
+// is resumed, see dis_journal.go, and other unfinished work is dumped.
+// It returns true if the unfinished work was the same command, so there is
+// nothing left to do.
+//
+// It holds the store lock, so an upload still being written by another
+// operation of the process, such as a mount, isn't taken as unfinished.
+func CheckState(ctx context.Context, action string, args []string, loadbalancer LoadBalancerType) (bool, error) {
+	ctx, unlock, err := lockStore(ctx, "check")
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	j, err := readJournal()
+	if err != nil {
+		return false, err
+	}
+	if j != nil {
+		fmt.Printf("There is unfinished work: upload - %s\n", strings.Join(j.Args, " "))
+		if err := resumeJournal(ctx, j); err != nil {
+			return false, err
+		}
+		if checkSameCommand(action, "upload", args, j.Args) {
+			return true, nil
+		}
+	}
+
 	flag, state, origin_name := CheckFlagAndState()
 	if !flag {
 		return false, nil
@@ -15,44 +45,26 @@ func CheckState(action string, args []string, loadbalancer LoadBalancerType) (bo
 
 	fmt.Printf("There is unfinished work: %s - %s\n", state, origin_name)
 
-	var answer bool
-
 	if state == "upload" {
-		answer = false // Remove this line and uncomment below line to allow interactive process for DoReUpload
-		//answer = DoReUpload(origin_name)
-		if answer {
-			// reupload
-			fmt.Printf("state: %s, answer: %t\n", state, answer)
-			return false, Dis_Upload([]string{origin_name}, true, loadbalancer)
-		} else {
-			// dump old file
-			return false, DumpUploadState([]string{origin_name})
-		}
+		// there is no journal to resume it from, as after dis_upload of an
+		// older release or an upload through the distributed backend
+		return false, DumpUploadState(ctx, []string{origin_name})
 	} else if state == "download" {
-		answer = false // Remove this line and uncomment below line to allow interactive process for DoReUpload
-		//answer = DoReDownload(origin_name)
-		if answer {
-			//redownload
-			path := AskDestination()
-			redownloadArgs := []string{origin_name, path}
-			return checkSameCommand(action, "download", args, redownloadArgs), Dis_Download(redownloadArgs, true)
-		} else {
-			// dump old file
-			return false, DumpDownloadState([]string{origin_name})
-		}
+		// downloads are written again from the start
+		return false, DumpDownloadState([]string{origin_name})
 	} else if state == "rm" {
 		// dump as default
 		reremoveArgs := []string{origin_name}
-		return checkSameCommand(action, "remove", args, reremoveArgs), DumpRmState([]string{origin_name})
+		return checkSameCommand(action, "remove", args, reremoveArgs), DumpRmState(ctx, []string{origin_name})
 	}
 
 	return false, nil
 
 }
 
-func DumpRmState(args []string) (err error) {
+func DumpRmState(ctx context.Context, args []string) (err error) {
 	// Remove shards in remote and info in datamap
-	err = Dis_rm(args, true)
+	err = Dis_rm(ctx, args, true)
 	if err != nil {
 		return err
 	}
@@ -76,20 +88,15 @@ func DumpDownloadState(args []string) (err error) {
 	return nil
 }
 
-func DumpUploadState(args []string) (err error) {
+func DumpUploadState(ctx context.Context, args []string) (err error) {
 	// Dump Shards in Shards Directory
 	err = DumpUploadShards(args)
 	if err != nil {
 		return err
 	}
 
-	// Remove shards in remote and info in datamap
-	err = Dis_rm(args, false)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	// only the unfinished version goes, the ones before it are kept
+	return discardUpload(ctx, args[0])
 }
 
 func DumpUploadShards(args []string) (err error) {
@@ -127,7 +134,7 @@ func DumpDownloadShards(args []string) (err error) {
 
 	for _, distributedFile := range distributedFiles {
 		if !distributedFile.Check {
-			shardsToDump = append(shardsToDump, distributedFile.DistributedFile)
+			shardsToDump = append(shardsToDump, path.Base(distributedFile.DistributedFile))
 		}
 	}
 
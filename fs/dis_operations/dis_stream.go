@@ -0,0 +1,574 @@
+package dis_operations
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/backend/crypt"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/config/obscure"
+	"github.com/rclone/rclone/fs/object"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/reedsolomon"
+	"golang.org/x/sync/errgroup"
+)
+
+// Formats of distributed files, stored in FileInfo.Format
+const (
+	// whole file encrypted with filecrypt then split by reedsolomon.DoEncode
+	formatLegacy = ""
+	// encrypted with the rclone crypt format and encoded in stripes while
+	// uploading, see reedsolomon.EncodeStripes
+	formatStream = "stream"
+	// as formatStream with every shard sealed, see dis_seal.go
+	formatSealed = "sealed"
+	// cut into content defined chunks each stored as a sealed entry of its
+	// own, see dis_chunk.go
+	formatChunked = "chunked"
+)
+
+// newStreamCipher returns the cipher used for the stream format, keyed by
+// password. File names are never encrypted, only data.
+func newStreamCipher(password string) (*crypt.Cipher, error) {
+	return crypt.NewCipher(configmap.Simple{
+		"password":            obscure.MustObscure(password),
+		"filename_encryption": "off",
+		"filename_encoding":   "base32",
+		"suffix":              ".bin",
+	})
+}
+
+// getShardFs returns the Fs holding the shards on remote
+func getShardFs(ctx context.Context, remote Remote) (fs.Fs, error) {
+	f, err := cache.Get(ctx, fmt.Sprintf("%s:%s", remote.Name, remoteDirectory))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open remote %s: %w", remote.Name, err)
+	}
+	return f, nil
+}
+
+// shardIndexOf returns the index of a shard from its name "<file>.fcef.<idx>"
+func shardIndexOf(distributedFileName string) (int, error) {
+	i := strings.LastIndex(distributedFileName, ".")
+	if i < 0 {
+		return 0, fmt.Errorf("no shard index in %q", distributedFileName)
+	}
+	idx, err := strconv.Atoi(distributedFileName[i+1:])
+	if err != nil {
+		return 0, fmt.Errorf("bad shard index in %q: %w", distributedFileName, err)
+	}
+	return idx, nil
+}
+
+// shardCount returns the number of shards of info, local parity included
+func (info FileInfo) shardCount() int {
+	return info.Shard + info.Parity + info.LocalGroups
+}
+
+// stripeOptions returns the options the stripes of info are coded with
+func (info FileInfo) stripeOptions() []reedsolomon.Option {
+	return []reedsolomon.Option{reedsolomon.WithLocalParity(info.LocalGroups)}
+}
+
+// hashingWriter computes the checksum of everything written through it
+type hashingWriter struct {
+	w io.Writer
+	h hash.Hash
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	return n, err
+}
+
+// streamUploadFile uploads absolutePath as originalFileName without staging
+// anything on the local disk.
+func streamUploadFile(ctx context.Context, absolutePath string, originalFileName string, loadBalancer LoadBalancerType, profile ShardProfile) error {
+	src, err := os.Open(absolutePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	// the versions uploaded before stay until this one is complete
+	version, versions, err := nextVersion(ctx, originalFileName)
+	if err != nil {
+		return err
+	}
+	entry := FileInfo{
+		FileName:   originalFileName,
+		ModTime:    stat.ModTime(),
+		Mode:       stat.Mode(),
+		Version:    version,
+		UploadTime: time.Now(),
+		Versions:   versions,
+	}
+	if err := uploadSealed(ctx, src, stat.Size(), entry, loadBalancer, profile, SaveFileInfo); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", absolutePath, err)
+	}
+	return nil
+}
+
+// errResumeMismatch is returned when an interrupted upload can't be resumed
+// from the shards it sent, so it has to start again
+var errResumeMismatch = errors.New("the shards uploaded before can't be used")
+
+// uploadSealed uploads size bytes read from src as the sealed datamap entry
+// made of entry, recorded by save before anything is sent. The checksum of
+// entry, if known already, is checked once the data is sent, else recorded.
+//
+// The source is read once, encrypted, and cut into stripes. Every shard is
+// streamed to its remote with fs.Fs.Put while it is being encoded, so memory
+// use is bounded by a single stripe whatever the size of the file.
+func uploadSealed(ctx context.Context, src io.Reader, size int64, entry FileInfo, loadBalancer LoadBalancerType, profile ShardProfile, save func(FileInfo) error) error {
+	originalFileName := entry.FileName
+
+	// every file has its own data key
+	dataKey, wrappedKey, keyVersion, err := newDataKey()
+	if err != nil {
+		return err
+	}
+	fileID, err := newFileID()
+	if err != nil {
+		return err
+	}
+	cipher, err := dataKeyCipher(dataKey)
+	if err != nil {
+		return err
+	}
+
+	encSize := cipher.EncryptedSize(size)
+	shard, parity, err := profile.Shards(size, len(configuredRemotes()))
+	if err != nil {
+		return err
+	}
+	stripeSize := reedsolomon.StripeSizeFor(encSize, shard)
+	shardSize := reedsolomon.StripeShardSize(encSize, shard, stripeSize)
+	fs.Infof(originalFileName, "Split into %d data + %d parity %s shards", shard, parity, reedsolomon.CodecFor(shard+parity))
+	if profile.LocalGroups > 0 {
+		fs.Infof(originalFileName, "Has %d more local parity shards", profile.LocalGroups)
+	}
+
+	// placing every shard before anything is sent, local parity shards
+	// like data shards
+	local := profile.LocalGroups
+	remotes, err := PlaceShards(ctx, shard+local, parity, loadBalancer)
+	if err != nil {
+		return err
+	}
+	dFileMap := make(map[string]DistributedFile, shard+parity+local)
+	for idx := 0; idx < shard+parity+local; idx++ {
+		dFile, err := GetDistributedInfo(shardName(originalFileName, entry.Version, idx), remotes[idx], "")
+		if err != nil {
+			return err
+		}
+		dFileMap[dFile.DistributedFile] = dFile
+	}
+
+	// recorded before streaming so an interrupted upload can be found and
+	// resumed or cleaned up
+	fileInfo := entry
+	fileInfo.FileID = fileID
+	fileInfo.FileSize = size
+	fileInfo.DisFileSize = shardSize
+	fileInfo.Shard = shard
+	fileInfo.Parity = parity
+	fileInfo.LocalGroups = local
+	fileInfo.Codec = string(reedsolomon.CodecFor(shard + parity))
+	fileInfo.Flag = true
+	fileInfo.State = "upload"
+	fileInfo.Padding = shardSize*int64(shard) - encSize
+	fileInfo.Format = formatSealed
+	fileInfo.StripeSize = stripeSize
+	fileInfo.Profile = profile.Name
+	fileInfo.WrappedKey = wrappedKey
+	fileInfo.KeyVersion = keyVersion
+	fileInfo.DistributedFileInfos = dFileMap
+	if err := save(fileInfo); err != nil {
+		return err
+	}
+	return sendSealed(ctx, src, fileInfo, dataKey)
+}
+
+// resumeSealed carries on with the interrupted upload info. The source isn't
+// read nor encrypted again: the shards which weren't uploaded completely are
+// rebuilt from the ones which were, like a repair, see repairShards. A shard
+// cut off in the middle is sent again whole.
+//
+// It returns errResumeMismatch if too few shards were uploaded to rebuild
+// the others, or the checksum of the source isn't recorded to check them
+// against, see resumeSealedFile.
+func resumeSealed(ctx context.Context, info FileInfo) error {
+	if info.Format != formatSealed || len(info.WrappedKey) == 0 || info.Checksum == "" {
+		return errResumeMismatch
+	}
+	shards := shardsByIndex(info)
+	statuses := make([]string, len(shards))
+	var lost []int
+	global := 0
+	for idx, dFile := range shards {
+		if !dFile.Check || dFile.Checksum == "" {
+			statuses[idx] = shardMissing
+			lost = append(lost, idx)
+			continue
+		}
+		statuses[idx] = shardOK
+		if idx < info.Shard+info.Parity {
+			global++
+		}
+	}
+	if _, ok := reedsolomon.LocalRepairShards(info.Shard, info.Parity, info.LocalGroups, lost); !ok && global < info.Shard {
+		return errResumeMismatch
+	}
+	fs.Infof(info.FileName, "Resuming: %d of %d shards uploaded already", len(shards)-len(lost), len(shards))
+	if len(lost) == 0 {
+		return nil
+	}
+
+	// rebuilt onto the remotes they were placed on
+	keep := func(i int, dFile *DistributedFile) error {
+		return nil
+	}
+	_, err := repairShards(ctx, info, shards, statuses, keep)
+	return err
+}
+
+// sendSealed encrypts the data of src, encodes it into the shards of
+// fileInfo and uploads them
+func sendSealed(ctx context.Context, src io.Reader, fileInfo FileInfo, dataKey []byte) error {
+	originalFileName := fileInfo.FileName
+	cipher, err := dataKeyCipher(dataKey)
+	if err != nil {
+		return err
+	}
+	encSize := cipher.EncryptedSize(fileInfo.FileSize)
+	shard, parity, shardSize := fileInfo.Shard, fileInfo.Parity, fileInfo.DisFileSize
+	distributedFiles := shardsByIndex(fileInfo)
+
+	// hashed as it is encrypted so src is read only once
+	srcHash := sha256.New()
+	encrypted, err := cipher.EncryptData(io.TeeReader(src, srcHash))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt: %w", err)
+	}
+
+	var mu sync.Mutex
+	g, gCtx := errgroup.WithContext(ctx)
+	writers := make([]io.Writer, len(distributedFiles))
+	pipes := make([]*io.PipeWriter, 0, len(distributedFiles))
+
+	for idx, dFile := range distributedFiles {
+		idx, dFile := idx, dFile
+		pr, pw := io.Pipe()
+		pipes = append(pipes, pw)
+		writers[idx] = pw
+
+		// hashed as it is read so the checksum is complete once the
+		// shard is uploaded
+		shardHash := sha256.New()
+		sealed, sealedSize, err := sealShard(fileInfo, dataKey, idx, io.TeeReader(pr, shardHash))
+		if err != nil {
+			return err
+		}
+
+		g.Go(func() error {
+			start := time.Now()
+			reportShard(originalFileName, dFile, stateUploading, nil)
+			err := putShard(gCtx, dFile, sealed, sealedSize, fileInfo.ModTime)
+			// unblocks the encoder if the upload stopped reading
+			_ = pr.CloseWithError(err)
+			reportShard(originalFileName, dFile, stateUploaded, err)
+			if err != nil {
+				return fmt.Errorf("failed to upload shard %s to %s: %w", dFile.DistributedFile, dFile.Remote.Name, err)
+			}
+			throughputKbps := float64(shardSize) / time.Since(start).Seconds() * 8 / 1e3
+			fs.Debugf(originalFileName, "Uploaded shard %d to %s", idx, dFile.Remote.Name)
+			return recordUploadedShard(originalFileName, dFile, hex.EncodeToString(shardHash.Sum(nil)), throughputKbps, &mu)
+		})
+	}
+
+	encodeErr := reedsolomon.EncodeStripes(gCtx, encrypted, encSize, reedsolomon.Codec(fileInfo.Codec), shard, parity, fileInfo.StripeSize, writers, fileInfo.stripeOptions()...)
+	for _, pw := range pipes {
+		_ = pw.CloseWithError(encodeErr)
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if encodeErr != nil {
+		return fmt.Errorf("failed to encode: %w", encodeErr)
+	}
+	checksum := hex.EncodeToString(srcHash.Sum(nil))
+	if fileInfo.Checksum != "" && checksum != fileInfo.Checksum {
+		return fmt.Errorf("%s changed while it was uploaded", originalFileName)
+	}
+	return updateFileInfo(originalFileName, func(info *FileInfo) error {
+		info.Checksum = checksum
+		return nil
+	})
+}
+
+// recordUploadedShard records that the shard dFile of originalFileName was
+// uploaded, with its checksum, and the throughput of its remote
+func recordUploadedShard(originalFileName string, dFile DistributedFile, checksum string, throughputKbps float64, mu *sync.Mutex) error {
+	mu.Lock()
+	defer mu.Unlock()
+	err := updateDistributedFile(originalFileName, dFile.DistributedFile, func(entry *DistributedFile) error {
+		entry.Check = true
+		entry.Remote = dFile.Remote
+		entry.Checksum = checksum
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record shard %s: %w", dFile.DistributedFile, err)
+	}
+	return UpdateRemoteInfo(dFile.Remote, func(b *RemoteInfo) {
+		b.UpdateThroughput(throughputKbps, 0)
+	})
+}
+
+// putShard streams size bytes from in to the shard file of dFile
+func putShard(ctx context.Context, dFile DistributedFile, in io.Reader, size int64, modTime time.Time) error {
+	f, err := getShardFs(ctx, dFile.Remote)
+	if err != nil {
+		return err
+	}
+	hashedFileName, err := CalculateHash(dFile.DistributedFile)
+	if err != nil {
+		return err
+	}
+	info := object.NewStaticObjectInfo(hashedFileName, modTime, size, true, nil, f)
+	in, done := accountShardUpload(ctx, dFile, f, in, size)
+	_, err = f.Put(ctx, in, info)
+	done(err)
+	return err
+}
+
+// shardReader records the download throughput of a shard when it is closed
+type shardReader struct {
+	io.ReadCloser
+	remote Remote
+	start  time.Time
+	n      int64
+}
+
+func (r *shardReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *shardReader) Close() error {
+	err := r.ReadCloser.Close()
+	if elapsed := time.Since(r.start).Seconds(); r.n > 0 && elapsed > 0 {
+		throughputKbps := float64(r.n) / elapsed * 8 / 1e3
+		if uerr := UpdateRemoteInfo(r.remote, func(b *RemoteInfo) {
+			b.UpdateThroughput(throughputKbps, Download)
+		}); uerr != nil {
+			fs.Errorf(nil, "failed to record throughput of %s: %v", r.remote.Name, uerr)
+		}
+	}
+	return err
+}
+
+// openShard opens the shard file of dFile on its remote from offset
+func openShard(ctx context.Context, dFile DistributedFile, offset int64) (io.ReadCloser, error) {
+	var options []fs.OpenOption
+	if offset > 0 {
+		options = append(options, &fs.RangeOption{Start: offset, End: -1})
+	}
+	in, err := openShardObject(ctx, dFile, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &shardReader{ReadCloser: in, remote: dFile.Remote, start: time.Now()}, nil
+}
+
+// openShardObject opens the object holding the shard dFile with options
+func openShardObject(ctx context.Context, dFile DistributedFile, options ...fs.OpenOption) (io.ReadCloser, error) {
+	f, err := getShardFs(ctx, dFile.Remote)
+	if err != nil {
+		return nil, err
+	}
+	hashedFileName, err := CalculateHash(dFile.DistributedFile)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := f.NewObject(ctx, hashedFileName)
+	if err != nil {
+		return nil, fmt.Errorf("shard %s on %s: %w", dFile.DistributedFile, dFile.Remote.Name, err)
+	}
+	in, err := operations.NewReOpen(ctx, obj, fs.GetConfig(ctx).LowLevelRetries, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shard %s on %s: %w", dFile.DistributedFile, dFile.Remote.Name, err)
+	}
+	size := obj.Size()
+	for _, option := range options {
+		if r, ok := option.(*fs.RangeOption); ok {
+			offset, limit := r.Decode(size)
+			size = max(size-offset, 0)
+			if limit >= 0 {
+				size = min(size, limit)
+			}
+		}
+	}
+	return accountShardDownload(ctx, dFile, f, in, size), nil
+}
+
+// streamDownloadFile rebuilds a stream format or chunked file straight from
+// its remotes into destDir without storing any shard locally.
+func streamDownloadFile(ctx context.Context, info FileInfo, destDir string) (err error) {
+	endPhase := startPhase(ctx, info.FileName, info.FileSize, phaseDecode)
+	defer func() {
+		endPhase(err)
+	}()
+	return writeLocalFile(filepath.Join(destDir, path.Base(info.FileName)), func(w io.Writer) error {
+		if info.Format == formatChunked {
+			return chunkedDecode(ctx, info, w)
+		}
+		return streamDecode(ctx, info, w)
+	})
+}
+
+// streamDecode writes the content of the stream format entry info to w,
+// checking it against the recorded checksum.
+//
+// Only Shard shards are read, from the fastest remotes. A spare shard is
+// fetched, from the stripe being decoded, only when a shard can't be read or
+// is too slow. Corrupted shards are caught when the data is decrypted or by
+// the final checksum.
+func streamDecode(ctx context.Context, info FileInfo, w io.Writer) error {
+	shards := shardsByIndex(info)
+	order, hedgeAfter := streamDecodeOptions(info, shards)
+	open := shardOpener(info, shards)
+
+	cipher, err := fileCipher(info)
+	if err != nil {
+		return fmt.Errorf("failed to make cipher: %w", err)
+	}
+	encSize := cipher.EncryptedSize(info.FileSize)
+	return decodeStream(cipher, info, func(w io.Writer) error {
+		return reedsolomon.DecodeStripesFrom(ctx, open, reedsolomon.Codec(info.Codec), info.Shard, info.Parity, info.StripeSize, encSize, w, reedsolomon.StripeDecodeOptions{
+			Order:      order,
+			HedgeAfter: hedgeAfter,
+		}, info.stripeOptions()...)
+	}, w)
+}
+
+// shardOpener returns the opener of the shards of info, shards by index
+func shardOpener(info FileInfo, shards []DistributedFile) reedsolomon.ShardOpener {
+	return func(ctx context.Context, i int, offset int64) (io.ReadCloser, error) {
+		if shards[i].DistributedFile == "" {
+			return nil, fmt.Errorf("shard %d is not recorded", i)
+		}
+		fs.Debugf(info.FileName, "Fetching shard %d from %s", i, shards[i].Remote.Name)
+		in, err := openShardData(ctx, info, shards[i], offset)
+		reportShard(info.FileName, shards[i], stateDownloading, err)
+		return in, err
+	}
+}
+
+// streamDecodeRange writes limit bytes of the content of the stream format
+// entry info, from offset, to w. A negative limit reads to the end.
+//
+// Only the encrypted blocks holding the range are decoded, from the parts
+// of the data shards they lie in, see reedsolomon.ReadStripesRange. Every
+// block is authenticated when decrypted but, as the whole file isn't read,
+// the checksum isn't checked.
+func streamDecodeRange(ctx context.Context, info FileInfo, offset, limit int64, w io.Writer) error {
+	shards := shardsByIndex(info)
+	order, _ := streamDecodeOptions(info, shards)
+	open := shardOpener(info, shards)
+
+	cipher, err := fileCipher(info)
+	if err != nil {
+		return fmt.Errorf("failed to make cipher: %w", err)
+	}
+	encSize := cipher.EncryptedSize(info.FileSize)
+	openEncrypted := func(ctx context.Context, encOffset, encLimit int64) (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			_ = pw.CloseWithError(reedsolomon.ReadStripesRange(ctx, open, reedsolomon.Codec(info.Codec), info.Shard, info.Parity, info.StripeSize, encSize, encOffset, encLimit, pw, reedsolomon.StripeDecodeOptions{
+				Order: order,
+			}, info.stripeOptions()...))
+		}()
+		return pr, nil
+	}
+	plain, err := cipher.DecryptDataSeek(ctx, openEncrypted, offset, limit)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", info.FileName, err)
+	}
+	defer func() {
+		_ = plain.Close()
+	}()
+	if _, err := io.Copy(w, plain); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", info.FileName, err)
+	}
+	return nil
+}
+
+// writeLocalFile creates outPath with what write writes, removing it if
+// write fails
+func writeLocalFile(outPath string, write func(io.Writer) error) (err error) {
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(outPath)
+		}
+	}()
+	return write(out)
+}
+
+// decodeStream runs decode, decrypts what it writes into out and checks the
+// result against the recorded checksum
+func decodeStream(cipher *crypt.Cipher, info FileInfo, decode func(io.Writer) error, out io.Writer) error {
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(decode(pw))
+	}()
+
+	plain, err := cipher.DecryptData(pr)
+	if err != nil {
+		_ = pr.CloseWithError(err)
+		return fmt.Errorf("failed to decrypt %s: %w", info.FileName, err)
+	}
+	defer func() {
+		_ = plain.Close()
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), plain); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", info.FileName, err)
+	}
+	if info.Checksum != "" && hex.EncodeToString(h.Sum(nil)) != info.Checksum {
+		return fmt.Errorf("checksum mismatch for %s", info.FileName)
+	}
+	return nil
+}
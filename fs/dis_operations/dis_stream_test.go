@@ -0,0 +1,242 @@
+package dis_operations
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/rclone/rclone/backend/alias"
+	_ "github.com/rclone/rclone/backend/local"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/reedsolomon"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// passphrase of the keyring made by the tests
+const testPassphrase = "dis test passphrase"
+
+// setupStreamRemotes points the config at a temporary directory holding
+// three alias remotes backed by local directories
+func setupStreamRemotes(t *testing.T) string {
+	dir := setupTestStore(t)
+	t.Setenv(PassphraseEnv, testPassphrase)
+	oldSettle := lockSettle
+	lockSettle = 10 * time.Millisecond
+	t.Cleanup(func() {
+		lockSettle = oldSettle
+		cache.Clear()
+		forgetMasterKey()
+	})
+	for _, name := range []string{"streama", "streamb", "streamc"} {
+		t.Setenv("RCLONE_CONFIG_"+strings.ToUpper(name)+"_TYPE", "alias")
+		t.Setenv("RCLONE_CONFIG_"+strings.ToUpper(name)+"_REMOTE", filepath.Join(dir, name))
+	}
+	return dir
+}
+
+func TestStreamUploadDownloadScrub(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	const name = "stream_test/data.bin"
+
+	data := make([]byte, 300000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "data.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+
+	require.NoError(t, streamUploadFile(ctx, src, name, RoundRobin, ShardProfile{}))
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+	}()
+
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	assert.Equal(t, formatSealed, info.Format)
+	assert.Len(t, info.DistributedFileInfos, info.Shard+info.Parity)
+
+	download := func() []byte {
+		out := t.TempDir()
+		info, err := GetFileInfoStruct(name)
+		require.NoError(t, err)
+		require.NoError(t, streamDownloadFile(ctx, info, out))
+		got, err := os.ReadFile(filepath.Join(out, "data.bin"))
+		require.NoError(t, err)
+		return got
+	}
+	assert.True(t, bytes.Equal(data, download()))
+
+	// losing a data shard is covered by parity
+	lost := info.DistributedFileInfos[name+fileCryptExtension+".0"]
+	hashedFileName, err := CalculateHash(lost.DistributedFile)
+	require.NoError(t, err)
+	shardPath := filepath.Join(dir, lost.Remote.Name, remoteDirectory, hashedFileName)
+	require.NoError(t, os.Remove(shardPath))
+	assert.True(t, bytes.Equal(data, download()))
+
+	// and scrub puts it back
+	report, err := scrubFile(ctx, name, RoundRobin, true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Repaired)
+	assert.Equal(t, info.Parity, report.Margin)
+	assert.FileExists(t, shardPath)
+
+	report, err = scrubFile(ctx, name, RoundRobin, false)
+	require.NoError(t, err)
+	assert.Equal(t, info.Shard+info.Parity, report.Healthy)
+}
+
+func TestStreamUploadLeopard(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	const name = "stream_test/leopard.bin"
+
+	data := make([]byte, 300000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "leopard.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+
+	// more shards than Reed-Solomon over GF(2^8) supports
+	profile := ShardProfile{Name: customProfile, Data: 200, Parity: 100}
+	require.NoError(t, streamUploadFile(ctx, src, name, RoundRobin, profile))
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+	}()
+
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	assert.Equal(t, string(reedsolomon.CodecLeopardGF16), info.Codec)
+	assert.Len(t, info.DistributedFileInfos, 300)
+
+	lost := info.DistributedFileInfos[name+fileCryptExtension+".7"]
+	hashedFileName, err := CalculateHash(lost.DistributedFile)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(dir, lost.Remote.Name, remoteDirectory, hashedFileName)))
+
+	out := t.TempDir()
+	require.NoError(t, streamDownloadFile(ctx, info, out))
+	got, err := os.ReadFile(filepath.Join(out, "leopard.bin"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+}
+
+func TestStreamUploadLocalParity(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	const name = "stream_test/local.bin"
+
+	data := make([]byte, 300000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "local.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+
+	profile := ShardProfile{Name: customProfile, Data: 4, Parity: 4, LocalGroups: 2}
+	require.NoError(t, streamUploadFile(ctx, src, name, RoundRobin, profile))
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+	}()
+
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	assert.Equal(t, 2, info.LocalGroups)
+	assert.Len(t, info.DistributedFileInfos, 10)
+
+	// a lost data shard is rebuilt from its group
+	lost := info.DistributedFileInfos[name+fileCryptExtension+".3"]
+	hashedFileName, err := CalculateHash(lost.DistributedFile)
+	require.NoError(t, err)
+	shardPath := filepath.Join(dir, lost.Remote.Name, remoteDirectory, hashedFileName)
+	require.NoError(t, os.Remove(shardPath))
+
+	statuses := make([]string, 10)
+	for i := range statuses {
+		statuses[i] = shardOK
+	}
+	statuses[3] = shardMissing
+	assert.Equal(t, []int{2, 9}, repairReads(info, shardsByIndex(info), statuses))
+
+	report, err := scrubFile(ctx, name, RoundRobin, true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Repaired)
+	assert.Equal(t, info.Parity, report.Margin)
+	assert.FileExists(t, shardPath)
+
+	out := t.TempDir()
+	require.NoError(t, streamDownloadFile(ctx, info, out))
+	got, err := os.ReadFile(filepath.Join(out, "local.bin"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+}
+
+func TestStreamDownloadFailureKeepsFile(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	const name = "stream_test/unreadable.bin"
+
+	data := make([]byte, 300000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "unreadable.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	require.NoError(t, streamUploadFile(ctx, src, name, RoundRobin, ShardProfile{}))
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+	}()
+
+	// more shards lost than there is parity
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	shards := shardsByIndex(info)
+	for _, dFile := range shards[:info.Parity+1] {
+		hashedFileName, err := CalculateHash(dFile.DistributedFile)
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(filepath.Join(dir, dFile.Remote.Name, remoteDirectory, hashedFileName)))
+	}
+
+	// the error is returned and nothing is removed
+	out := t.TempDir()
+	assert.Error(t, disDownloadFile(ctx, name, out, false))
+	info, err = GetFileInfoStruct(name)
+	require.NoError(t, err)
+	assert.False(t, info.Flag)
+	for _, dFile := range shards[info.Parity+1:] {
+		hashedFileName, err := CalculateHash(dFile.DistributedFile)
+		require.NoError(t, err)
+		assert.FileExists(t, filepath.Join(dir, dFile.Remote.Name, remoteDirectory, hashedFileName))
+	}
+}
+
+func TestUploadSealedReadsOnce(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	const name = "stream_test/once.bin"
+
+	data := make([]byte, 300000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "once.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	in, err := os.Open(src)
+	require.NoError(t, err)
+	defer func() {
+		_ = in.Close()
+	}()
+
+	counting := &countingFile{File: in}
+	entry := FileInfo{FileName: name, ModTime: time.Now(), Version: 1}
+	require.NoError(t, uploadSealed(context.Background(), counting, int64(len(data)), entry, RoundRobin, ShardProfile{}, SaveFileInfo))
+	assert.Equal(t, int64(len(data)), counting.n)
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	sum := sha256.Sum256(data)
+	assert.Equal(t, hex.EncodeToString(sum[:]), info.Checksum)
+}
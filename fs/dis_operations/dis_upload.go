@@ -2,8 +2,13 @@ package dis_operations
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -13,100 +18,151 @@ import (
 	"github.com/rclone/rclone/fs"
 	"github.com/rclone/rclone/fs/config"
 	"github.com/rclone/rclone/fs/operations"
-	rsync "github.com/rclone/rclone/fs/sync"
 	"github.com/rclone/rclone/reedsolomon"
 	"github.com/spf13/cobra"
 )
 
-var (
-	createEmptySrcDirs = false
-)
-
-var copyCommandDefinition = &cobra.Command{
-	Use: "copy source:path dest:path",
-	Annotations: map[string]string{
-		"groups": "Copy,Filter,Listing,Important",
-	},
-	Run: func(command *cobra.Command, args []string) {
-		cmd.CheckArgs(2, 2, command, args)
-		fsrc, srcFileName, fdst := cmd.NewFsSrcFileDst(args)
-		cmd.RunWithSustainOS(true, true, command, func() error {
-			if srcFileName == "" {
-				return rsync.CopyDir(context.Background(), fdst, fsrc, createEmptySrcDirs)
-			}
-			return operations.CopyFile(context.Background(), fdst, fsrc, srcFileName, srcFileName)
-		}, true)
-	},
-}
+// Dis_Upload distributes args[0] which may be a file or a directory.
+// args[1], if given, is the logical path to store it under; otherwise the
+// path given in args[0] is used. The progress is journaled, and with
+// reSignal the upload the journal holds is resumed.
+func Dis_Upload(ctx context.Context, args []string, reSignal bool, loadBalancer LoadBalancerType, profile ShardProfile) error {
+	ctx, unlock, err := lockStore(ctx, "upload")
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-func Dis_Upload(args []string, reSignal bool, loadBalancer LoadBalancerType) error {
 	absolutePath, err := dis_init(args[0])
 
 	if err != nil {
 		return err
 	}
 
-	originalFileName := filepath.Base(args[0])
-	var distributedFileArray []DistributedFile
-	hashedNamesMap := make(map[string]string)
-
-	if reSignal {
-		tempDistributedFileArray, err := GetDistributedFileStruct(originalFileName)
+	var logicalPath string
+	if len(args) > 1 {
+		logicalPath, err = NormalizeLogicalPath(args[1])
 		if err != nil {
 			return err
 		}
+	} else {
+		logicalPath = defaultLogicalPath(args[0], absolutePath)
+	}
 
-		for _, dFile := range tempDistributedFileArray {
-			if !dFile.Check {
-				distributedFileArray = append(distributedFileArray, dFile)
-				hashVal, err := CalculateHash(dFile.DistributedFile)
-				if err != nil {
-					return err
-				}
-				hashedNamesMap[dFile.DistributedFile] = hashVal
-			}
-		}
+	info, err := os.Stat(absolutePath)
+	if err != nil {
+		return err
+	}
+
+	syncMetadata()
+	j, err := startJournal(args, absolutePath, logicalPath, reSignal, loadBalancer, profile)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = disUploadDir(ctx, absolutePath, logicalPath, reSignal, loadBalancer, profile, j)
 	} else {
-		// Uncomment this to allow duplicate check
-		// Currently commented bc gui not supporting this behavior
+		err = disUploadFile(ctx, absolutePath, logicalPath, reSignal, loadBalancer, profile, j)
+	}
+	if err == nil {
+		// complete, there is nothing to resume
+		err = writeJournal(nil, nil)
+	}
+	syncMetadata()
+	return err
+}
+
+// walking the directory and uploading every regular file in it.
+// files are recorded in the datamap under "<logicalPath>/<relative path>" and
+// every directory walked gets its own entry, so empty ones are kept too
+func disUploadDir(ctx context.Context, absolutePath string, logicalPath string, reSignal bool, loadBalancer LoadBalancerType, profile ShardProfile, j *uploadJournal) error {
+	var files []string
 
-		isDuplicate, err := DoesFileStructExist(originalFileName)
+	err := filepath.WalkDir(absolutePath, func(p string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-
-		if isDuplicate {
-			// if ShowDescription_DoOverwrite(originalFileName) {
-			// 	err = Dis_rm(args, false)
-			// 	if err != nil {
-			// 		return err
-			// 	}
-			// } else {
-			// 	return nil
-			// }
-			err = Dis_rm(args, false)
+		if d.IsDir() {
+			info, err := d.Info()
 			if err != nil {
 				return err
 			}
+			rel, err := filepath.Rel(absolutePath, p)
+			if err != nil {
+				return err
+			}
+			return MakeDirEntry(path.Join(logicalPath, filepath.ToSlash(rel)), info.ModTime(), info.Mode())
+		}
+		if d.Type().IsRegular() {
+			files = append(files, p)
 		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk directory %s: %w", absolutePath, err)
+	}
+
+	if len(files) == 0 {
+		fmt.Printf("No files to upload in %s\n", absolutePath)
+		return nil
+	}
 
-		hashedNamesMap, distributedFileArray, err = prepareUpload(absolutePath)
+	for _, p := range files {
+		rel, err := filepath.Rel(absolutePath, p)
 		if err != nil {
 			return err
 		}
+		originalFileName := path.Join(logicalPath, filepath.ToSlash(rel))
+		fmt.Printf("Uploading %s as %s\n", p, originalFileName)
+
+		if err := disUploadFile(ctx, p, originalFileName, reSignal, loadBalancer, profile, j); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", originalFileName, err)
+		}
 	}
 
-	start := time.Now()
+	fmt.Printf("Completed Dis_Upload of %d files in %s\n", len(files), logicalPath)
+	return nil
+}
 
-	if err := startUploadFileGoroutine_Worker(originalFileName, hashedNamesMap, distributedFileArray, loadBalancer, 32); err != nil {
+// uploading a single local file which is recorded in the datamap as originalFileName
+func disUploadFile(ctx context.Context, absolutePath string, originalFileName string, reSignal bool, loadBalancer LoadBalancerType, profile ShardProfile, j *uploadJournal) (err error) {
+	reportFile(originalFileName, stateUploading, nil)
+	defer func() {
+		reportFile(originalFileName, stateUploaded, err)
+	}()
+	if j.isDone(originalFileName) {
+		fmt.Printf("%s was uploaded before the interruption\n", originalFileName)
+		return nil
+	}
+	start := time.Now()
+	fileInfo, err := os.Stat(absolutePath)
+	if err != nil {
 		return err
 	}
 
-	elapsed := time.Since(start)
-	fileInfo, err := os.Stat(args[0])
+	existing, err := GetFileInfoStruct(originalFileName)
+	ctx, done := fileStatsContext(ctx, originalFileName)
+	defer done()
+	endPhase := startPhase(ctx, originalFileName, fileInfo.Size(), phaseEncode)
+	if reSignal && err == nil && existing.Flag && existing.State == "upload" {
+		err = resumeUploadFile(ctx, absolutePath, originalFileName, loadBalancer, profile, j)
+	} else {
+		// uploading a file again makes a new version of it, unless it was
+		// being removed, see nextVersion
+		err = nil
+		if existing.Flag && existing.State == "rm" {
+			err = Dis_rm(ctx, []string{originalFileName}, false)
+		}
+		if err == nil {
+			err = chunkedUploadFile(ctx, absolutePath, originalFileName, loadBalancer, profile, j)
+		}
+	}
+	endPhase(err)
 	if err != nil {
 		return err
 	}
+
+	elapsed := time.Since(start)
 	throughput := float64(fileInfo.Size()) / elapsed.Seconds() / (1024 * 1024) // MB/s
 	currentTime := time.Now().Format("2006-01-02 15:04:05")
 
@@ -117,16 +173,157 @@ func Dis_Upload(args []string, reSignal bool, loadBalancer LoadBalancerType) err
 		return err
 	}
 
+	if err := applyRetention(ctx, originalFileName); err != nil {
+		return err
+	}
+
+	if err := j.finish(originalFileName); err != nil {
+		return err
+	}
+
 	fmt.Println("Completed Dis_Upload!")
-	//local->remote sync
-	// err = dis_config.SyncAllLocalToRemote(rclonePath)
-	// if err != nil {
-	// 	return err
-	// }
 
 	return nil
 }
 
+// applyRetention drops the versions of originalFileName, just uploaded,
+// which the configured retention policy doesn't keep
+func applyRetention(ctx context.Context, originalFileName string) error {
+	policy, err := GetRetentionPolicy()
+	if err != nil {
+		return err
+	}
+	dropped, err := pruneVersions(ctx, originalFileName, policy, false)
+	if err != nil {
+		return err
+	}
+	for _, version := range dropped {
+		fmt.Printf("Dropped %s version %d\n", originalFileName, version.VersionNumber())
+	}
+	return nil
+}
+
+// resuming an interrupted upload of originalFileName.
+// Shards of the legacy format are still in the shard dir so only the ones not
+// uploaded yet are sent. Chunked files carry on from the progress in j and
+// send neither the chunks stored nor the shards uploaded already; sealed
+// files only send the shards not uploaded yet. Anything else starts again
+// from scratch, keeping the earlier versions.
+func resumeUploadFile(ctx context.Context, absolutePath string, originalFileName string, loadBalancer LoadBalancerType, profile ShardProfile, j *uploadJournal) error {
+	fileInfo, err := GetFileInfoStruct(originalFileName)
+	if err != nil {
+		return err
+	}
+
+	if fileInfo.Format == formatChunked {
+		return chunkedUploadFile(ctx, absolutePath, originalFileName, loadBalancer, profile, j)
+	}
+	if fileInfo.Format == formatSealed {
+		err := resumeSealedFile(ctx, absolutePath, fileInfo)
+		if !errors.Is(err, errResumeMismatch) {
+			return err
+		}
+		fmt.Printf("%s: %v, uploading it again\n", originalFileName, err)
+	}
+	if fileInfo.Format == formatStream || fileInfo.Format == formatSealed {
+		// uploaded again with the shard counts it was started with
+		profile := ShardProfile{Name: fileInfo.Profile, Data: fileInfo.Shard, Parity: fileInfo.Parity, LocalGroups: fileInfo.LocalGroups}
+		return streamUploadFile(ctx, absolutePath, originalFileName, loadBalancer, profile)
+	}
+
+	var distributedFileArray []DistributedFile
+	var uploaded []Remote
+	hashedNamesMap := make(map[string]string)
+	for _, dFile := range fileInfo.DistributedFileInfos {
+		if dFile.Check {
+			uploaded = append(uploaded, dFile.Remote)
+			continue
+		}
+		distributedFileArray = append(distributedFileArray, dFile)
+		hashVal, err := CalculateHash(dFile.DistributedFile)
+		if err != nil {
+			return err
+		}
+		hashedNamesMap[dFile.DistributedFile] = hashVal
+	}
+
+	// placing the remaining shards around the ones already uploaded
+	remotes, err := placeReplacements(ctx, loadBalancer, uploaded, len(distributedFileArray), fileInfo.Parity, nil)
+	if err != nil {
+		return err
+	}
+	for i := range distributedFileArray {
+		distributedFileArray[i].Remote = remotes[i]
+	}
+
+	return startUploadFileGoroutine_Worker(ctx, originalFileName, hashedNamesMap, distributedFileArray, loadBalancer, 32)
+}
+
+// resumeSealedFile carries on with the interrupted upload info of the file
+// absolutePath, see resumeSealed
+func resumeSealedFile(ctx context.Context, absolutePath string, info FileInfo) error {
+	src, err := os.Open(absolutePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() != info.FileSize || !stat.ModTime().Equal(info.ModTime) {
+		return errResumeMismatch
+	}
+	// the shards uploaded hold the source as it was, so it must be the same
+	srcHash := sha256.New()
+	if _, err := io.Copy(srcHash, src); err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(srcHash.Sum(nil))
+	if info.Checksum == "" {
+		if info.Checksum, err = uploadedChecksum(ctx, info); err != nil {
+			return err
+		}
+		if checksum == info.Checksum {
+			err = updateFileInfo(info.FileName, func(fileInfo *FileInfo) error {
+				fileInfo.Checksum = checksum
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if checksum != info.Checksum {
+		return errResumeMismatch
+	}
+	return resumeSealed(ctx, info)
+}
+
+// uploadedChecksum returns the checksum of the data the shards of the
+// interrupted upload info which got to their remotes hold. The checksum is
+// only recorded once every shard is sent, so this is how a resumed upload
+// checks its source didn't change.
+func uploadedChecksum(ctx context.Context, info FileInfo) (string, error) {
+	uploaded := info
+	uploaded.DistributedFileInfos = make(map[string]DistributedFile, len(info.DistributedFileInfos))
+	for key, dFile := range info.DistributedFileInfos {
+		if dFile.Check && dFile.Checksum != "" {
+			uploaded.DistributedFileInfos[key] = dFile
+		}
+	}
+	h := sha256.New()
+	if err := streamDecode(ctx, uploaded, h); err != nil {
+		if ctx.Err() != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("%w: %v", errResumeMismatch, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func createHashNames(distributedFileArray []DistributedFile) (hashNameMap map[string]string, errors []error) {
 	hashNameMap = make(map[string]string)
 	var errs []error
@@ -142,11 +339,24 @@ func createHashNames(distributedFileArray []DistributedFile) (hashNameMap map[st
 	return hashNameMap, errs
 }
 
-func prepareUpload(absolutePath string) (hashNameMap map[string]string, distributedFileInfos []DistributedFile, err error) {
-	dis_names, checksums, shardSize, padding, shard, parity := reedsolomon.DoEncode(absolutePath, tryGetPassword())
-	fmt.Println("Shard:", shard)
-	fmt.Println("Parity:", parity)
-	remotes := config.GetRemotes()
+func prepareUpload(ctx context.Context, absolutePath string, originalFileName string) (hashNameMap map[string]string, distributedFileInfos []DistributedFile, err error) {
+	stat, err := os.Stat(absolutePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataShards, parityShards := reedsolomon.ShardsForSize(stat.Size())
+	codec := reedsolomon.CodecFor(dataShards + parityShards)
+	password, err := legacyPassword()
+	if err != nil {
+		return nil, nil, err
+	}
+	encoded, err := reedsolomon.DoEncode(ctx, absolutePath, password, codec, dataShards, parityShards)
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Println("Shard:", encoded.DataShards)
+	fmt.Println("Parity:", encoded.ParityShards)
+	remotes := shardRemotes()
 
 	err = MakeDistributionDir(remotes)
 	if err != nil {
@@ -154,11 +364,22 @@ func prepareUpload(absolutePath string) (hashNameMap map[string]string, distribu
 	}
 
 	// get Distributed info	해야함
-	for idx, source := range dis_names {
-		dis_fileName := filepath.Base(source)
+	// shard names keep the directory part of the logical path so that their
+	// hashed names don't collide on the remote with same named files elsewhere
+	for idx, source := range encoded.Paths {
+		dis_fileName := fmt.Sprintf("%s%s.%d", originalFileName, fileCryptExtension, idx)
+
+		// the local shard is named after the source file which may differ from
+		// the logical name, so rename it to what the download will look for
+		localName := filepath.Join(filepath.Dir(source), path.Base(dis_fileName))
+		if localName != source {
+			if err := os.Rename(source, localName); err != nil {
+				return nil, nil, fmt.Errorf("failed to rename shard %s: %w", source, err)
+			}
+		}
 
 		// Get the distributed info (Remote is filled at distribution-time)
-		distributionFile, err := GetDistributedInfo(dis_fileName, Remote{}, checksums[idx])
+		distributionFile, err := GetDistributedInfo(dis_fileName, Remote{}, encoded.Checksums[idx])
 		if err != nil {
 			return nil, nil, err
 		}
@@ -172,7 +393,7 @@ func prepareUpload(absolutePath string) (hashNameMap map[string]string, distribu
 		return nil, nil, fmt.Errorf("errors occurred during hashing: %v", errs)
 	}
 
-	err = MakeDataMap(absolutePath, distributedFileInfos, shardSize, padding, shard, parity)
+	err = MakeDataMapWithName(absolutePath, originalFileName, distributedFileInfos, encoded.ShardSize, encoded.Padding, encoded.Codec, encoded.DataShards, encoded.ParityShards)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -180,7 +401,7 @@ func prepareUpload(absolutePath string) (hashNameMap map[string]string, distribu
 	return hashNameMap, distributedFileInfos, nil
 }
 
-func uploadFile(source, dest string, mu *sync.Mutex, totalThroughput *float64, fileCount *int, errs *[]error, originalFileName string, shardInfo DistributedFile, hashedFileNameMap map[string]string) error {
+func uploadFile(ctx context.Context, source string, mu *sync.Mutex, totalThroughput *float64, fileCount *int, errs *[]error, originalFileName string, shardInfo DistributedFile, hashedFileNameMap map[string]string) error {
 	// Get file info
 	fileInfo, err := os.Stat(source)
 	if err != nil {
@@ -193,10 +414,10 @@ func uploadFile(source, dest string, mu *sync.Mutex, totalThroughput *float64, f
 
 	// Measure time for upload
 	startTime := time.Now()
-	err = remoteCallCopy([]string{source, dest})
+	err = copyShard(ctx, source, shardInfo)
 	if err != nil {
 		mu.Lock()
-		*errs = append(*errs, fmt.Errorf("error in remoteCallCopy for file %s: %w", source, err))
+		*errs = append(*errs, fmt.Errorf("error uploading shard file %s: %w", source, err))
 		mu.Unlock()
 		return err
 	}
@@ -226,6 +447,22 @@ func uploadFile(source, dest string, mu *sync.Mutex, totalThroughput *float64, f
 	return nil
 }
 
+// copyShard uploads the local shard file source as the shard dFile
+func copyShard(ctx context.Context, source string, dFile DistributedFile) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	return putShard(ctx, dFile, in, stat.Size(), stat.ModTime())
+}
+
 func updateRemoteInfo_Up(originalFileName string, shardInfo DistributedFile, throughputKbps float64, mu *sync.Mutex) error {
 	mu.Lock()
 	err := UpdateDistributedFile_CheckFlagAndRemote(originalFileName, shardInfo.DistributedFile, true, shardInfo.Remote)
@@ -243,7 +480,7 @@ func updateRemoteInfo_Up(originalFileName string, shardInfo DistributedFile, thr
 	return nil
 }
 
-func startUploadFileGoroutine_Worker(originalFileName string, hashedFileNameMap map[string]string, distributedFileArray []DistributedFile, loadBalancer LoadBalancerType, workerCount int) (err error) {
+func startUploadFileGoroutine_Worker(ctx context.Context, originalFileName string, hashedFileNameMap map[string]string, distributedFileArray []DistributedFile, loadBalancer LoadBalancerType, workerCount int) (err error) {
 	var mu sync.Mutex
 	var wg sync.WaitGroup
 	var errs []error
@@ -256,10 +493,13 @@ func startUploadFileGoroutine_Worker(originalFileName string, hashedFileNameMap
 	// Worker function
 	uploader := func() {
 		for shardInfo := range jobs {
-			// Allocate Remote
-			mu.Lock()
-			err := shardInfo.AllocateRemote(loadBalancer)
-			mu.Unlock()
+			// Allocate Remote unless the shard was placed already
+			var err error
+			if shardInfo.Remote.Name == "" {
+				mu.Lock()
+				err = shardInfo.AllocateRemote(loadBalancer)
+				mu.Unlock()
+			}
 			if err != nil {
 				mu.Lock()
 				errs = append(errs, err)
@@ -267,11 +507,10 @@ func startUploadFileGoroutine_Worker(originalFileName string, hashedFileNameMap
 				continue
 			}
 
-			dest := fmt.Sprintf("%s:%s", shardInfo.Remote.Name, remoteDirectory)
 			source := filepath.Join(dir, hashedFileNameMap[shardInfo.DistributedFile])
 
 			// Upload file and calculate throughput
-			err = uploadFile(source, dest, &mu, &totalThroughput, &fileCount, &errs, originalFileName, shardInfo, hashedFileNameMap)
+			err = uploadFile(ctx, source, &mu, &totalThroughput, &fileCount, &errs, originalFileName, shardInfo, hashedFileNameMap)
 			if err != nil {
 				mu.Lock()
 				errs = append(errs, err)
@@ -309,7 +548,7 @@ func startUploadFileGoroutine_Worker(originalFileName string, hashedFileNameMap
 	return nil
 }
 
-func startUploadFileGoroutine(originalFileName string, hashedFileNameMap map[string]string, distributedFileArray []DistributedFile, loadBalancer LoadBalancerType) (err error) {
+func startUploadFileGoroutine(ctx context.Context, originalFileName string, hashedFileNameMap map[string]string, distributedFileArray []DistributedFile, loadBalancer LoadBalancerType) (err error) {
 	var mu sync.Mutex
 	var wg sync.WaitGroup
 	var errs []error
@@ -335,11 +574,10 @@ func startUploadFileGoroutine(originalFileName string, hashedFileNameMap map[str
 				return
 			}
 
-			dest := fmt.Sprintf("%s:%s", shardInfo.Remote.Name, remoteDirectory)
 			source := filepath.Join(dir, hashedFileNameMap[shardInfo.DistributedFile])
 
 			// Upload file and calculate throughput
-			err = uploadFile(source, dest, &mu, &totalThroughput, &fileCount, &errs, originalFileName, shardInfo, hashedFileNameMap)
+			err = uploadFile(ctx, source, &mu, &totalThroughput, &fileCount, &errs, originalFileName, shardInfo, hashedFileNameMap)
 			if err != nil {
 				mu.Lock()
 				errs = append(errs, err)
@@ -389,21 +627,6 @@ func MakeDistributionDir(remotes []config.Remote) (err error) {
 	return nil
 }
 
-func remoteCallCopy(args []string) (err error) {
-	fmt.Printf("Calling remoteCallCopy with args: %v\n", args)
-
-	// Fetch the copy command
-	copyCommand := *copyCommandDefinition
-	copyCommand.SetArgs(args)
-
-	err = copyCommand.Execute()
-	if err != nil {
-		return fmt.Errorf("error executing copyCommand: %w", err)
-	}
-
-	return nil
-}
-
 func logThroughput(totalThroughput float64, fileCount int) {
 	if fileCount > 0 {
 		averageThroughput := totalThroughput / float64(fileCount)
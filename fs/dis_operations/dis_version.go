@@ -0,0 +1,442 @@
+package dis_operations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/operations"
+	"golang.org/x/sync/errgroup"
+)
+
+// File versions
+//
+// Uploading a file which is already distributed makes a new version of it
+// and keeps the previous ones, which stay readable until the new upload has
+// succeeded and afterwards until the retention policy drops them. The
+// datamap entry of a file describes its current version and holds the older
+// ones retained in Versions, newest first.
+//
+// Every version has its own shards, named after the version, see shardName.
+// The shards of a dropped version are deleted unless a retained version
+// still references them. Scrub and rebalance only look after the current
+// version of a file.
+//
+// The retention policy is set in the dis_retention section of rclone.conf, eg
+//
+//	[dis_retention]
+//	keep_last = 5
+//	keep_daily = 7
+//
+// Without it every version is kept.
+const retentionSection = "dis_retention"
+
+// shardName returns the name of shard index of version of fileName. The
+// first version keeps the names shards had before files were versioned.
+func shardName(fileName string, version, index int) string {
+	if version <= 1 {
+		return fmt.Sprintf("%s%s.%d", fileName, fileCryptExtension, index)
+	}
+	return fmt.Sprintf("%s%s.v%d.%d", fileName, fileCryptExtension, version, index)
+}
+
+// shardFileOf returns the name of the file the shard distributedFileName
+// is part of
+func shardFileOf(distributedFileName string) string {
+	if i := strings.LastIndex(distributedFileName, fileCryptExtension); i >= 0 {
+		return distributedFileName[:i]
+	}
+	return distributedFileName
+}
+
+// VersionNumber returns the version of info, files uploaded before
+// versioning being version 1
+func (info FileInfo) VersionNumber() int {
+	if info.Version == 0 {
+		return 1
+	}
+	return info.Version
+}
+
+// Uploaded returns when the version info was uploaded
+func (info FileInfo) Uploaded() time.Time {
+	if info.UploadTime.IsZero() {
+		return info.ModTime
+	}
+	return info.UploadTime
+}
+
+// history returns every retained version of info, newest first
+func (info FileInfo) history() []FileInfo {
+	current := info
+	current.Versions = nil
+	return append([]FileInfo{current}, info.Versions...)
+}
+
+// eachVersion calls fn on info and every older version of it
+func (info *FileInfo) eachVersion(fn func(version *FileInfo) error) error {
+	if err := fn(info); err != nil {
+		return err
+	}
+	for i := range info.Versions {
+		if err := fn(&info.Versions[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextVersion returns the version number the upload of name starting now
+// gets and the versions it keeps. An interrupted upload is replaced, after
+// its shards are deleted.
+func nextVersion(ctx context.Context, name string) (int, []FileInfo, error) {
+	files, err := readDatamap()
+	if err != nil {
+		return 0, nil, err
+	}
+	prev, ok := files[name]
+	if !ok || prev.IsDir {
+		return 1, nil, nil
+	}
+	if prev.Flag && prev.State == "upload" {
+		rest := prev
+		rest.DistributedFileInfos = nil
+		files[name] = rest
+		if err := deleteShards(ctx, unreferencedShards(files, []FileInfo{prev})); err != nil {
+			return 0, nil, fmt.Errorf("failed to delete the interrupted upload of %s: %w", name, err)
+		}
+		return prev.VersionNumber(), prev.Versions, nil
+	}
+	versions := prev.history()
+	for i := range versions {
+		versions[i] = publishedInfo(versions[i])
+	}
+	return prev.VersionNumber() + 1, versions, nil
+}
+
+// FileVersions returns every retained version of the file name, newest
+// first, or of every file below it if name is a directory
+func FileVersions(name string) ([]FileInfo, error) {
+	name, err := NormalizeLogicalPath(name)
+	if err != nil {
+		return nil, err
+	}
+	files, err := readDatamap()
+	if err != nil {
+		return nil, err
+	}
+	if info, ok := files[name]; ok && !info.IsDir {
+		return info.history(), nil
+	}
+	fileNames, err := GetFileNamesInDir(name)
+	if err != nil {
+		return nil, fmt.Errorf("file name '%s' not found", name)
+	}
+	sort.Strings(fileNames)
+	var versions []FileInfo
+	for _, fileName := range fileNames {
+		versions = append(versions, files[fileName].history()...)
+	}
+	return versions, nil
+}
+
+// FileVersion returns version n of the file name
+func FileVersion(name string, n int) (FileInfo, error) {
+	info, err := GetFileInfoStruct(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	for _, version := range info.history() {
+		if version.VersionNumber() == n {
+			return version, nil
+		}
+	}
+	return FileInfo{}, fmt.Errorf("version %d of %s not found", n, name)
+}
+
+// RetentionPolicy chooses which versions of a file are kept. A version is
+// kept if any rule keeps it and the current version is always kept.
+type RetentionPolicy struct {
+	// KeepLast is the number of most recent versions kept
+	KeepLast int
+	// KeepDaily is the number of days, from the most recent one with an
+	// upload, for which the last version uploaded that day is kept
+	KeepDaily int
+}
+
+// keepsAll returns true if p drops nothing
+func (p RetentionPolicy) keepsAll() bool {
+	return p.KeepLast <= 0 && p.KeepDaily <= 0
+}
+
+// GetRetentionPolicy returns the retention policy of the config
+func GetRetentionPolicy() (RetentionPolicy, error) {
+	var p RetentionPolicy
+	for key, value := range map[string]*int{"keep_last": &p.KeepLast, "keep_daily": &p.KeepDaily} {
+		s := config.GetValue(retentionSection, key)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return RetentionPolicy{}, fmt.Errorf("bad %s %q in the [%s] config section", key, s, retentionSection)
+		}
+		*value = n
+	}
+	return p, nil
+}
+
+// retained returns which of versions, newest first, p keeps
+func (p RetentionPolicy) retained(versions []FileInfo) []bool {
+	keep := make([]bool, len(versions))
+	days := 0
+	lastDay := ""
+	for i, version := range versions {
+		keep[i] = i == 0 || p.keepsAll() || i < p.KeepLast
+		day := version.Uploaded().Local().Format("2006-01-02")
+		if day != lastDay && days < p.KeepDaily {
+			days++
+			keep[i] = true
+		}
+		lastDay = day
+	}
+	return keep
+}
+
+// unreferencedShards returns the shards of dropped which no version of
+// files references
+func unreferencedShards(files map[string]FileInfo, dropped []FileInfo) []DistributedFile {
+	key := func(dFile DistributedFile) string {
+		return dFile.Remote.Name + ":" + dFile.DistributedFile
+	}
+	referenced := make(map[string]bool)
+	for _, info := range files {
+		for _, version := range info.history() {
+			for _, dFile := range version.DistributedFileInfos {
+				referenced[key(dFile)] = true
+			}
+		}
+	}
+	var shards []DistributedFile
+	for _, version := range dropped {
+		for _, dFile := range version.DistributedFileInfos {
+			if dFile.Remote.Name == "" || referenced[key(dFile)] {
+				continue
+			}
+			referenced[key(dFile)] = true
+			shards = append(shards, dFile)
+		}
+	}
+	return shards
+}
+
+// deleteShards deletes shards from their remotes. Shards already gone
+// aren't an error.
+func deleteShards(ctx context.Context, shards []DistributedFile) error {
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(fs.GetConfig(ctx).Checkers)
+	for _, dFile := range shards {
+		dFile := dFile
+		g.Go(func() error {
+			err := deleteShard(gCtx, dFile)
+			reportShard(shardFileOf(dFile.DistributedFile), dFile, stateDeleted, err)
+			return err
+		})
+	}
+	return g.Wait()
+}
+
+// deleteShard deletes the shard dFile from its remote
+func deleteShard(ctx context.Context, dFile DistributedFile) error {
+	f, err := getShardFs(ctx, dFile.Remote)
+	if err != nil {
+		return err
+	}
+	hashedFileName, err := CalculateHash(dFile.DistributedFile)
+	if err != nil {
+		return err
+	}
+	obj, err := f.NewObject(ctx, hashedFileName)
+	if errors.Is(err, fs.ErrorObjectNotFound) || errors.Is(err, fs.ErrorDirNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("shard %s on %s: %w", dFile.DistributedFile, dFile.Remote.Name, err)
+	}
+	return operations.DeleteFile(ctx, obj)
+}
+
+// removeVersions deletes the shards of versions, the older versions of the
+// file name being removed, which no other file references
+func removeVersions(ctx context.Context, name string, versions []FileInfo) error {
+	if len(versions) == 0 {
+		return nil
+	}
+	files, err := readDatamap()
+	if err != nil {
+		return err
+	}
+	delete(files, name)
+	return deleteShards(ctx, unreferencedShards(files, versions))
+}
+
+// discardUpload drops the unfinished upload of the file name, going back to
+// the version before it, and deletes the shards and chunks only it used
+func discardUpload(ctx context.Context, name string) error {
+	var unfinished FileInfo
+	var files map[string]FileInfo
+	err := updateDatamap(func(filesMap map[string]FileInfo) error {
+		info, ok := filesMap[name]
+		if !ok || !info.Flag || info.State != "upload" {
+			return fmt.Errorf("%s has no unfinished upload", name)
+		}
+		unfinished, files = info, filesMap
+		if len(info.Versions) == 0 {
+			delete(filesMap, name)
+			return nil
+		}
+		previous := info.Versions[0]
+		previous.Versions = info.Versions[1:]
+		filesMap[name] = previous
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	unfinished.Versions = nil
+	if err := deleteShards(ctx, unreferencedShards(files, []FileInfo{unfinished})); err != nil {
+		return fmt.Errorf("failed to delete the unfinished upload of %s: %w", name, err)
+	}
+	if _, err := collectChunks(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("Dropped the unfinished upload of %s\n", name)
+	return nil
+}
+
+// pruneVersions drops the versions of the file name which policy doesn't
+// retain and deletes the shards no retained version references. It returns
+// the versions dropped, or which would be with dryRun.
+func pruneVersions(ctx context.Context, name string, policy RetentionPolicy, dryRun bool) ([]FileInfo, error) {
+	var dropped []FileInfo
+	var files map[string]FileInfo
+	err := updateDatamap(func(filesMap map[string]FileInfo) error {
+		dropped, files = nil, filesMap
+		info, ok := filesMap[name]
+		if !ok || info.IsDir {
+			return fmt.Errorf("file '%s' not found", name)
+		}
+		if info.Flag {
+			return fmt.Errorf("%s has an unfinished %s", name, info.State)
+		}
+		keep := policy.retained(info.history())
+		var kept []FileInfo
+		for i, version := range info.Versions {
+			if keep[i+1] {
+				kept = append(kept, version)
+			} else {
+				dropped = append(dropped, version)
+			}
+		}
+		if len(dropped) == 0 {
+			return nil
+		}
+		info.Versions = kept
+		filesMap[name] = info
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+	if len(dropped) == 0 || dryRun {
+		return dropped, nil
+	}
+	if err := deleteShards(ctx, unreferencedShards(files, dropped)); err != nil {
+		return dropped, fmt.Errorf("failed to delete the shards of dropped versions of %s: %w", name, err)
+	}
+	if _, err := collectChunks(ctx); err != nil {
+		return dropped, err
+	}
+	return dropped, nil
+}
+
+// Dis_GC drops the versions of the files named in args, every file when
+// args is empty, which policy doesn't retain and deletes their shards.
+// With --dry-run the versions which would be dropped are only listed.
+func Dis_GC(ctx context.Context, args []string, policy RetentionPolicy) error {
+	dryRun := fs.GetConfig(ctx).DryRun
+	if !dryRun {
+		var unlock func()
+		var err error
+		ctx, unlock, err = lockStore(ctx, "gc")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	syncMetadata()
+
+	var fileNames []string
+	if len(args) == 0 {
+		entries, err := ListDir("", true)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir {
+				fileNames = append(fileNames, entry.FileName)
+			}
+		}
+	} else {
+		name, err := NormalizeLogicalPath(args[0])
+		if err != nil {
+			return err
+		}
+		exists, err := DoesFileStructExist(name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			fileNames = []string{name}
+		} else if fileNames, err = GetFileNamesInDir(name); err != nil {
+			return fmt.Errorf("file name '%s' not found", name)
+		}
+	}
+
+	var errs []error
+	total := 0
+	for _, name := range fileNames {
+		dropped, err := pruneVersions(ctx, name, policy, dryRun)
+		for _, version := range dropped {
+			if dryRun {
+				fmt.Printf("Would drop %s version %d\n", name, version.VersionNumber())
+			} else {
+				fmt.Printf("Dropped %s version %d\n", name, version.VersionNumber())
+			}
+		}
+		total += len(dropped)
+		if err != nil {
+			fmt.Printf("Failed to prune %s: %v\n", name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	fmt.Printf("Dropped %d versions of %d files\n", total, len(fileNames))
+	if !dryRun {
+		// chunks left behind by interrupted uploads are collected too
+		if _, err := collectChunks(ctx); err != nil {
+			errs = append(errs, err)
+		}
+		syncMetadata()
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,127 @@
+package dis_operations
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	day := time.Date(2024, 5, 10, 12, 0, 0, 0, time.Local)
+	// newest first: two uploads on the 10th, one on the 9th, two on the 7th
+	var versions []FileInfo
+	for _, upload := range []time.Time{
+		day.Add(2 * time.Hour), day, day.Add(-24 * time.Hour), day.Add(-72 * time.Hour), day.Add(-74 * time.Hour),
+	} {
+		versions = append(versions, FileInfo{UploadTime: upload})
+	}
+
+	for _, test := range []struct {
+		policy RetentionPolicy
+		want   []bool
+	}{
+		{RetentionPolicy{}, []bool{true, true, true, true, true}},
+		{RetentionPolicy{KeepLast: 1}, []bool{true, false, false, false, false}},
+		{RetentionPolicy{KeepLast: 2}, []bool{true, true, false, false, false}},
+		{RetentionPolicy{KeepDaily: 2}, []bool{true, false, true, false, false}},
+		{RetentionPolicy{KeepDaily: 5}, []bool{true, false, true, true, false}},
+		{RetentionPolicy{KeepLast: 2, KeepDaily: 3}, []bool{true, true, true, true, false}},
+	} {
+		assert.Equal(t, test.want, test.policy.retained(versions), "%+v", test.policy)
+	}
+}
+
+func TestFileVersions(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	ctx := context.Background()
+	const name = "version_test/data.bin"
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+	}()
+
+	var contents [][]byte
+	upload := func(finish bool) {
+		data := make([]byte, 50000*(len(contents)+1))
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		src := filepath.Join(dir, "data.bin")
+		require.NoError(t, os.WriteFile(src, data, 0644))
+		require.NoError(t, streamUploadFile(ctx, src, name, RoundRobin, ShardProfile{}))
+		if finish {
+			require.NoError(t, ResetCheckFlag(name))
+			contents = append(contents, data)
+		}
+	}
+	shardsExist := func(info FileInfo) (n int) {
+		for _, dFile := range info.DistributedFileInfos {
+			hashedFileName, err := CalculateHash(dFile.DistributedFile)
+			require.NoError(t, err)
+			if _, err := os.Stat(filepath.Join(dir, dFile.Remote.Name, remoteDirectory, hashedFileName)); err == nil {
+				n++
+			}
+		}
+		return n
+	}
+
+	upload(true)
+	upload(true)
+	// an upload which didn't finish is replaced by the next one
+	upload(false)
+	interrupted, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	upload(true)
+	assert.Zero(t, shardsExist(interrupted))
+
+	versions, err := FileVersions(name)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	for i, version := range versions {
+		assert.Equal(t, 3-i, version.VersionNumber())
+		assert.Equal(t, int64(len(contents[2-i])), version.FileSize)
+		assert.Equal(t, len(version.DistributedFileInfos), shardsExist(version))
+	}
+
+	// every version can still be read
+	for n := 1; n <= 3; n++ {
+		info, err := FileVersion(name, n)
+		require.NoError(t, err)
+		out := t.TempDir()
+		require.NoError(t, streamDownloadFile(ctx, info, out))
+		got, err := os.ReadFile(filepath.Join(out, "data.bin"))
+		require.NoError(t, err)
+		assert.Equal(t, contents[n-1], got)
+	}
+
+	// a dry run drops nothing
+	dropped, err := pruneVersions(ctx, name, RetentionPolicy{KeepLast: 2}, true)
+	require.NoError(t, err)
+	require.Len(t, dropped, 1)
+	versions, err = FileVersions(name)
+	require.NoError(t, err)
+	assert.Len(t, versions, 3)
+
+	dropped, err = pruneVersions(ctx, name, RetentionPolicy{KeepLast: 2}, false)
+	require.NoError(t, err)
+	require.Len(t, dropped, 1)
+	assert.Equal(t, 1, dropped[0].VersionNumber())
+	assert.Zero(t, shardsExist(dropped[0]))
+	_, err = FileVersion(name, 1)
+	assert.Error(t, err)
+	versions, err = FileVersions(name)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, len(versions[1].DistributedFileInfos), shardsExist(versions[1]))
+
+	// removing the file removes the shards of every version
+	info, err := GetFileInfoStruct(name)
+	require.NoError(t, err)
+	require.NoError(t, removeVersions(ctx, name, info.Versions))
+	assert.Zero(t, shardsExist(versions[1]))
+	assert.Equal(t, len(info.DistributedFileInfos), shardsExist(info))
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 )
 
@@ -14,9 +15,10 @@ func ConvertFileNameForUP(name string) (string, error) {
 		fmt.Errorf("failed to calculate hash: %v", err)
 	}
 
+	// name may carry the directory of an uploaded directory, the local shard doesn't
 	dir := GetShardPath()
 	hashedFilePath := filepath.Join(dir, hashFileName)
-	originalFilePath := filepath.Join(dir, name)
+	originalFilePath := filepath.Join(dir, path.Base(name))
 
 	err = os.Rename(originalFilePath, hashedFilePath)
 	if err != nil {
@@ -30,7 +32,7 @@ func ConvertFileNameForUP(name string) (string, error) {
 func ConvertFileNameForDo(hashedName string, originalName string) error {
 	dir := GetShardPath()
 	hashedFilePath := filepath.Join(dir, hashedName)
-	originalFilePath := filepath.Join(dir, originalName)
+	originalFilePath := filepath.Join(dir, path.Base(originalName))
 
 	_, err := os.Stat(hashedFilePath)
 	if err != nil {
@@ -0,0 +1,197 @@
+package dis_operations
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NormalizeLogicalPath converts a user supplied path into the logical path
+// used as the key of the datamap, eg "./a//b/report.pdf" -> "a/b/report.pdf"
+func NormalizeLogicalPath(p string) (string, error) {
+	p = strings.TrimSpace(filepath.ToSlash(p))
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return "", errors.New("logical path cannot be empty")
+	}
+	return p, nil
+}
+
+// defaultLogicalPath chooses the logical path of an upload when the user gave none.
+// Relative sources keep their path so that a/report.pdf and b/report.pdf don't
+// collide, anything outside the working directory falls back to its base name
+func defaultLogicalPath(arg string, absolutePath string) string {
+	slashed := filepath.ToSlash(filepath.Clean(arg))
+	if filepath.IsAbs(arg) || slashed == ".." || strings.HasPrefix(slashed, "../") {
+		return filepath.Base(absolutePath)
+	}
+	logicalPath, err := NormalizeLogicalPath(slashed)
+	if err != nil {
+		return filepath.Base(absolutePath)
+	}
+	return logicalPath
+}
+
+// parentDirs returns every parent directory of logicalPath, outermost first
+func parentDirs(logicalPath string) []string {
+	var dirs []string
+	for dir := path.Dir(logicalPath); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	return dirs
+}
+
+// addParentDirs records the parent directories of logicalPath in filesMap
+// if they are not there yet
+func addParentDirs(filesMap map[string]FileInfo, logicalPath string, modTime time.Time) error {
+	for _, dir := range parentDirs(logicalPath) {
+		entry, exists := filesMap[dir]
+		if !exists {
+			filesMap[dir] = newDirEntry(dir, modTime, os.ModeDir|0755)
+			continue
+		}
+		if !entry.IsDir {
+			return fmt.Errorf("can't create %q: %q is a file", logicalPath, dir)
+		}
+	}
+	return nil
+}
+
+func newDirEntry(dirName string, modTime time.Time, mode os.FileMode) FileInfo {
+	return FileInfo{
+		FileName: dirName,
+		IsDir:    true,
+		ModTime:  modTime,
+		Mode:     mode | os.ModeDir,
+	}
+}
+
+// MakeDirEntry records the directory dirName with its parents in the datamap
+func MakeDirEntry(dirName string, modTime time.Time, mode os.FileMode) error {
+	return updateDatamap(func(filesMap map[string]FileInfo) error {
+		if entry, exists := filesMap[dirName]; exists && !entry.IsDir {
+			return fmt.Errorf("can't create directory %q: a file with that name exists", dirName)
+		}
+		if err := addParentDirs(filesMap, dirName, modTime); err != nil {
+			return err
+		}
+		filesMap[dirName] = newDirEntry(dirName, modTime, mode)
+		return nil
+	})
+}
+
+// isUnder returns true if logicalPath is below dirName
+func isUnder(logicalPath, dirName string) bool {
+	return strings.HasPrefix(logicalPath, strings.TrimSuffix(dirName, "/")+"/")
+}
+
+// returning the entries below dirName (all of them when recursive is set),
+// sorted by path. Directories only implied by the paths of files uploaded
+// before directory entries existed are included as well.
+func ListDir(dirName string, recursive bool) ([]FileInfo, error) {
+	filesMap, err := readDatamap()
+	if err != nil {
+		return nil, err
+	}
+
+	if dirName != "" {
+		if entry, exists := filesMap[dirName]; exists && !entry.IsDir {
+			return nil, fmt.Errorf("%q is not a directory", dirName)
+		}
+	}
+
+	entries := make(map[string]FileInfo)
+	for name, info := range filesMap {
+		if isChunkEntry(name) || dirName != "" && !isUnder(name, dirName) {
+			continue
+		}
+
+		// the part of the path below dirName
+		rel := name
+		if dirName != "" {
+			rel = name[len(dirName)+1:]
+		}
+
+		if !recursive {
+			if i := strings.Index(rel, "/"); i >= 0 {
+				child := rel[:i]
+				if dirName != "" {
+					child = dirName + "/" + child
+				}
+				if _, ok := entries[child]; !ok {
+					if dir, ok := filesMap[child]; ok {
+						entries[child] = dir
+					} else {
+						entries[child] = newDirEntry(child, info.ModTime, 0755)
+					}
+				}
+				continue
+			}
+		} else {
+			for _, dir := range parentDirs(name) {
+				if dirName != "" && !isUnder(dir, dirName) {
+					continue
+				}
+				if _, ok := entries[dir]; !ok {
+					if entry, ok := filesMap[dir]; ok {
+						entries[dir] = entry
+					} else {
+						entries[dir] = newDirEntry(dir, info.ModTime, 0755)
+					}
+				}
+			}
+		}
+		entries[name] = info
+	}
+
+	if dirName != "" && len(entries) == 0 {
+		if _, exists := filesMap[dirName]; !exists {
+			return nil, fmt.Errorf("directory '%s' not found", dirName)
+		}
+	}
+
+	result := make([]FileInfo, 0, len(entries))
+	for _, info := range entries {
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].FileName < result[j].FileName
+	})
+	return result, nil
+}
+
+// RemoveDirFromMetadata removes dirName and all directory entries below it.
+// Files below dirName must have been removed already.
+func RemoveDirFromMetadata(dirName string) error {
+	return updateDatamap(func(filesMap map[string]FileInfo) error {
+		for name, info := range filesMap {
+			if name != dirName && !isUnder(name, dirName) {
+				continue
+			}
+			if !info.IsDir {
+				return fmt.Errorf("directory %q is not empty: %q remains", dirName, name)
+			}
+			delete(filesMap, name)
+		}
+		return nil
+	})
+}
+
+// restoring mtime and mode recorded in the datamap on a downloaded file or directory
+func applyEntryMetadata(localPath string, info FileInfo) {
+	if info.Mode != 0 {
+		if err := os.Chmod(localPath, info.Mode.Perm()); err != nil {
+			fmt.Printf("failed to set mode of %s: %v\n", localPath, err)
+		}
+	}
+	if !info.ModTime.IsZero() {
+		if err := os.Chtimes(localPath, info.ModTime, info.ModTime); err != nil {
+			fmt.Printf("failed to set modification time of %s: %v\n", localPath, err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package dis_operations
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeLogicalPath(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"./a//b/report.pdf", "a/b/report.pdf"},
+		{"/a/b/", "a/b"},
+		{"a/../b/report.pdf", "b/report.pdf"},
+		{"../../etc/passwd", "etc/passwd"},
+	} {
+		got, err := NormalizeLogicalPath(test.in)
+		require.NoError(t, err, test.in)
+		assert.Equal(t, test.want, got, test.in)
+	}
+
+	_, err := NormalizeLogicalPath("/")
+	assert.Error(t, err)
+}
+
+func TestDefaultLogicalPath(t *testing.T) {
+	assert.Equal(t, "a/report.pdf", defaultLogicalPath("a/report.pdf", "/home/user/a/report.pdf"))
+	assert.Equal(t, "report.pdf", defaultLogicalPath("/home/user/a/report.pdf", "/home/user/a/report.pdf"))
+	assert.Equal(t, "report.pdf", defaultLogicalPath("../report.pdf", "/home/report.pdf"))
+}
+
+func TestAddParentDirs(t *testing.T) {
+	now := time.Now()
+	filesMap := map[string]FileInfo{}
+	require.NoError(t, addParentDirs(filesMap, "a/b/c.txt", now))
+	assert.True(t, filesMap["a"].IsDir)
+	assert.True(t, filesMap["a/b"].IsDir)
+	assert.Len(t, filesMap, 2)
+
+	filesMap["a/b/c.txt"] = FileInfo{FileName: "a/b/c.txt"}
+	assert.Error(t, addParentDirs(filesMap, "a/b/c.txt/d.txt", now))
+}
@@ -0,0 +1,387 @@
+package dis_operations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rclone/rclone/fs/rc"
+	"github.com/rclone/rclone/fs/rc/jobs"
+)
+
+func init() {
+	rc.Add(rc.Call{
+		Path:         "dis/upload",
+		AuthRequired: true,
+		Fn:           rcUpload,
+		Title:        "Distribute a local file or directory over the remotes",
+		Help: `This takes the following parameters:
+
+- source - the local file or directory to upload
+- dest - the logical path to store it under (optional)
+- loadBalancer - RoundRobin, UploadOptima, DownloadOptima or ResourceBased (default RoundRobin)
+- profile - name of the durability profile (optional)
+- dataShards, parityShards - shard counts overriding the profile (optional)
+- autoParity - derive the parity from the number of remotes if set
+- localGroups - number of groups of data shards given a local parity (optional)
+
+An unfinished upload is resumed first. Run it with _async=true and
+follow it with dis/status or job/status, job/stop cancels it.
+
+See the [dis_upload](/commands/rclone_dis_upload/) command for more information on the above.
+` + rcProgressHelp,
+	})
+	rc.Add(rc.Call{
+		Path:         "dis/download",
+		AuthRequired: true,
+		Fn:           rcDownload,
+		Title:        "Download a distributed file or directory",
+		Help: `This takes the following parameters:
+
+- name - the logical path of the file or directory
+- dest - the local directory to download it into
+- version - the version of the file to download (optional)
+
+See the [dis_download](/commands/rclone_dis_download/) command for more information on the above.
+` + rcProgressHelp,
+	})
+	rc.Add(rc.Call{
+		Path:         "dis/rm",
+		AuthRequired: true,
+		Fn:           rcRm,
+		Title:        "Remove a distributed file or directory",
+		Help: `This takes the following parameters:
+
+- name - the logical path of the file or directory
+
+Every version of the files is removed.
+` + rcProgressHelp,
+	})
+	rc.Add(rc.Call{
+		Path:         "dis/scrub",
+		AuthRequired: true,
+		Fn:           rcScrub,
+		Title:        "Check the shards of distributed files and repair them",
+		Help: `This takes the following parameters:
+
+- name - the logical path of a file or directory, every file if not set
+- loadBalancer - how rebuilt shards are placed (default RoundRobin)
+
+See the [dis_scrub](/commands/rclone_dis_scrub/) command for more information on the above.
+` + rcProgressHelp,
+	})
+	rc.Add(rc.Call{
+		Path:         "dis/list",
+		AuthRequired: true,
+		Fn:           rcList,
+		Title:        "List the distributed files",
+		Help: `This takes the following parameters:
+
+- dir - the logical directory to list, the root if not set
+- recursive - list every entry below dir if set
+- versions - list every retained version of the files below dir if set
+
+Returns
+
+- list - the entries, each with name, size, modTime, isDir, version,
+  format, profile, shards, parity, sha256 and the unfinished operation
+  on it if any
+`,
+	})
+	rc.Add(rc.Call{
+		Path:         "dis/status",
+		AuthRequired: true,
+		Fn:           rcStatus,
+		Title:        "Progress of the dis/* calls and work left unfinished",
+		Help: `This takes the following parameters:
+
+- id - the operation to report, the last one if not set
+- jobid - the job of the operation to report, instead of id
+
+Returns
+
+- operation - the progress of the operation, as returned by dis/upload
+- unfinished - the operations an interruption left unfinished, each with
+  operation and name, resumed or cleaned up by the next dis/* call
+`,
+	})
+}
+
+const rcProgressHelp = `
+Returns the progress of the operation:
+
+- id, jobid - the id of the operation and of its job
+- operation, args - what was run
+- started, ended, finished - when it ran and whether it is over
+- error - what failed, if anything
+- files - the state of every file: name, state, error
+- shards - the state of every shard: file, shard, remote, state, error
+
+The transfers of the shards are accounted in the stats group of the job,
+see core/stats.
+`
+
+// rcRun runs the operation fn under the store lock, recording its progress,
+// and returns the progress. fn is given the context of the job, cancelled
+// by job/stop or if the lock is lost.
+func rcRun(ctx context.Context, operation string, args []string, fn func(ctx context.Context) error) (rc.Params, error) {
+	jobID, _ := jobs.GetJobID(ctx)
+	p := startProgress(operation, args, max(jobID, 0))
+	ctx, unlock, err := lockStore(ctx, operation)
+	if err == nil {
+		err = fn(ctx)
+		unlock()
+	}
+	p.finish(err)
+	out := make(rc.Params)
+	if reshapeErr := rc.Reshape(&out, p.snapshot()); reshapeErr != nil && err == nil {
+		err = reshapeErr
+	}
+	return out, err
+}
+
+// rcLoadBalancer returns the load balancer in the parameter loadBalancer
+func rcLoadBalancer(in rc.Params) (LoadBalancerType, error) {
+	name, err := in.GetString("loadBalancer")
+	if rc.IsErrParamNotFound(err) {
+		return RoundRobin, nil
+	} else if err != nil {
+		return "", err
+	}
+	loadBalancer := LoadBalancerType(name)
+	if !loadBalancer.IsValid() {
+		return "", rc.NewErrParamInvalid(fmt.Errorf("invalid load balancer type: %s", name))
+	}
+	return loadBalancer, nil
+}
+
+// rcUpload runs dis/upload
+func rcUpload(ctx context.Context, in rc.Params) (rc.Params, error) {
+	source, err := in.GetString("source")
+	if err != nil {
+		return nil, err
+	}
+	args := []string{source}
+	dest, err := in.GetString("dest")
+	if rc.NotErrParamNotFound(err) {
+		return nil, err
+	}
+	if dest != "" {
+		args = append(args, dest)
+	}
+	loadBalancer, err := rcLoadBalancer(in)
+	if err != nil {
+		return nil, err
+	}
+	profileName, err := in.GetString("profile")
+	if rc.NotErrParamNotFound(err) {
+		return nil, err
+	}
+	dataShards, err := in.GetInt64("dataShards")
+	if rc.NotErrParamNotFound(err) {
+		return nil, err
+	}
+	parityShards, err := in.GetInt64("parityShards")
+	if rc.NotErrParamNotFound(err) {
+		return nil, err
+	}
+	autoParity, err := in.GetBool("autoParity")
+	if rc.NotErrParamNotFound(err) {
+		return nil, err
+	}
+	localGroups, err := in.GetInt64("localGroups")
+	if rc.NotErrParamNotFound(err) {
+		return nil, err
+	}
+	profile, err := ResolveShardProfile(profileName, int(dataShards), int(parityShards), int(localGroups), autoParity)
+	if err != nil {
+		return nil, rc.NewErrParamInvalid(err)
+	}
+	return rcRun(ctx, "upload", args, func(ctx context.Context) error {
+		sameCommand, err := CheckState(ctx, "upload", args, loadBalancer)
+		if err != nil || sameCommand {
+			return err
+		}
+		return Dis_Upload(ctx, args, false, loadBalancer, profile)
+	})
+}
+
+// rcDownload runs dis/download
+func rcDownload(ctx context.Context, in rc.Params) (rc.Params, error) {
+	name, err := in.GetString("name")
+	if err != nil {
+		return nil, err
+	}
+	dest, err := in.GetString("dest")
+	if err != nil {
+		return nil, err
+	}
+	version, err := in.GetInt64("version")
+	if rc.NotErrParamNotFound(err) {
+		return nil, err
+	}
+	args := []string{name, dest}
+	return rcRun(ctx, "download", args, func(ctx context.Context) error {
+		if version != 0 {
+			return Dis_DownloadVersion(ctx, args, int(version))
+		}
+		sameCommand, err := CheckState(ctx, "download", args, None)
+		if err != nil || sameCommand {
+			return err
+		}
+		return Dis_Download(ctx, args, false)
+	})
+}
+
+// rcRm runs dis/rm
+func rcRm(ctx context.Context, in rc.Params) (rc.Params, error) {
+	name, err := in.GetString("name")
+	if err != nil {
+		return nil, err
+	}
+	args := []string{name}
+	return rcRun(ctx, "rm", args, func(ctx context.Context) error {
+		sameCommand, err := CheckState(ctx, "remove", args, None)
+		if err != nil || sameCommand {
+			return err
+		}
+		return Dis_rm(ctx, args, false)
+	})
+}
+
+// rcScrub runs dis/scrub
+func rcScrub(ctx context.Context, in rc.Params) (rc.Params, error) {
+	var args []string
+	name, err := in.GetString("name")
+	if rc.NotErrParamNotFound(err) {
+		return nil, err
+	}
+	if name != "" {
+		args = append(args, name)
+	}
+	loadBalancer, err := rcLoadBalancer(in)
+	if err != nil {
+		return nil, err
+	}
+	return rcRun(ctx, "scrub", args, func(ctx context.Context) error {
+		return Dis_Scrub(ctx, args, loadBalancer)
+	})
+}
+
+// rcEntry is an entry returned by dis/list
+type rcEntry struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+	IsDir      bool      `json:"isDir"`
+	Version    int       `json:"version,omitempty"`
+	Format     string    `json:"format,omitempty"`
+	Profile    string    `json:"profile,omitempty"`
+	Shards     int       `json:"shards,omitempty"`
+	Parity     int       `json:"parity,omitempty"`
+	SHA256     string    `json:"sha256,omitempty"`
+	Unfinished string    `json:"unfinished,omitempty"`
+}
+
+// rcList runs dis/list
+func rcList(ctx context.Context, in rc.Params) (rc.Params, error) {
+	dir, err := in.GetString("dir")
+	if rc.NotErrParamNotFound(err) {
+		return nil, err
+	}
+	recursive, err := in.GetBool("recursive")
+	if rc.NotErrParamNotFound(err) {
+		return nil, err
+	}
+	versions, err := in.GetBool("versions")
+	if rc.NotErrParamNotFound(err) {
+		return nil, err
+	}
+	_, unlock, err := lockStore(ctx, "list")
+	if err != nil {
+		return nil, err
+	}
+	var infos []FileInfo
+	if versions {
+		infos, err = Dis_lsVersions(dir)
+	} else {
+		syncMetadata()
+		infos, err = Dis_lsDir(dir, recursive)
+	}
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]rcEntry, 0, len(infos))
+	for _, info := range infos {
+		entry := rcEntry{
+			Name:    info.FileName,
+			Size:    info.FileSize,
+			ModTime: info.ModTime,
+			IsDir:   info.IsDir,
+		}
+		if !info.IsDir {
+			entry.Version = info.VersionNumber()
+			entry.Format = info.Format
+			entry.Profile = info.Profile
+			entry.Shards = info.Shard
+			entry.Parity = info.Parity
+			entry.SHA256 = info.SHA256()
+		}
+		if info.Flag {
+			entry.Unfinished = info.State
+		}
+		list = append(list, entry)
+	}
+	return rc.Params{"list": list}, nil
+}
+
+// rcUnfinished is an operation left unfinished, returned by dis/status
+type rcUnfinished struct {
+	Operation string `json:"operation"`
+	Name      string `json:"name"`
+}
+
+// rcStatus runs dis/status
+func rcStatus(ctx context.Context, in rc.Params) (rc.Params, error) {
+	id, err := in.GetInt64("id")
+	if rc.NotErrParamNotFound(err) {
+		return nil, err
+	}
+	jobID, err := in.GetInt64("jobid")
+	if rc.NotErrParamNotFound(err) {
+		return nil, err
+	}
+	out := rc.Params{}
+	if p := findProgress(id, jobID); p != nil {
+		out["operation"] = p.snapshot()
+	} else if id != 0 || jobID != 0 {
+		return nil, rc.NewErrParamInvalid(fmt.Errorf("operation not found"))
+	}
+
+	unfinished := []rcUnfinished{}
+	j, err := readJournal()
+	if err != nil {
+		return nil, err
+	}
+	if j != nil {
+		unfinished = append(unfinished, rcUnfinished{Operation: "upload", Name: j.Target})
+	}
+	files, err := readDatamap()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name, info := range files {
+		if info.Flag && !isChunkEntry(name) && (j == nil || name != j.Target) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		unfinished = append(unfinished, rcUnfinished{Operation: files[name].State, Name: name})
+	}
+	out["unfinished"] = unfinished
+	return out, nil
+}
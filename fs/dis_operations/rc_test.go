@@ -0,0 +1,113 @@
+package dis_operations
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rclone/rclone/fs/rc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func rcCall(t *testing.T, path string, in rc.Params) (rc.Params, error) {
+	call := rc.Calls.Get(path)
+	require.NotNil(t, call, path)
+	return call.Fn(context.Background(), in)
+}
+
+func TestRcUploadDownloadRm(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	const name = "rc_test/data.bin"
+	defer func() {
+		_ = RemoveFileFromMetadata(name)
+	}()
+
+	data := make([]byte, 300000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	src := filepath.Join(dir, "data.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+
+	out, err := rcCall(t, "dis/upload", rc.Params{"source": src, "dest": name})
+	require.NoError(t, err)
+	var p Progress
+	require.NoError(t, rc.Reshape(&p, out))
+	assert.Equal(t, "upload", p.Operation)
+	assert.True(t, p.Finished)
+	assert.Empty(t, p.Error)
+	require.Len(t, p.Files, 1)
+	assert.Equal(t, FileState{Name: name, State: stateUploaded, Updated: p.Files[0].Updated}, p.Files[0])
+	require.NotEmpty(t, p.Shards)
+	for _, shard := range p.Shards {
+		assert.Equal(t, stateUploaded, shard.State, shard.Shard)
+		assert.NotEmpty(t, shard.Remote)
+	}
+
+	_, err = rcCall(t, "dis/upload", rc.Params{"source": src, "loadBalancer": "Nope"})
+	assert.True(t, rc.IsErrParamInvalid(err))
+
+	out, err = rcCall(t, "dis/list", rc.Params{"dir": "rc_test"})
+	require.NoError(t, err)
+	list, ok := out["list"].([]rcEntry)
+	require.True(t, ok)
+	require.Len(t, list, 1)
+	assert.Equal(t, name, list[0].Name)
+	assert.Equal(t, int64(len(data)), list[0].Size)
+	assert.Equal(t, 1, list[0].Version)
+	assert.Empty(t, list[0].Unfinished)
+
+	out, err = rcCall(t, "dis/status", rc.Params{"id": p.ID})
+	require.NoError(t, err)
+	status, ok := out["operation"].(Progress)
+	require.True(t, ok)
+	assert.Equal(t, p.ID, status.ID)
+	assert.Empty(t, out["unfinished"])
+	_, err = rcCall(t, "dis/status", rc.Params{"id": p.ID + 1000})
+	assert.True(t, rc.IsErrParamInvalid(err))
+
+	dest := t.TempDir()
+	out, err = rcCall(t, "dis/download", rc.Params{"name": name, "dest": dest})
+	require.NoError(t, err)
+	require.NoError(t, rc.Reshape(&p, out))
+	assert.Empty(t, p.Error)
+	got, err := os.ReadFile(filepath.Join(dest, "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	require.Len(t, p.Files, 1)
+	assert.Equal(t, stateDownloaded, p.Files[0].State)
+
+	out, err = rcCall(t, "dis/rm", rc.Params{"name": name})
+	require.NoError(t, err)
+	require.NoError(t, rc.Reshape(&p, out))
+	assert.Empty(t, p.Error)
+	require.Len(t, p.Files, 1)
+	assert.Equal(t, stateRemoved, p.Files[0].State)
+	for _, shard := range p.Shards {
+		assert.Equal(t, stateDeleted, shard.State, shard.Shard)
+	}
+	_, err = GetFileInfoStruct(name)
+	assert.Error(t, err)
+}
+
+func TestRcStopped(t *testing.T) {
+	dir := setupStreamRemotes(t)
+	src := filepath.Join(dir, "data.bin")
+	require.NoError(t, os.WriteFile(src, []byte("stopped"), 0644))
+
+	// job/stop cancels the context of the call
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	call := rc.Calls.Get("dis/upload")
+	require.NotNil(t, call)
+	out, err := call.Fn(ctx, rc.Params{"source": src, "dest": "rc_test/stopped.bin"})
+	assert.ErrorIs(t, err, context.Canceled)
+	var p Progress
+	require.NoError(t, rc.Reshape(&p, out))
+	assert.True(t, p.Finished)
+	assert.NotEmpty(t, p.Error)
+	_, err = GetFileInfoStruct("rc_test/stopped.bin")
+	assert.Error(t, err)
+}
@@ -0,0 +1,562 @@
+package dis_operations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/lib/kv"
+)
+
+// The datamap and the load balancer state live in a bolt database next to
+// the rest of the dis data, under GetRcloneDirPath()/data, so that it is
+// kept and encrypted with it. Every read-modify-write of the metadata runs
+// as a single bolt transaction, so a crash never leaves a half written index
+// behind, and bolt's file lock serialises concurrent rclone dis_* processes.
+const (
+	storeFacility = "dis_metadata"
+	storeFileName = "dis_metadata.bolt"
+	fileKeyPrefix = "file/"
+	lbKey         = "loadbalancer"
+	keyringKey    = "keyring"
+	manifestKey   = "manifest"
+	journalKey    = "journal"
+)
+
+var (
+	storeMu       sync.Mutex
+	storeImported = make(map[string]bool)
+)
+
+// getStore returns the metadata database of the current config directory,
+// importing the metadata kept elsewhere before on first use
+func getStore() (*metadataDB, error) {
+	if !kv.Supported() {
+		return nil, kv.ErrUnsupported
+	}
+	dataDir := filepath.Join(GetRcloneDirPath(), "data")
+	db := &metadataDB{path: filepath.Join(dataDir, storeFileName)}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if storeImported[db.path] {
+		return db, nil
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to make metadata directory: %w", err)
+	}
+	if err := importCachedStore(db); err != nil {
+		return nil, err
+	}
+	if err := importLegacyJSON(db, dataDir); err != nil {
+		return nil, err
+	}
+	storeImported[db.path] = true
+	return db, nil
+}
+
+// MetadataStorePath returns the path of the metadata database
+func MetadataStorePath() string {
+	db, err := getStore()
+	if err != nil {
+		return ""
+	}
+	return db.Path()
+}
+
+// DoesMetadataStoreExist returns true if any distributed file has been recorded
+func DoesMetadataStoreExist() bool {
+	path := MetadataStorePath()
+	if path == "" {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Size() > 0
+}
+
+// loadDatamap decodes every file entry in the bucket. The raw values are
+// returned as well so that updates only rewrite entries which changed
+func loadDatamap(b kv.Bucket) (map[string]FileInfo, map[string][]byte, error) {
+	files := make(map[string]FileInfo)
+	raw := make(map[string][]byte)
+
+	cur := b.Cursor()
+	for bkey, data := cur.Seek([]byte(fileKeyPrefix)); bkey != nil; bkey, data = cur.Next() {
+		key := string(bkey)
+		if !strings.HasPrefix(key, fileKeyPrefix) {
+			break
+		}
+		name := key[len(fileKeyPrefix):]
+		var info FileInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode entry %q: %w", name, err)
+		}
+		files[name] = info
+		raw[name] = append([]byte(nil), data...)
+	}
+	return files, raw, nil
+}
+
+// kvReadDatamap: read all file entries
+type kvReadDatamap struct {
+	files map[string]FileInfo
+}
+
+func (op *kvReadDatamap) Do(ctx context.Context, b kv.Bucket) (err error) {
+	op.files, _, err = loadDatamap(b)
+	return err
+}
+
+// kvUpdateDatamap: modify the file entries in a single transaction
+type kvUpdateDatamap struct {
+	update func(map[string]FileInfo) error
+}
+
+func (op *kvUpdateDatamap) Do(ctx context.Context, b kv.Bucket) error {
+	files, raw, err := loadDatamap(b)
+	if err != nil {
+		return err
+	}
+
+	if err := op.update(files); err != nil {
+		return err
+	}
+	countChunkRefs(files)
+
+	for name, info := range files {
+		data, err := json.Marshal(info)
+		if err != nil {
+			return fmt.Errorf("failed to encode entry %q: %w", name, err)
+		}
+		if bytes.Equal(raw[name], data) {
+			continue
+		}
+		if err := b.Put([]byte(fileKeyPrefix+name), data); err != nil {
+			return err
+		}
+	}
+	for name := range raw {
+		if _, exists := files[name]; !exists {
+			if err := b.Delete([]byte(fileKeyPrefix + name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readDatamap returns all entries of the datamap keyed by logical path
+func readDatamap() (map[string]FileInfo, error) {
+	db, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	op := &kvReadDatamap{}
+	err = db.Do(false, op)
+	if errors.Is(err, kv.ErrEmpty) {
+		return make(map[string]FileInfo), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read datamap: %w", err)
+	}
+	return op.files, nil
+}
+
+// updateDatamap runs update on the datamap and commits the result atomically.
+// Nothing is written if update returns an error.
+func updateDatamap(update func(files map[string]FileInfo) error) error {
+	db, err := getStore()
+	if err != nil {
+		return err
+	}
+	return db.Do(true, &kvUpdateDatamap{update: update})
+}
+
+func newLoadBalancerInfo() *LoadBalancerInfo {
+	return &LoadBalancerInfo{
+		RoundRobinCounter: 0,
+		RemoteInfos:       make(map[string]RemoteInfo),
+	}
+}
+
+func decodeLoadBalancerInfo(data []byte) (*LoadBalancerInfo, error) {
+	lbInfo := newLoadBalancerInfo()
+	if data == nil {
+		return lbInfo, nil
+	}
+	if err := json.Unmarshal(data, lbInfo); err != nil {
+		return nil, fmt.Errorf("failed to decode load balancer info: %w", err)
+	}
+	if lbInfo.RemoteInfos == nil {
+		lbInfo.RemoteInfos = make(map[string]RemoteInfo)
+	}
+	return lbInfo, nil
+}
+
+// kvLoadBalancer: read or modify the load balancer state
+type kvLoadBalancer struct {
+	update func(*LoadBalancerInfo) error
+	lbInfo *LoadBalancerInfo
+}
+
+func (op *kvLoadBalancer) Do(ctx context.Context, b kv.Bucket) (err error) {
+	op.lbInfo, err = decodeLoadBalancerInfo(b.Get([]byte(lbKey)))
+	if err != nil || op.update == nil {
+		return err
+	}
+	if err := op.update(op.lbInfo); err != nil {
+		return err
+	}
+	data, err := json.Marshal(op.lbInfo)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(lbKey), data)
+}
+
+// readLoadBalancerInfo returns the load balancer state
+func readLoadBalancerInfo() (*LoadBalancerInfo, error) {
+	db, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	op := &kvLoadBalancer{}
+	err = db.Do(false, op)
+	if errors.Is(err, kv.ErrEmpty) {
+		return newLoadBalancerInfo(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read load balancer info: %w", err)
+	}
+	return op.lbInfo, nil
+}
+
+// updateLoadBalancerInfo runs update on the load balancer state and commits it atomically
+func updateLoadBalancerInfo(update func(*LoadBalancerInfo) error) error {
+	db, err := getStore()
+	if err != nil {
+		return err
+	}
+	return db.Do(true, &kvLoadBalancer{update: update})
+}
+
+// kvKeyRing: read the keyring or replace it, rewrapping the data keys of the
+// files in the same transaction
+type kvKeyRing struct {
+	put *KeyRing
+	// the put is refused unless the stored keyring has this version, 0 for none
+	expectVersion int
+	update        func(map[string]FileInfo) error
+	ring          *KeyRing
+}
+
+func (op *kvKeyRing) Do(ctx context.Context, b kv.Bucket) error {
+	op.ring = nil
+	if data := b.Get([]byte(keyringKey)); data != nil {
+		op.ring = &KeyRing{}
+		if err := json.Unmarshal(data, op.ring); err != nil {
+			return fmt.Errorf("failed to decode keyring: %w", err)
+		}
+	}
+	if op.put == nil {
+		return nil
+	}
+	stored := 0
+	if op.ring != nil {
+		stored = op.ring.Version
+	}
+	if stored != op.expectVersion {
+		return errKeyRingChanged
+	}
+	if op.update != nil {
+		if err := (&kvUpdateDatamap{update: op.update}).Do(ctx, b); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(op.put)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(keyringKey), data)
+}
+
+// readKeyRing returns the keyring, nil if there is none yet
+func readKeyRing() (*KeyRing, error) {
+	db, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	op := &kvKeyRing{}
+	err = db.Do(false, op)
+	if errors.Is(err, kv.ErrEmpty) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+	return op.ring, nil
+}
+
+// writeKeyRing replaces the keyring of version expectVersion, 0 if there is
+// none, by ring and runs update on the datamap in the same transaction
+func writeKeyRing(ring *KeyRing, expectVersion int, update func(map[string]FileInfo) error) error {
+	db, err := getStore()
+	if err != nil {
+		return err
+	}
+	return db.Do(true, &kvKeyRing{put: ring, expectVersion: expectVersion, update: update})
+}
+
+// kvManifest: read or replace the manifest last synced with the remotes
+type kvManifest struct {
+	put      *manifestState
+	manifest *manifestState
+}
+
+func (op *kvManifest) Do(ctx context.Context, b kv.Bucket) error {
+	if op.put != nil {
+		data, err := json.Marshal(op.put)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(manifestKey), data)
+	}
+	op.manifest = nil
+	if data := b.Get([]byte(manifestKey)); data != nil {
+		op.manifest = &manifestState{}
+		if err := json.Unmarshal(data, op.manifest); err != nil {
+			return fmt.Errorf("failed to decode manifest: %w", err)
+		}
+	}
+	return nil
+}
+
+// readManifestState returns the manifest last synced, nil if there is none
+func readManifestState() (*manifestState, error) {
+	db, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	op := &kvManifest{}
+	err = db.Do(false, op)
+	if errors.Is(err, kv.ErrEmpty) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	return op.manifest, nil
+}
+
+// writeManifestState records state as the manifest last synced
+func writeManifestState(state *manifestState) error {
+	db, err := getStore()
+	if err != nil {
+		return err
+	}
+	return db.Do(true, &kvManifest{put: state})
+}
+
+// kvSyncManifest: run sync on the manifest last synced and the datamap,
+// committing both in a single transaction
+type kvSyncManifest struct {
+	sync func(state *manifestState, files map[string]FileInfo) error
+}
+
+func (op *kvSyncManifest) Do(ctx context.Context, b kv.Bucket) error {
+	read := &kvManifest{}
+	if err := read.Do(ctx, b); err != nil {
+		return err
+	}
+	if read.manifest == nil {
+		return errors.New("no manifest state")
+	}
+	update := &kvUpdateDatamap{update: func(files map[string]FileInfo) error {
+		return op.sync(read.manifest, files)
+	}}
+	if err := update.Do(ctx, b); err != nil {
+		return err
+	}
+	return (&kvManifest{put: read.manifest}).Do(ctx, b)
+}
+
+// syncManifestState runs sync on the manifest last synced and the datamap
+// and commits both atomically. Nothing is written if sync returns an error.
+func syncManifestState(sync func(state *manifestState, files map[string]FileInfo) error) error {
+	db, err := getStore()
+	if err != nil {
+		return err
+	}
+	return db.Do(true, &kvSyncManifest{sync: sync})
+}
+
+// kvJournal: read, replace or remove the journal of the operation in
+// progress, running update on the datamap in the same transaction
+type kvJournal struct {
+	put     *uploadJournal
+	remove  bool
+	update  func(map[string]FileInfo) error
+	journal *uploadJournal
+}
+
+func (op *kvJournal) Do(ctx context.Context, b kv.Bucket) error {
+	if op.update != nil {
+		if err := (&kvUpdateDatamap{update: op.update}).Do(ctx, b); err != nil {
+			return err
+		}
+	}
+	if op.remove {
+		return b.Delete([]byte(journalKey))
+	}
+	if op.put != nil {
+		data, err := json.Marshal(op.put)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(journalKey), data)
+	}
+	op.journal = nil
+	if data := b.Get([]byte(journalKey)); data != nil {
+		op.journal = &uploadJournal{}
+		if err := json.Unmarshal(data, op.journal); err != nil {
+			return fmt.Errorf("failed to decode journal: %w", err)
+		}
+	}
+	return nil
+}
+
+// readJournal returns the journal of the operation in progress, nil if
+// there is none
+func readJournal() (*uploadJournal, error) {
+	db, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	op := &kvJournal{}
+	err = db.Do(false, op)
+	if errors.Is(err, kv.ErrEmpty) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+	return op.journal, nil
+}
+
+// writeJournal records j, or removes the journal if j is nil, and runs
+// update, if not nil, on the datamap in the same transaction
+func writeJournal(j *uploadJournal, update func(map[string]FileInfo) error) error {
+	db, err := getStore()
+	if err != nil {
+		return err
+	}
+	return db.Do(true, &kvJournal{put: j, remove: j == nil, update: update})
+}
+
+// kvImportLegacy: import the JSON files used before the metadata store
+type kvImportLegacy struct {
+	files  map[string]FileInfo
+	lbInfo *LoadBalancerInfo
+}
+
+func (op *kvImportLegacy) Do(ctx context.Context, b kv.Bucket) error {
+	for name, info := range op.files {
+		key := []byte(fileKeyPrefix + name)
+		if b.Get(key) != nil {
+			continue
+		}
+		data, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(key, data); err != nil {
+			return err
+		}
+	}
+	if op.lbInfo != nil && b.Get([]byte(lbKey)) == nil {
+		data, err := json.Marshal(op.lbInfo)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(lbKey), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importLegacyJSON moves datamap.json and loadbalancer.json into the store.
+// The JSON files are renamed afterwards so they are only imported once.
+func importLegacyJSON(db *metadataDB, dataDir string) error {
+	datamapPath := filepath.Join(dataDir, datamap_file_name)
+	lbPath := filepath.Join(dataDir, lb_file_name)
+
+	op := &kvImportLegacy{}
+	if data, err := os.ReadFile(datamapPath); err == nil {
+		if len(bytes.TrimSpace(data)) > 0 {
+			if err := json.Unmarshal(data, &op.files); err != nil {
+				return fmt.Errorf("failed to decode %s: %w", datamapPath, err)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if data, err := os.ReadFile(lbPath); err == nil {
+		if op.lbInfo, err = decodeLoadBalancerInfo(data); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if op.files == nil && op.lbInfo == nil {
+		return nil
+	}
+	if err := db.Do(true, op); err != nil {
+		return fmt.Errorf("failed to import legacy metadata: %w", err)
+	}
+
+	for _, legacyPath := range []string{datamapPath, lbPath} {
+		if err := os.Rename(legacyPath, legacyPath+".imported"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	fs.Infof(nil, "Imported %d entries from %s into %s", len(op.files), dataDir, db.Path())
+	return nil
+}
+
+// importCachedStore moves the database kept in the lib/kv cache directory
+// before into db, unless db exists already. The cache directory is
+// disposable, the metadata isn't.
+func importCachedStore(db *metadataDB) error {
+	cachedPath := filepath.Join(config.GetCacheDir(), "kv", storeFacility+".bolt")
+	if _, err := os.Stat(db.path); !os.IsNotExist(err) {
+		return err
+	}
+	data, err := os.ReadFile(cachedPath)
+	if os.IsNotExist(err) || err == nil && len(data) == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(db.path+".partial", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(db.path+".partial", db.path); err != nil {
+		return err
+	}
+	if err := os.Rename(cachedPath, cachedPath+".imported"); err != nil {
+		return err
+	}
+	fs.Infof(nil, "Moved the metadata store from %s to %s", cachedPath, db.path)
+	return nil
+}
@@ -0,0 +1,83 @@
+//go:build !plan9 && !js
+
+package dis_operations
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/lib/kv"
+	"go.etcd.io/bbolt"
+)
+
+// storeOpenTimeout is how long to wait for another process to release the
+// metadata database
+const storeOpenTimeout = time.Minute
+
+// storeDoMu serialises the transactions of this process, which bolt's file
+// lock doesn't between the handles of one process
+var storeDoMu sync.Mutex
+
+// metadataDB is the bolt database holding the metadata. It is opened for
+// every transaction and closed after it, so that no handle stays open for
+// other processes to wait on or for the data directory to be encrypted
+// under.
+type metadataDB struct {
+	path string
+}
+
+// Path returns the path of the database file
+func (db *metadataDB) Path() string {
+	return db.path
+}
+
+// Do runs op in a transaction of the metadata bucket, returning
+// kv.ErrEmpty when reading a database which doesn't exist yet
+func (db *metadataDB) Do(write bool, op kv.Op) error {
+	storeDoMu.Lock()
+	defer storeDoMu.Unlock()
+
+	if !write {
+		if _, err := os.Stat(db.path); os.IsNotExist(err) {
+			return kv.ErrEmpty
+		}
+	}
+	bolt, err := bbolt.Open(db.path, 0600, &bbolt.Options{Timeout: storeOpenTimeout, ReadOnly: !write})
+	if err != nil {
+		return fmt.Errorf("failed to open metadata store %s: %w", db.path, err)
+	}
+	defer func() {
+		_ = bolt.Close()
+	}()
+
+	ctx := context.Background()
+	if write {
+		return bolt.Update(func(tx *bbolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte(storeFacility))
+			if err != nil {
+				return err
+			}
+			return op.Do(ctx, boltBucket{b})
+		})
+	}
+	return bolt.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(storeFacility))
+		if b == nil {
+			return kv.ErrEmpty
+		}
+		return op.Do(ctx, boltBucket{b})
+	})
+}
+
+// boltBucket adapts a bbolt.Bucket to kv.Bucket
+type boltBucket struct {
+	*bbolt.Bucket
+}
+
+// Cursor returns a cursor over the bucket
+func (b boltBucket) Cursor() kv.Cursor {
+	return b.Bucket.Cursor()
+}
@@ -0,0 +1,106 @@
+package dis_operations
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/lib/kv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain points the config directory, and with it the metadata store, at
+// a temporary directory so that no test touches the store of the user
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "dis_operations")
+	if err != nil {
+		panic(err)
+	}
+	if err := config.SetConfigPath(filepath.Join(dir, "rclone.conf")); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// setupTestStore gives the test a config directory, and so a metadata store,
+// of its own and returns it
+func setupTestStore(t *testing.T) string {
+	if !kv.Supported() {
+		t.Skip("kv not supported on this OS")
+	}
+	dir := t.TempDir()
+	oldConfigPath := config.GetConfigPath()
+	require.NoError(t, config.SetConfigPath(filepath.Join(dir, "rclone.conf")))
+	t.Cleanup(func() {
+		_ = config.SetConfigPath(oldConfigPath)
+	})
+	return dir
+}
+
+func TestStoreDatamapTransaction(t *testing.T) {
+	dir := setupTestStore(t)
+	const name = "store_test/file.txt"
+
+	require.NoError(t, updateDatamap(func(filesMap map[string]FileInfo) error {
+		filesMap[name] = FileInfo{FileName: name, FileSize: 42}
+		return nil
+	}))
+	assert.Equal(t, filepath.Join(dir, "data", storeFileName), MetadataStorePath())
+
+	filesMap, err := readDatamap()
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), filesMap[name].FileSize)
+
+	// a failing update must not be committed
+	errAbort := errors.New("abort")
+	err = updateDatamap(func(filesMap map[string]FileInfo) error {
+		delete(filesMap, name)
+		return errAbort
+	})
+	assert.ErrorIs(t, err, errAbort)
+
+	filesMap, err = readDatamap()
+	require.NoError(t, err)
+	assert.Contains(t, filesMap, name)
+}
+
+func TestStoreLoadBalancerInfo(t *testing.T) {
+	setupTestStore(t)
+	before, err := readLoadBalancerInfo()
+	require.NoError(t, err)
+	assert.Equal(t, 0, before.RoundRobinCounter)
+
+	require.NoError(t, IncrementRoundRobinCounter())
+
+	after, err := readLoadBalancerInfo()
+	require.NoError(t, err)
+	assert.Equal(t, 1, after.RoundRobinCounter)
+}
+
+func TestStoreImportsCachedStore(t *testing.T) {
+	dir := setupTestStore(t)
+	cacheDir := filepath.Join(dir, "cache")
+	oldCacheDir := config.GetCacheDir()
+	require.NoError(t, config.SetCacheDir(cacheDir))
+	defer func() {
+		_ = config.SetCacheDir(oldCacheDir)
+	}()
+
+	// a store written where lib/kv kept it before
+	old := &metadataDB{path: filepath.Join(cacheDir, "kv", storeFacility+".bolt")}
+	require.NoError(t, os.MkdirAll(filepath.Dir(old.path), 0700))
+	require.NoError(t, old.Do(true, &kvUpdateDatamap{update: func(filesMap map[string]FileInfo) error {
+		filesMap["cached.txt"] = FileInfo{FileName: "cached.txt"}
+		return nil
+	}}))
+
+	filesMap, err := readDatamap()
+	require.NoError(t, err)
+	assert.Contains(t, filesMap, "cached.txt")
+	assert.NoFileExists(t, old.path)
+}
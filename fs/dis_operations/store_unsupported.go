@@ -0,0 +1,20 @@
+//go:build plan9 || js
+
+package dis_operations
+
+import "github.com/rclone/rclone/lib/kv"
+
+// metadataDB is the metadata database, unsupported on this OS
+type metadataDB struct {
+	path string
+}
+
+// Path returns the path of the database file
+func (db *metadataDB) Path() string {
+	return db.path
+}
+
+// Do returns kv.ErrUnsupported
+func (db *metadataDB) Do(write bool, op kv.Op) error {
+	return kv.ErrUnsupported
+}
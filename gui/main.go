@@ -28,22 +28,48 @@ import (
 
 var loadingIndicator = widget.NewProgressBarInfinite()
 
-func checkCoreFile() int {
-	rcloneDir := dis_operations.GetRcloneDirPath()
-	dataDir := filepath.Join(rcloneDir, "data")
-
-	datamapBase := filepath.Join(dataDir, dis_operations.GetDatamapFileName())
-	lbBase := filepath.Join(dataDir, dis_operations.GetLBFileName())
+var (
+	// userPassword locks the rclone directory while the GUI is closed
+	userPassword string
+	// passphrase unlocks the master key of the distributed files. It is
+	// asked for the first time it is needed and only kept in memory.
+	passphrase string
+)
 
-	datamapFcef := datamapBase + ".fcef"
-	lbFcef := lbBase + ".fcef"
+// askPassphrase calls run with the master passphrase, asking for it first
+// if it isn't known yet. Nothing runs without one.
+func askPassphrase(w fyne.Window, run func()) {
+	if passphrase != "" {
+		run()
+		return
+	}
+	passphraseEntry := widget.NewPasswordEntry()
+	items := []*widget.FormItem{widget.NewFormItem("Passphrase", passphraseEntry)}
+	dialog.ShowForm("Enter dis master key passphrase", "OK", "Cancel", items, func(ok bool) {
+		if !ok {
+			return
+		}
+		if passphraseEntry.Text == "" {
+			dialog.ShowError(fmt.Errorf("Passphrase cannot be empty"), w)
+			return
+		}
+		passphrase = passphraseEntry.Text
+		run()
+	}, w)
+}
 
-	// Check original files
-	baseExists := fileExists(datamapBase) && fileExists(lbBase)
-	// Check .fcef files
-	fcefExists := fileExists(datamapFcef) && fileExists(lbFcef)
+// disCommand returns the rclone command running args, given the master
+// passphrase if it is known
+func disCommand(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	if passphrase != "" {
+		cmd.Env = append(os.Environ(), dis_operations.PassphraseEnv+"="+passphrase)
+	}
+	return cmd
+}
 
-	if baseExists || fcefExists {
+func checkCoreFile() int {
+	if dis_operations.DoesMetadataStoreExist() {
 		return 1
 	}
 	return -1
@@ -55,21 +81,14 @@ func fileExists(path string) bool {
 }
 
 func refreshRemoteFileList(fileListContainer *fyne.Container, logOutput *widget.RichText, progress *widget.ProgressBar, w fyne.Window, modeSelect *widget.Select, targetEntry *widget.Entry) {
-	rootPath := dis_operations.GetRcloneDirPath()
-	dataPath := filepath.Join(rootPath, "data")
-
-	if _, err := os.Stat(dataPath); os.IsNotExist(err) {
-		return
-	}
-
-	//Check if both core files exist
+	//Check if the metadata store exists
 	if checkCoreFile() == -1 {
 		fmt.Println("NO found")
 		return
 	}
 	fileListContainer.Objects = nil // 기존 항목 비우기
 
-	cmd := exec.Command("./rclone", "dis_ls")
+	cmd := disCommand("./rclone", "dis_ls")
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		fileListContainer.Add(widget.NewLabel(fmt.Sprintf("❌ Failed to load list:\n%s", string(output))))
@@ -96,13 +115,16 @@ func refreshRemoteFileList(fileListContainer *fyne.Container, logOutput *widget.
 
 		deleteButton := widget.NewButtonWithIcon("", theme.DeleteIcon(), func() {
 			dialog.ShowConfirm("Delete File", fmt.Sprintf("Delete '%s'?", fileName), func(confirm bool) {
-				if confirm {
+				if !confirm {
+					return
+				}
+				askPassphrase(w, func() {
 					progress.Show()
 					go func() {
 						defer progress.Hide()
 						loadingIndicator.Show()
 
-						cmd := exec.Command("rclone", "dis_rm", fileName)
+						cmd := disCommand("rclone", "dis_rm", fileName)
 						rmOut, rmErr := cmd.CombinedOutput()
 						if rmErr != nil {
 							logOutput.ParseMarkdown(fmt.Sprintf("❌ **Delete Error:**\n```\n%s\n```", string(rmOut)))
@@ -112,7 +134,7 @@ func refreshRemoteFileList(fileListContainer *fyne.Container, logOutput *widget.
 						}
 						loadingIndicator.Hide()
 					}()
-				}
+				})
 			}, w)
 		})
 
@@ -138,6 +160,7 @@ func showPasswordSetupWindow(w fyne.Window) {
 
 		// Save the password
 		dis_operations.SaveUserPassword(password)
+		userPassword = password
 		showMainGUIContent(w) // Just change window content
 	})
 
@@ -170,6 +193,7 @@ func showPasswordPromptWindow(w fyne.Window) {
 			return
 		}
 
+		userPassword = password
 		showMainGUIContent(w) // Just change window content
 	})
 
@@ -184,9 +208,8 @@ func showPasswordPromptWindow(w fyne.Window) {
 
 // Function to encrypt all files before closing the app
 func encryptFilesOnExit() {
-	userPassword := dis_operations.GetUserPassword()
 	if userPassword == "" {
-		fmt.Println("Error: No user password found.")
+		fmt.Println("Error: No user password entered.")
 		return
 	}
 
@@ -381,18 +404,10 @@ func startUpload(source, loadBalancer string,
 		return
 	}
 
-	cmd := exec.Command("rclone", "dis_upload", source, "--loadbalancer", loadBalancer)
-	stdoutPipe, err := cmd.StdoutPipe()
-	if err != nil {
-		logOutput.ParseMarkdown(fmt.Sprintf("❌ **Pipe error:**\n```\n%s\n```", err.Error()))
-		return
-	}
-	if err := cmd.Start(); err != nil {
-		logOutput.ParseMarkdown(fmt.Sprintf("❌ **Start error:**\n```\n%s\n```", err.Error()))
-		return
-	}
-
-	go monitorProgress(cmd, stdoutPipe, progressBar, logOutput, "upload", fileListContainer, w, modeSelect, targetEntry)
+	askPassphrase(w, func() {
+		cmd := disCommand("rclone", "dis_upload", source, "--loadbalancer", loadBalancer)
+		runCommand(cmd, progressBar, logOutput, "upload", fileListContainer, w, modeSelect, targetEntry)
+	})
 }
 
 func startDownload(target, destination string,
@@ -405,7 +420,18 @@ func startDownload(target, destination string,
 		return
 	}
 
-	cmd := exec.Command("rclone", "dis_download", target, destination)
+	askPassphrase(w, func() {
+		cmd := disCommand("rclone", "dis_download", target, destination)
+		runCommand(cmd, progressBar, logOutput, "download", fileListContainer, w, modeSelect, targetEntry)
+	})
+}
+
+// runCommand starts cmd and follows its progress
+func runCommand(cmd *exec.Cmd,
+	progressBar *widget.ProgressBar, logOutput *widget.RichText,
+	mode string, fileListContainer *fyne.Container,
+	w fyne.Window, modeSelect *widget.Select, targetEntry *widget.Entry,
+) {
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
 		logOutput.ParseMarkdown(fmt.Sprintf("❌ **Pipe error:**\n```\n%s\n```", err.Error()))
@@ -416,7 +442,7 @@ func startDownload(target, destination string,
 		return
 	}
 
-	go monitorProgress(cmd, stdoutPipe, progressBar, logOutput, "download", fileListContainer, w, modeSelect, targetEntry)
+	go monitorProgress(cmd, stdoutPipe, progressBar, logOutput, mode, fileListContainer, w, modeSelect, targetEntry)
 }
 
 func monitorProgress(
@@ -0,0 +1,162 @@
+// Package fastcdc cuts a stream into content defined chunks.
+//
+// It implements FastCDC ("FastCDC: a Fast and Efficient Content-Defined
+// Chunking Approach for Data Deduplication", Xia et al, USENIX ATC 2016)
+// with normalized chunking: a gear rolling hash is computed over the data
+// and a chunk ends where the hash matches a mask. A stricter mask is used
+// before the average size and a looser one after it, so chunk sizes
+// cluster around the average.
+//
+// Chunk boundaries only depend on the bytes around them, so inserting or
+// deleting data only changes the chunks around the change, the others are
+// cut exactly as before.
+package fastcdc
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// Default chunk sizes
+const (
+	DefaultMinSize = 1 << 20
+	DefaultAvgSize = 4 << 20
+	DefaultMaxSize = 16 << 20
+)
+
+// Options are the chunk sizes of a Chunker. Zero values take the defaults.
+type Options struct {
+	// MinSize is the smallest chunk cut, the last one may be smaller
+	MinSize int
+	// AvgSize is the size chunks are normalized around, a power of 2
+	AvgSize int
+	// MaxSize is the largest chunk cut
+	MaxSize int
+}
+
+// gear is the table of the rolling hash. It must never change or chunks
+// would be cut differently, so it is generated by splitmix64 from a fixed
+// seed rather than at random.
+var gear = func() (table [256]uint64) {
+	seed := uint64(0x6469735f63646331)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunker reads a stream and returns it chunk by chunk
+type Chunker struct {
+	in    io.Reader
+	opt   Options
+	maskS uint64
+	maskL uint64
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+// mask returns a mask of n bits taken from the top of the hash, where the
+// gear hash mixes in the most bytes
+func mask(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// New returns a Chunker reading from in
+func New(in io.Reader, opt Options) (*Chunker, error) {
+	if opt.MinSize == 0 {
+		opt.MinSize = DefaultMinSize
+	}
+	if opt.AvgSize == 0 {
+		opt.AvgSize = DefaultAvgSize
+	}
+	if opt.MaxSize == 0 {
+		opt.MaxSize = DefaultMaxSize
+	}
+	if opt.AvgSize&(opt.AvgSize-1) != 0 || opt.AvgSize < 64 {
+		return nil, errors.New("fastcdc: average size must be a power of 2 of at least 64")
+	}
+	if opt.MinSize <= 0 || opt.MinSize > opt.AvgSize || opt.AvgSize > opt.MaxSize {
+		return nil, errors.New("fastcdc: sizes must be 0 < min <= avg <= max")
+	}
+	avgBits := bits.TrailingZeros(uint(opt.AvgSize))
+	return &Chunker{
+		in:    in,
+		opt:   opt,
+		maskS: mask(avgBits + 2),
+		maskL: mask(avgBits - 2),
+		buf:   make([]byte, 2*opt.MaxSize),
+	}, nil
+}
+
+// fill reads until at least MaxSize bytes are buffered or the input ends
+func (c *Chunker) fill() error {
+	if c.end-c.start >= c.opt.MaxSize || c.eof {
+		return nil
+	}
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.in.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the chunk starting data
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.opt.MinSize {
+		return n
+	}
+	if n > c.opt.MaxSize {
+		n = c.opt.MaxSize
+	}
+	normal := c.opt.AvgSize
+	if normal > n {
+		normal = n
+	}
+	var hash uint64
+	i := c.opt.MinSize
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Next returns the next chunk, or io.EOF once the input is exhausted. The
+// chunk is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
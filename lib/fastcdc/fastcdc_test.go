@@ -0,0 +1,88 @@
+package fastcdc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testOptions = Options{MinSize: 2 << 10, AvgSize: 8 << 10, MaxSize: 32 << 10}
+
+// chunks returns the sha256 of every chunk of data
+func chunks(t *testing.T, data []byte, opt Options) (sums [][32]byte, sizes []int) {
+	c, err := New(bytes.NewReader(data), opt)
+	require.NoError(t, err)
+	var joined []byte
+	for {
+		chunk, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		sums = append(sums, sha256.Sum256(chunk))
+		sizes = append(sizes, len(chunk))
+		joined = append(joined, chunk...)
+	}
+	require.Equal(t, data, joined)
+	return sums, sizes
+}
+
+func TestChunkSizes(t *testing.T) {
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	_, sizes := chunks(t, data, testOptions)
+	total := 0
+	for i, size := range sizes {
+		if i < len(sizes)-1 {
+			assert.GreaterOrEqual(t, size, testOptions.MinSize)
+		}
+		assert.LessOrEqual(t, size, testOptions.MaxSize)
+		total += size
+	}
+	avg := total / len(sizes)
+	assert.Greater(t, avg, testOptions.AvgSize/2)
+	assert.Less(t, avg, testOptions.AvgSize*2)
+
+	// zeros never match the mask so are cut at the max size
+	_, sizes = chunks(t, make([]byte, 100<<10), testOptions)
+	assert.Equal(t, []int{32 << 10, 32 << 10, 32 << 10, 4 << 10}, sizes)
+
+	_, sizes = chunks(t, nil, testOptions)
+	assert.Empty(t, sizes)
+}
+
+func TestChunksSurviveEdits(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	before, _ := chunks(t, data, testOptions)
+
+	// insert some bytes in the middle
+	edited := append(append(append([]byte(nil), data[:500000]...), []byte("inserted bytes")...), data[500000:]...)
+	after, _ := chunks(t, edited, testOptions)
+
+	old := make(map[[32]byte]bool)
+	for _, sum := range before {
+		old[sum] = true
+	}
+	changed := 0
+	for _, sum := range after {
+		if !old[sum] {
+			changed++
+		}
+	}
+	assert.LessOrEqual(t, changed, 2)
+	assert.Greater(t, len(after), 50)
+}
+
+func TestBadOptions(t *testing.T) {
+	_, err := New(nil, Options{AvgSize: 3000})
+	assert.Error(t, err)
+	_, err = New(nil, Options{MinSize: 8192, AvgSize: 4096, MaxSize: 16384})
+	assert.Error(t, err)
+}
@@ -34,13 +34,14 @@ import (
 
 	"github.com/rclone/rclone/librclone/librclone"
 
-	_ "github.com/rclone/rclone/backend/all"   // import all backends
-	_ "github.com/rclone/rclone/cmd/cmount"    // import cmount
-	_ "github.com/rclone/rclone/cmd/mount"     // import mount
-	_ "github.com/rclone/rclone/cmd/mount2"    // import mount2
-	_ "github.com/rclone/rclone/fs/operations" // import operations/* rc commands
-	_ "github.com/rclone/rclone/fs/sync"       // import sync/*
-	_ "github.com/rclone/rclone/lib/plugin"    // import plugins
+	_ "github.com/rclone/rclone/backend/all"       // import all backends
+	_ "github.com/rclone/rclone/cmd/cmount"        // import cmount
+	_ "github.com/rclone/rclone/cmd/mount"         // import mount
+	_ "github.com/rclone/rclone/cmd/mount2"        // import mount2
+	_ "github.com/rclone/rclone/fs/dis_operations" // import dis/* rc commands
+	_ "github.com/rclone/rclone/fs/operations"     // import operations/* rc commands
+	_ "github.com/rclone/rclone/fs/sync"           // import sync/*
+	_ "github.com/rclone/rclone/lib/plugin"        // import plugins
 )
 
 // RcloneInitialize initializes rclone as a library
@@ -0,0 +1,84 @@
+package reedsolomon
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Codec is the erasure code shards are encoded with. It is recorded with
+// the shards so that they are decoded with the same code.
+type Codec string
+
+const (
+	// CodecReedSolomon is Reed-Solomon over GF(2^8), for up to 256 shards
+	CodecReedSolomon Codec = ""
+	// CodecLeopardGF16 is Leopard over GF(2^16), for up to 65536 shards.
+	// Shard sizes are rounded up to a multiple of 64 bytes.
+	CodecLeopardGF16 Codec = "leopard-gf16"
+)
+
+// ErrUnknownCodec is returned for a Codec this package doesn't implement
+var ErrUnknownCodec = errors.New("unknown codec")
+
+// CodecFor returns the codec to encode totalShards shards with:
+// Reed-Solomon as long as it can, Leopard above 256 shards
+func CodecFor(totalShards int) Codec {
+	if totalShards > CodecReedSolomon.MaxShards() {
+		return CodecLeopardGF16
+	}
+	return CodecReedSolomon
+}
+
+// MaxShards returns the most data+parity shards the codec supports, 0 if
+// it is unknown
+func (c Codec) MaxShards() int {
+	switch c {
+	case CodecReedSolomon:
+		return 256
+	case CodecLeopardGF16:
+		return 65536
+	}
+	return 0
+}
+
+// String returns the name of the codec
+func (c Codec) String() string {
+	if c == CodecReedSolomon {
+		return "reed-solomon"
+	}
+	return string(c)
+}
+
+// options returns the options selecting the codec
+func (c Codec) options(dataShards, parityShards int) ([]Option, error) {
+	maxShards := c.MaxShards()
+	if maxShards == 0 {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCodec, string(c))
+	}
+	if dataShards+parityShards > maxShards {
+		return nil, ErrMaxShardNum
+	}
+	if c == CodecLeopardGF16 {
+		return []Option{WithLeopardGF16(true)}, nil
+	}
+	return nil, nil
+}
+
+// New returns an Encoder of dataShards and parityShards using the codec
+func (c Codec) New(dataShards, parityShards int, o ...Option) (Encoder, error) {
+	opts, err := c.options(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	return New(dataShards, parityShards, append(o[:len(o):len(o)], opts...)...)
+}
+
+// NewStream returns a StreamEncoder of dataShards and parityShards using
+// the codec
+func (c Codec) NewStream(dataShards, parityShards int, o ...Option) (StreamEncoder, error) {
+	opts, err := c.options(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	return NewStream(dataShards, parityShards, append(o[:len(o):len(o)], opts...)...)
+}
@@ -0,0 +1,360 @@
+package reedsolomon
+
+import (
+	"bytes"
+	"io"
+)
+
+// Locally repairable codes
+//
+// With WithLocalParity the data shards are cut into groups of consecutive
+// shards and each group gets a local parity shard, the XOR of its data
+// shards. The shards are laid out as the data shards, the global parity
+// shards, computed by the encoder underneath, then the local parity shards
+// in group order.
+//
+// A shard which is the only one missing from its group, its data shards
+// and local parity, is rebuilt from the rest of its group: a repair reads
+// as many shards as there are in the group instead of as many as there are
+// data shards. Any other loss is rebuilt from the global parity, by the
+// matrix inversions of the encoder underneath. As XOR works byte by byte
+// like the encoders do, the local parity of whole shards is the local parity
+// of their stripes.
+
+// LocalGroups returns the data shards of each of the groups local groups of
+// dataShards data shards
+func LocalGroups(dataShards, groups int) [][]int {
+	if groups <= 0 || groups > dataShards {
+		return nil
+	}
+	out := make([][]int, groups)
+	for g := range out {
+		for i := g * dataShards / groups; i < (g+1)*dataShards/groups; i++ {
+			out[g] = append(out[g], i)
+		}
+	}
+	return out
+}
+
+// LocalRepairShards returns the shards to read to rebuild the lost shards
+// of dataShards data, parityShards global parity and localGroups local
+// parity shards from their groups only. It returns false if a lost shard
+// can't be: a global parity shard, or a shard whose group lost another.
+func LocalRepairShards(dataShards, parityShards, localGroups int, lost []int) ([]int, bool) {
+	groups := LocalGroups(dataShards, localGroups)
+	if len(groups) == 0 || len(lost) == 0 {
+		return nil, false
+	}
+	groupOf := make(map[int]int)
+	for g, group := range groups {
+		for _, i := range group {
+			groupOf[i] = g
+		}
+		groupOf[dataShards+parityShards+g] = g
+	}
+	lostIn := make(map[int]int)
+	for _, i := range lost {
+		g, ok := groupOf[i]
+		if !ok {
+			return nil, false
+		}
+		if _, ok := lostIn[g]; ok {
+			return nil, false
+		}
+		lostIn[g] = i
+	}
+	var read []int
+	for g, group := range groups {
+		lostShard, ok := lostIn[g]
+		if !ok {
+			continue
+		}
+		for _, i := range append(group, dataShards+parityShards+g) {
+			if i != lostShard {
+				read = append(read, i)
+			}
+		}
+	}
+	return read, true
+}
+
+// lrc is an Encoder adding local parity shards to the global parity of
+// the Encoder it embeds
+type lrc struct {
+	Encoder
+	o            options
+	dataShards   int
+	parityShards int // global parity shards
+	groups       [][]int
+}
+
+// newLRC returns the locally repairable code of o.localGroups groups of
+// the dataShards, over the encoder made by New with opts
+func newLRC(dataShards, parityShards int, o options, opts []Option) (*lrc, error) {
+	if dataShards <= 0 || parityShards < 0 || o.localGroups > dataShards {
+		return nil, ErrInvShardNum
+	}
+	enc, err := New(dataShards, parityShards, append(opts[:len(opts):len(opts)], WithLocalParity(0))...)
+	if err != nil {
+		return nil, err
+	}
+	return &lrc{
+		Encoder:      enc,
+		o:            o,
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		groups:       LocalGroups(dataShards, o.localGroups),
+	}, nil
+}
+
+// globalShards is the number of data and global parity shards
+func (l *lrc) globalShards() int {
+	return l.dataShards + l.parityShards
+}
+
+// localShard is the index of the local parity shard of group g
+func (l *lrc) localShard(g int) int {
+	return l.globalShards() + g
+}
+
+// members returns the shards of group g, its local parity last
+func (l *lrc) members(g int) []int {
+	return append(l.groups[g][:len(l.groups[g]):len(l.groups[g])], l.localShard(g))
+}
+
+// xorInto sets shards[dst] to the XOR of the shards srcs
+func (l *lrc) xorInto(shards [][]byte, dst int, srcs []int) {
+	out := shards[dst]
+	copy(out, shards[srcs[0]])
+	for _, i := range srcs[1:] {
+		sliceXor(shards[i], out, &l.o)
+	}
+}
+
+// ShardSizeMultiple returns the multiple of the shard sizes of the
+// encoder underneath
+func (l *lrc) ShardSizeMultiple() int {
+	if ext, ok := l.Encoder.(Extensions); ok {
+		return ext.ShardSizeMultiple()
+	}
+	return 1
+}
+
+// DataShards returns the number of data shards
+func (l *lrc) DataShards() int {
+	return l.dataShards
+}
+
+// ParityShards returns the number of global and local parity shards
+func (l *lrc) ParityShards() int {
+	return l.parityShards + len(l.groups)
+}
+
+// TotalShards returns the number of shards
+func (l *lrc) TotalShards() int {
+	return l.globalShards() + len(l.groups)
+}
+
+// AllocAligned allocates TotalShards number of slices, aligned to reasonable
+// boundaries
+func (l *lrc) AllocAligned(each int) [][]byte {
+	return AllocAligned(l.TotalShards(), each)
+}
+
+// checkShards returns the size of the shards present, checking they are
+// all of it
+func (l *lrc) checkShards(shards [][]byte) (int, error) {
+	if len(shards) != l.TotalShards() {
+		return 0, ErrTooFewShards
+	}
+	size := 0
+	for _, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		if size != 0 && len(shard) != size {
+			return 0, ErrShardSize
+		}
+		size = len(shard)
+	}
+	if size == 0 {
+		return 0, ErrShardNoData
+	}
+	return size, nil
+}
+
+// Encode computes the global and local parity of the data shards
+func (l *lrc) Encode(shards [][]byte) error {
+	size, err := l.checkShards(shards)
+	if err != nil {
+		return err
+	}
+	if err := l.Encoder.Encode(shards[:l.globalShards()]); err != nil {
+		return err
+	}
+	for g, group := range l.groups {
+		if len(shards[l.localShard(g)]) != size {
+			return ErrShardSize
+		}
+		l.xorInto(shards, l.localShard(g), group)
+	}
+	return nil
+}
+
+// Verify returns true if the global and local parity shards match the
+// data shards
+func (l *lrc) Verify(shards [][]byte) (bool, error) {
+	size, err := l.checkShards(shards)
+	if err != nil {
+		return false, err
+	}
+	if ok, err := l.Encoder.Verify(shards[:l.globalShards()]); !ok || err != nil {
+		return ok, err
+	}
+	buf := make([]byte, size)
+	for g, group := range l.groups {
+		local := shards[l.localShard(g)]
+		if len(local) != size {
+			return false, ErrShardSize
+		}
+		copy(buf, shards[group[0]])
+		for _, i := range group[1:] {
+			sliceXor(shards[i], buf, &l.o)
+		}
+		if !bytes.Equal(buf, local) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Reconstruct rebuilds all the missing shards
+func (l *lrc) Reconstruct(shards [][]byte) error {
+	required := make([]bool, l.TotalShards())
+	for i := range required {
+		required[i] = true
+	}
+	return l.reconstruct(shards, required)
+}
+
+// ReconstructData rebuilds the missing data shards
+func (l *lrc) ReconstructData(shards [][]byte) error {
+	required := make([]bool, l.TotalShards())
+	for i := 0; i < l.dataShards; i++ {
+		required[i] = true
+	}
+	return l.reconstruct(shards, required)
+}
+
+// ReconstructSome rebuilds the missing shards marked in required, which
+// holds either all the shards or the data shards only
+func (l *lrc) ReconstructSome(shards [][]byte, required []bool) error {
+	all := make([]bool, l.TotalShards())
+	copy(all, required)
+	return l.reconstruct(shards, all)
+}
+
+// reconstruct rebuilds the missing shards marked in required, a shard lost
+// alone in its group from its group and the others from the global parity
+func (l *lrc) reconstruct(shards [][]byte, required []bool) error {
+	size, err := l.checkShards(shards)
+	if err != nil {
+		return err
+	}
+	missing := func(i int) bool {
+		return len(shards[i]) == 0
+	}
+	fill := func(i int) {
+		if cap(shards[i]) >= size {
+			shards[i] = shards[i][:size]
+		} else {
+			shards[i] = make([]byte, size)
+		}
+	}
+
+	// first from the groups
+	for g := range l.groups {
+		members := l.members(g)
+		lost := -1
+		for _, i := range members {
+			if missing(i) {
+				if lost >= 0 {
+					lost = -1
+					break
+				}
+				lost = i
+			}
+		}
+		// data shards help rebuilding the others, required or not
+		if lost < 0 || !required[lost] && lost >= l.dataShards {
+			continue
+		}
+		var others []int
+		for _, i := range members {
+			if i != lost {
+				others = append(others, i)
+			}
+		}
+		fill(lost)
+		l.xorInto(shards, lost, others)
+	}
+
+	// then from the global parity, with the data shards the local parity
+	// shards left to rebuild need
+	globalRequired := make([]bool, l.globalShards())
+	copy(globalRequired, required)
+	for g, group := range l.groups {
+		if local := l.localShard(g); missing(local) && required[local] {
+			for _, i := range group {
+				globalRequired[i] = true
+			}
+		}
+	}
+	needed := false
+	for i := range globalRequired {
+		needed = needed || globalRequired[i] && missing(i)
+	}
+	if needed {
+		if err := l.Encoder.ReconstructSome(shards[:l.globalShards()], globalRequired); err != nil {
+			return err
+		}
+	}
+
+	for g, group := range l.groups {
+		if local := l.localShard(g); missing(local) && required[local] {
+			fill(local)
+			l.xorInto(shards, local, group)
+		}
+	}
+	return nil
+}
+
+// Split splits data into the data shards, leaving room for the parity
+func (l *lrc) Split(data []byte) ([][]byte, error) {
+	shards, err := l.Encoder.Split(data)
+	if err != nil {
+		return nil, err
+	}
+	for range l.groups {
+		shards = append(shards, make([]byte, len(shards[0])))
+	}
+	return shards, nil
+}
+
+// Join writes outSize bytes of the data shards to dst
+func (l *lrc) Join(dst io.Writer, shards [][]byte, outSize int) error {
+	if len(shards) < l.dataShards {
+		return ErrTooFewShards
+	}
+	return l.Encoder.Join(dst, shards[:l.dataShards], outSize)
+}
+
+// EncodeIdx isn't supported with local parity
+func (l *lrc) EncodeIdx(dataShard []byte, idx int, parity [][]byte) error {
+	return ErrNotSupported
+}
+
+// Update isn't supported with local parity
+func (l *lrc) Update(shards [][]byte, newDatashards [][]byte) error {
+	return ErrNotSupported
+}
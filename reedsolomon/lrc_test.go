@@ -0,0 +1,145 @@
+package reedsolomon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestLocalGroups(t *testing.T) {
+	groups := LocalGroups(10, 3)
+	want := [][]int{{0, 1, 2}, {3, 4, 5}, {6, 7, 8, 9}}
+	if len(groups) != len(want) {
+		t.Fatalf("got %v, want %v", groups, want)
+	}
+	for g := range want {
+		if !equalInts(groups[g], want[g]) {
+			t.Fatalf("got %v, want %v", groups, want)
+		}
+	}
+
+	// 10 data, 4 global parity, local parity 14, 15 and 16
+	read, ok := LocalRepairShards(10, 4, 3, []int{1, 15})
+	if !ok || !equalInts(read, []int{0, 2, 14, 3, 4, 5}) {
+		t.Fatalf("got %v %v", read, ok)
+	}
+	for _, lost := range [][]int{{1, 2}, {10}, nil} {
+		if _, ok := LocalRepairShards(10, 4, 3, lost); ok {
+			t.Errorf("%v can't be repaired locally", lost)
+		}
+	}
+}
+
+func TestLocalParity(t *testing.T) {
+	const dataShards, parityShards, groups = 10, 4, 3
+	enc, err := New(dataShards, parityShards, WithLocalParity(groups))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := enc.(Extensions).TotalShards(); got != dataShards+parityShards+groups {
+		t.Fatalf("got %d shards", got)
+	}
+	shards := enc.(Extensions).AllocAligned(1000)
+	for i := 0; i < dataShards; i++ {
+		fillRandom(shards[i])
+	}
+	if err := enc.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := enc.Verify(shards); !ok || err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	saved := make([][]byte, len(shards))
+	for i := range shards {
+		saved[i] = append([]byte(nil), shards[i]...)
+	}
+
+	// a shard lost alone in its group comes back from its group only
+	read, ok := LocalRepairShards(dataShards, parityShards, groups, []int{4})
+	if !ok {
+		t.Fatal("shard 4 should be repaired locally")
+	}
+	partial := make([][]byte, len(shards))
+	for _, i := range read {
+		partial[i] = append([]byte(nil), saved[i]...)
+	}
+	required := make([]bool, len(shards))
+	required[4] = true
+	if err := enc.ReconstructSome(partial, required); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(partial[4], saved[4]) {
+		t.Fatal("shard 4 wasn't rebuilt from its group")
+	}
+
+	// more than one lost in a group needs the global parity
+	for _, i := range []int{0, 1, 2, 14, 11} {
+		shards[i] = shards[i][:0]
+	}
+	if err := enc.Reconstruct(shards); err != nil {
+		t.Fatal(err)
+	}
+	for i := range shards {
+		if !bytes.Equal(shards[i], saved[i]) {
+			t.Fatalf("shard %d wasn't rebuilt", i)
+		}
+	}
+
+	// a corrupted local parity fails verification
+	shards[15][0] ^= 1
+	if ok, _ := enc.Verify(shards); ok {
+		t.Fatal("corrupted local parity verified")
+	}
+
+	if _, err := New(2, 1, WithLocalParity(3)); !errors.Is(err, ErrInvShardNum) {
+		t.Fatalf("got %v, want ErrInvShardNum", err)
+	}
+}
+
+func TestReconstructStripesLocally(t *testing.T) {
+	const dataShards, parityShards, groups = 6, 3, 2
+	data := make([]byte, 5000)
+	fillRandom(data)
+	total := dataShards + parityShards + groups
+
+	shards := emptyBuffers(total)
+	err := EncodeStripes(context.Background(), bytes.NewReader(data), int64(len(data)), CodecReedSolomon, dataShards, parityShards, MinStripeSize, toWriters(shards), WithLocalParity(groups))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardBytes := toBytes(shards)
+
+	// only the group of the lost shard is read
+	read, ok := LocalRepairShards(dataShards, parityShards, groups, []int{5})
+	if !ok || len(read) != 3 {
+		t.Fatalf("got %v %v", read, ok)
+	}
+	readers := make([]io.Reader, total)
+	for _, i := range read {
+		readers[i] = bytes.NewReader(shardBytes[i])
+	}
+	fill := make([]io.Writer, total)
+	rebuilt := emptyBuffers(total)
+	fill[5] = rebuilt[5]
+	err = ReconstructStripes(context.Background(), readers, CodecReedSolomon, dataShards, parityShards, MinStripeSize, int64(len(shardBytes[0])), fill, WithLocalParity(groups))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rebuilt[5].Bytes(), shardBytes[5]) {
+		t.Fatal("shard 5 wasn't rebuilt correctly")
+	}
+
+	// decoding copes with the local parity shards
+	decodeReaders := toReaders(toBuffers(shardBytes))
+	decodeReaders[0], decodeReaders[4], decodeReaders[6] = nil, nil, nil
+	var out bytes.Buffer
+	err = DecodeStripes(context.Background(), decodeReaders, CodecReedSolomon, dataShards, parityShards, MinStripeSize, int64(len(data)), &out, WithLocalParity(groups))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("decoded data differs")
+	}
+}
@@ -34,6 +34,7 @@ type options struct {
 	forcedInversionCache bool
 	customMatrix         [][]byte
 	withLeopard          leopardMode
+	localGroups          int
 
 	// stream options
 	concReads  bool
@@ -302,6 +303,16 @@ func WithLeopardGF(enabled bool) Option {
 	}
 }
 
+// WithLocalParity adds a local parity shard, the XOR of its data shards, to
+// each of groups groups of consecutive data shards, after the parity shards.
+// A shard lost alone in its group is then rebuilt from its group only.
+// See lrc.go. If groups <= 0 no local parity is added.
+func WithLocalParity(groups int) Option {
+	return func(o *options) {
+		o.localGroups = max(groups, 0)
+	}
+}
+
 func (o *options) cpuOptions() string {
 	var res []string
 	if o.useSSE2 {
@@ -415,6 +415,9 @@ func New(dataShards, parityShards int, opts ...Option) (Encoder, error) {
 	for _, opt := range opts {
 		opt(&o)
 	}
+	if o.localGroups > 0 {
+		return newLRC(dataShards, parityShards, o, opts)
+	}
 
 	totShards := dataShards + parityShards
 	switch {
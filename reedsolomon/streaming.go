@@ -8,14 +8,15 @@
 package reedsolomon
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 
 	v2 "github.com/flew-software/filecrypt"
@@ -24,26 +25,13 @@ import (
 
 var shardDir = "shard"
 
-var dataShards = flag.Int("data", 170, "Number of shards to split the data into, must be below 257.")
-var parShards = flag.Int("par", 85, "Number of parity shards")
-
 const fileCryptExtension string = ".fcef"
 
-var outFile = flag.String("out", "", "Alternative output path/file")
-
 var app = v2.App{
 	FileCryptExtension: fileCryptExtension,
 	Overwrite:          true,
 }
 
-func init() {
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s [-flags] filename.ext\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Valid flags:\n")
-		flag.PrintDefaults()
-	}
-}
 func GetShardDir() (string, error) {
 	fullConfigPath := config.GetConfigPath()
 	path := filepath.Dir(fullConfigPath)
@@ -87,344 +75,474 @@ func DeleteShardDir() {
 	}
 }
 
-func calculateShardsNum(filename string) {
+// ShardsForSize returns the number of data and parity shards used for a file
+// of the given size: 5+3 below 10 MiB, otherwise as many data shards (in steps
+// of 10 from 170) as keep each shard above 10 MiB with half as many parity shards.
+func ShardsForSize(fileSize int64) (data int, parity int) {
 	const minSize = 10 * 1024 * 1024
+	const maxData = 170
 
-	fileInfo, err := os.Stat(filename)
-	checkErr(err)
+	if fileSize < minSize {
+		return 5, 3
+	}
 
-	fileSize := fileInfo.Size()
+	data = maxData
+	for fileSize/int64(data) < minSize && data > 10 {
+		data -= 10
+	}
 
-	if fileSize < minSize {
-		*dataShards = 5
-		*parShards = 3
-	} else {
+	return data, data / 2
+}
 
-		for fileSize/int64(*dataShards) < minSize && *dataShards > 10 {
-			*dataShards -= 10
+// InsufficientShardsError is returned by DoDecode when fewer valid shards
+// than data shards are left to rebuild the file from. It matches
+// ErrTooFewShards, and Errs holds why the other shards were left out.
+type InsufficientShardsError struct {
+	Have int     // valid shards found
+	Need int     // data shards needed
+	Errs []error // why the missing shards are missing
+}
+
+// Error returns the error as a string
+func (e InsufficientShardsError) Error() string {
+	msg := fmt.Sprintf("insufficient shards: %d valid of %d needed", e.Have, e.Need)
+	for i, err := range e.Errs {
+		if i == 0 {
+			msg += ": "
+		} else {
+			msg += "; "
 		}
+		msg += err.Error()
+	}
+	return msg
+}
+
+// Is returns true for ErrTooFewShards
+func (e InsufficientShardsError) Is(target error) bool {
+	return target == ErrTooFewShards
+}
+
+// Unwrap returns why the missing shards are missing
+func (e InsufficientShardsError) Unwrap() []error {
+	return e.Errs
+}
+
+// ChecksumMismatchError is returned when shard Shard doesn't match the
+// checksum recorded for it
+type ChecksumMismatchError struct {
+	Shard    int    // The shard number
+	Expected string // The checksum recorded
+	Actual   string // The checksum of the shard
+}
+
+// Error returns the error as a string
+func (e ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch on shard %d: expected %s, got %s", e.Shard, e.Expected, e.Actual)
+}
 
-		*parShards = *dataShards / 2
+// DecryptError is returned when the decoded file can't be decrypted, as
+// the password is wrong or the file is corrupted
+type DecryptError struct {
+	Err error // The error
+}
+
+// Error returns the error as a string
+func (e DecryptError) Error() string {
+	return fmt.Sprintf("decrypt failed: %v", e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e DecryptError) Unwrap() error {
+	return e.Err
+}
+
+// contextReader fails reading once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
 	}
+	return c.r.Read(p)
 }
 
-func DoEncode(fname string, password string) ([]string, []string, int64, int64, int, int) {
-	var paths []string
-	var checksums []string
-	var padding int64
+// EncodedFile describes the shard files DoEncode wrote
+type EncodedFile struct {
+	Paths        []string // paths of the shard files, data shards first
+	Checksums    []string // SHA-256 of each shard file
+	ShardSize    int64    // size of each shard file
+	Padding      int64    // zero bytes padding the data shards
+	Codec        Codec    // the codec of the shards
+	DataShards   int
+	ParityShards int
+}
+
+// DoEncode encrypts fname and splits it into dataShards data and parShards
+// parity shard files in the shard directory, encoded with codec. Nothing is
+// left in the shard directory if it fails or ctx is canceled.
+func DoEncode(ctx context.Context, fname string, password string, codec Codec, dataShards, parShards int) (_ *EncodedFile, err error) {
+	enc, err := codec.NewStream(dataShards, parShards)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create Dir to save shards
 	path, _ := GetShardDir()
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		err := os.Mkdir(path, 0755)
-		checkErr(err)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create shard directory: %w", err)
 	}
 
-	calculateShardsNum(fname)
-
 	// Encrypt the file
 	encFile, err := app.Encrypt(fname, v2.Passphrase(password))
-	checkErr(err)
-
-	if (*dataShards + *parShards) > 256 {
-		fmt.Fprintf(os.Stderr, "Error: sum of data and parity shards cannot exceed 256\n")
-		os.Exit(1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt %s: %w", fname, err)
 	}
-
-	// Create encoding matrix.
-	enc, err := NewStream(*dataShards, *parShards)
-	checkErr(err)
+	defer func() {
+		_ = os.Remove(encFile)
+	}()
 
 	fmt.Println("Opening", encFile)
 	f, err := os.Open(encFile)
-	checkErr(err)
-
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
 	instat, err := f.Stat()
-	checkErr(err)
-
-	shards := *dataShards + *parShards
-	out := make([]*os.File, shards)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create the resulting files.
 	_, file := filepath.Split(encFile)
-
-	// Get path and checksum of all shards
+	out := make([]*os.File, dataShards+parShards)
+	result := &EncodedFile{Codec: codec, DataShards: dataShards, ParityShards: parShards}
+	defer func() {
+		for _, o := range out {
+			if o != nil {
+				_ = o.Close()
+				if err != nil {
+					_ = os.Remove(o.Name())
+				}
+			}
+		}
+	}()
 	for i := range out {
 		outfn := fmt.Sprintf("%s.%d", file, i)
 		fmt.Println("Creating", outfn)
 		out[i], err = os.Create(filepath.Join(path, outfn))
-		checkErr(err)
-
-		paths = append(paths, out[i].Name())
-		fmt.Printf("name : %s \n", out[i].Name())
+		if err != nil {
+			return nil, err
+		}
+		result.Paths = append(result.Paths, out[i].Name())
 	}
 
 	// Split into files.
-	data := make([]io.Writer, *dataShards)
+	data := make([]io.Writer, dataShards)
 	for i := range data {
 		data[i] = out[i]
 	}
-	// Do the split
-	padding, err = enc.Split(f, data, instat.Size())
-	fmt.Printf("Padding : %d\n", padding)
-	checkErr(err)
-
-	// Close and re-open the files.
-	input := make([]io.Reader, *dataShards)
-
-	for i := range data {
-		out[i].Close()
-		f, err := os.Open(out[i].Name())
-		checkErr(err)
-		input[i] = f
+	result.Padding, err = enc.Split(contextReader{ctx, f}, data, instat.Size())
+	if err != nil {
+		return nil, fmt.Errorf("failed to split %s: %w", fname, err)
+	}
+	fmt.Printf("Padding : %d\n", result.Padding)
 
-		defer f.Close()
-		checksum, err := calculateChecksum(out[i].Name())
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: calculating checksum\n")
-			os.Exit(1)
+	// Read the data shards back to encode the parity.
+	input := make([]io.Reader, dataShards)
+	for i := range input {
+		if _, err := out[i].Seek(0, io.SeekStart); err != nil {
+			return nil, err
 		}
-		checksums = append(checksums, checksum)
+		input[i] = contextReader{ctx, out[i]}
 	}
-
-	// Create parity output writers
-	parity := make([]io.Writer, *parShards)
+	parity := make([]io.Writer, parShards)
 	for i := range parity {
-		parity[i] = out[*dataShards+i]
-		// defer out[*dataShards+i].Close()
+		parity[i] = out[dataShards+i]
 	}
+	if err := enc.Encode(input, parity); err != nil {
+		return nil, fmt.Errorf("failed to encode parity of %s: %w", fname, err)
+	}
+	fmt.Printf("File split into %d data + %d parity shards.\n", dataShards, parShards)
 
-	// Calculate the size Per Shard
-	fileShard, err := os.Open(paths[1])
-	checkErr(err)
-
-	fInfo, err := fileShard.Stat()
-	checkErr(err)
-
-	sizePerShard := int64(fInfo.Size())
-
-	fileShard.Close()
-
-	// Encode parity
-	err = enc.Encode(input, parity)
-	checkErr(err)
-	fmt.Printf("File split into %d data + %d parity shards.\n", *dataShards, *parShards)
-
-	//Calculate Shard Checksums.
-	for i := range parity {
-		out[*dataShards+i].Close()
-		checksum, err := calculateChecksum(out[*dataShards+i].Name())
+	// Calculate Shard Checksums.
+	for i := range out {
+		if err := out[i].Close(); err != nil {
+			return nil, err
+		}
+		checksum, err := calculateChecksum(out[i].Name())
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: calculating checksum\n")
-			os.Exit(1)
+			return nil, err
 		}
-		checksums = append(checksums, checksum)
+		result.Checksums = append(result.Checksums, checksum)
 	}
-
-	// Remove the Encrypted file
-	err = os.Remove(encFile)
-	checkErr(err)
-
-	return paths, checksums, sizePerShard, padding, *dataShards, *parShards
+	stat, err := os.Stat(result.Paths[0])
+	if err != nil {
+		return nil, err
+	}
+	result.ShardSize = stat.Size()
+	return result, nil
 }
 
-func trimPadding(f *os.File, trimSize int64) {
-	_, err := f.Seek(0, io.SeekEnd)
-	checkErr(err)
-
+// trimPadding removes the trimSize bytes of padding from the end of f
+func trimPadding(f *os.File, trimSize int64) error {
 	// Get the current size of the file
 	stat, err := f.Stat()
-	checkErr(err)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("trimSize : %d\n", trimSize)
 	// Check if file size is larger than expected size
-	if stat.Size() > trimSize {
-		buf := make([]byte, trimSize)
-		_, err = f.Seek(-trimSize, io.SeekEnd)
-		checkErr(err)
-
-		n, err := f.Read(buf)
-		checkErr(err)
-
-		// Count how many null bytes are at the end of the file
-		var nullByteCount int64 // Change to int64
-		for _, b := range buf[:n] {
-			if b == 0x00 {
-				nullByteCount++
-			} else {
-				break
-			}
-		}
+	if stat.Size() <= trimSize {
+		return nil
+	}
+	buf := make([]byte, trimSize)
+	n, err := f.ReadAt(buf, stat.Size()-trimSize)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read padding: %w", err)
+	}
 
-		// If we found enough null bytes, we should trim them
-		if nullByteCount == trimSize {
-			err := f.Truncate(stat.Size() - trimSize)
-			checkErr(err)
-			fmt.Printf("Trimmed %d null bytes from the end of the file\n", trimSize)
+	// Count how many null bytes are at the end of the file
+	var nullByteCount int64
+	for _, b := range buf[:n] {
+		if b == 0x00 {
+			nullByteCount++
 		} else {
-			// If we don't find enough null bytes, just trim excess bytes
-			err := f.Truncate(trimSize)
-			checkErr(err)
-			fmt.Printf("Trimmed excess bytes, keeping only %d bytes\n", trimSize)
+			break
 		}
 	}
-}
 
-func DoDecode(fname string, outfn string, padding int64, confChecksums map[string]string, downloadshard int, downloadparity int, password string) error {
-	// ConfChecksums is the checksums from configfile
+	// If we found enough null bytes, we should trim them
+	if nullByteCount == trimSize {
+		if err := f.Truncate(stat.Size() - trimSize); err != nil {
+			return fmt.Errorf("failed to trim padding: %w", err)
+		}
+		fmt.Printf("Trimmed %d null bytes from the end of the file\n", trimSize)
+	} else {
+		// If we don't find enough null bytes, just trim excess bytes
+		if err := f.Truncate(trimSize); err != nil {
+			return fmt.Errorf("failed to trim padding: %w", err)
+		}
+		fmt.Printf("Trimmed excess bytes, keeping only %d bytes\n", trimSize)
+	}
+	return nil
+}
 
+// DoDecode rebuilds the file fname into the directory outfn from its
+// downloadshard data and downloadparity parity shard files in the shard
+// directory, encoded with codec, rebuilding the missing ones, and decrypts
+// it.
+//
+// Shards not matching confChecksums, keyed by shard file name, are left
+// out. It returns an InsufficientShardsError if too few shards are left, a
+// DecryptError if the file can't be decrypted, and the error of ctx if it is
+// canceled.
+func DoDecode(ctx context.Context, fname string, outfn string, padding int64, confChecksums map[string]string, codec Codec, downloadshard int, downloadparity int, password string) error {
 	fname = fmt.Sprintf("%s%s", fname, fileCryptExtension)
 	shardDir, _ := GetShardDir()
 	fmt.Printf("outfn: %s, fname: %s\n", outfn, fname)
 
 	// Create Dir to save Decoded file
-	if _, err := os.Stat(outfn); os.IsNotExist(err) {
-		err := os.Mkdir(outfn, 0755)
+	if err := os.MkdirAll(outfn, 0755); err != nil {
 		return err
 	}
 
-	// Caclulate downloaded Checksum of Shards
-	shardChecksums := make(map[string]string)
-	for i := 0; i < len(confChecksums); i++ {
-		tmpPath := fmt.Sprintf("%s/%s.%d", shardDir, fname, i)
-		fileName := fmt.Sprintf("%s.%d", fname, i)
-		fmt.Println("===" + tmpPath + "===")
-		tmpChecksum, _ := calculateChecksum(tmpPath)
-		fmt.Println(tmpPath + "'s checksum is ::: " + tmpChecksum)
-		shardChecksums[fileName] = tmpChecksum
-	}
-	tmpPath := fmt.Sprintf("%s/%s", shardDir, fname)
-
-	// Compare Two shard dir and Delete if error occured
-	compareandDeleteChecksum(shardChecksums, confChecksums, tmpPath)
+	// Leave out the shards which don't match their checksums
+	mismatches := checkShardChecksums(shardDir, fname, confChecksums, downloadshard+downloadparity)
 
 	// Create matrix
-	enc, err := NewStream(downloadshard, downloadparity)
+	enc, err := codec.NewStream(downloadshard, downloadparity)
 	if err != nil {
 		return err
 	}
 
-	// Open the inputs
-	shards, size, err := openInput(downloadshard, downloadparity, fname)
+	// Verify the shards
+	shards, _, missing, err := openInput(downloadshard, downloadparity, fname)
 	if err != nil {
 		return err
 	}
-
-	// Verify the shards
-	ok, err := enc.Verify(shards)
+	ok, err := enc.Verify(contextReaders(ctx, shards))
+	closeInput(shards)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if ok {
-		closeInput(shards)
 		fmt.Println("No reconstruction needed")
 	} else {
 		fmt.Println("Verification failed. Reconstructing data")
-		closeInput(shards)
-
-		shards, size, err = openInput(downloadshard, downloadparity, fname)
-		if err != nil {
-			return err
+		insufficient := InsufficientShardsError{
+			Have: downloadshard + downloadparity - len(missing),
+			Need: downloadshard,
+			Errs: mismatches,
 		}
-
-		// Create out destination writers
-		out := make([]io.Writer, len(shards))
-		for i := range out {
-			if shards[i] == nil {
-				path, _ := GetShardDir()
-				outfn := filepath.Join(path, fmt.Sprintf("%s.%d", fname, i))
-				fmt.Println("Creating", outfn)
-				out[i], err = os.Create(outfn)
-				if err != nil {
-					return err
-				}
+		for i := 0; i < downloadshard+downloadparity; i++ {
+			var mismatch ChecksumMismatchError
+			if err, ok := missing[i]; ok && !slices.ContainsFunc(mismatches, func(e error) bool {
+				return errors.As(e, &mismatch) && mismatch.Shard == i
+			}) {
+				insufficient.Errs = append(insufficient.Errs, fmt.Errorf("shard %d: %w", i, err))
 			}
 		}
-		err = enc.Reconstruct(shards, out)
-		if err != nil {
-			fmt.Println("Reconstruct failed -", err)
-			return err
+		if insufficient.Have < insufficient.Need {
+			return insufficient
 		}
-		// Close output.
-		for i := range out {
-			if out[i] != nil {
-				err := out[i].(*os.File).Close()
-				if err != nil {
-					return err
-				}
+		if err := reconstructShards(ctx, enc, downloadshard, downloadparity, shardDir, fname); err != nil {
+			if errors.Is(err, ErrTooFewShards) {
+				return insufficient
 			}
-		}
-		shards, size, err = openInput(downloadshard, downloadparity, fname)
-		ok, err = enc.Verify(shards)
-		if !ok {
-			fmt.Println("Verification failed after reconstruction, data likely corrupted:", err)
-			return err
-		}
-
-		if err != nil {
 			return err
 		}
-
 	}
-	outfn = filepath.Join(outfn, fname)
 
-	fmt.Println("Writing data to", outfn)
-	f, err := os.Create(outfn)
+	shards, size, _, err := openInput(downloadshard, downloadparity, fname)
 	if err != nil {
 		return err
 	}
+	defer closeInput(shards)
 
-	shards, size, err = openInput(downloadshard, downloadparity, fname)
+	outfn = filepath.Join(outfn, fname)
+	fmt.Println("Writing data to", outfn)
+	f, err := os.Create(outfn)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = f.Close()
+		// Remove the Decoded file
+		_ = os.Remove(outfn)
+	}()
 
 	// We don't know the exact filesize.
-	err = enc.Join(f, shards, int64(downloadshard)*size)
-	if err != nil {
-		return err
+	if err := enc.Join(f, contextReaders(ctx, shards), int64(downloadshard)*size); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return fmt.Errorf("failed to join shards: %w", err)
 	}
 	if padding > 0 {
-		trimPadding(f, padding)
+		if err := trimPadding(f, padding); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
 	}
 	originFile, err := app.Decrypt(outfn, v2.Passphrase(password))
-	fmt.Println("====  origin file Location ", originFile)
 	if err != nil {
-		return err
+		return DecryptError{Err: err}
 	}
-	f.Close()
+	fmt.Println("====  origin file Location ", originFile)
+	return nil
+}
 
-	// Remove the Decodeded file
-	err = os.Remove(outfn)
+// reconstructShards rebuilds the missing shard files of fname and verifies
+// the result
+func reconstructShards(ctx context.Context, enc StreamEncoder, dataShards, parShards int, shardDir, fname string) (err error) {
+	shards, _, _, err := openInput(dataShards, parShards, fname)
 	if err != nil {
 		return err
 	}
+	defer closeInput(shards)
 
-	closeInput(shards)
+	// Create out destination writers
+	out := make([]io.Writer, len(shards))
+	var created []*os.File
+	defer func() {
+		for _, o := range created {
+			_ = o.Close()
+			if err != nil {
+				_ = os.Remove(o.Name())
+			}
+		}
+	}()
+	for i := range out {
+		if shards[i] == nil {
+			outfn := filepath.Join(shardDir, fmt.Sprintf("%s.%d", fname, i))
+			fmt.Println("Creating", outfn)
+			o, err := os.Create(outfn)
+			if err != nil {
+				return err
+			}
+			created = append(created, o)
+			out[i] = o
+		}
+	}
+	if err := enc.Reconstruct(contextReaders(ctx, shards), out); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return fmt.Errorf("reconstruct failed: %w", err)
+	}
+	for _, o := range created {
+		if err := o.Close(); err != nil {
+			return err
+		}
+	}
 
+	verify, _, _, err := openInput(dataShards, parShards, fname)
+	if err != nil {
+		return err
+	}
+	defer closeInput(verify)
+	ok, err := enc.Verify(contextReaders(ctx, verify))
+	if err != nil {
+		return fmt.Errorf("verification failed after reconstruction: %w", err)
+	}
+	if !ok {
+		return errors.New("verification failed after reconstruction, data likely corrupted")
+	}
 	return nil
 }
 
-func openInput(dataShards, parShards int, fname string) (r []io.Reader, size int64, err error) {
-	// Create shards and load the data.
+// contextReaders returns shards reading only while ctx isn't done, nil
+// shards left nil
+func contextReaders(ctx context.Context, shards []io.Reader) []io.Reader {
+	out := make([]io.Reader, len(shards))
+	for i, r := range shards {
+		if r != nil {
+			out[i] = contextReader{ctx, r}
+		}
+	}
+	return out
+}
+
+// openInput opens the shard files of fname. Shards which are missing or
+// empty are left nil, with why in missing by shard number.
+func openInput(dataShards, parShards int, fname string) (r []io.Reader, size int64, missing map[int]error, err error) {
+	path, err := GetShardDir()
+	if err != nil {
+		return nil, 0, nil, err
+	}
 	shards := make([]io.Reader, dataShards+parShards)
+	missing = make(map[int]error)
 	for i := range shards {
-		path, err := GetShardDir()
 		infn := filepath.Join(path, fmt.Sprintf("%s.%d", fname, i))
 		fmt.Println("Opening", infn)
 		f, err := os.Open(infn)
 		if err != nil {
 			fmt.Println("Error reading file", err)
-			shards[i] = nil
+			missing[i] = err
 			continue
-		} else {
-			shards[i] = f
 		}
 		stat, err := f.Stat()
-		checkErr(err)
-		if stat.Size() > 0 {
-			size = stat.Size()
-		} else {
-			shards[i] = nil
+		if err != nil {
+			_ = f.Close()
+			closeInput(shards)
+			return nil, 0, nil, err
 		}
+		if stat.Size() == 0 {
+			_ = f.Close()
+			missing[i] = ErrShardNoData
+			continue
+		}
+		shards[i] = f
+		size = stat.Size()
 	}
-	return shards, size, nil
+	return shards, size, missing, nil
 }
 
 func closeInput(shards []io.Reader) {
@@ -554,9 +672,15 @@ func (s StreamWriteError) String() string {
 // distribution of datashards and parity shards.
 // Construct if using NewStream()
 type rsStream struct {
-	r *reedSolomon
+	r Encoder
 	o options
 
+	dataShards   int
+	parityShards int
+	totalShards  int
+	// shards sizes must be multiples of shardMultiple
+	shardMultiple int
+
 	// Shard reader
 	readShards func(dst [][]byte, in []io.Reader) error
 	// Shard writer
@@ -568,16 +692,16 @@ type rsStream struct {
 // NewStream creates a new encoder and initializes it to
 // the number of data shards and parity shards that
 // you want to use. You can reuse this encoder.
-// Note that the maximum number of data shards is 256.
+// Note that the maximum number of data shards is 256, unless Leopard
+// GF(2^16) is used with WithLeopardGF16.
 func NewStream(dataShards, parityShards int, o ...Option) (StreamEncoder, error) {
-	if dataShards+parityShards > 256 {
-		return nil, ErrMaxShardNum
-	}
-
 	r := rsStream{o: defaultOptions}
 	for _, opt := range o {
 		opt(&r.o)
 	}
+	if dataShards+parityShards > 256 && r.o.withLeopard != leopardGF16 {
+		return nil, ErrMaxShardNum
+	}
 	// Override block size if shard size is set.
 	if r.o.streamBS == 0 && r.o.shardSize > 0 {
 		r.o.streamBS = r.o.shardSize
@@ -593,7 +717,16 @@ func NewStream(dataShards, parityShards int, o ...Option) (StreamEncoder, error)
 	if err != nil {
 		return nil, err
 	}
-	r.r = enc.(*reedSolomon)
+	r.r = enc
+	r.dataShards = dataShards
+	r.parityShards = parityShards
+	r.totalShards = dataShards + parityShards
+	r.shardMultiple = 1
+	if ext, ok := enc.(Extensions); ok {
+		r.shardMultiple = ext.ShardSizeMultiple()
+	}
+	// Leopard only works on blocks of shardMultiple bytes
+	r.o.streamBS = (r.o.streamBS + r.shardMultiple - 1) / r.shardMultiple * r.shardMultiple
 
 	r.blockPool.New = func() interface{} {
 		return AllocAligned(dataShards+parityShards, r.o.streamBS)
@@ -642,18 +775,18 @@ func (r *rsStream) createSlice() [][]byte {
 // will be returned. If a parity writer returns an error, a
 // StreamWriteError will be returned.
 func (r *rsStream) Encode(data []io.Reader, parity []io.Writer) error {
-	if len(data) != r.r.dataShards {
+	if len(data) != r.dataShards {
 		return ErrTooFewShards
 	}
 
-	if len(parity) != r.r.parityShards {
+	if len(parity) != r.parityShards {
 		return ErrTooFewShards
 	}
 
 	all := r.createSlice()
 	defer r.blockPool.Put(all)
-	in := all[:r.r.dataShards]
-	out := all[r.r.dataShards:]
+	in := all[:r.dataShards]
+	out := all[r.dataShards:]
 	read := 0
 
 	for {
@@ -848,7 +981,7 @@ func cWriteShards(out []io.Writer, in [][]byte) error {
 // If a shard stream returns an error, a StreamReadError type error
 // will be returned.
 func (r *rsStream) Verify(shards []io.Reader) (bool, error) {
-	if len(shards) != r.r.totalShards {
+	if len(shards) != r.totalShards {
 		return false, ErrTooFewShards
 	}
 
@@ -895,10 +1028,10 @@ var ErrReconstructMismatch = errors.New("valid shards and fill shards are mutual
 // However its integrity is not automatically verified.
 // Use the Verify function to check in case the data set is complete.
 func (r *rsStream) Reconstruct(valid []io.Reader, fill []io.Writer) error {
-	if len(valid) != r.r.totalShards {
+	if len(valid) != r.totalShards {
 		return ErrTooFewShards
 	}
-	if len(fill) != r.r.totalShards {
+	if len(fill) != r.totalShards {
 		return ErrTooFewShards
 	}
 
@@ -909,7 +1042,7 @@ func (r *rsStream) Reconstruct(valid []io.Reader, fill []io.Writer) error {
 		if valid[i] != nil && fill[i] != nil {
 			return ErrReconstructMismatch
 		}
-		if i >= r.r.dataShards && fill[i] != nil {
+		if i >= r.dataShards && fill[i] != nil {
 			reconDataOnly = false
 		}
 	}
@@ -953,12 +1086,12 @@ func (r *rsStream) Reconstruct(valid []io.Reader, fill []io.Writer) error {
 // If the total data size is less than outSize, ErrShortData will be returned.
 func (r *rsStream) Join(dst io.Writer, shards []io.Reader, outSize int64) error {
 	// Do we have enough shards?
-	if len(shards) < r.r.dataShards {
+	if len(shards) < r.dataShards {
 		return ErrTooFewShards
 	}
 
 	// Trim off parity shards if any
-	shards = shards[:r.r.dataShards]
+	shards = shards[:r.dataShards]
 	for i := range shards {
 		if shards[i] == nil {
 			return StreamReadError{Err: ErrShardNoData, Stream: i}
@@ -994,7 +1127,7 @@ func (r *rsStream) Split(data io.Reader, dst []io.Writer, size int64) (int64, er
 	if size == 0 {
 		return 0, ErrShortData
 	}
-	if len(dst) != r.r.dataShards {
+	if len(dst) != r.dataShards {
 		return 0, ErrInvShardNum
 	}
 
@@ -1005,10 +1138,11 @@ func (r *rsStream) Split(data io.Reader, dst []io.Writer, size int64) (int64, er
 	}
 
 	// Calculate number of bytes per shard.
-	perShard := (size + int64(r.r.dataShards) - 1) / int64(r.r.dataShards)
+	perShard := (size + int64(r.dataShards) - 1) / int64(r.dataShards)
+	perShard = (perShard + int64(r.shardMultiple) - 1) / int64(r.shardMultiple) * int64(r.shardMultiple)
 
 	// Calculate padding size.
-	paddingSize := (int64(r.r.totalShards) * perShard) - size
+	paddingSize := (int64(r.totalShards) * perShard) - size
 
 	// Create zeroPaddingReader to track padding bytes.
 	paddingReader := &zeroPaddingReader{}
@@ -1043,13 +1177,6 @@ func (t *zeroPaddingReader) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
-func checkErr(err error) {
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s", err.Error())
-		os.Exit(2)
-	}
-}
-
 func calculateChecksum(filePath string) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -1064,23 +1191,31 @@ func calculateChecksum(filePath string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func compareandDeleteChecksum(serverChecksum map[string]string, confChecksum map[string]string, path string) error {
-
-	fname := filepath.Base(path)
-	numShards := len(confChecksum)
-
+// checkShardChecksums removes the shard files of fname which don't match
+// their checksums in confChecksums, keyed by shard file name, so they are
+// rebuilt, and returns a ChecksumMismatchError for each
+func checkShardChecksums(shardDir, fname string, confChecksums map[string]string, numShards int) []error {
+	var mismatches []error
 	for i := 0; i < numShards; i++ {
-		fileName := fmt.Sprint("%s.%d", fname, i)
-
-		if serverChecksum[fileName] != confChecksum[fileName] {
-			fileToDelete := fmt.Sprintf("%s.%d", path, i)
-			fmt.Printf("Mismatch for file %s: server checksum %s, conf checksum %s\n", fileToDelete, serverChecksum[fileName], confChecksum[fileName])
+		fileName := fmt.Sprintf("%s.%d", fname, i)
+		expected, ok := confChecksums[fileName]
+		if !ok || expected == "" {
+			continue
+		}
+		shardPath := filepath.Join(shardDir, fileName)
+		actual, err := calculateChecksum(shardPath)
+		if err != nil {
+			// missing, openInput reports it
+			continue
+		}
+		if actual != expected {
+			fmt.Printf("Mismatch for file %s: checksum %s, expected %s\n", shardPath, actual, expected)
 			fmt.Println("Deleting mismatched shard...")
-			if err := os.Remove(fileToDelete); err != nil {
-				return fmt.Errorf("delete failed for %s: %w", fileToDelete, err)
+			if err := os.Remove(shardPath); err != nil {
+				fmt.Printf("delete failed for %s: %v\n", shardPath, err)
 			}
+			mismatches = append(mismatches, ChecksumMismatchError{Shard: i, Expected: expected, Actual: actual})
 		}
 	}
-
-	return nil
+	return mismatches
 }
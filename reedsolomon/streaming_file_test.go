@@ -0,0 +1,170 @@
+package reedsolomon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rclone/rclone/fs/config"
+)
+
+// encodeTestFile writes data as a file named name and encodes it with codec
+// into dataShards+parShards shards in the shard dir of a temporary config
+func encodeTestFile(t *testing.T, name string, data []byte, codec Codec, dataShards, parShards int) (*EncodedFile, map[string]string) {
+	dir := t.TempDir()
+	oldConfigPath := config.GetConfigPath()
+	if err := config.SetConfigPath(filepath.Join(dir, "rclone.conf")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = config.SetConfigPath(oldConfigPath)
+	})
+	src := filepath.Join(dir, name)
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := DoEncode(context.Background(), src, "password", codec, dataShards, parShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := dataShards + parShards; len(encoded.Paths) != total || len(encoded.Checksums) != total {
+		t.Fatalf("got %d shards and %d checksums, want %d", len(encoded.Paths), len(encoded.Checksums), total)
+	}
+	checksums := make(map[string]string)
+	for i, p := range encoded.Paths {
+		checksums[filepath.Base(p)] = encoded.Checksums[i]
+	}
+	return encoded, checksums
+}
+
+func TestDoEncodeDecode(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 100000)
+	fillRandom(data)
+	encoded, checksums := encodeTestFile(t, "data.bin", data, CodecReedSolomon, 5, 3)
+
+	decode := func(password string) ([]byte, error) {
+		out := t.TempDir()
+		err := DoDecode(ctx, "data.bin", out, encoded.Padding, checksums, CodecReedSolomon, 5, 3, password)
+		if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(filepath.Join(out, "data.bin"))
+	}
+
+	got, err := decode("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("decoded data differs")
+	}
+
+	// a corrupted shard is left out and rebuilt
+	if err := os.WriteFile(encoded.Paths[1], []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err = decode("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("decoded data differs after rebuilding a shard")
+	}
+
+	var decryptErr DecryptError
+	if _, err := decode("wrong"); !errors.As(err, &decryptErr) {
+		t.Fatalf("got %v, want a DecryptError", err)
+	}
+
+	// too many shards lost
+	for _, i := range []int{0, 2, 4} {
+		if err := os.WriteFile(encoded.Paths[i], []byte("corrupted"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(encoded.Paths[6]); err != nil {
+		t.Fatal(err)
+	}
+	_, err = decode("password")
+	var insufficient InsufficientShardsError
+	if !errors.As(err, &insufficient) || insufficient.Have != 4 || insufficient.Need != 5 {
+		t.Fatalf("got %v, want 4 of 5 insufficient shards", err)
+	}
+	if !errors.Is(err, ErrTooFewShards) {
+		t.Fatalf("%v doesn't match ErrTooFewShards", err)
+	}
+	var mismatch ChecksumMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Shard != 0 {
+		t.Fatalf("got %v, want a checksum mismatch on shard 0", err)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("%v doesn't report shard 6 missing", err)
+	}
+}
+
+func TestDoEncodeDecodeLeopard(t *testing.T) {
+	ctx := context.Background()
+	const dataShards, parShards = 200, 100
+	data := make([]byte, 100000)
+	fillRandom(data)
+	encoded, checksums := encodeTestFile(t, "data.bin", data, CodecLeopardGF16, dataShards, parShards)
+	if encoded.Codec != CodecLeopardGF16 || encoded.ShardSize%64 != 0 {
+		t.Fatalf("got %s shards of %d bytes, want leopard shards of a multiple of 64 bytes", encoded.Codec, encoded.ShardSize)
+	}
+
+	// lose some data and parity shards
+	for _, i := range []int{0, 17, 199, 250} {
+		if err := os.Remove(encoded.Paths[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := t.TempDir()
+	if err := DoDecode(ctx, "data.bin", out, encoded.Padding, checksums, CodecLeopardGF16, dataShards, parShards, "password"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(out, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("decoded data differs")
+	}
+}
+
+func TestDoEncodeErrors(t *testing.T) {
+	data := make([]byte, 1000)
+	fillRandom(data)
+	encoded, _ := encodeTestFile(t, "small.bin", data, CodecReedSolomon, 5, 3)
+	src := filepath.Join(filepath.Dir(config.GetConfigPath()), "small.bin")
+
+	if _, err := DoEncode(context.Background(), src, "password", CodecReedSolomon, 200, 100); !errors.Is(err, ErrMaxShardNum) {
+		t.Fatalf("got %v, want ErrMaxShardNum", err)
+	}
+
+	// a canceled encode leaves no shards behind
+	for _, p := range encoded.Paths {
+		if err := os.Remove(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DoEncode(ctx, src, "password", CodecReedSolomon, 5, 3); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	shardDir, _ := GetShardDir()
+	entries, err := os.ReadDir(shardDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("%d files left in the shard dir", len(entries))
+	}
+	if err := DoDecode(ctx, "small.bin", t.TempDir(), encoded.Padding, nil, CodecReedSolomon, 5, 3, "password"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
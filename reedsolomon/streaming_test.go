@@ -627,7 +627,7 @@ func TestStreamSplitJoin(t *testing.T) {
 
 	enc, _ := NewStream(5, 3, testOptions()...)
 	split := emptyBuffers(5)
-	err := enc.Split(bytes.NewBuffer(data), toWriters(split), int64(len(data)))
+	_, err := enc.Split(bytes.NewBuffer(data), toWriters(split), int64(len(data)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -638,7 +638,7 @@ func TestStreamSplitJoin(t *testing.T) {
 		t.Errorf("unexpected size. expected %d, got %d", expect, split[0].Len())
 	}
 
-	err = enc.Split(bytes.NewBuffer([]byte{}), toWriters(emptyBuffers(3)), 0)
+	_, err = enc.Split(bytes.NewBuffer([]byte{}), toWriters(emptyBuffers(3)), 0)
 	if err != ErrShortData {
 		t.Errorf("expected %v, got %v", ErrShortData, err)
 	}
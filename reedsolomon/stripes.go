@@ -0,0 +1,666 @@
+package reedsolomon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Stripe layout used by the streaming distributed file pipeline.
+//
+// The input is cut into stripes of dataShards*stripeSize bytes. Each stripe
+// is split into dataShards chunks of stripeSize bytes, the parity chunks are
+// computed in memory and chunk i of every stripe is appended to shard i.
+// Only a single stripe is held in memory whatever the size of the input, so
+// shards can be streamed to their destination while the input is read.
+
+const (
+	// MinStripeSize is the smallest stripe size used
+	MinStripeSize = 64
+	// DefaultStripeSize is the stripe size used for large inputs
+	DefaultStripeSize = 1 << 20
+	// maxStripeBuffer limits the memory used by a single stripe of data shards
+	maxStripeBuffer = 64 << 20
+)
+
+// StripeSizeFor returns the stripe size to use when splitting size bytes
+// into dataShards. It is a multiple of 64 bytes.
+func StripeSizeFor(size int64, dataShards int) int {
+	if dataShards < 1 {
+		dataShards = 1
+	}
+	// Small inputs don't need a full stripe
+	stripeSize := (size + int64(dataShards) - 1) / int64(dataShards)
+	stripeSize = (stripeSize + MinStripeSize - 1) / MinStripeSize * MinStripeSize
+	if stripeSize > DefaultStripeSize {
+		stripeSize = DefaultStripeSize
+	}
+	if limit := int64(maxStripeBuffer/dataShards) / MinStripeSize * MinStripeSize; stripeSize > limit {
+		stripeSize = limit
+	}
+	if stripeSize < MinStripeSize {
+		stripeSize = MinStripeSize
+	}
+	return int(stripeSize)
+}
+
+// StripeCount returns the number of stripes needed for size bytes
+func StripeCount(size int64, dataShards, stripeSize int) int64 {
+	stripe := int64(dataShards) * int64(stripeSize)
+	n := (size + stripe - 1) / stripe
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// StripeShardSize returns the size of every shard when size bytes are
+// encoded with the given layout
+func StripeShardSize(size int64, dataShards, stripeSize int) int64 {
+	return StripeCount(size, dataShards, stripeSize) * int64(stripeSize)
+}
+
+// newStripeEncoder returns the encoder of the stripes and their number of
+// shards, which is more than dataShards+parityShards with local parity
+func newStripeEncoder(codec Codec, dataShards, parityShards int, o []Option) (Encoder, int, error) {
+	enc, err := codec.New(dataShards, parityShards, o...)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := dataShards + parityShards
+	if ext, ok := enc.(Extensions); ok {
+		total = ext.TotalShards()
+	}
+	return enc, total, nil
+}
+
+// EncodeStripes reads size bytes from in and writes the data and parity
+// shards to out, which must hold a writer per shard, dataShards+parityShards
+// unless local parity is added with o. The parity is computed with codec
+// and o, which the shards must be decoded with.
+//
+// Every writer receives StripeShardSize(size, dataShards, stripeSize) bytes.
+// The last stripe is padded with zeros. Writes to the shards of a stripe
+// happen concurrently so a slow writer doesn't hold up the others until the
+// next stripe.
+func EncodeStripes(ctx context.Context, in io.Reader, size int64, codec Codec, dataShards, parityShards, stripeSize int, out []io.Writer, o ...Option) error {
+	enc, total, err := newStripeEncoder(codec, dataShards, parityShards, o)
+	if err != nil {
+		return err
+	}
+	if len(out) != total {
+		return ErrTooFewShards
+	}
+
+	buf := AllocAligned(total, stripeSize)
+	for i := range buf {
+		buf[i] = buf[i][:stripeSize]
+	}
+	remaining := size
+	stripes := StripeCount(size, dataShards, stripeSize)
+
+	for s := int64(0); s < stripes; s++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for i := 0; i < dataShards; i++ {
+			chunk := buf[i]
+			n := int64(stripeSize)
+			if remaining < n {
+				n = remaining
+			}
+			if n > 0 {
+				if _, err := io.ReadFull(in, chunk[:n]); err != nil {
+					if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+						return ErrShortData
+					}
+					return err
+				}
+			}
+			clear(chunk[n:])
+			remaining -= n
+		}
+		if err := enc.Encode(buf); err != nil {
+			return err
+		}
+		if err := cWriteShards(out, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeStripes reads the shards written by EncodeStripes and writes the
+// first outSize bytes of the original data to dst.
+//
+// shards holds a reader per shard; missing shards are nil. A
+// shard which fails to read is dropped for the rest of the decode. As long
+// as dataShards shards remain, lost data chunks are reconstructed per
+// stripe, otherwise ErrTooFewShards is returned.
+func DecodeStripes(ctx context.Context, shards []io.Reader, codec Codec, dataShards, parityShards, stripeSize int, outSize int64, dst io.Writer, o ...Option) error {
+	enc, total, err := newStripeEncoder(codec, dataShards, parityShards, o)
+	if err != nil {
+		return err
+	}
+	if len(shards) != total {
+		return ErrTooFewShards
+	}
+
+	readers := append([]io.Reader(nil), shards...)
+	buf := AllocAligned(total, stripeSize)
+	chunks := make([][]byte, total)
+	readErrs := make([]error, total)
+	remaining := outSize
+
+	for remaining > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var wg sync.WaitGroup
+		for i, r := range readers {
+			if r == nil {
+				chunks[i] = buf[i][:0]
+				continue
+			}
+			wg.Add(1)
+			go func(i int, r io.Reader) {
+				defer wg.Done()
+				chunks[i] = buf[i][:stripeSize]
+				if _, err := io.ReadFull(r, chunks[i]); err != nil {
+					readErrs[i] = StreamReadError{Err: err, Stream: i}
+					chunks[i] = buf[i][:0]
+				}
+			}(i, r)
+		}
+		wg.Wait()
+
+		present := 0
+		dataMissing := false
+		for i := range readers {
+			if readErrs[i] != nil {
+				readers[i] = nil
+			}
+			if len(chunks[i]) > 0 {
+				present++
+			} else if i < dataShards {
+				dataMissing = true
+			}
+		}
+
+		if dataMissing {
+			if present < dataShards {
+				return fmt.Errorf("%w: %d of %d shards available: %v", ErrTooFewShards, present, dataShards, errors.Join(readErrs...))
+			}
+			if err := enc.ReconstructData(chunks); err != nil {
+				return err
+			}
+		}
+
+		for i := 0; i < dataShards && remaining > 0; i++ {
+			chunk := chunks[i]
+			if int64(len(chunk)) > remaining {
+				chunk = chunk[:remaining]
+			}
+			if _, err := dst.Write(chunk); err != nil {
+				return err
+			}
+			remaining -= int64(len(chunk))
+		}
+	}
+	return nil
+}
+
+// ShardOpener opens shard i for reading, starting offset bytes into the shard
+type ShardOpener func(ctx context.Context, i int, offset int64) (io.ReadCloser, error)
+
+// StripeDecodeOptions tune DecodeStripesFrom
+type StripeDecodeOptions struct {
+	// Order lists the shards in the order they are tried. Shards left out
+	// are tried last in index order. nil tries the data shards first.
+	Order []int
+	// HedgeAfter is how long a stripe may take before reading it from a
+	// spare shard as well, 0 disables hedging
+	HedgeAfter time.Duration
+}
+
+// shardOrder returns the order total shards are tried in: those of order
+// first, then the others in index order
+func shardOrder(order []int, total int) []int {
+	all := make([]int, 0, total)
+	seen := make([]bool, total)
+	for _, i := range order {
+		if i >= 0 && i < total && !seen[i] {
+			seen[i] = true
+			all = append(all, i)
+		}
+	}
+	for i := 0; i < total; i++ {
+		if !seen[i] {
+			all = append(all, i)
+		}
+	}
+	return all
+}
+
+// shardResult is the outcome of reading a stripe chunk from a shard
+type shardResult struct {
+	i   int
+	err error
+}
+
+// DecodeStripesFrom is like DecodeStripes but opens the shards itself.
+//
+// Only dataShards shards are read at any time, tried in opt.Order. Another
+// shard is only opened, at the offset of the current stripe, when a shard
+// can't be opened, fails while reading or, with opt.HedgeAfter set, is too
+// slow. As soon as dataShards chunks of a stripe are in, shards still
+// reading it are closed and dropped. A shard which was dropped is never
+// opened again.
+func DecodeStripesFrom(ctx context.Context, open ShardOpener, codec Codec, dataShards, parityShards, stripeSize int, outSize int64, dst io.Writer, opt StripeDecodeOptions, o ...Option) error {
+	enc, total, err := newStripeEncoder(codec, dataShards, parityShards, o)
+	if err != nil {
+		return err
+	}
+
+	order := shardOrder(opt.Order, total)
+
+	readers := make([]io.ReadCloser, total)
+	tried := make([]bool, total)
+	// shards abandoned while reading, their buffers may still be written to
+	abandoned := make([]bool, total)
+	defer func() {
+		for _, r := range readers {
+			if r != nil {
+				_ = r.Close()
+			}
+		}
+	}()
+
+	buf := AllocAligned(total, stripeSize)
+	chunks := make([][]byte, total)
+	var readErrs []error
+	remaining := outSize
+	offset := int64(0)
+
+	// dropping shard i for the rest of the decode
+	drop := func(i int) {
+		_ = readers[i].Close()
+		readers[i] = nil
+	}
+
+	// opening the next untried shard at the current offset
+	openNext := func() (int, bool) {
+		for _, i := range order {
+			if tried[i] {
+				continue
+			}
+			tried[i] = true
+			r, err := open(ctx, i, offset)
+			if err != nil {
+				readErrs = append(readErrs, StreamReadError{Err: err, Stream: i})
+				continue
+			}
+			readers[i] = r
+			return i, true
+		}
+		return 0, false
+	}
+
+	for remaining > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		results := make(chan shardResult, total)
+		inflight := make(map[int]bool)
+		start := func(i int) {
+			inflight[i] = true
+			go func(r io.Reader, chunk []byte) {
+				_, err := io.ReadFull(r, chunk)
+				results <- shardResult{i: i, err: err}
+			}(readers[i], buf[i][:stripeSize])
+		}
+
+		for i, r := range readers {
+			chunks[i] = buf[i][:0]
+			if abandoned[i] {
+				chunks[i] = nil
+			}
+			if r != nil {
+				start(i)
+			}
+		}
+
+		var hedge <-chan time.Time
+		var timer *time.Timer
+		if opt.HedgeAfter > 0 {
+			timer = time.NewTimer(opt.HedgeAfter)
+			hedge = timer.C
+		}
+
+		present := 0
+		for present < dataShards {
+			// keeping enough shards busy to complete the stripe
+			for len(inflight) < dataShards-present {
+				i, ok := openNext()
+				if !ok {
+					break
+				}
+				start(i)
+			}
+			if len(inflight) == 0 {
+				return fmt.Errorf("%w: %d of %d shards available: %v", ErrTooFewShards, present, dataShards, errors.Join(readErrs...))
+			}
+
+			select {
+			case res := <-results:
+				delete(inflight, res.i)
+				if res.err != nil {
+					readErrs = append(readErrs, StreamReadError{Err: res.err, Stream: res.i})
+					drop(res.i)
+					continue
+				}
+				chunks[res.i] = buf[res.i][:stripeSize]
+				present++
+			case <-hedge:
+				if i, ok := openNext(); ok {
+					start(i)
+				}
+				timer.Reset(opt.HedgeAfter)
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		// cancelling the shards which lost the race
+		for i := range inflight {
+			abandoned[i] = true
+			chunks[i] = nil
+			drop(i)
+		}
+
+		for i := 0; i < dataShards; i++ {
+			if len(chunks[i]) == 0 {
+				if err := enc.ReconstructData(chunks); err != nil {
+					return err
+				}
+				break
+			}
+		}
+
+		for i := 0; i < dataShards && remaining > 0; i++ {
+			chunk := chunks[i]
+			if int64(len(chunk)) > remaining {
+				chunk = chunk[:remaining]
+			}
+			if _, err := dst.Write(chunk); err != nil {
+				return err
+			}
+			remaining -= int64(len(chunk))
+		}
+		offset += int64(stripeSize)
+	}
+	return nil
+}
+
+// rangeShard is a shard being read by ReadStripesRange
+type rangeShard struct {
+	rc  io.ReadCloser
+	pos int64
+}
+
+// ReadStripesRange writes length bytes of the data encoded by
+// EncodeStripes, starting offset bytes into it, to dst. outSize is the size
+// of the data and a negative length reads up to it.
+//
+// As stripes are cut into consecutive chunks of stripeSize bytes, a range
+// of the data lies in known parts of known data shards, and only these are
+// read. A shard is opened at the first byte of the range it holds and read
+// on from there. When one of them can't be read, the stripes it is missing
+// from are rebuilt from full chunks of dataShards other shards, tried in
+// opt.Order, and it isn't opened again. opt.HedgeAfter is ignored.
+func ReadStripesRange(ctx context.Context, open ShardOpener, codec Codec, dataShards, parityShards, stripeSize int, outSize, offset, length int64, dst io.Writer, opt StripeDecodeOptions, o ...Option) error {
+	if offset < 0 || offset > outSize {
+		return fmt.Errorf("offset %d outside of %d bytes", offset, outSize)
+	}
+	end := outSize
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+	if offset == end {
+		return nil
+	}
+	enc, total, err := newStripeEncoder(codec, dataShards, parityShards, o)
+	if err != nil {
+		return err
+	}
+	order := shardOrder(opt.Order, total)
+
+	shards := make([]*rangeShard, total)
+	failed := make([]bool, total)
+	var readErrs []error
+	defer func() {
+		for _, r := range shards {
+			if r != nil {
+				_ = r.rc.Close()
+			}
+		}
+	}()
+	fail := func(i int, err error) {
+		failed[i] = true
+		readErrs = append(readErrs, StreamReadError{Err: err, Stream: i})
+		if shards[i] != nil {
+			_ = shards[i].rc.Close()
+			shards[i] = nil
+		}
+	}
+
+	// reading len(p) bytes of shard i from shardOffset, going on with the
+	// open shard if it is at or just before shardOffset
+	read := func(i int, shardOffset int64, p []byte) error {
+		r := shards[i]
+		if r != nil && (shardOffset < r.pos || shardOffset-r.pos > int64(stripeSize)) {
+			_ = r.rc.Close()
+			r, shards[i] = nil, nil
+		}
+		if r == nil {
+			rc, err := open(ctx, i, shardOffset)
+			if err != nil {
+				return err
+			}
+			r = &rangeShard{rc: rc, pos: shardOffset}
+			shards[i] = r
+		}
+		if skip := shardOffset - r.pos; skip > 0 {
+			n, err := io.CopyN(io.Discard, r.rc, skip)
+			r.pos += n
+			if err != nil {
+				return err
+			}
+		}
+		n, err := io.ReadFull(r.rc, p)
+		r.pos += int64(n)
+		return err
+	}
+
+	// reading the given parts of shards concurrently
+	readAll := func(idx []int, shardOffset func(i int) int64, part func(i int) []byte) []error {
+		errs := make([]error, len(idx))
+		var wg sync.WaitGroup
+		for n, i := range idx {
+			wg.Add(1)
+			go func(n, i int) {
+				defer wg.Done()
+				errs[n] = read(i, shardOffset(i), part(i))
+			}(n, i)
+		}
+		wg.Wait()
+		return errs
+	}
+
+	buf := AllocAligned(total, stripeSize)
+	width := int64(dataShards) * int64(stripeSize)
+	for s := offset / width; s*width < end; s++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		stripeStart := s * width
+		shardBase := s * int64(stripeSize)
+		// the part of the stripe in the range, and of every chunk in it
+		from, to := max(offset, stripeStart)-stripeStart, min(end, stripeStart+width)-stripeStart
+		first, last := int(from/int64(stripeSize)), int((to-1)/int64(stripeSize))
+		lo := func(i int) int64 { return max(from, int64(i*stripeSize)) - int64(i*stripeSize) }
+		hi := func(i int) int64 { return min(to, int64((i+1)*stripeSize)) - int64(i*stripeSize) }
+
+		var covering []int
+		degraded := false
+		for i := first; i <= last; i++ {
+			if failed[i] {
+				degraded = true
+			} else {
+				covering = append(covering, i)
+			}
+		}
+		errs := readAll(covering, func(i int) int64 { return shardBase + lo(i) }, func(i int) []byte { return buf[i][lo(i):hi(i)] })
+		for n, err := range errs {
+			if err != nil {
+				fail(covering[n], err)
+				degraded = true
+			}
+		}
+
+		if degraded {
+			// rebuilding the stripe from full chunks of the shards left
+			chunks := make([][]byte, total)
+			for i := range chunks {
+				chunks[i] = buf[i][:0]
+			}
+			present, next := 0, 0
+			for present < dataShards {
+				var batch []int
+				for len(batch) < dataShards-present && next < len(order) {
+					if i := order[next]; !failed[i] {
+						batch = append(batch, i)
+					}
+					next++
+				}
+				if len(batch) == 0 {
+					return fmt.Errorf("%w: %d of %d shards available: %v", ErrTooFewShards, present, dataShards, errors.Join(readErrs...))
+				}
+				errs := readAll(batch, func(int) int64 { return shardBase }, func(i int) []byte { return buf[i][:stripeSize] })
+				for n, err := range errs {
+					if err != nil {
+						fail(batch[n], err)
+						continue
+					}
+					chunks[batch[n]] = buf[batch[n]][:stripeSize]
+					present++
+				}
+			}
+			if err := enc.ReconstructData(chunks); err != nil {
+				return err
+			}
+		}
+
+		for i := first; i <= last; i++ {
+			if _, err := dst.Write(buf[i][lo(i):hi(i)]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReconstructStripes rebuilds lost shards of shardSize bytes each.
+//
+// shards holds a reader for at least dataShards of the shards, the others
+// are nil, or with local parity added by o, for the rest of the group of
+// every lost shard, see LocalRepairShards. Every shard with a writer in fill
+// is rebuilt into it. Shards are
+// processed stripeSize bytes at a time; as Reed-Solomon works byte by byte
+// any stripe size works, whatever layout the shards were written with.
+// Leopard needs it to be a multiple of 64 bytes, as the stripe sizes given
+// by StripeSizeFor are.
+func ReconstructStripes(ctx context.Context, shards []io.Reader, codec Codec, dataShards, parityShards, stripeSize int, shardSize int64, fill []io.Writer, o ...Option) error {
+	enc, total, err := newStripeEncoder(codec, dataShards, parityShards, o)
+	if err != nil {
+		return err
+	}
+	if len(shards) != total || len(fill) != total {
+		return ErrTooFewShards
+	}
+
+	required := make([]bool, total)
+	present := 0
+	for i := range shards {
+		required[i] = fill[i] != nil
+		if shards[i] != nil {
+			present++
+		}
+	}
+	// with local parity fewer shards may do, the encoder tells
+	if _, local := enc.(*lrc); present < dataShards && !local {
+		return fmt.Errorf("%w: %d of %d shards available", ErrTooFewShards, present, dataShards)
+	}
+
+	buf := AllocAligned(total, stripeSize)
+	chunks := make([][]byte, total)
+	out := make([][]byte, total)
+	readErrs := make([]error, total)
+	for remaining := shardSize; remaining > 0; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := int64(stripeSize)
+		if remaining < n {
+			n = remaining
+		}
+
+		var wg sync.WaitGroup
+		for i, r := range shards {
+			chunks[i] = buf[i][:0]
+			if r == nil {
+				continue
+			}
+			wg.Add(1)
+			go func(i int, r io.Reader) {
+				defer wg.Done()
+				if _, err := io.ReadFull(r, buf[i][:n]); err != nil {
+					readErrs[i] = StreamReadError{Err: err, Stream: i}
+				}
+			}(i, r)
+		}
+		wg.Wait()
+		for i, r := range shards {
+			if r == nil {
+				continue
+			}
+			if readErrs[i] != nil {
+				return readErrs[i]
+			}
+			chunks[i] = buf[i][:n]
+		}
+
+		if err := enc.ReconstructSome(chunks, required); err != nil {
+			return err
+		}
+		for i := range out {
+			if fill[i] != nil {
+				out[i] = chunks[i]
+			}
+		}
+		if err := cWriteShards(fill, out); err != nil {
+			return err
+		}
+		remaining -= n
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package reedsolomon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStripesRoundTrip(t *testing.T) {
+	const dataShards, parityShards = 5, 3
+	for _, size := range []int64{0, 1, 1000, 3*64*dataShards + 17} {
+		data := make([]byte, size)
+		fillRandom(data)
+		stripeSize := MinStripeSize
+
+		shards := emptyBuffers(dataShards + parityShards)
+		err := EncodeStripes(context.Background(), bytes.NewReader(data), size, CodecReedSolomon, dataShards, parityShards, stripeSize, toWriters(shards))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantShardSize := StripeShardSize(size, dataShards, stripeSize)
+		for i, shard := range shards {
+			if int64(shard.Len()) != wantShardSize {
+				t.Fatalf("size %d: shard %d has %d bytes, want %d", size, i, shard.Len(), wantShardSize)
+			}
+		}
+
+		// lose as many shards as there are parity shards, data ones included
+		readers := toReaders(toBuffers(toBytes(shards)))
+		readers[0], readers[2], readers[dataShards] = nil, nil, nil
+
+		var out bytes.Buffer
+		err = DecodeStripes(context.Background(), readers, CodecReedSolomon, dataShards, parityShards, stripeSize, size, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("size %d: decoded data differs", size)
+		}
+	}
+}
+
+func TestStripesTooFewShards(t *testing.T) {
+	const dataShards, parityShards = 4, 2
+	data := make([]byte, 10000)
+	fillRandom(data)
+
+	shards := emptyBuffers(dataShards + parityShards)
+	err := EncodeStripes(context.Background(), bytes.NewReader(data), int64(len(data)), CodecReedSolomon, dataShards, parityShards, MinStripeSize, toWriters(shards))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readers := toReaders(toBuffers(toBytes(shards)))
+	readers[0], readers[1], readers[2] = nil, nil, nil
+	err = DecodeStripes(context.Background(), readers, CodecReedSolomon, dataShards, parityShards, MinStripeSize, int64(len(data)), io.Discard)
+	if !errors.Is(err, ErrTooFewShards) {
+		t.Fatalf("expected %v, got %v", ErrTooFewShards, err)
+	}
+}
+
+// failingReader fails after n bytes
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errors.New("shard read failed")
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func TestDecodeStripesFrom(t *testing.T) {
+	const dataShards, parityShards, stripeSize = 4, 2, MinStripeSize
+	data := make([]byte, 5000)
+	fillRandom(data)
+
+	shards := emptyBuffers(dataShards + parityShards)
+	err := EncodeStripes(context.Background(), bytes.NewReader(data), int64(len(data)), CodecReedSolomon, dataShards, parityShards, stripeSize, toWriters(shards))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardBytes := toBytes(shards)
+
+	var opened []int
+	open := func(ctx context.Context, i int, offset int64) (io.ReadCloser, error) {
+		opened = append(opened, i)
+		switch i {
+		case 1:
+			return nil, errors.New("shard unavailable")
+		case 2:
+			// fails in the middle of the third stripe
+			return io.NopCloser(&failingReader{r: bytes.NewReader(shardBytes[i][offset:]), n: 2*stripeSize + 10}), nil
+		}
+		return io.NopCloser(bytes.NewReader(shardBytes[i][offset:])), nil
+	}
+
+	var out bytes.Buffer
+	err = DecodeStripesFrom(context.Background(), open, CodecReedSolomon, dataShards, parityShards, stripeSize, int64(len(data)), &out, StripeDecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("decoded data differs")
+	}
+	// every data shard, then one parity shard for each failure
+	if want := []int{0, 1, 2, 3, 4, 5}; !equalInts(opened, want) {
+		t.Errorf("opened %v, want %v", opened, want)
+	}
+
+	// without failures parity is never opened
+	opened = nil
+	out.Reset()
+	err = DecodeStripesFrom(context.Background(), func(ctx context.Context, i int, offset int64) (io.ReadCloser, error) {
+		opened = append(opened, i)
+		return io.NopCloser(bytes.NewReader(shardBytes[i][offset:])), nil
+	}, CodecReedSolomon, dataShards, parityShards, stripeSize, int64(len(data)), &out, StripeDecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 1, 2, 3}; !equalInts(opened, want) {
+		t.Errorf("opened %v, want %v", opened, want)
+	}
+}
+
+// slowReader blocks every read until it is closed
+type slowReader struct {
+	closed chan struct{}
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	<-s.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (s *slowReader) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func TestDecodeStripesFromHedged(t *testing.T) {
+	const dataShards, parityShards, stripeSize = 4, 2, MinStripeSize
+	data := make([]byte, 3000)
+	fillRandom(data)
+
+	shards := emptyBuffers(dataShards + parityShards)
+	err := EncodeStripes(context.Background(), bytes.NewReader(data), int64(len(data)), CodecReedSolomon, dataShards, parityShards, stripeSize, toWriters(shards))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardBytes := toBytes(shards)
+
+	var opened []int
+	slow := &slowReader{closed: make(chan struct{})}
+	open := func(ctx context.Context, i int, offset int64) (io.ReadCloser, error) {
+		opened = append(opened, i)
+		if i == 5 {
+			return slow, nil
+		}
+		return io.NopCloser(bytes.NewReader(shardBytes[i][offset:])), nil
+	}
+
+	// shard 5 is tried first but never answers
+	var out bytes.Buffer
+	opt := StripeDecodeOptions{Order: []int{5, 4, 3, 2, 1, 0}, HedgeAfter: 10 * time.Millisecond}
+	err = DecodeStripesFrom(context.Background(), open, CodecReedSolomon, dataShards, parityShards, stripeSize, int64(len(data)), &out, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("decoded data differs")
+	}
+	if want := []int{5, 4, 3, 2, 1}; !equalInts(opened, want) {
+		t.Errorf("opened %v, want %v", opened, want)
+	}
+	select {
+	case <-slow.closed:
+	default:
+		t.Error("slow shard wasn't cancelled")
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStripeSizeFor(t *testing.T) {
+	if got := StripeSizeFor(10, 5); got != MinStripeSize {
+		t.Errorf("small input: got %d, want %d", got, MinStripeSize)
+	}
+	if got := StripeSizeFor(1<<40, 10); got != DefaultStripeSize {
+		t.Errorf("large input: got %d, want %d", got, DefaultStripeSize)
+	}
+	if got := StripeSizeFor(1<<40, 170); got%MinStripeSize != 0 || got*170 > maxStripeBuffer {
+		t.Errorf("many shards: got %d", got)
+	}
+}
+
+func TestReconstructStripes(t *testing.T) {
+	const dataShards, parityShards = 4, 3
+	data := make([]byte, 7000)
+	fillRandom(data)
+
+	shards := emptyBuffers(dataShards + parityShards)
+	err := EncodeStripes(context.Background(), bytes.NewReader(data), int64(len(data)), CodecReedSolomon, dataShards, parityShards, MinStripeSize, toWriters(shards))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardBytes := toBytes(shards)
+	shardSize := int64(len(shardBytes[0]))
+
+	// losing a data and a parity shard, rebuilt with a different stripe size
+	readers := toReaders(toBuffers(shardBytes))
+	readers[1], readers[5] = nil, nil
+	fill := make([]io.Writer, dataShards+parityShards)
+	rebuilt := emptyBuffers(dataShards + parityShards)
+	fill[1], fill[5] = rebuilt[1], rebuilt[5]
+
+	err = ReconstructStripes(context.Background(), readers, CodecReedSolomon, dataShards, parityShards, 3*MinStripeSize, shardSize, fill)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{1, 5} {
+		if !bytes.Equal(rebuilt[i].Bytes(), shardBytes[i]) {
+			t.Errorf("shard %d wasn't rebuilt correctly", i)
+		}
+	}
+}
+
+func TestReadStripesRange(t *testing.T) {
+	const dataShards, parityShards, stripeSize = 4, 2, MinStripeSize
+	data := make([]byte, 5000)
+	fillRandom(data)
+
+	shards := emptyBuffers(dataShards + parityShards)
+	err := EncodeStripes(context.Background(), bytes.NewReader(data), int64(len(data)), CodecReedSolomon, dataShards, parityShards, stripeSize, toWriters(shards))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardBytes := toBytes(shards)
+
+	var mu sync.Mutex
+	var opened []int
+	var unavailable int
+	open := func(ctx context.Context, i int, offset int64) (io.ReadCloser, error) {
+		mu.Lock()
+		opened = append(opened, i)
+		mu.Unlock()
+		if i == unavailable {
+			return nil, errors.New("shard unavailable")
+		}
+		return io.NopCloser(bytes.NewReader(shardBytes[i][offset:])), nil
+	}
+	readRange := func(offset, length int64) []byte {
+		var out bytes.Buffer
+		err := ReadStripesRange(context.Background(), open, CodecReedSolomon, dataShards, parityShards, stripeSize, int64(len(data)), offset, length, &out, StripeDecodeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Ints(opened)
+		return out.Bytes()
+	}
+
+	unavailable = -1
+	for _, r := range [][2]int64{{0, 5000}, {0, -1}, {100, 10}, {63, 2}, {250, 600}, {4990, 100}, {5000, 10}, {1234, -1}} {
+		opened = nil
+		end := int64(len(data))
+		if r[1] >= 0 && r[0]+r[1] < end {
+			end = r[0] + r[1]
+		}
+		if got := readRange(r[0], r[1]); !bytes.Equal(got, data[r[0]:end]) {
+			t.Errorf("range %v differs", r)
+		}
+		for _, i := range opened {
+			if i >= dataShards {
+				t.Errorf("range %v opened parity shard %d", r, i)
+			}
+		}
+	}
+
+	// a range within a single chunk only reads the shard holding it
+	opened = nil
+	readRange(64*2+5, 50)
+	if want := []int{2}; !equalInts(opened, want) {
+		t.Errorf("opened %v, want %v", opened, want)
+	}
+
+	// parity stands in for a covering shard which is unavailable
+	unavailable = 2
+	opened = nil
+	if got := readRange(64*2+5, 50); !bytes.Equal(got, data[64*2+5:64*2+55]) {
+		t.Error("range rebuilt from parity differs")
+	}
+	if want := []int{0, 1, 2, 3, 4}; !equalInts(opened, want) {
+		t.Errorf("opened %v, want %v", opened, want)
+	}
+	if got := readRange(1000, 2000); !bytes.Equal(got, data[1000:3000]) {
+		t.Error("range rebuilt from parity differs")
+	}
+
+	if err := ReadStripesRange(context.Background(), open, CodecReedSolomon, dataShards, parityShards, stripeSize, int64(len(data)), 6000, 1, io.Discard, StripeDecodeOptions{}); err == nil {
+		t.Error("expected an error for an offset past the end")
+	}
+}
+
+func TestStripesLeopard(t *testing.T) {
+	const dataShards, parityShards = 300, 100
+	data := make([]byte, 100000)
+	fillRandom(data)
+	size := int64(len(data))
+	stripeSize := StripeSizeFor(size, dataShards)
+
+	shards := emptyBuffers(dataShards + parityShards)
+	err := EncodeStripes(context.Background(), bytes.NewReader(data), size, CodecLeopardGF16, dataShards, parityShards, stripeSize, toWriters(shards))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EncodeStripes(context.Background(), bytes.NewReader(data), size, CodecReedSolomon, dataShards, parityShards, stripeSize, toWriters(emptyBuffers(dataShards+parityShards))); !errors.Is(err, ErrMaxShardNum) {
+		t.Fatalf("got %v, want ErrMaxShardNum", err)
+	}
+	shardBytes := toBytes(shards)
+
+	// lose as many shards as there are parity shards
+	readers := toReaders(toBuffers(shardBytes))
+	for i := 0; i < parityShards; i++ {
+		readers[i*3] = nil
+	}
+	var out bytes.Buffer
+	err = DecodeStripes(context.Background(), readers, CodecLeopardGF16, dataShards, parityShards, stripeSize, size, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("decoded data differs")
+	}
+
+	// and rebuild them
+	fill := make([]io.Writer, dataShards+parityShards)
+	rebuilt := emptyBuffers(dataShards + parityShards)
+	for i := range readers {
+		if readers[i] == nil {
+			fill[i] = rebuilt[i]
+		}
+	}
+	readers = toReaders(toBuffers(shardBytes))
+	for i := 0; i < parityShards; i++ {
+		readers[i*3] = nil
+	}
+	err = ReconstructStripes(context.Background(), readers, CodecLeopardGF16, dataShards, parityShards, stripeSize, int64(len(shardBytes[0])), fill)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < parityShards; i++ {
+		if !bytes.Equal(rebuilt[i*3].Bytes(), shardBytes[i*3]) {
+			t.Errorf("shard %d wasn't rebuilt correctly", i*3)
+		}
+	}
+
+	if err := DecodeStripes(context.Background(), toReaders(toBuffers(shardBytes)), Codec("bogus"), dataShards, parityShards, stripeSize, size, io.Discard); !errors.Is(err, ErrUnknownCodec) {
+		t.Fatalf("got %v, want ErrUnknownCodec", err)
+	}
+}